@@ -0,0 +1,144 @@
+// Error responses of the API with machine-readable codes
+package apierror
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Codes of error responses, clients can rely on them while the messages may change
+const (
+	// The request can't be parsed or has invalid parameters
+	CodeInvalidRequest = "invalid_request"
+	// The request fields break declared constraints, details lists the fields
+	CodeValidationFailed = "validation_failed"
+	// Missing, wrong or expired credentials
+	CodeUnauthorized = "unauthorized"
+	// The account lacks a role or permission
+	CodeForbidden = "forbidden"
+	// The change would exceed a quota, details has the usage breakdown
+	CodeQuotaExceeded = "quota_exceeded"
+	// The resource (or route) doesn't exist or isn't visible to the account
+	CodeNotFound = "not_found"
+	// The route exists for other methods only
+	CodeMethodNotAllowed = "method_not_allowed"
+	// The request conflicts with the state of a resource (e.g., it is still in use)
+	CodeConflict = "conflict"
+	// A resource with the same unique value exists
+	CodeAlreadyExists = "already_exists"
+	// The If-Match header doesn't match the current ETag (version) of the resource
+	CodePreconditionFailed = "precondition_failed"
+	// The server requires an If-Match header for changes
+	CodePreconditionRequired = "precondition_required"
+	// The request body is too large
+	CodePayloadTooLarge = "payload_too_large"
+	// The content type of the request body isn't supported by the route
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	// The container runtime (Docker) failed to carry out the change
+	CodeRuntimeError = "runtime_error"
+	// The database is busy, the request can be retried
+	CodeUnavailable = "unavailable"
+	// Unexpected failure of the server
+	CodeInternal = "internal_error"
+)
+
+// Error is the body of every error response.
+// @Description The code is stable, details carry structured context like failing fields or the cause.
+type Error struct {
+	// Machine-readable code, e.g., not_found
+	Code string `json:"code" example:"not_found"`
+
+	// Human readable description
+	Message string `json:"message" example:"VM not found"`
+
+	// Structured context of the error (optional)
+	Details Details `json:"details,omitempty" swaggertype:"object"`
+
+	// The X-Request-ID of the request
+	RequestID string `json:"request_id"`
+}
+
+// Details are the structured context of an error response
+type Details map[string]any
+
+// Abort writes the error response and stops the remaining handlers of the request
+func Abort(context *gin.Context, status int, code, message string, details Details) {
+	context.AbortWithStatusJSON(status, Error{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: context.GetString("request_id"),
+	})
+}
+
+// AbortErr writes the error response with the cause in details.error
+func AbortErr(context *gin.Context, status int, code, message string, err error) {
+	var details Details
+	if err != nil {
+		details = Details{"error": err.Error()}
+	}
+	Abort(context, status, code, message, details)
+}
+
+// AbortError writes the error response of a failed operation, the status and code follow from the error:
+// sql.ErrNoRows is 404, unique constraints 409, other constraints 422, a busy database 503, everything else 500
+func AbortError(context *gin.Context, message string, err error) {
+	status, code := Classify(err)
+	AbortErr(context, status, code, message, err)
+}
+
+// Classify maps errors of the database (driver) to the status and code of the response
+func Classify(err error) (int, string) {
+	if errors.Is(err, sql.ErrNoRows) {
+		return http.StatusNotFound, CodeNotFound
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch {
+		case sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey:
+			return http.StatusConflict, CodeAlreadyExists
+		case sqliteErr.Code == sqlite3.ErrConstraint:
+			return http.StatusUnprocessableEntity, CodeValidationFailed
+		case sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked:
+			return http.StatusServiceUnavailable, CodeUnavailable
+		}
+	}
+
+	return http.StatusInternalServerError, CodeInternal
+}
+
+// CodeForStatus is the code of error responses which have no more specific one
+func CodeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeInvalidRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusPreconditionFailed:
+		return CodePreconditionFailed
+	case http.StatusPreconditionRequired:
+		return CodePreconditionRequired
+	case http.StatusRequestEntityTooLarge:
+		return CodePayloadTooLarge
+	case http.StatusUnsupportedMediaType:
+		return CodeUnsupportedMediaType
+	case http.StatusUnprocessableEntity:
+		return CodeValidationFailed
+	case http.StatusServiceUnavailable:
+		return CodeUnavailable
+	}
+	return CodeInternal
+}
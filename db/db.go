@@ -3,8 +3,7 @@ package db
 
 import (
 	"database/sql"
-
-	_ "github.com/mattn/go-sqlite3" // SQLite driver
+	"fmt"
 )
 
 // DB is a globally accessible database handle
@@ -16,7 +15,7 @@ func InitDB() {
 	var err error
 
 	// Open a connection to a SQLite database file
-	DB, err = sql.Open("sqlite3", "minicloud.db")
+	DB, err = sql.Open(instrumentedDriverName, "minicloud.db")
 
 	if err != nil {
 		panic("Could not connect to database.")
@@ -82,4 +81,424 @@ CREATE TABLE IF NOT EXISTS accounts (
 		panic("Could not create 'accounts' table.")
 	}
 
+	// Columns added after the first release
+	addColumnIfMissing("accounts", "role", "TEXT NOT NULL DEFAULT 'user'")
+	addColumnIfMissing("vms", "image_digest", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing("vms", "flavor", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing("vms", "disk_gb", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing("vms", "account_id", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing("storages", "account_id", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing("vms", "status", "TEXT NOT NULL DEFAULT 'unknown'")
+	addColumnIfMissing("vms", "user_data", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing("vms", "key_pair_ids", "TEXT NOT NULL DEFAULT 'null'")
+	addColumnIfMissing("vms", "ssh_port", "INTEGER NOT NULL DEFAULT 0")
+
+	// Resources from before ownership existed keep account_id 0, so only admins can reach them
+	// until models.BootstrapAdmin assigns them to the configured admin account
+
+	// Create the 'settings' table for admin-controlled key/value options
+	createSettingsTable := `
+	CREATE TABLE IF NOT EXISTS settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
+	`
+
+	_, err = DB.Exec(createSettingsTable)
+	if err != nil {
+		panic("Could not create 'settings' table.")
+	}
+
+	// Create the 'images' table for the catalog of approved images
+	createImagesTable := `
+	CREATE TABLE IF NOT EXISTS images (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT UNIQUE NOT NULL,
+		display_name TEXT NOT NULL,
+		default_cpu REAL NOT NULL DEFAULT 0,
+		default_memory INTEGER NOT NULL DEFAULT 0,
+		default_ports TEXT NOT NULL DEFAULT '[]',
+		digest TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'pending',
+		status_message TEXT NOT NULL DEFAULT '',
+		pulled_at DATETIME
+	);
+	`
+
+	_, err = DB.Exec(createImagesTable)
+	if err != nil {
+		panic("Could not create 'images' table.")
+	}
+
+	// Create the 'api_keys' table for long-lived account credentials
+	createAPIKeysTable := `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		account_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		key_hash TEXT UNIQUE NOT NULL,
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME
+	);
+	`
+
+	_, err = DB.Exec(createAPIKeysTable)
+	if err != nil {
+		panic("Could not create 'api_keys' table.")
+	}
+
+	// Create the 'flavors' table for the instance types of VMs
+	createFlavorsTable := `
+	CREATE TABLE IF NOT EXISTS flavors (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT UNIQUE NOT NULL,
+		cpu REAL NOT NULL,
+		memory INTEGER NOT NULL,
+		disk_gb INTEGER NOT NULL DEFAULT 0
+	);
+	`
+
+	_, err = DB.Exec(createFlavorsTable)
+	if err != nil {
+		panic("Could not create 'flavors' table.")
+	}
+
+	// Create the 'account_permissions' table for permissions granted by admins
+	createAccountPermissionsTable := `
+	CREATE TABLE IF NOT EXISTS account_permissions (
+		account_id INTEGER NOT NULL,
+		permission TEXT NOT NULL,
+		PRIMARY KEY (account_id, permission)
+	);
+	`
+
+	_, err = DB.Exec(createAccountPermissionsTable)
+	if err != nil {
+		panic("Could not create 'account_permissions' table.")
+	}
+
+	// Create the 'quotas' table for the resource limits of accounts
+	createQuotasTable := `
+	CREATE TABLE IF NOT EXISTS quotas (
+		account_id INTEGER PRIMARY KEY,
+		max_vms INTEGER NOT NULL,
+		max_vcpus REAL NOT NULL,
+		max_memory_mb INTEGER NOT NULL,
+		max_volumes INTEGER NOT NULL,
+		max_storage_gb INTEGER NOT NULL
+	);
+	`
+
+	_, err = DB.Exec(createQuotasTable)
+	if err != nil {
+		panic("Could not create 'quotas' table.")
+	}
+
+	// Create the 'metering_records' table for the usage intervals of VMs and storages
+	createMeteringRecordsTable := `
+	CREATE TABLE IF NOT EXISTS metering_records (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		account_id INTEGER NOT NULL,
+		resource_type TEXT NOT NULL,
+		resource_id INTEGER NOT NULL,
+		resource_name TEXT NOT NULL,
+		cpu REAL NOT NULL DEFAULT 0,
+		memory_mb INTEGER NOT NULL DEFAULT 0,
+		size_gb INTEGER NOT NULL DEFAULT 0,
+		started_at DATETIME NOT NULL,
+		ended_at DATETIME
+	);
+	CREATE INDEX IF NOT EXISTS idx_metering_records_account ON metering_records (account_id, started_at);
+	CREATE INDEX IF NOT EXISTS idx_metering_records_resource ON metering_records (resource_type, resource_id, ended_at);
+	`
+
+	_, err = DB.Exec(createMeteringRecordsTable)
+	if err != nil {
+		panic("Could not create 'metering_records' table.")
+	}
+
+	// Create the 'prices' table with the price list of billable items
+	createPricesTable := `
+	CREATE TABLE IF NOT EXISTS prices (
+		item TEXT PRIMARY KEY,
+		unit_price REAL NOT NULL,
+		unit TEXT NOT NULL
+	);
+	INSERT OR IGNORE INTO prices (item, unit_price, unit) VALUES
+		('vm.vcpu_hour', 0.02, 'vCPU-hour'),
+		('vm.memory_gb_hour', 0.005, 'GB-hour'),
+		('storage.gb_hour', 0.0001, 'GB-hour');
+	`
+
+	_, err = DB.Exec(createPricesTable)
+	if err != nil {
+		panic("Could not create 'prices' table.")
+	}
+
+	// Create the 'vm_boot_runs' table for the result of the last boot script of each VM
+	createVMBootRunsTable := `
+	CREATE TABLE IF NOT EXISTS vm_boot_runs (
+		vm_id INTEGER PRIMARY KEY,
+		container_id TEXT NOT NULL,
+		status TEXT NOT NULL,
+		exit_code INTEGER,
+		log TEXT NOT NULL DEFAULT '',
+		started_at DATETIME NOT NULL,
+		finished_at DATETIME
+	);
+	`
+
+	_, err = DB.Exec(createVMBootRunsTable)
+	if err != nil {
+		panic("Could not create 'vm_boot_runs' table.")
+	}
+
+	// Create the 'key_pairs' table for the SSH public keys of accounts
+	createKeyPairsTable := `
+	CREATE TABLE IF NOT EXISTS key_pairs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		account_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		public_key TEXT NOT NULL,
+		fingerprint TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		UNIQUE (account_id, name)
+	);
+	`
+
+	_, err = DB.Exec(createKeyPairsTable)
+	if err != nil {
+		panic("Could not create 'key_pairs' table.")
+	}
+
+	// Create the 'audit_events' table, the audit trail is append-only
+	createAuditEventsTable := `
+	CREATE TABLE IF NOT EXISTS audit_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		account_id INTEGER NOT NULL,
+		action TEXT NOT NULL,
+		resource_type TEXT NOT NULL,
+		resource_id INTEGER NOT NULL,
+		detail TEXT NOT NULL DEFAULT '',
+		source_ip TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_audit_events_resource ON audit_events (resource_type, resource_id);
+	CREATE INDEX IF NOT EXISTS idx_audit_events_account ON audit_events (account_id, created_at);
+	CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events
+	BEGIN SELECT RAISE(ABORT, 'audit_events is append-only'); END;
+	CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events
+	BEGIN SELECT RAISE(ABORT, 'audit_events is append-only'); END;
+	`
+
+	_, err = DB.Exec(createAuditEventsTable)
+	if err != nil {
+		panic("Could not create 'audit_events' table.")
+	}
+
+	// Request details of the audit trail, added after the first release
+	addColumnIfMissing("audit_events", "auth_method", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing("audit_events", "request_id", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing("audit_events", "body_digest", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing("audit_events", "status_code", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing("audit_events", "result", "TEXT NOT NULL DEFAULT ''")
+
+	// Create the 'vm_metrics' table for the usage time series of VMs (ts in unix seconds)
+	createVMMetricsTable := `
+	CREATE TABLE IF NOT EXISTS vm_metrics (
+		vm_id INTEGER NOT NULL,
+		resolution TEXT NOT NULL,
+		ts INTEGER NOT NULL,
+		cpu_cores REAL NOT NULL,
+		cpu_cores_max REAL NOT NULL,
+		memory_mb REAL NOT NULL,
+		memory_mb_max REAL NOT NULL,
+		net_rx_bytes INTEGER NOT NULL,
+		net_tx_bytes INTEGER NOT NULL,
+		block_read_bytes INTEGER NOT NULL,
+		block_write_bytes INTEGER NOT NULL,
+		PRIMARY KEY (vm_id, resolution, ts)
+	);
+	`
+
+	_, err = DB.Exec(createVMMetricsTable)
+	if err != nil {
+		panic("Could not create 'vm_metrics' table.")
+	}
+
+	// Create the 'events' table, the resource changes behind the event stream and its cursors
+	createEventsTable := `
+	CREATE TABLE IF NOT EXISTS events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		type TEXT NOT NULL,
+		resource_type TEXT NOT NULL,
+		resource_id INTEGER NOT NULL,
+		account_id INTEGER NOT NULL,
+		data TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_events_created ON events (created_at);
+	`
+
+	_, err = DB.Exec(createEventsTable)
+	if err != nil {
+		panic("Could not create 'events' table.")
+	}
+
+	// Create the 'webhooks' table, URLs subscribed to event types
+	createWebhooksTable := `
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		account_id INTEGER NOT NULL,
+		url TEXT NOT NULL,
+		event_types TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		secret TEXT NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT 1,
+		created_at DATETIME NOT NULL
+	);
+	`
+
+	_, err = DB.Exec(createWebhooksTable)
+	if err != nil {
+		panic("Could not create 'webhooks' table.")
+	}
+
+	// Create the 'webhook_deliveries' table, the delivery log and retry queue of the webhooks
+	createWebhookDeliveriesTable := `
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER NOT NULL,
+		event_id INTEGER NOT NULL,
+		event_type TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_status_code INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		next_attempt_at DATETIME,
+		delivered_at DATETIME,
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook ON webhook_deliveries (webhook_id, id);
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at);
+	`
+
+	_, err = DB.Exec(createWebhookDeliveriesTable)
+	if err != nil {
+		panic("Could not create 'webhook_deliveries' table.")
+	}
+
+	// Create the 'labels' table, the key/value labels of VMs, storages, images and key pairs
+	createLabelsTable := `
+	CREATE TABLE IF NOT EXISTS labels (
+		resource_type TEXT NOT NULL,
+		resource_id INTEGER NOT NULL,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (resource_type, resource_id, key)
+	);
+	CREATE INDEX IF NOT EXISTS idx_labels_key ON labels (resource_type, key, value);
+	`
+
+	_, err = DB.Exec(createLabelsTable)
+	if err != nil {
+		panic("Could not create 'labels' table.")
+	}
+
+	// Create the 'projects' and 'project_members' tables, projects group resources of several accounts
+	createProjectsTables := `
+	CREATE TABLE IF NOT EXISTS projects (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		description TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS project_members (
+		project_id INTEGER NOT NULL,
+		account_id INTEGER NOT NULL,
+		role TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (project_id, account_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_project_members_account ON project_members (account_id);
+	CREATE TABLE IF NOT EXISTS project_quotas (
+		project_id INTEGER PRIMARY KEY,
+		max_vms INTEGER NOT NULL,
+		max_vcpus REAL NOT NULL,
+		max_memory_mb INTEGER NOT NULL,
+		max_volumes INTEGER NOT NULL,
+		max_storage_gb INTEGER NOT NULL
+	);
+	`
+
+	_, err = DB.Exec(createProjectsTables)
+	if err != nil {
+		panic("Could not create 'projects' tables.")
+	}
+
+	// The project of VMs, storages and their usage records, 0 for resources outside of any project
+	addColumnIfMissing("vms", "project_id", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing("storages", "project_id", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing("metering_records", "project_id", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing("events", "project_id", "INTEGER NOT NULL DEFAULT 0")
+
+	// The version of a resource counts its changes through the API, it is the ETag of the resource
+	for _, table := range []string{"vms", "storages", "images", "flavors", "key_pairs", "webhooks", "projects"} {
+		addColumnIfMissing(table, "version", "INTEGER NOT NULL DEFAULT 1")
+	}
+
+	// Create the 'idempotency_keys' table, the responses of POST requests replayed on retries
+	createIdempotencyKeysTable := `
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		account_id INTEGER NOT NULL,
+		key TEXT NOT NULL,
+		fingerprint TEXT NOT NULL,
+		status_code INTEGER NOT NULL DEFAULT 0,
+		headers TEXT NOT NULL DEFAULT '{}',
+		body BLOB,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		PRIMARY KEY (account_id, key)
+	);
+	CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires ON idempotency_keys (expires_at);
+	`
+
+	_, err = DB.Exec(createIdempotencyKeysTable)
+	if err != nil {
+		panic("Could not create 'idempotency_keys' table.")
+	}
+}
+
+// addColumnIfMissing adds a column to an existing table, so databases
+// created by an older version pick up new fields without being recreated
+func addColumnIfMissing(table, column, definition string) {
+	rows, err := DB.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		panic(fmt.Sprintf("Could not read columns of '%s' table.", table))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey); err != nil {
+			panic(fmt.Sprintf("Could not read columns of '%s' table.", table))
+		}
+		if name == column {
+			return
+		}
+	}
+
+	_, err = DB.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		panic(fmt.Sprintf("Could not add '%s' column to '%s' table.", column, table))
+	}
 }
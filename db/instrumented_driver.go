@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/odeeka/go-minicloud-rest-api/metrics"
+	"github.com/odeeka/go-minicloud-rest-api/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// instrumentedDriverName is the SQLite driver which times every statement
+const instrumentedDriverName = "sqlite3_instrumented"
+
+func init() {
+	sql.Register(instrumentedDriverName, &instrumentedDriver{})
+}
+
+// instrumentedDriver wraps the SQLite driver, the connections time and trace the statements they run
+type instrumentedDriver struct {
+	sqlite3.SQLiteDriver
+}
+
+func (d *instrumentedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.SQLiteDriver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+type instrumentedConn struct {
+	*sqlite3.SQLiteConn
+}
+
+func (conn *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := conn.SQLiteConn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedStmt{stmt.(*sqlite3.SQLiteStmt), query}, nil
+}
+
+func (conn *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (result driver.Result, err error) {
+	ctx, done := observeQuery(ctx, query)
+	defer func() { done(err) }()
+	return conn.SQLiteConn.ExecContext(ctx, query, args)
+}
+
+func (conn *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (rows driver.Rows, err error) {
+	ctx, done := observeQuery(ctx, query)
+	defer func() { done(err) }()
+	return conn.SQLiteConn.QueryContext(ctx, query, args)
+}
+
+type instrumentedStmt struct {
+	*sqlite3.SQLiteStmt
+	query string
+}
+
+func (stmt *instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (result driver.Result, err error) {
+	ctx, done := observeQuery(ctx, stmt.query)
+	defer func() { done(err) }()
+	return stmt.SQLiteStmt.ExecContext(ctx, args)
+}
+
+func (stmt *instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (rows driver.Rows, err error) {
+	ctx, done := observeQuery(ctx, stmt.query)
+	defer func() { done(err) }()
+	return stmt.SQLiteStmt.QueryContext(ctx, args)
+}
+
+// queryTable finds the first table a statement reads or writes
+var queryTable = regexp.MustCompile(`(?i)\b(?:from|into|update|table)\s+(?:if\s+not\s+exists\s+)?(\w+)`)
+
+// observeQuery starts the span of a statement, the returned function ends it and records
+// the duration by operation (e.g., select) and table. The span carries the query text
+// with its placeholders, the arguments are left out.
+func observeQuery(ctx context.Context, query string) (context.Context, func(error)) {
+	started := time.Now()
+
+	operation := "other"
+	if fields := strings.Fields(query); len(fields) > 0 {
+		operation = strings.ToLower(fields[0])
+	}
+
+	table := "none"
+	if match := queryTable.FindStringSubmatch(query); match != nil {
+		table = strings.ToLower(match[1])
+	}
+
+	ctx, span := tracing.StartChild(ctx, operation+" "+table,
+		attribute.String("db.system.name", "sqlite"),
+		attribute.String("db.operation.name", operation),
+		attribute.String("db.collection.name", table),
+		attribute.String("db.query.text", strings.TrimSpace(query)),
+	)
+
+	return ctx, func(err error) {
+		if err == driver.ErrSkip {
+			err = nil
+		}
+		tracing.End(span, err)
+		metrics.DBQueryDuration.WithLabelValues(operation, table).Observe(time.Since(started).Seconds())
+	}
+}
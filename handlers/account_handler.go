@@ -2,27 +2,40 @@ package handlers
 
 import (
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
 	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/services"
 	"github.com/odeeka/go-minicloud-rest-api/utils"
 )
 
 // GetAccounts godoc
 // @Summary List all accounts
-// @Description Retrieves all registered user accounts
+// @Description Retrieves all registered user accounts (admin only), without their passwords
 // @Tags account
+// @Security BearerAuth
 // @Produce json
-// @Success 200 {array} models.Account
-// @Failure 500 {object} map[string]string
-// @Router /account/all [get]
+// @Param limit query int false "Maximum number of items (default 100, max 1000)"
+// @Param page_token query string false "NextPageToken of the previous page"
+// @Param sort query string false "id, username, with - for descending (default id)"
+// @Param role query string false "Account role, e.g., admin"
+// @Param name_prefix query string false "Beginning of the username"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400,401,403,500 {object} apierror.Error
+// @Router /accounts [get]
 func GetAccounts(context *gin.Context) {
-	accounts, err := models.GetAllAccount()
-	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Could not fetch accounts.", "error": err.Error()})
+	options, ok := listOptions(context)
+	if !ok {
 		return
 	}
-	context.JSON(http.StatusOK, accounts)
+
+	accounts, nextPageToken, err := models.ListAccounts(context.Request.Context(), options)
+	for i := range accounts {
+		accounts[i].Password = ""
+	}
+	respondList(context, "Fetched accounts", accounts, nextPageToken, err)
 }
 
 // RegisterAccount godoc
@@ -32,41 +45,45 @@ func GetAccounts(context *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param account body models.Account true "Account registration payload"
+// @Param Idempotency-Key header string false "Key to retry the request safely, anonymous keys only replay the identical request"
 // @Success 201 {object} map[string]string
-// @Failure 400 {object} map[string]string
-// @Failure 500 {object} map[string]string
-// @Router /accounts/register [post]
+// @Failure 400 {object} apierror.Error
+// @Failure 409 {object} apierror.Error
+// @Failure 500 {object} apierror.Error
+// @Router /accounts [post]
 func RegisterAccount(context *gin.Context) {
 	var acc models.Account
 
 	err := context.ShouldBindJSON(&acc)
 
 	if err != nil {
-		context.JSON(http.StatusBadRequest, gin.H{"message": "Could not parse request data.", "error": err.Error()})
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse request data.", err)
 		return
 	}
 
-	err = acc.Save()
+	err = acc.Save(context.Request.Context())
 
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Could not save account.", "error": err.Error()})
+		apierror.AbortError(context, "Could not save account.", err)
 		return
 	}
 
+	context.Set("audit_detail", "username="+acc.Username)
+
 	context.JSON(http.StatusCreated, gin.H{"message": "Account created successfully"})
 }
 
 // LoginAccount godoc
 // @Summary Authenticate an account
-// @Description Login with username and password to receive JWT token
+// @Description Login with username and password to receive JWT token. Logins are safe to retry, the Idempotency-Key header is ignored since tokens are not stored.
 // @Tags account
 // @Accept json
 // @Produce json
 // @Param credentials body models.Account true "Account login credentials"
 // @Success 200 {object} map[string]interface{} "Returns JWT token and account info"
-// @Failure 400 {object} map[string]string
-// @Failure 401 {object} map[string]string
-// @Failure 500 {object} map[string]string
+// @Failure 400 {object} apierror.Error
+// @Failure 401 {object} apierror.Error
+// @Failure 500 {object} apierror.Error
 // @Router /accounts/login [post]
 func LoginAccount(context *gin.Context) {
 	var acc models.Account
@@ -74,23 +91,102 @@ func LoginAccount(context *gin.Context) {
 	err := context.ShouldBindJSON(&acc)
 
 	if err != nil {
-		context.JSON(http.StatusBadRequest, gin.H{"message": "Could not parse request data.", "error": err.Error()})
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse request data.", err)
 		return
 	}
 
-	err = acc.ValidateCredentials()
+	auditAs(context, "account.login", "account", 0, "username="+acc.Username)
+
+	err = acc.ValidateCredentials(context.Request.Context())
 
 	if err != nil {
-		context.JSON(http.StatusUnauthorized, gin.H{"message": "Could not authenticate the account.", "Error": err.Error()})
+		apierror.AbortErr(context, http.StatusUnauthorized, apierror.CodeUnauthorized, "Could not authenticate the account.", err)
 		return
 	}
 
+	context.Set("user_id", acc.ID)
+	context.Set("auth_method", "password")
+	auditCreated(context, acc.ID)
+
 	token, err := utils.GenerateToken(acc.Username, acc.ID)
 
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Could not authenticate the account", "Error": err.Error()})
+		apierror.AbortError(context, "Could not authenticate the account", err)
 		return
 	}
 
 	context.JSON(http.StatusOK, gin.H{"message": "Login successful!", "Token": token, "Account ID": acc.ID, "Account username": acc.Username})
 }
+
+// DeleteAccount godoc
+// @Summary Delete an account
+// @Description Deletes an account with its key pairs, API keys, quota, permissions, project memberships, webhooks and registry repositories (own account or admin). VMs and storages of the account, also those in projects, have to be deleted first, and the projects of which it is the last owner need another owner.
+// @Tags account
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Account ID"
+// @Success 200 {object} map[string]string
+// @Failure 400,403,404,409,500 {object} apierror.Error
+// @Router /accounts/{id} [delete]
+func DeleteAccount(context *gin.Context) {
+	account, ok := accountFromParam(context)
+	if !ok || !requireSelfOrAdmin(context, account.ID) {
+		return
+	}
+
+	usage, err := models.GetUsage(context.Request.Context(), account.ID)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the usage.", err)
+		return
+	}
+	if usage.VMs > 0 || usage.Volumes > 0 {
+		apierror.Abort(context, http.StatusConflict, apierror.CodeConflict, "The account still owns VMs or storages, delete them first", apierror.Details{"usage": usage})
+		return
+	}
+
+	projectUsage, err := models.GetProjectResourcesUsage(context.Request.Context(), account.ID)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the usage.", err)
+		return
+	}
+	if projectUsage.VMs > 0 || projectUsage.Volumes > 0 {
+		apierror.Abort(context, http.StatusConflict, apierror.CodeConflict, "The account still owns VMs or storages in projects, delete them first", apierror.Details{"usage": projectUsage})
+		return
+	}
+
+	projects, err := models.GetSoleOwnedProjects(context.Request.Context(), account.ID)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the projects.", err)
+		return
+	}
+	if len(projects) > 0 {
+		apierror.Abort(context, http.StatusConflict, apierror.CodeConflict, "The account is the last owner of projects, add another owner first", apierror.Details{"projects": projects})
+		return
+	}
+
+	if account.IsAdmin() {
+		admins, err := models.CountAdmins(context.Request.Context())
+		if err != nil {
+			apierror.AbortError(context, "Could not count the admins.", err)
+			return
+		}
+		if admins <= 1 {
+			apierror.Abort(context, http.StatusConflict, apierror.CodeConflict, "The last admin account can't be deleted", nil)
+			return
+		}
+	}
+
+	// The repositories go first, so a new account with the same username can never get the old images
+	if err := services.DeleteNamespace(account.Username); err != nil {
+		apierror.AbortError(context, "Could not delete the registry repositories.", err)
+		return
+	}
+
+	err = account.DeleteAccount(context.Request.Context())
+	if err != nil {
+		apierror.AbortError(context, "Could not delete the account.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Account deleted successfully with ID: " + strconv.FormatInt(account.ID, 10)})
+}
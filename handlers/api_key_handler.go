@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+)
+
+// ListAPIKeys godoc
+// @Summary List own API keys
+// @Description Retrieves the API keys of the authenticated account (without the keys themselves)
+// @Tags account
+// @Security BearerAuth
+// @Produce json
+// @Param limit query int false "Maximum number of items (default 100, max 1000)"
+// @Param page_token query string false "NextPageToken of the previous page"
+// @Param sort query string false "id, name, created_at, with - for descending (default id)"
+// @Param name_prefix query string false "Beginning of the name"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400,500 {object} apierror.Error
+// @Router /accounts/api-keys [get]
+func ListAPIKeys(context *gin.Context) {
+	options, ok := listOptions(context)
+	if !ok {
+		return
+	}
+
+	keys, nextPageToken, err := models.ListAPIKeys(context.Request.Context(), context.GetInt64("user_id"), options)
+	respondList(context, "Fetched API keys", keys, nextPageToken, err)
+}
+
+// CreateAPIKey godoc
+// @Summary Create an API key
+// @Description Creates an API key for the authenticated account. The key is only returned in this response. The Idempotency-Key header is ignored, the key is not stored in clear for a replay.
+// @Tags account
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param key body models.APIKey true "API key (only the name is used)"
+// @Success 201 {object} map[string]interface{}
+// @Failure 400,500 {object} apierror.Error
+// @Router /accounts/api-keys [post]
+func CreateAPIKey(context *gin.Context) {
+	var key models.APIKey
+
+	err := context.ShouldBindJSON(&key)
+
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse request data.", err)
+		return
+	}
+
+	if key.Name == "" {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "The API key name is required.", nil)
+		return
+	}
+
+	key.AccountID = context.GetInt64("user_id")
+	err = key.InsertAPIKey(context.Request.Context())
+
+	if err != nil {
+		apierror.AbortError(context, "Could not create API key.", err)
+		return
+	}
+
+	auditCreated(context, key.ID)
+
+	context.JSON(http.StatusCreated, gin.H{"message": "API key created, store it now: it is not shown again", "APIKey": key})
+}
+
+// DeleteAPIKey godoc
+// @Summary Revoke an API key
+// @Description Deletes an API key of the authenticated account
+// @Tags account
+// @Security BearerAuth
+// @Param id path int true "API key ID"
+// @Success 200 {object} map[string]string
+// @Failure 400,404,500 {object} apierror.Error
+// @Router /accounts/api-keys/{id} [delete]
+func DeleteAPIKey(context *gin.Context) {
+	keyId, err := strconv.ParseInt(context.Param("id"), 10, 64)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse API key id.", err)
+		return
+	}
+
+	deleted, err := models.DeleteAPIKey(context.Request.Context(), context.GetInt64("user_id"), keyId)
+	if err != nil {
+		apierror.AbortError(context, "Could not delete the API key.", err)
+		return
+	}
+
+	if !deleted {
+		apierror.Abort(context, http.StatusNotFound, apierror.CodeNotFound, "API key not found", nil)
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "API key deleted successfully with ID: " + strconv.FormatInt(keyId, 10)})
+}
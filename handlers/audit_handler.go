@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"log/slog"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/services"
+)
+
+// auditAs names the action of the request for the audit trail, which the Audit middleware
+// records after the handler with its result. It also audits reads (e.g., a file download).
+func auditAs(context *gin.Context, action, resourceType string, resourceID int64, detail string) {
+	context.Set("audit_action", action)
+	context.Set("audit_resource_type", resourceType)
+	context.Set("audit_resource_id", resourceID)
+	context.Set("audit_detail", detail)
+}
+
+// auditCreated records the ID of a resource created by the request in its audit event
+func auditCreated(context *gin.Context, resourceID int64) {
+	context.Set("audit_resource_id", resourceID)
+}
+
+// recordAudit appends an event to the audit trail right away, for requests which last long (e.g., a console)
+// A failure is only logged, it doesn't fail the request which already happened
+func recordAudit(context *gin.Context, action, resourceType string, resourceID int64, detail string) {
+	event := models.AuditEvent{
+		AccountID:    context.GetInt64("user_id"),
+		AuthMethod:   context.GetString("auth_method"),
+		Action:       action,
+		ResourceType: resourceType,
+		ResourceID:   resourceID,
+		Detail:       detail,
+		StatusCode:   context.Writer.Status(),
+		Result:       models.AuditResultSuccess,
+		SourceIP:     context.ClientIP(),
+		RequestID:    context.GetString("request_id"),
+	}
+
+	if err := services.RecordAuditEvent(context.Request.Context(), &event); err != nil {
+		slog.ErrorContext(context.Request.Context(), "Could not record audit event", "action", action, "error", err)
+	}
+}
+
+// ListAuditEvents godoc
+// @Summary      List audit events
+// @Description  Returns the audit trail newest first (admin only). Every mutating request is recorded with account, auth method, body digest and result.
+// @Tags         audit
+// @Security BearerAuth
+// @Produce      json
+// @Param        limit       query     int     false  "Maximum number of items (default 100, max 1000)"
+// @Param        page_token  query     string  false  "NextPageToken of the previous page"
+// @Param        sort        query     string  false  "id, created_at, with - for descending (default -id)"
+// @Param        resource    query     string  false  "Resource type or type and ID, e.g., vm or vm:5"
+// @Param        actor       query     string  false  "Account ID or username"
+// @Param        from        query     string  false  "RFC 3339 time or a duration like 24h"
+// @Param        to          query     string  false  "RFC 3339 time or a duration like 1h"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400,403,500  {object}  apierror.Error
+// @Router       /audit [get]
+func ListAuditEvents(context *gin.Context) {
+	options, ok := listOptions(context)
+	if !ok {
+		return
+	}
+
+	events, nextPageToken, err := models.ListAuditEvents(context.Request.Context(), options)
+	respondList(context, "Fetched audit events", events, nextPageToken, err)
+}
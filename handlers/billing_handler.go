@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/services"
+)
+
+// GetAccountInvoice godoc
+// @Summary Get account invoice
+// @Description Applies the price list to the metered usage of the resources of an account outside of any project in a month (own account or admin). The running month is billed up to now.
+// @Tags account
+// @Security BearerAuth
+// @Produce json
+// @Produce text/csv
+// @Param id path int true "Account ID"
+// @Param period query string false "Month as YYYY-MM (default: current month)"
+// @Param format query string false "json (default) or csv"
+// @Success 200 {object} services.Invoice
+// @Failure 400,403,404,500 {object} apierror.Error
+// @Router /accounts/{id}/invoices [get]
+func GetAccountInvoice(context *gin.Context) {
+	account, ok := accountFromParam(context)
+	if !ok || !requireSelfOrAdmin(context, account.ID) {
+		return
+	}
+
+	filename := "invoice-" + strconv.FormatInt(account.ID, 10)
+	respondInvoice(context, account.ID, 0, filename)
+}
+
+// respondInvoice builds the invoice of the period query parameter, in the format of the format query parameter
+func respondInvoice(context *gin.Context, accountID, projectID int64, filename string) {
+	period := context.DefaultQuery("period", time.Now().UTC().Format("2006-01"))
+	format := context.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Unsupported format, use json or csv", nil)
+		return
+	}
+
+	if _, _, err := services.ParseBillingPeriod(period); err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse period.", err)
+		return
+	}
+
+	invoice, err := services.BuildInvoice(context.Request.Context(), accountID, projectID, period)
+	if err != nil {
+		apierror.AbortError(context, "Could not build the invoice.", err)
+		return
+	}
+
+	if format == "json" {
+		context.JSON(http.StatusOK, invoice)
+		return
+	}
+
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	writer.Write([]string{"resource_type", "resource_id", "resource_name", "item", "runtime_seconds", "quantity", "unit", "unit_price", "amount", "currency"})
+	for _, line := range invoice.LineItems {
+		writer.Write([]string{
+			line.ResourceType,
+			strconv.FormatInt(line.ResourceID, 10),
+			line.ResourceName,
+			line.Item,
+			strconv.FormatInt(line.RuntimeSeconds, 10),
+			strconv.FormatFloat(line.Quantity, 'f', -1, 64),
+			line.Unit,
+			strconv.FormatFloat(line.UnitPrice, 'f', -1, 64),
+			strconv.FormatFloat(line.Amount, 'f', -1, 64),
+			invoice.Currency,
+		})
+	}
+	writer.Flush()
+
+	context.Header("Content-Disposition", `attachment; filename="`+filename+"-"+period+`.csv"`)
+	context.Data(http.StatusOK, "text/csv; charset=utf-8", buffer.Bytes())
+}
+
+// ListPrices godoc
+// @Summary List prices
+// @Description Retrieves the price list which applies to the metered usage
+// @Tags billing
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Failure 500 {object} apierror.Error
+// @Router /prices [get]
+func ListPrices(context *gin.Context) {
+	prices, err := models.GetPriceList(context.Request.Context())
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the price list.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"Prices": prices})
+}
+
+// UpdatePrice godoc
+// @Summary Update price
+// @Description Changes the unit price of a billable item, it applies to every invoice built afterwards (admin only)
+// @Tags billing
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param item path string true "Billable item (e.g., vm.vcpu_hour)"
+// @Param price body models.Price true "Price"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400,403,404,500 {object} apierror.Error
+// @Router /prices/{item} [put]
+func UpdatePrice(context *gin.Context) {
+	var price models.Price
+	err := context.ShouldBindJSON(&price)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse request data.", err)
+		return
+	}
+
+	if price.UnitPrice < 0 {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "The unit price can't be negative", nil)
+		return
+	}
+
+	price.Item = context.Param("item")
+	found, err := price.UpdatePrice(context.Request.Context())
+	if err != nil {
+		apierror.AbortError(context, "Could not update the price.", err)
+		return
+	}
+	if !found {
+		apierror.Abort(context, http.StatusNotFound, apierror.CodeNotFound, "Unknown billable item: "+price.Item, nil)
+		return
+	}
+
+	prices, err := models.GetPriceList(context.Request.Context())
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the price list.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Price updated successfully!", "Price": prices[price.Item]})
+}
@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	ctx "context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/services"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+)
+
+// The default CheckOrigin rejects cross-origin browser connections
+var consoleUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// ConsoleMessage is a text message of the console client
+// Binary messages are passed to the terminal as they are
+type ConsoleMessage struct {
+	// "input" or "resize"
+	Type string `json:"type"`
+
+	// Keystrokes for "input"
+	Data string `json:"data"`
+
+	// Terminal size for "resize"
+	Cols uint16 `json:"cols"`
+	Rows uint16 `json:"rows"`
+}
+
+// ExecRequest is a one-shot command to run in a VM
+type ExecRequest struct {
+	// The command and its arguments, run without a shell (e.g., ["ls", "-l", "/"])
+	Command []string `json:"command" binding:"required"`
+
+	// Data passed to the standard input of the command
+	Stdin string `json:"stdin"`
+
+	// Seconds until the command is killed (default and maximum: MINICLOUD_EXEC_TIMEOUT, 60s)
+	TimeoutSeconds int `json:"timeout_seconds"`
+}
+
+// VMConsole godoc
+// @Summary      Interactive VM console
+// @Description  Upgrades to a WebSocket attached to a shell on a TTY in the VM. Binary messages and {"type":"input","data":"..."} are keystrokes, {"type":"resize","cols":120,"rows":40} resizes the terminal. The output is sent as binary messages. Sessions are recorded in the audit trail.
+// @Tags         vms
+// @Security BearerAuth
+// @Param        id   path      int  true  "VM ID"
+// @Success      101
+// @Failure      400,403,404,409,500  {object}  apierror.Error
+// @Router       /vms/{id}/console [get]
+func VMConsole(context *gin.Context) {
+	vm, ok := vmFromParam(context)
+	if !ok || !requireContainer(context, vm) {
+		return
+	}
+
+	terminal, cmd, err := services.StartConsole(vm.ContainerID)
+	if err != nil {
+		apierror.AbortError(context, "Could not start the console.", err)
+		return
+	}
+	defer terminal.Close()
+
+	conn, err := consoleUpgrader.Upgrade(context.Writer, context.Request, nil)
+	if err != nil {
+		// The upgrader already wrote the error response
+		cmd.Process.Kill()
+		cmd.Wait()
+		return
+	}
+	defer conn.Close()
+
+	startedAt := time.Now()
+	recordAudit(context, "vm.console.open", "vm", vm.ID, "")
+
+	// Terminal output to the client, until the shell exits
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		buffer := make([]byte, 4096)
+		for {
+			n, err := terminal.Read(buffer)
+			if n > 0 {
+				if conn.WriteMessage(websocket.BinaryMessage, buffer[:n]) != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Client input to the terminal, until the client disconnects
+	inputDone := make(chan struct{})
+	go func() {
+		defer close(inputDone)
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			if messageType == websocket.BinaryMessage {
+				terminal.Write(data)
+				continue
+			}
+
+			var message ConsoleMessage
+			if json.Unmarshal(data, &message) != nil {
+				continue
+			}
+			switch message.Type {
+			case "input":
+				terminal.Write([]byte(message.Data))
+			case "resize":
+				if message.Cols > 0 && message.Rows > 0 {
+					services.ResizeConsole(terminal, message.Cols, message.Rows)
+				}
+			}
+		}
+	}()
+
+	select {
+	case <-outputDone:
+	case <-inputDone:
+	}
+
+	cmd.Process.Kill()
+	cmd.Wait()
+	<-outputDone
+
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "console closed"),
+		time.Now().Add(time.Second))
+
+	auditAs(context, "vm.console.close", "vm", vm.ID, fmt.Sprintf("duration=%s", time.Since(startedAt).Round(time.Second)))
+}
+
+// ExecVM godoc
+// @Summary      Run a command in a VM
+// @Description  Runs a one-shot command in the VM and returns its stdout, stderr and exit code. Commands are recorded in the audit trail.
+// @Tags         vms
+// @Security BearerAuth
+// @Accept       json
+// @Produce      json
+// @Param        id       path      int                   true  "VM ID"
+// @Param        request  body      handlers.ExecRequest  true  "Command"
+// @Param        Idempotency-Key  header  string  false  "Key to retry the request safely, retries replay the first response"
+// @Success      200  {object}  services.ExecResult
+// @Failure      400,403,404,409,500  {object}  apierror.Error
+// @Router       /vms/{id}/exec [post]
+func ExecVM(context *gin.Context) {
+	vm, ok := vmFromParam(context)
+	if !ok || !requireContainer(context, vm) {
+		return
+	}
+
+	var request ExecRequest
+	err := context.ShouldBindJSON(&request)
+	if err != nil || len(request.Command) == 0 {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse request data, the command is required.", nil)
+		return
+	}
+
+	maxTimeout := utils.GetEnvDuration("MINICLOUD_EXEC_TIMEOUT", time.Minute)
+	timeout := maxTimeout
+	if request.TimeoutSeconds > 0 && time.Duration(request.TimeoutSeconds)*time.Second < maxTimeout {
+		timeout = time.Duration(request.TimeoutSeconds) * time.Second
+	}
+
+	execCtx, cancel := ctx.WithTimeout(context.Request.Context(), timeout)
+	defer cancel()
+
+	result, err := services.ExecInContainer(execCtx, vm.ContainerID, request.Command, request.Stdin)
+	if err != nil {
+		auditAs(context, "vm.exec", "vm", vm.ID, fmt.Sprintf("command=%q error=%q", request.Command, err.Error()))
+		apierror.AbortError(context, "Could not run the command.", err)
+		return
+	}
+
+	auditAs(context, "vm.exec", "vm", vm.ID, fmt.Sprintf("command=%q exit_code=%d", request.Command, result.ExitCode))
+
+	context.JSON(http.StatusOK, result)
+}
+
+// vmFromParam loads the VM of the ":id" path parameter for its owner or an admin,
+// VMs of a project for the members of the selected project
+// It writes the error response and returns false otherwise
+func vmFromParam(context *gin.Context) (*models.VM, bool) {
+	vmId, err := strconv.ParseInt(context.Param("id"), 10, 64)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse VM id.", err)
+		return nil, false
+	}
+
+	vm, err := models.GetVMByID(context.Request.Context(), vmId)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the VM.", err)
+		return nil, false
+	}
+
+	if !requireResourceAccess(context, vm.AccountID, vm.ProjectID) {
+		return nil, false
+	}
+
+	return vm, true
+}
+
+// requireContainer rejects VMs without a running container with 409
+func requireContainer(context *gin.Context, vm *models.VM) bool {
+	if vm.ContainerID == "" || vm.Status == models.VMStatusMissing {
+		apierror.Abort(context, http.StatusConflict, apierror.CodeConflict, "The VM has no container", apierror.Details{"status": vm.Status})
+		return false
+	}
+	if vm.Status != models.VMStatusRunning && vm.Status != models.VMStatusUnknown {
+		apierror.Abort(context, http.StatusConflict, apierror.CodeConflict, "The VM is not running", apierror.Details{"status": vm.Status})
+		return false
+	}
+	return true
+}
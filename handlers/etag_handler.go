@@ -0,0 +1,76 @@
+// Manage the incoming HTTP requests
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+)
+
+// resourceLocks serializes the changes of one VM or volume (e.g., a recreate and a delete of the same VM),
+// so the container and the stored metadata can't get out of sync. Take the VM lock before the storage lock
+var resourceLocks = utils.NewKeyedMutex()
+
+// lockResource locks a resource (e.g., "vm" 5) until the returned function is called
+func lockResource(resourceType string, id int64) func() {
+	return resourceLocks.Lock(resourceType + "-" + strconv.FormatInt(id, 10))
+}
+
+// etag is the ETag of a resource version, e.g., "3"
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// setETag adds the ETag of the resource version to the response
+func setETag(context *gin.Context, version int64) {
+	context.Header("ETag", etag(version))
+}
+
+// requireIfMatch reports whether changes must send an If-Match header (MINICLOUD_REQUIRE_IF_MATCH)
+func requireIfMatch() bool {
+	return utils.GetEnv("MINICLOUD_REQUIRE_IF_MATCH", "false") == "true"
+}
+
+// checkIfMatch compares the If-Match header of the request with the version of the resource,
+// "*" matches every version. Without the header the change is allowed unless MINICLOUD_REQUIRE_IF_MATCH is true.
+// It writes the error response and returns false if the request is based on another version
+func checkIfMatch(context *gin.Context, version int64) bool {
+	header := context.GetHeader("If-Match")
+	if header == "" {
+		if requireIfMatch() {
+			apierror.Abort(context, http.StatusPreconditionRequired, apierror.CodePreconditionRequired,
+				"The If-Match header with the ETag of the resource is required.", nil)
+			return false
+		}
+		return true
+	}
+
+	current := etag(version)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == current {
+			return true
+		}
+	}
+
+	apierror.Abort(context, http.StatusPreconditionFailed, apierror.CodePreconditionFailed,
+		"The resource was changed, fetch it again and retry with its ETag.", apierror.Details{"etag": current})
+	return false
+}
+
+// abortUpdateError writes the error response of a failed update, a version conflict of the
+// stored resource is 412 like a stale If-Match header
+func abortUpdateError(context *gin.Context, message string, err error) {
+	if errors.Is(err, models.ErrVersionConflict) {
+		apierror.AbortErr(context, http.StatusPreconditionFailed, apierror.CodePreconditionFailed,
+			"The resource was changed, fetch it again and retry with its ETag.", err)
+		return
+	}
+	apierror.AbortError(context, message, err)
+}
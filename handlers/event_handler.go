@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	ctx "context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/services"
+)
+
+// The default CheckOrigin rejects cross-origin browser connections
+var eventsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// StreamEvents godoc
+// @Summary      Stream resource changes
+// @Description  Streams events like vm.created, vm.state_changed, storage.attached and operation.completed of the own resources and of the resources of the projects the account is a member of (all resources for admins). Server-sent events by default, a WebSocket with one JSON event per text message when the request is an upgrade. The event ID is the cursor: a stream resumes after the Last-Event-ID header or last_event_id, otherwise it starts with new events.
+// @Tags         events
+// @Security BearerAuth
+// @Produce      text/event-stream
+// @Param        resource       query     string  false  "Resource type or type and ID, e.g., vm or vm:5"
+// @Param        last_event_id  query     int     false  "Resume after this event (same as the Last-Event-ID header)"
+// @Success      200  {object}  models.Event
+// @Failure      400,500  {object}  apierror.Error
+// @Router       /events [get]
+func StreamEvents(context *gin.Context) {
+	var filter models.EventFilter
+	var err error
+
+	filter.ResourceType, filter.ResourceID, err = parseResource(context.Query("resource"))
+	if err != nil {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error(), nil)
+		return
+	}
+
+	cursor := context.GetHeader("Last-Event-ID")
+	if cursor == "" {
+		cursor = context.Query("last_event_id")
+	}
+	resume := cursor != ""
+	if resume {
+		filter.AfterID, err = strconv.ParseInt(cursor, 10, 64)
+		if err != nil || filter.AfterID < 0 {
+			apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "The last event ID must be a positive number", nil)
+			return
+		}
+	}
+
+	account, err := models.GetAccountByID(context.Request.Context(), context.GetInt64("user_id"))
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the account.", err)
+		return
+	}
+	filter.AccountID = account.ID
+	filter.Admin = account.IsAdmin()
+
+	if websocket.IsWebSocketUpgrade(context.Request) {
+		streamEventsWebSocket(context, filter, resume)
+		return
+	}
+
+	context.Header("Content-Type", "text/event-stream")
+	context.Header("Cache-Control", "no-cache")
+	context.Status(http.StatusOK)
+	context.Writer.Flush()
+
+	err = services.FollowEvents(context.Request.Context(), filter, resume, func(event *models.Event) error {
+		if event == nil {
+			if _, err := context.Writer.WriteString(": keepalive\n\n"); err != nil {
+				return err
+			}
+		} else if err := sse.Encode(context.Writer, sse.Event{Id: strconv.FormatInt(event.ID, 10), Event: event.Type, Data: event}); err != nil {
+			return err
+		}
+		context.Writer.Flush()
+		return nil
+	})
+	if err != nil {
+		slog.WarnContext(context.Request.Context(), "Event stream ended", "error", err)
+	}
+}
+
+// streamEventsWebSocket sends the events as JSON text messages until the client closes the connection
+func streamEventsWebSocket(context *gin.Context, filter models.EventFilter, resume bool) {
+	conn, err := eventsUpgrader.Upgrade(context.Writer, context.Request, nil)
+	if err != nil {
+		// The upgrader already wrote the error response
+		return
+	}
+	defer conn.Close()
+
+	// The client doesn't send messages, reading only notices when it goes away
+	streamCtx, cancel := ctx.WithCancel(context.Request.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	err = services.FollowEvents(streamCtx, filter, resume, func(event *models.Event) error {
+		if event == nil {
+			return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+		}
+		return conn.WriteJSON(event)
+	})
+
+	closeCode, reason := websocket.CloseNormalClosure, "stream closed"
+	if errors.Is(err, services.ErrEventSubscriberDropped) {
+		closeCode, reason = websocket.CloseTryAgainLater, err.Error()
+	}
+	if err != nil {
+		slog.WarnContext(context.Request.Context(), "Event stream ended", "error", err)
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, reason), time.Now().Add(time.Second))
+}
+
+// parseResource parses a resource filter: a type or a type and ID, e.g., vm or vm:5
+func parseResource(value string) (string, int64, error) {
+	resourceType, resourceID, hasID := strings.Cut(value, ":")
+	if !hasID {
+		return resourceType, 0, nil
+	}
+
+	id, err := strconv.ParseInt(resourceID, 10, 64)
+	if err != nil {
+		return "", 0, errors.New("resource must be a type or type:id, e.g., vm:5")
+	}
+	return resourceType, id, nil
+}
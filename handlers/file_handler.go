@@ -0,0 +1,261 @@
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/services"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+)
+
+// Pseudo file systems of the container which can't be read or written as files
+var forbiddenFilePaths = []string{"/proc", "/sys", "/dev"}
+
+// UploadVMFiles godoc
+// @Summary      Upload files into a VM
+// @Description  Writes the body to the path in the VM. With Content-Type application/x-tar the archive is extracted into the directory path, otherwise the body becomes the file at path. The size is limited by MINICLOUD_FILES_MAX_SIZE_MB (default 100).
+// @Tags         vms
+// @Security BearerAuth
+// @Accept       application/octet-stream
+// @Accept       application/x-tar
+// @Produce      json
+// @Param        id    path      int     true  "VM ID"
+// @Param        path  query     string  true  "Absolute path in the VM"
+// @Success      200  {object}  map[string]string
+// @Failure      400,403,404,409,413,500  {object}  apierror.Error
+// @Router       /vms/{id}/files [put]
+func UploadVMFiles(context *gin.Context) {
+	vm, ok := vmFromParam(context)
+	if !ok || !requireContainer(context, vm) {
+		return
+	}
+
+	filePath, ok := vmFilePath(context)
+	if !ok {
+		return
+	}
+
+	maxSize := maxFileTransferSize()
+	body := http.MaxBytesReader(context.Writer, context.Request.Body, maxSize)
+	data, err := io.ReadAll(body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		apierror.Abort(context, http.StatusRequestEntityTooLarge, apierror.CodePayloadTooLarge, fmt.Sprintf("The upload is larger than %d bytes", maxSize), nil)
+		return
+	}
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not read the upload.", err)
+		return
+	}
+
+	targetDir := filePath
+	archive := data
+	isTar := strings.HasPrefix(context.ContentType(), "application/x-tar")
+
+	if isTar {
+		if err := validateTarArchive(data); err != nil {
+			apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid tar archive.", err)
+			return
+		}
+	} else {
+		// A single file is wrapped into an archive for the copy
+		targetDir = path.Dir(filePath)
+		archive, err = singleFileArchive(path.Base(filePath), data)
+		if err != nil {
+			apierror.AbortError(context, "Could not prepare the upload.", err)
+			return
+		}
+	}
+
+	err = services.CopyToContainer(context.Request.Context(), vm.ContainerID, targetDir, bytes.NewReader(archive))
+	if err != nil {
+		apierror.AbortError(context, "Could not copy the files into the VM.", err)
+		return
+	}
+
+	auditAs(context, "vm.files.upload", "vm", vm.ID, fmt.Sprintf("path=%q bytes=%d tar=%t", filePath, len(data), isTar))
+
+	context.JSON(http.StatusOK, gin.H{"message": "Files uploaded successfully to " + filePath})
+}
+
+// DownloadVMFiles godoc
+// @Summary      Download files from a VM
+// @Description  Returns a regular file as it is, or a directory as tar archive. format=tar returns a tar archive for files too. The size is limited by MINICLOUD_FILES_MAX_SIZE_MB (default 100).
+// @Tags         vms
+// @Security BearerAuth
+// @Produce      application/octet-stream
+// @Produce      application/x-tar
+// @Param        id      path      int     true   "VM ID"
+// @Param        path    query     string  true   "Absolute path in the VM"
+// @Param        format  query     string  false  "tar to always return a tar archive"
+// @Success      200  {file}  file
+// @Failure      400,403,404,409,413,500  {object}  apierror.Error
+// @Router       /vms/{id}/files [get]
+func DownloadVMFiles(context *gin.Context) {
+	vm, ok := vmFromParam(context)
+	if !ok || !requireContainer(context, vm) {
+		return
+	}
+
+	filePath, ok := vmFilePath(context)
+	if !ok {
+		return
+	}
+
+	// Buffer the archive in a temporary file, so the size limit can be enforced before the response starts
+	archive, err := os.CreateTemp("", "minicloud-download-*.tar")
+	if err != nil {
+		apierror.AbortError(context, "Could not prepare the download.", err)
+		return
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	maxSize := maxFileTransferSize()
+	limited := &limitedWriter{writer: archive, remaining: maxSize}
+	err = services.CopyFromContainer(context.Request.Context(), vm.ContainerID, filePath, limited)
+	if limited.exceeded {
+		apierror.Abort(context, http.StatusRequestEntityTooLarge, apierror.CodePayloadTooLarge, fmt.Sprintf("The download is larger than %d bytes", maxSize), nil)
+		return
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "No such container:path") || strings.Contains(err.Error(), "Could not find the file") {
+			apierror.Abort(context, http.StatusNotFound, apierror.CodeNotFound, "File not found in the VM: "+filePath, nil)
+			return
+		}
+		apierror.AbortError(context, "Could not copy the files from the VM.", err)
+		return
+	}
+
+	auditAs(context, "vm.files.download", "vm", vm.ID, fmt.Sprintf("path=%q", filePath))
+
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		apierror.AbortError(context, "Could not read the download.", err)
+		return
+	}
+
+	// A single regular file is returned without the archive
+	if context.Query("format") != "tar" {
+		reader := tar.NewReader(archive)
+		header, err := reader.Next()
+		if err == nil && header.Typeflag == tar.TypeReg {
+			context.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, path.Base(header.Name)))
+			context.DataFromReader(http.StatusOK, header.Size, "application/octet-stream", reader, nil)
+			return
+		}
+
+		if _, err := archive.Seek(0, io.SeekStart); err != nil {
+			apierror.AbortError(context, "Could not read the download.", err)
+			return
+		}
+	}
+
+	info, err := archive.Stat()
+	if err != nil {
+		apierror.AbortError(context, "Could not read the download.", err)
+		return
+	}
+
+	context.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.tar"`, path.Base(filePath)))
+	context.DataFromReader(http.StatusOK, info.Size(), "application/x-tar", archive, nil)
+}
+
+// vmFilePath validates the "path" query parameter
+// It writes the error response and returns false for relative paths and pseudo file systems
+func vmFilePath(context *gin.Context) (string, bool) {
+	filePath := context.Query("path")
+	if !path.IsAbs(filePath) || strings.ContainsRune(filePath, 0) {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "The path must be absolute (e.g., /etc/nginx/nginx.conf)", nil)
+		return "", false
+	}
+
+	filePath = path.Clean(filePath)
+	for _, forbidden := range forbiddenFilePaths {
+		if filePath == forbidden || strings.HasPrefix(filePath, forbidden+"/") {
+			apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "The path is not allowed: "+filePath, nil)
+			return "", false
+		}
+	}
+
+	return filePath, true
+}
+
+// validateTarArchive accepts regular files, directories and links with relative names inside the target directory
+func validateTarArchive(data []byte) error {
+	reader := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean(header.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("entry outside of the target directory: %s", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeDir, tar.TypeSymlink, tar.TypeLink:
+		default:
+			return fmt.Errorf("unsupported entry type of %s", header.Name)
+		}
+	}
+}
+
+// singleFileArchive wraps one file into a tar archive
+func singleFileArchive(name string, data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+
+	err := writer.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0o644,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func maxFileTransferSize() int64 {
+	return int64(utils.GetEnvInt("MINICLOUD_FILES_MAX_SIZE_MB", 100)) * 1024 * 1024
+}
+
+// limitedWriter fails once more than the remaining bytes are written
+type limitedWriter struct {
+	writer    io.Writer
+	remaining int64
+	exceeded  bool
+}
+
+func (limited *limitedWriter) Write(data []byte) (int, error) {
+	if int64(len(data)) > limited.remaining {
+		limited.exceeded = true
+		return 0, errors.New("size limit exceeded")
+	}
+	limited.remaining -= int64(len(data))
+	return limited.writer.Write(data)
+}
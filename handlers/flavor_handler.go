@@ -0,0 +1,305 @@
+// Manage the incoming HTTP requests
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/services"
+)
+
+// ListFlavors godoc
+// @Summary List flavors
+// @Description Retrieves all instance types VMs can be created with.
+// @Tags flavors
+// @Security BearerAuth
+// @Produce json
+// @Param limit query int false "Maximum number of items (default 100, max 1000)"
+// @Param page_token query string false "NextPageToken of the previous page"
+// @Param sort query string false "id, name, cpu, memory, disk_gb, with - for descending (default cpu)"
+// @Param name_prefix query string false "Beginning of the name"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400,500 {object} apierror.Error
+// @Router /flavors [get]
+func ListFlavors(context *gin.Context) {
+	options, ok := listOptions(context)
+	if !ok {
+		return
+	}
+
+	flavors, nextPageToken, err := models.ListFlavors(context.Request.Context(), options)
+	respondList(context, "Fetched Flavors from database", flavors, nextPageToken, err)
+}
+
+// CreateFlavor godoc
+// @Summary Create a flavor
+// @Description Creates an instance type with CPU, memory and disk size (admin only). The flavor must fit on the host.
+// @Tags flavors
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param flavor body models.Flavor true "Flavor object"
+// @Param Idempotency-Key header string false "Key to retry the request safely, retries replay the first response"
+// @Success 201 {object} map[string]interface{}
+// @Failure 400,403,409,500 {object} apierror.Error
+// @Router /flavors [post]
+func CreateFlavor(context *gin.Context) {
+	var flavor models.Flavor
+
+	err := context.ShouldBindJSON(&flavor)
+
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse request data.", err)
+		return
+	}
+
+	if flavor.Name == "" {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "The flavor name is required.", nil)
+		return
+	}
+
+	if !checkHostCapacity(context, flavor.CPU, flavor.Memory) {
+		return
+	}
+
+	if flavor.DiskGB < 0 {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "The disk size can't be negative.", nil)
+		return
+	}
+
+	if _, err := models.GetFlavorByName(context.Request.Context(), flavor.Name); err == nil {
+		apierror.Abort(context, http.StatusConflict, apierror.CodeConflict, "Flavor already exists: "+flavor.Name, nil)
+		return
+	}
+
+	err = flavor.InsertFlavor(context.Request.Context())
+
+	if err != nil {
+		apierror.AbortError(context, "Could not create flavor.", err)
+		return
+	}
+
+	auditCreated(context, flavor.ID)
+
+	setETag(context, flavor.Version)
+	context.JSON(http.StatusCreated, gin.H{"message": "Flavor created", "Flavor": flavor})
+}
+
+// GetFlavor godoc
+// @Summary Get flavor by ID
+// @Description Fetches an instance type by its ID.
+// @Tags flavors
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Flavor ID"
+// @Success 200 {object} map[string]interface{}
+// @Header 200 {string} ETag "Version of the resource, for If-Match"
+// @Failure 400,404,500 {object} apierror.Error
+// @Router /flavors/{id} [get]
+func GetFlavor(context *gin.Context) {
+	flavorId, err := strconv.ParseInt(context.Param("id"), 10, 64)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse Flavor id.", err)
+		return
+	}
+
+	flavor, err := models.GetFlavorByID(context.Request.Context(), flavorId)
+	if errors.Is(err, sql.ErrNoRows) {
+		apierror.Abort(context, http.StatusNotFound, apierror.CodeNotFound, "Flavor not found", nil)
+		return
+	}
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch target Flavor.", err)
+		return
+	}
+
+	setETag(context, flavor.Version)
+	context.JSON(http.StatusOK, gin.H{"Flavor": flavor})
+}
+
+// UpdateFlavor godoc
+// @Summary Update flavor
+// @Description Changes CPU, memory and disk size of a flavor (admin only). Existing VMs keep their resources until they are updated.
+// @Tags flavors
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path int true "Flavor ID"
+// @Param flavor body models.Flavor true "Updated flavor data"
+// @Param If-Match header string false "ETag of the version the change is based on"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400,403,404,412,428,500 {object} apierror.Error
+// @Router /flavors/{id} [put]
+func UpdateFlavor(context *gin.Context) {
+	flavorId, err := strconv.ParseInt(context.Param("id"), 10, 64)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse Flavor id.", err)
+		return
+	}
+
+	flavor, err := models.GetFlavorByID(context.Request.Context(), flavorId)
+	if errors.Is(err, sql.ErrNoRows) {
+		apierror.Abort(context, http.StatusNotFound, apierror.CodeNotFound, "Flavor not found", nil)
+		return
+	}
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch target Flavor.", err)
+		return
+	}
+
+	if !checkIfMatch(context, flavor.Version) {
+		return
+	}
+
+	var updatedFlavor models.Flavor
+	err = context.ShouldBindJSON(&updatedFlavor)
+
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse request data.", err)
+		return
+	}
+
+	if !checkHostCapacity(context, updatedFlavor.CPU, updatedFlavor.Memory) {
+		return
+	}
+
+	if updatedFlavor.DiskGB < 0 {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "The disk size can't be negative.", nil)
+		return
+	}
+
+	// The name is referenced by VMs and can't be changed
+	flavor.CPU = updatedFlavor.CPU
+	flavor.Memory = updatedFlavor.Memory
+	flavor.DiskGB = updatedFlavor.DiskGB
+
+	err = flavor.UpdateFlavorByID(context.Request.Context())
+	if err != nil {
+		abortUpdateError(context, "Could not update the Flavor.", err)
+		return
+	}
+
+	setETag(context, flavor.Version)
+	context.JSON(http.StatusOK, gin.H{"message": "Flavor updated successfully!", "Flavor": flavor})
+}
+
+// DeleteFlavor godoc
+// @Summary Delete flavor
+// @Description Deletes a flavor which is not used by any VM (admin only).
+// @Tags flavors
+// @Security BearerAuth
+// @Param id path int true "Flavor ID"
+// @Param If-Match header string false "ETag of the version the change is based on"
+// @Success 200 {object} map[string]string
+// @Failure 400,403,404,409,412,428,500 {object} apierror.Error
+// @Router /flavors/{id} [delete]
+func DeleteFlavor(context *gin.Context) {
+	flavorId, err := strconv.ParseInt(context.Param("id"), 10, 64)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse Flavor id.", err)
+		return
+	}
+
+	flavor, err := models.GetFlavorByID(context.Request.Context(), flavorId)
+	if errors.Is(err, sql.ErrNoRows) {
+		apierror.Abort(context, http.StatusNotFound, apierror.CodeNotFound, "Flavor not found", nil)
+		return
+	}
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch target Flavor.", err)
+		return
+	}
+
+	if !checkIfMatch(context, flavor.Version) {
+		return
+	}
+
+	inUse, err := models.CountVMsByFlavor(context.Request.Context(), flavor.Name)
+	if err != nil {
+		apierror.AbortError(context, "Could not check the usage of the Flavor.", err)
+		return
+	}
+	if inUse > 0 {
+		apierror.Abort(context, http.StatusConflict, apierror.CodeConflict, "Flavor is used by "+strconv.Itoa(inUse)+" VM(s)", nil)
+		return
+	}
+
+	err = flavor.DeleteFlavorByID(context.Request.Context())
+	if err != nil {
+		apierror.AbortError(context, "Could not delete the Flavor.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Flavor deleted successfully with ID: " + strconv.FormatInt(flavor.ID, 10)})
+}
+
+// resolveVMFlavor applies the flavor of a VM to its CPU, memory and disk size.
+// VMs without a flavor use free-form values, which require the custom resources permission
+// (on update only if they change). current is nil when the VM is created.
+// It writes the error response and returns false if the request must be rejected.
+func resolveVMFlavor(context *gin.Context, vm *models.VM, current *models.VM) bool {
+	if vm.Flavor != "" {
+		flavor, err := models.GetFlavorByName(context.Request.Context(), vm.Flavor)
+		if errors.Is(err, sql.ErrNoRows) {
+			apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Unknown flavor: "+vm.Flavor, nil)
+			return false
+		}
+		if err != nil {
+			apierror.AbortError(context, "Could not fetch the flavor.", err)
+			return false
+		}
+
+		flavor.ApplyTo(vm)
+		return true
+	}
+
+	vm.DiskGB = 0
+
+	customValues := vm.CPU != 0 || vm.Memory != 0
+	if current != nil {
+		customValues = vm.CPU != current.CPU || vm.Memory != current.Memory
+	}
+	if !customValues {
+		return true
+	}
+
+	account, err := models.GetAccountByID(context.Request.Context(), context.GetInt64("user_id"))
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the account.", err)
+		return false
+	}
+
+	allowed, err := account.HasPermission(context.Request.Context(), models.PermissionCustomResources)
+	if err != nil {
+		apierror.AbortError(context, "Could not check the permissions.", err)
+		return false
+	}
+	if !allowed {
+		apierror.Abort(context, http.StatusForbidden, apierror.CodeForbidden, "Custom cpu and memory require the '"+models.PermissionCustomResources+"' permission, use a flavor instead", nil)
+		return false
+	}
+
+	return true
+}
+
+// checkHostCapacity rejects CPU and memory values which are not positive or larger than the host
+// It writes the error response and returns false if the values don't fit
+func checkHostCapacity(context *gin.Context, cpu float64, memory int) bool {
+	capacity, err := services.GetHostCapacity(context.Request.Context())
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the host capacity.", err)
+		return false
+	}
+
+	if err := capacity.Fits(cpu, memory); err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid VM resources.", err)
+		return false
+	}
+
+	return true
+}
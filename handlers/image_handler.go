@@ -0,0 +1,382 @@
+// Manage the incoming HTTP requests
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/services"
+)
+
+// ImagePolicy controls how VM creation treats images outside of the catalog
+type ImagePolicy struct {
+	// Reject VM images which are not registered in the catalog
+	EnforceCatalog bool `json:"enforce_catalog"`
+}
+
+// ListImages godoc
+// @Summary List catalog images
+// @Description Retrieves all approved images of the catalog with their pull state.
+// @Tags images
+// @Security BearerAuth
+// @Produce json
+// @Param limit query int false "Maximum number of items (default 100, max 1000)"
+// @Param page_token query string false "NextPageToken of the previous page"
+// @Param sort query string false "id, name, status, with - for descending (default id)"
+// @Param status query string false "Pull state, e.g., ready"
+// @Param name_prefix query string false "Beginning of the name"
+// @Param selector query string false "Label selector, e.g., env=dev,team in (a,b)"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400,500 {object} apierror.Error
+// @Router /images [get]
+func ListImages(context *gin.Context) {
+	options, ok := listOptions(context)
+	if !ok {
+		return
+	}
+
+	images, nextPageToken, err := models.ListImages(context.Request.Context(), options)
+	respondList(context, "Fetched Images from database", images, nextPageToken, err)
+}
+
+// CreateImage godoc
+// @Summary Register a catalog image
+// @Description Registers an approved image (admin only). The image is pulled in the background and its tag is resolved to a digest.
+// @Tags images
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param image body models.Image true "Image object"
+// @Param Idempotency-Key header string false "Key to retry the request safely, retries replay the first response"
+// @Success 202 {object} map[string]interface{}
+// @Failure 400,403,422,500 {object} apierror.Error
+// @Router /images [post]
+func CreateImage(context *gin.Context) {
+	var image models.Image
+
+	// The defaults are checked like the values of a VM, so every VM using them can be created
+	if !bindRequest(context, &image) {
+		return
+	}
+
+	if image.Name == "" {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "The image name is required.", nil)
+		return
+	}
+
+	if !validLabels(context, image.Labels) {
+		return
+	}
+
+	if image.DisplayName == "" {
+		image.DisplayName = image.Name
+	}
+
+	// The pull state is owned by the server
+	image.Digest = ""
+	image.Status = models.ImageStatusPending
+	image.StatusMessage = ""
+	image.PulledAt = nil
+
+	err := image.InsertImage(context.Request.Context())
+
+	if err != nil {
+		apierror.AbortError(context, "Could not create image in the catalog.", err)
+		return
+	}
+
+	auditCreated(context, image.ID)
+
+	// Pre-pull the image, so VM creation does not wait for the registry
+	pulled := image
+	go services.PullImage(context.Request.Context(), &pulled)
+
+	setETag(context, image.Version)
+	context.JSON(http.StatusAccepted, gin.H{"message": "Image registered, pull started", "Image": image})
+}
+
+// GetImage godoc
+// @Summary Get catalog image by ID
+// @Description Fetches a catalog image by its ID, including the resolved digest.
+// @Tags images
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Image ID"
+// @Success 200 {object} map[string]interface{}
+// @Header 200 {string} ETag "Version of the resource, for If-Match"
+// @Failure 400,404,500 {object} apierror.Error
+// @Router /images/{id} [get]
+func GetImage(context *gin.Context) {
+	imageId, err := strconv.ParseInt(context.Param("id"), 10, 64)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse Image id.", err)
+		return
+	}
+
+	image, err := models.GetImageByID(context.Request.Context(), imageId)
+	if errors.Is(err, sql.ErrNoRows) {
+		apierror.Abort(context, http.StatusNotFound, apierror.CodeNotFound, "Image not found", nil)
+		return
+	}
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch target Image.", err)
+		return
+	}
+
+	setETag(context, image.Version)
+	context.JSON(http.StatusOK, gin.H{"Image": image})
+}
+
+// UpdateImage godoc
+// @Summary Update catalog image
+// @Description Updates the display name and default resources of a catalog image (admin only).
+// @Tags images
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path int true "Image ID"
+// @Param image body models.Image true "Updated image data"
+// @Param If-Match header string false "ETag of the version the change is based on"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400,403,404,412,422,428,500 {object} apierror.Error
+// @Router /images/{id} [put]
+func UpdateImage(context *gin.Context) {
+	imageId, err := strconv.ParseInt(context.Param("id"), 10, 64)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse Image id.", err)
+		return
+	}
+
+	image, err := models.GetImageByID(context.Request.Context(), imageId)
+	if errors.Is(err, sql.ErrNoRows) {
+		apierror.Abort(context, http.StatusNotFound, apierror.CodeNotFound, "Image not found", nil)
+		return
+	}
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch target Image.", err)
+		return
+	}
+
+	if !checkIfMatch(context, image.Version) {
+		return
+	}
+
+	var updatedImage models.Image
+	if !bindRequest(context, &updatedImage) {
+		return
+	}
+
+	// The reference and pull state can't be changed, register a new image instead
+	image.DisplayName = updatedImage.DisplayName
+	image.DefaultCPU = updatedImage.DefaultCPU
+	image.DefaultMemory = updatedImage.DefaultMemory
+	image.DefaultPorts = updatedImage.DefaultPorts
+
+	if image.DisplayName == "" {
+		image.DisplayName = image.Name
+	}
+
+	err = image.UpdateImageByID(context.Request.Context())
+	if err != nil {
+		abortUpdateError(context, "Could not update the Image.", err)
+		return
+	}
+
+	setETag(context, image.Version)
+	context.JSON(http.StatusOK, gin.H{"message": "Image updated successfully!", "Image": image})
+}
+
+// DeleteImage godoc
+// @Summary Delete catalog image
+// @Description Removes an image from the catalog (admin only). Running VMs are not affected.
+// @Tags images
+// @Security BearerAuth
+// @Param id path int true "Image ID"
+// @Param If-Match header string false "ETag of the version the change is based on"
+// @Success 200 {object} map[string]string
+// @Failure 400,403,404,412,428,500 {object} apierror.Error
+// @Router /images/{id} [delete]
+func DeleteImage(context *gin.Context) {
+	imageId, err := strconv.ParseInt(context.Param("id"), 10, 64)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse Image id.", err)
+		return
+	}
+
+	image, err := models.GetImageByID(context.Request.Context(), imageId)
+	if errors.Is(err, sql.ErrNoRows) {
+		apierror.Abort(context, http.StatusNotFound, apierror.CodeNotFound, "Image not found", nil)
+		return
+	}
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch target Image.", err)
+		return
+	}
+
+	if !checkIfMatch(context, image.Version) {
+		return
+	}
+
+	err = image.DeleteImageByID(context.Request.Context())
+	if err != nil {
+		apierror.AbortError(context, "Could not delete the Image.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Image deleted successfully with ID: " + strconv.FormatInt(image.ID, 10)})
+}
+
+// PullCatalogImage godoc
+// @Summary Re-pull catalog image
+// @Description Pulls the image again and re-resolves its tag to the current digest (admin only).
+// @Tags images
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Image ID"
+// @Param Idempotency-Key header string false "Key to retry the request safely, retries replay the first response"
+// @Success 202 {object} map[string]interface{}
+// @Failure 400,403,404,409,500 {object} apierror.Error
+// @Router /images/{id}/pull [post]
+func PullCatalogImage(context *gin.Context) {
+	imageId, err := strconv.ParseInt(context.Param("id"), 10, 64)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse Image id.", err)
+		return
+	}
+
+	image, err := models.GetImageByID(context.Request.Context(), imageId)
+	if errors.Is(err, sql.ErrNoRows) {
+		apierror.Abort(context, http.StatusNotFound, apierror.CodeNotFound, "Image not found", nil)
+		return
+	}
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch target Image.", err)
+		return
+	}
+
+	if image.Status == models.ImageStatusPulling {
+		apierror.Abort(context, http.StatusConflict, apierror.CodeConflict, "Image is already being pulled", nil)
+		return
+	}
+
+	pulled := *image
+	go services.PullImage(context.Request.Context(), &pulled)
+
+	context.JSON(http.StatusAccepted, gin.H{"message": "Image pull started", "Image": image})
+}
+
+// GetImagePolicy godoc
+// @Summary Get image policy
+// @Description Shows whether VM creation is restricted to catalog images.
+// @Tags images
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} ImagePolicy
+// @Failure 500 {object} apierror.Error
+// @Router /images/policy [get]
+func GetImagePolicy(context *gin.Context) {
+	enforce, err := models.GetBoolSetting(context.Request.Context(), models.SettingEnforceImageCatalog, false)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the image policy.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, ImagePolicy{EnforceCatalog: enforce})
+}
+
+// UpdateImagePolicy godoc
+// @Summary Update image policy
+// @Description Enables or disables rejecting VM images which are not in the catalog (admin only).
+// @Tags images
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param policy body ImagePolicy true "Image policy"
+// @Success 200 {object} ImagePolicy
+// @Failure 400,403,500 {object} apierror.Error
+// @Router /images/policy [put]
+func UpdateImagePolicy(context *gin.Context) {
+	var policy ImagePolicy
+
+	err := context.ShouldBindJSON(&policy)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse request data.", err)
+		return
+	}
+
+	err = models.SetSetting(context.Request.Context(), models.SettingEnforceImageCatalog, strconv.FormatBool(policy.EnforceCatalog))
+	if err != nil {
+		apierror.AbortError(context, "Could not update the image policy.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, policy)
+}
+
+// resolveVMImage applies the image catalog to a VM before its container starts:
+// defaults are filled in and the image is pinned to the catalog digest.
+// Images outside of the catalog are rejected when the policy enforces the catalog,
+// except images of the account's own repositories in the embedded registry.
+// Catalog images which aren't pulled yet (or failed to) run without a pinned digest, which is described by the warning.
+// Registry images are only pulled and pinned with pull, otherwise just the access is checked.
+// It writes the error response and returns false if the VM must not be started.
+func resolveVMImage(context *gin.Context, vm *models.VM, pull bool) (string, bool) {
+	// The digest is always resolved by the server
+	vm.ImageDigest = ""
+
+	// Images of the embedded registry are private to their account and pulled with its credentials
+	if owner, pullReference, ok := services.ParseRegistryImage(vm.Image); ok {
+		account, err := models.GetAccountByID(context.Request.Context(), context.GetInt64("user_id"))
+		if err != nil {
+			apierror.AbortError(context, "Could not fetch the account.", err)
+			return "", false
+		}
+		if owner != account.Username && !account.IsAdmin() {
+			apierror.Abort(context, http.StatusForbidden, apierror.CodeForbidden, "Image belongs to another account: "+vm.Image, nil)
+			return "", false
+		}
+		if !pull {
+			return "", true
+		}
+
+		digest, err := services.PullRegistryImage(context.Request.Context(), pullReference, account.Username, account.ID)
+		if err != nil {
+			apierror.AbortErr(context, http.StatusBadGateway, apierror.CodeRuntimeError, "Failed to pull the image from the MiniCloud registry", err)
+			return "", false
+		}
+
+		vm.ImageDigest = digest
+		return "", true
+	}
+
+	image, err := models.GetImageByName(context.Request.Context(), vm.Image)
+	if errors.Is(err, sql.ErrNoRows) {
+		enforce, err := models.GetBoolSetting(context.Request.Context(), models.SettingEnforceImageCatalog, false)
+		if err != nil {
+			apierror.AbortError(context, "Could not fetch the image policy.", err)
+			return "", false
+		}
+		if enforce {
+			apierror.Abort(context, http.StatusForbidden, apierror.CodeForbidden, "Image is not in the catalog: "+vm.Image, nil)
+			return "", false
+		}
+		return "", true
+	}
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the catalog image.", err)
+		return "", false
+	}
+
+	image.ApplyDefaults(vm)
+	vm.ImageDigest = image.Digest
+
+	if image.Digest == "" {
+		return "The catalog image " + image.Name + " has no pinned digest (pull status " + image.Status + "), the VM runs the tag", true
+	}
+	return "", true
+}
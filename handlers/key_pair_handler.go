@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+)
+
+// ListKeyPairs godoc
+// @Summary List own key pairs
+// @Description Retrieves the SSH key pairs of the authenticated account
+// @Tags key-pairs
+// @Security BearerAuth
+// @Produce json
+// @Param limit query int false "Maximum number of items (default 100, max 1000)"
+// @Param page_token query string false "NextPageToken of the previous page"
+// @Param sort query string false "id, name, created_at, with - for descending (default name)"
+// @Param name_prefix query string false "Beginning of the name"
+// @Param selector query string false "Label selector, e.g., env=dev,team in (a,b)"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400,500 {object} apierror.Error
+// @Router /key-pairs [get]
+func ListKeyPairs(context *gin.Context) {
+	options, ok := listOptions(context)
+	if !ok {
+		return
+	}
+
+	keyPairs, nextPageToken, err := models.ListKeyPairs(context.Request.Context(), context.GetInt64("user_id"), options)
+	respondList(context, "Fetched key pairs", keyPairs, nextPageToken, err)
+}
+
+// CreateKeyPair godoc
+// @Summary Import or generate a key pair
+// @Description Imports the given public key, or generates an ed25519 key pair if public_key is empty. The private key of a generated key pair is only returned in this response. The Idempotency-Key header is ignored, the private key is not stored for a replay.
+// @Tags key-pairs
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param keyPair body models.KeyPair true "Key pair (name and optional public_key)"
+// @Success 201 {object} map[string]interface{}
+// @Failure 400,409,500 {object} apierror.Error
+// @Router /key-pairs [post]
+func CreateKeyPair(context *gin.Context) {
+	var keyPair models.KeyPair
+
+	err := context.ShouldBindJSON(&keyPair)
+
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse request data.", err)
+		return
+	}
+
+	keyPair.Name = strings.TrimSpace(keyPair.Name)
+	if keyPair.Name == "" {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "The key pair name is required.", nil)
+		return
+	}
+
+	if !validLabels(context, keyPair.Labels) {
+		return
+	}
+
+	keyPair.AccountID = context.GetInt64("user_id")
+
+	existing, err := models.GetKeyPairByName(context.Request.Context(), keyPair.AccountID, keyPair.Name)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the key pair.", err)
+		return
+	}
+	if existing != nil {
+		apierror.Abort(context, http.StatusConflict, apierror.CodeConflict, "A key pair with this name already exists", nil)
+		return
+	}
+
+	message := "Key pair imported"
+	keyPair.PrivateKey = ""
+	if keyPair.PublicKey == "" {
+		keyPair.PublicKey, keyPair.PrivateKey, err = utils.GenerateSSHKeyPair(keyPair.Name)
+		if err != nil {
+			apierror.AbortError(context, "Could not generate the key pair.", err)
+			return
+		}
+		message = "Key pair generated, store the private key now: it is not shown again"
+	}
+
+	keyPair.PublicKey, keyPair.Fingerprint, err = utils.ParseSSHPublicKey(keyPair.PublicKey)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse the public key.", err)
+		return
+	}
+
+	err = keyPair.InsertKeyPair(context.Request.Context())
+
+	if err != nil {
+		apierror.AbortError(context, "Could not create key pair.", err)
+		return
+	}
+
+	auditCreated(context, keyPair.ID)
+
+	setETag(context, keyPair.Version)
+	context.JSON(http.StatusCreated, gin.H{"message": message, "KeyPair": keyPair})
+}
+
+// GetKeyPair godoc
+// @Summary Get key pair by ID
+// @Description Retrieves a key pair (own key pair or admin)
+// @Tags key-pairs
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Key pair ID"
+// @Success 200 {object} map[string]interface{}
+// @Header 200 {string} ETag "Version of the resource, for If-Match"
+// @Failure 400,403,404,500 {object} apierror.Error
+// @Router /key-pairs/{id} [get]
+func GetKeyPair(context *gin.Context) {
+	keyPair, ok := keyPairFromParam(context)
+	if !ok {
+		return
+	}
+
+	setETag(context, keyPair.Version)
+	context.JSON(http.StatusOK, gin.H{"KeyPair": keyPair})
+}
+
+// DeleteKeyPair godoc
+// @Summary Delete key pair
+// @Description Deletes a key pair (own key pair or admin). Keys already installed into VMs stay there.
+// @Tags key-pairs
+// @Security BearerAuth
+// @Param id path int true "Key pair ID"
+// @Param If-Match header string false "ETag of the version the change is based on"
+// @Success 200 {object} map[string]string
+// @Failure 400,403,404,412,428,500 {object} apierror.Error
+// @Router /key-pairs/{id} [delete]
+func DeleteKeyPair(context *gin.Context) {
+	keyPair, ok := keyPairFromParam(context)
+	if !ok || !checkIfMatch(context, keyPair.Version) {
+		return
+	}
+
+	err := keyPair.DeleteKeyPairByID(context.Request.Context())
+	if err != nil {
+		apierror.AbortError(context, "Could not delete the key pair.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Key pair deleted successfully with ID: " + strconv.FormatInt(keyPair.ID, 10)})
+}
+
+// keyPairFromParam loads the key pair of the ":id" path parameter for its owner or an admin
+// It writes the error response and returns false otherwise
+func keyPairFromParam(context *gin.Context) (*models.KeyPair, bool) {
+	keyPairId, err := strconv.ParseInt(context.Param("id"), 10, 64)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse key pair id.", err)
+		return nil, false
+	}
+
+	keyPair, err := models.GetKeyPairByID(context.Request.Context(), keyPairId)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the key pair.", err)
+		return nil, false
+	}
+	if keyPair == nil {
+		apierror.Abort(context, http.StatusNotFound, apierror.CodeNotFound, "Key pair not found", nil)
+		return nil, false
+	}
+
+	if !requireSelfOrAdmin(context, keyPair.AccountID) {
+		return nil, false
+	}
+
+	return keyPair, true
+}
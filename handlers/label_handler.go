@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/services"
+)
+
+// LabelRequest adds labels to several resources of a type
+type LabelRequest struct {
+	// vm, storage, image or key_pair
+	ResourceType string `json:"resource_type" binding:"required"`
+
+	// IDs of the resources
+	IDs []int64 `json:"ids" binding:"required"`
+
+	// The labels to add, existing keys get the new value
+	Labels map[string]string `json:"labels" binding:"required"`
+}
+
+// UnlabelRequest removes label keys from several resources of a type
+type UnlabelRequest struct {
+	// vm, storage, image or key_pair
+	ResourceType string `json:"resource_type" binding:"required"`
+
+	// IDs of the resources
+	IDs []int64 `json:"ids" binding:"required"`
+
+	// The label keys to remove
+	Keys []string `json:"keys" binding:"required"`
+}
+
+// LabelResources godoc
+// @Summary Label resources
+// @Description Adds labels to several resources of a type at once (own resources or admin, resources of the selected project for its members, catalog images admin only). VMs whose labels change are recreated with the new Docker labels, the Docker labels of volumes stay those of their creation.
+// @Tags labels
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param X-MiniCloud-Project header string false "Project ID or name"
+// @Param labels body LabelRequest true "Resources and labels"
+// @Param Idempotency-Key header string false "Key to retry the request safely, retries replay the first response"
+// @Success 200 {object} map[string]string
+// @Failure 400,403,404,500,502 {object} apierror.Error
+// @Router /labels [post]
+func LabelResources(context *gin.Context) {
+	var request LabelRequest
+	if err := context.ShouldBindJSON(&request); err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse request data, resource_type, ids and labels are required.", err)
+		return
+	}
+
+	if len(request.Labels) == 0 {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "At least one label is required.", nil)
+		return
+	}
+	if !validLabels(context, request.Labels) {
+		return
+	}
+
+	auditAs(context, "labels.set", request.ResourceType, 0, "ids="+formatIDs(request.IDs)+" keys="+strings.Join(sortedLabelKeys(request.Labels), ","))
+
+	if !requireLabelResources(context, request.ResourceType, request.IDs) {
+		return
+	}
+
+	vms, unlock, ok := lockLabeledVMs(context, request.ResourceType, request.IDs)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	if err := models.SetLabels(context.Request.Context(), request.ResourceType, request.IDs, request.Labels); err != nil {
+		apierror.AbortError(context, "Could not store the labels.", err)
+		return
+	}
+
+	if !recreateRelabeledVMs(context, vms) {
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Labeled %d resources", len(request.IDs))})
+}
+
+// UnlabelResources godoc
+// @Summary Unlabel resources
+// @Description Removes label keys from several resources of a type at once (own resources or admin, resources of the selected project for its members, catalog images admin only). VMs whose labels change are recreated with the new Docker labels, the Docker labels of volumes stay those of their creation.
+// @Tags labels
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param X-MiniCloud-Project header string false "Project ID or name"
+// @Param labels body UnlabelRequest true "Resources and label keys"
+// @Param Idempotency-Key header string false "Key to retry the request safely, retries replay the first response"
+// @Success 200 {object} map[string]string
+// @Failure 400,403,404,500,502 {object} apierror.Error
+// @Router /labels/remove [post]
+func UnlabelResources(context *gin.Context) {
+	var request UnlabelRequest
+	if err := context.ShouldBindJSON(&request); err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse request data, resource_type, ids and keys are required.", err)
+		return
+	}
+
+	if len(request.Keys) == 0 {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "At least one label key is required.", nil)
+		return
+	}
+
+	auditAs(context, "labels.remove", request.ResourceType, 0, "ids="+formatIDs(request.IDs)+" keys="+strings.Join(request.Keys, ","))
+
+	if !requireLabelResources(context, request.ResourceType, request.IDs) {
+		return
+	}
+
+	vms, unlock, ok := lockLabeledVMs(context, request.ResourceType, request.IDs)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	if err := models.RemoveLabels(context.Request.Context(), request.ResourceType, request.IDs, request.Keys); err != nil {
+		apierror.AbortError(context, "Could not remove the labels.", err)
+		return
+	}
+
+	if !recreateRelabeledVMs(context, vms) {
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Unlabeled %d resources", len(request.IDs))})
+}
+
+// validLabels checks the syntax of labels of a request
+// It writes the error response and returns false otherwise
+func validLabels(context *gin.Context, labels map[string]string) bool {
+	if err := models.ValidateLabels(labels); err != nil {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, err.Error(), nil)
+		return false
+	}
+	return true
+}
+
+// requireLabelResources checks that the resources exist and belong to the account or the selected project,
+// admins may label all resources outside of projects and only admins the images of the catalog. It writes the error response and returns false otherwise
+func requireLabelResources(context *gin.Context, resourceType string, ids []int64) bool {
+	if !models.ValidLabelResourceType(resourceType) {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "resource_type must be one of "+strings.Join(models.LabelResourceTypes, ", "), nil)
+		return false
+	}
+	if len(ids) == 0 || len(ids) > models.MaxListLimit {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, fmt.Sprintf("Between 1 and %d ids are required.", models.MaxListLimit), nil)
+		return false
+	}
+
+	owners, err := models.GetResourceOwners(context.Request.Context(), resourceType, ids)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the resources.", err)
+		return false
+	}
+
+	userId := context.GetInt64("user_id")
+	adminChecked := false
+	for _, id := range ids {
+		owner, found := owners[id]
+		if !found {
+			apierror.Abort(context, http.StatusNotFound, apierror.CodeNotFound, fmt.Sprintf("No %s with ID %d", resourceType, id), nil)
+			return false
+		}
+		// Resources of a project are labeled by the members of the selected project
+		if owner.ProjectID != 0 {
+			if !inSelectedProject(context, owner.ProjectID, fmt.Sprintf("No %s with ID %d in the selected project", resourceType, id)) {
+				return false
+			}
+			continue
+		}
+		if owner.AccountID != userId && !adminChecked {
+			if !requireSelfOrAdmin(context, owner.AccountID) {
+				return false
+			}
+			adminChecked = true
+		}
+	}
+
+	return true
+}
+
+// lockLabeledVMs serializes the label change with the other changes of the VMs and fetches them,
+// nothing is locked for other resource types. It writes the error response and returns false otherwise
+func lockLabeledVMs(context *gin.Context, resourceType string, ids []int64) ([]*models.VM, func(), bool) {
+	if resourceType != models.LabelResourceVM {
+		return nil, func() {}, true
+	}
+
+	// Locked in the order of the IDs, so two bulk requests can't wait for each other
+	ids = slices.Clone(ids)
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+
+	var unlocks []func()
+	unlock := func() {
+		for _, unlock := range slices.Backward(unlocks) {
+			unlock()
+		}
+	}
+
+	vms := make([]*models.VM, 0, len(ids))
+	for _, id := range ids {
+		unlocks = append(unlocks, lockResource("vm", id))
+		vm, err := models.GetVMByID(context.Request.Context(), id)
+		if err != nil {
+			unlock()
+			apierror.AbortError(context, "Could not fetch the VM.", err)
+			return nil, nil, false
+		}
+		vms = append(vms, vm)
+	}
+
+	return vms, unlock, true
+}
+
+// recreateRelabeledVMs starts new containers with the stored labels for the VMs whose labels changed,
+// Docker can't change the labels of a container. It writes the error response and returns false otherwise
+func recreateRelabeledVMs(context *gin.Context, vms []*models.VM) bool {
+	for _, vm := range vms {
+		labels, err := models.GetLabels(context.Request.Context(), models.LabelResourceVM, vm.ID)
+		if err != nil {
+			apierror.AbortError(context, "Could not fetch the labels.", err)
+			return false
+		}
+		if maps.Equal(vm.Labels, labels) {
+			continue
+		}
+		vm.Labels = labels
+
+		bootScript, ok := buildBootScript(context, vm)
+		if !ok {
+			return false
+		}
+
+		slog.InfoContext(context.Request.Context(), "Recreating VM for its labels", "vm_id", vm.ID)
+		if !recreateVMContainer(context, vm.ContainerID, vm) {
+			return false
+		}
+
+		if err := vm.UpdateVMByID(context.Request.Context()); err != nil {
+			abortUpdateError(context, "Could not update the metadata of VM in database", err)
+			return false
+		}
+
+		startRecreatedVM(context, vm, bootScript)
+
+		services.PublishEvent(context.Request.Context(), models.EventVMUpdated, "vm", vm.ID, vm.AccountID, vm.ProjectID, *vm)
+	}
+
+	return true
+}
+
+func formatIDs(ids []int64) string {
+	values := make([]string, 0, len(ids))
+	for _, id := range ids {
+		values = append(values, fmt.Sprint(id))
+	}
+	return strings.Join(values, ",")
+}
+
+func sortedLabelKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+)
+
+// listOptions reads limit, page_token and sort of a list request, every other query parameter is a filter
+// It writes the error response and returns false otherwise
+func listOptions(context *gin.Context) (models.ListOptions, bool) {
+	options := models.ListOptions{
+		PageToken: context.Query("page_token"),
+		Sort:      context.Query("sort"),
+		Filters:   map[string]string{},
+	}
+
+	if value := context.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > models.MaxListLimit {
+			apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "limit must be between 1 and "+strconv.Itoa(models.MaxListLimit), nil)
+			return options, false
+		}
+		options.Limit = limit
+	}
+
+	for name, values := range context.Request.URL.Query() {
+		if name == "limit" || name == "page_token" || name == "sort" {
+			continue
+		}
+		if len(values) > 1 {
+			apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "The filter "+name+" is given more than once", nil)
+			return options, false
+		}
+		options.Filters[name] = values[0]
+	}
+
+	return options, true
+}
+
+// respondList writes a page of a list in the envelope shared by all list endpoints:
+// the items and the token of the next page, which is empty on the last page
+func respondList[T any](context *gin.Context, message string, items []T, nextPageToken string, err error) {
+	var listErr *models.ListError
+	if errors.As(err, &listErr) {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, listErr.Message, nil)
+		return
+	}
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the list.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": message, "Items": items, "NextPageToken": nextPageToken})
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/services"
+)
+
+// GetVMLogs godoc
+// @Summary      Get VM logs
+// @Description  Returns the stdout and stderr of the VM from the log store, also after the container was recreated or the VM deleted (within the retention period). With follow=true new lines are streamed, as server-sent events when the client accepts text/event-stream, otherwise as chunked plain text.
+// @Tags         vms
+// @Security BearerAuth
+// @Produce      plain
+// @Produce      text/event-stream
+// @Param        id      path      int     true   "VM ID"
+// @Param        since   query     string  false  "RFC 3339 time or a duration like 10m"
+// @Param        tail    query     int     false  "Number of lines from the end"
+// @Param        follow  query     bool    false  "Stream new lines"
+// @Success      200  {string}  string
+// @Failure      400,403,404,500  {object}  apierror.Error
+// @Router       /vms/{id}/logs [get]
+func GetVMLogs(context *gin.Context) {
+	vmId, ok := vmLogsAccess(context)
+	if !ok {
+		return
+	}
+
+	since, err := parseSince(context.Query("since"))
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse since.", err)
+		return
+	}
+
+	tail := 0
+	if value := context.Query("tail"); value != "" {
+		tail, err = strconv.Atoi(value)
+		if err != nil || tail < 0 {
+			apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "tail must be a positive number", nil)
+			return
+		}
+	}
+
+	if context.Query("follow") != "true" {
+		entries, err := services.ReadLogs(vmId, since, tail)
+		if err != nil {
+			apierror.AbortError(context, "Could not read the logs.", err)
+			return
+		}
+
+		var text strings.Builder
+		for _, entry := range entries {
+			text.WriteString(formatLogEntry(entry))
+		}
+		context.String(http.StatusOK, text.String())
+		return
+	}
+
+	sse := strings.Contains(context.GetHeader("Accept"), "text/event-stream")
+	if sse {
+		context.Header("Content-Type", "text/event-stream")
+		context.Header("Cache-Control", "no-cache")
+	} else {
+		context.Header("Content-Type", "text/plain; charset=utf-8")
+	}
+	context.Status(http.StatusOK)
+	context.Writer.Flush()
+
+	err = services.FollowLogs(context.Request.Context(), vmId, since, tail, func(entry services.LogEntry) error {
+		if sse {
+			context.SSEvent("log", entry)
+		} else if _, err := context.Writer.WriteString(formatLogEntry(entry)); err != nil {
+			return err
+		}
+		context.Writer.Flush()
+		return nil
+	})
+	if err != nil {
+		slog.ErrorContext(context.Request.Context(), "Following the logs failed", "vm_id", vmId, "error", err)
+	}
+}
+
+// vmLogsAccess checks that the VM or the logs of the deleted VM belong to the account, or the account is an admin
+// It writes the error response and returns false otherwise
+func vmLogsAccess(context *gin.Context) (int64, bool) {
+	vmId, err := strconv.ParseInt(context.Param("id"), 10, 64)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse VM id.", err)
+		return 0, false
+	}
+
+	vm, err := models.GetVMByID(context.Request.Context(), vmId)
+	if err == nil {
+		return vmId, requireResourceAccess(context, vm.AccountID, vm.ProjectID)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		apierror.AbortError(context, "Could not fetch the VM.", err)
+		return 0, false
+	}
+
+	// The logs of deleted VMs are kept for the retention period
+	meta, err := services.GetLogMeta(vmId)
+	if err != nil {
+		apierror.AbortError(context, "Could not read the logs.", err)
+		return 0, false
+	}
+	if meta == nil {
+		apierror.Abort(context, http.StatusNotFound, apierror.CodeNotFound, "VM not found", nil)
+		return 0, false
+	}
+
+	return vmId, requireSelfOrAdmin(context, meta.AccountID)
+}
+
+// parseSince accepts an RFC 3339 time or a duration back from now
+func parseSince(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+func formatLogEntry(entry services.LogEntry) string {
+	return entry.Time.Format(time.RFC3339Nano) + " " + entry.Stream + " " + entry.Log + "\n"
+}
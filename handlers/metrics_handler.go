@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/services"
+)
+
+// maxMetricPoints limits the number of buckets of one metrics query
+const maxMetricPoints = 10000
+
+// GetVMMetrics godoc
+// @Summary      Get VM metrics
+// @Description  Returns the CPU (cores), memory (MB), network and block I/O (bytes per bucket) time series of the VM. Raw samples are kept for MINICLOUD_METRICS_RAW_RETENTION (24h), older ranges use hourly points.
+// @Tags         vms
+// @Security BearerAuth
+// @Produce      json
+// @Param        id    path      int     true   "VM ID"
+// @Param        from  query     string  false  "RFC 3339 time or a duration like 6h (default: 1h)"
+// @Param        to    query     string  false  "RFC 3339 time or a duration like 5m (default: now)"
+// @Param        step  query     string  false  "Bucket size like 5m (default: 60 buckets)"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400,403,404,500  {object}  apierror.Error
+// @Router       /vms/{id}/metrics [get]
+func GetVMMetrics(context *gin.Context) {
+	vm, ok := vmFromParam(context)
+	if !ok {
+		return
+	}
+
+	to := time.Now()
+	if value := context.Query("to"); value != "" {
+		parsed, err := parseSince(value)
+		if err != nil {
+			apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse to.", err)
+			return
+		}
+		to = parsed
+	}
+
+	from := to.Add(-time.Hour)
+	if value := context.Query("from"); value != "" {
+		parsed, err := parseSince(value)
+		if err != nil {
+			apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse from.", err)
+			return
+		}
+		from = parsed
+	}
+
+	if !to.After(from) {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "from must be before to", nil)
+		return
+	}
+
+	step := to.Sub(from) / 60
+	if value := context.Query("step"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < time.Second {
+			apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "step must be a duration of at least 1s (e.g., 5m)", nil)
+			return
+		}
+		step = parsed
+	}
+
+	// Older ranges only have hourly points
+	rawSince := services.MetricsRawSince()
+	if from.Before(rawSince) && step < time.Hour {
+		step = time.Hour
+	}
+	step = step.Round(time.Second)
+	if step < time.Second {
+		step = time.Second
+	}
+
+	if to.Sub(from)/step > maxMetricPoints {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Too many points, use a larger step", nil)
+		return
+	}
+
+	samples, err := models.GetVMMetrics(context.Request.Context(), vm.ID, from, to, step, rawSince)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the metrics.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{
+		"vm_id":  vm.ID,
+		"from":   from.UTC(),
+		"to":     to.UTC(),
+		"step":   step.String(),
+		"limits": gin.H{"cpu_cores": vm.CPU, "memory_mb": vm.Memory},
+		"points": samples,
+	})
+}
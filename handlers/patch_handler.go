@@ -0,0 +1,97 @@
+// Manage the incoming HTTP requests
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+)
+
+// MergePatchContentType is the media type of JSON Merge Patch (RFC 7396) bodies,
+// PATCH routes also accept application/json
+const MergePatchContentType = "application/merge-patch+json"
+
+// bindMergePatch applies the JSON Merge Patch of the body to the request document, which holds the
+// current values of the resource, and checks the constraints of the result like bindRequest.
+// Fields which aren't part of the request document (e.g., id) can't be patched.
+// It writes the error response and returns false if the patch can't be applied
+func bindMergePatch(context *gin.Context, request any) bool {
+	contentType := context.ContentType()
+	if contentType != MergePatchContentType && contentType != binding.MIMEJSON {
+		apierror.Abort(context, http.StatusUnsupportedMediaType, apierror.CodeUnsupportedMediaType,
+			"The body must be a JSON Merge Patch ("+MergePatchContentType+").", nil)
+		return false
+	}
+
+	patch, err := io.ReadAll(context.Request.Body)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not read request data.", err)
+		return false
+	}
+
+	// A patch which isn't an object would replace the whole resource
+	if !bytes.HasPrefix(bytes.TrimSpace(patch), []byte("{")) {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "The merge patch must be a JSON object.", nil)
+		return false
+	}
+
+	document, err := json.Marshal(request)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusInternalServerError, apierror.CodeInternal, "Could not encode the resource.", err)
+		return false
+	}
+
+	merged, err := utils.MergePatch(document, patch)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse request data.", err)
+		return false
+	}
+
+	// The result replaces the request document, so removed fields get their zero value
+	reflect.ValueOf(request).Elem().SetZero()
+	decoder := json.NewDecoder(bytes.NewReader(merged))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(request); err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not apply the merge patch.", err)
+		return false
+	}
+
+	err = binding.Validator.ValidateStruct(request)
+	var validationErrors validator.ValidationErrors
+	if errors.As(err, &validationErrors) {
+		abortValidation(context, fieldErrors(validationErrors))
+		return false
+	}
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not apply the merge patch.", err)
+		return false
+	}
+
+	return true
+}
+
+// dryRunParam parses the optional dry_run query parameter.
+// It writes the error response and returns false if it isn't a boolean
+func dryRunParam(context *gin.Context) (bool, bool) {
+	value := context.Query("dry_run")
+	if value == "" {
+		return false, true
+	}
+
+	dryRun, err := strconv.ParseBool(value)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "dry_run must be true or false.", err)
+		return false, false
+	}
+	return dryRun, true
+}
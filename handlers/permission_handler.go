@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+)
+
+// GetAccountPermissions godoc
+// @Summary List account permissions
+// @Description Retrieves the permissions granted to an account (admin only)
+// @Tags account
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Account ID"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400,403,404,500 {object} apierror.Error
+// @Router /accounts/{id}/permissions [get]
+func GetAccountPermissions(context *gin.Context) {
+	account, ok := accountFromParam(context)
+	if !ok {
+		return
+	}
+
+	permissions, err := models.GetPermissions(context.Request.Context(), account.ID)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch permissions.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"Account ID": account.ID, "Permissions": permissions, "Known permissions": models.KnownPermissions})
+}
+
+// GrantAccountPermission godoc
+// @Summary Grant a permission
+// @Description Grants a permission (e.g., vms.custom_resources) to an account (admin only)
+// @Tags account
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Account ID"
+// @Param permission path string true "Permission"
+// @Success 200 {object} map[string]string
+// @Failure 400,403,404,500 {object} apierror.Error
+// @Router /accounts/{id}/permissions/{permission} [put]
+func GrantAccountPermission(context *gin.Context) {
+	account, ok := accountFromParam(context)
+	if !ok {
+		return
+	}
+
+	permission := context.Param("permission")
+	if !models.IsKnownPermission(permission) {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Unknown permission: "+permission, nil)
+		return
+	}
+
+	err := models.GrantPermission(context.Request.Context(), account.ID, permission)
+	if err != nil {
+		apierror.AbortError(context, "Could not grant the permission.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Permission " + permission + " granted to account " + account.Username})
+}
+
+// RevokeAccountPermission godoc
+// @Summary Revoke a permission
+// @Description Removes a permission from an account (admin only)
+// @Tags account
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Account ID"
+// @Param permission path string true "Permission"
+// @Success 200 {object} map[string]string
+// @Failure 400,403,404,500 {object} apierror.Error
+// @Router /accounts/{id}/permissions/{permission} [delete]
+func RevokeAccountPermission(context *gin.Context) {
+	account, ok := accountFromParam(context)
+	if !ok {
+		return
+	}
+
+	permission := context.Param("permission")
+	err := models.RevokePermission(context.Request.Context(), account.ID, permission)
+	if err != nil {
+		apierror.AbortError(context, "Could not revoke the permission.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Permission " + permission + " revoked from account " + account.Username})
+}
+
+// accountFromParam loads the account of the ":id" path parameter
+// It writes the error response and returns false if there is no such account
+func accountFromParam(context *gin.Context) (*models.Account, bool) {
+	return accountFromNamedParam(context, "id")
+}
+
+// accountFromNamedParam loads the account of a path parameter other than ":id" (e.g., ":account")
+func accountFromNamedParam(context *gin.Context, name string) (*models.Account, bool) {
+	accountId, err := strconv.ParseInt(context.Param(name), 10, 64)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse account id.", err)
+		return nil, false
+	}
+
+	account, err := models.GetAccountByID(context.Request.Context(), accountId)
+	if errors.Is(err, sql.ErrNoRows) {
+		apierror.Abort(context, http.StatusNotFound, apierror.CodeNotFound, "Account not found", nil)
+		return nil, false
+	}
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the account.", err)
+		return nil, false
+	}
+
+	return account, true
+}
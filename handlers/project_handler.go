@@ -0,0 +1,496 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+)
+
+// ProjectMemberRequest sets the role of an account in a project
+type ProjectMemberRequest struct {
+	// owner, member or viewer
+	Role string `json:"role" binding:"required"`
+}
+
+// ListProjects godoc
+// @Summary List projects
+// @Description Retrieves the projects the authenticated account is a member of (all projects for admins)
+// @Tags projects
+// @Security BearerAuth
+// @Produce json
+// @Param limit query int false "Maximum number of items (default 100, max 1000)"
+// @Param page_token query string false "NextPageToken of the previous page"
+// @Param sort query string false "id, name, created_at, with - for descending (default name)"
+// @Param name_prefix query string false "Beginning of the name"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400,500 {object} apierror.Error
+// @Router /projects [get]
+func ListProjects(context *gin.Context) {
+	options, ok := listOptions(context)
+	if !ok {
+		return
+	}
+
+	account, err := models.GetAccountByID(context.Request.Context(), context.GetInt64("user_id"))
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the account.", err)
+		return
+	}
+
+	projects, nextPageToken, err := models.ListProjects(context.Request.Context(), account.ID, account.IsAdmin(), options)
+	respondList(context, "Fetched projects", projects, nextPageToken, err)
+}
+
+// CreateProject godoc
+// @Summary Create a project
+// @Description Creates a project, the authenticated account becomes its owner
+// @Tags projects
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param project body models.Project true "Project"
+// @Param Idempotency-Key header string false "Key to retry the request safely, retries replay the first response"
+// @Success 201 {object} map[string]interface{}
+// @Failure 400,409,500 {object} apierror.Error
+// @Router /projects [post]
+func CreateProject(context *gin.Context) {
+	var project models.Project
+	if !bindProject(context, &project) {
+		return
+	}
+
+	err := project.InsertProject(context.Request.Context(), context.GetInt64("user_id"))
+	if err != nil {
+		apierror.AbortError(context, "Could not create the project.", err)
+		return
+	}
+
+	auditCreated(context, project.ID)
+
+	setETag(context, project.Version)
+	context.JSON(http.StatusCreated, gin.H{"message": "Project created", "Project": project})
+}
+
+// GetProject godoc
+// @Summary Get project
+// @Description Retrieves a project with its members and the role of the authenticated account (members or admin)
+// @Tags projects
+// @Security BearerAuth
+// @Produce json
+// @Param project path string true "Project ID or name"
+// @Success 200 {object} map[string]interface{}
+// @Header 200 {string} ETag "Version of the resource, for If-Match"
+// @Failure 403,404,500 {object} apierror.Error
+// @Router /projects/{project} [get]
+func GetProject(context *gin.Context) {
+	project, ok := selectedProject(context)
+	if !ok {
+		return
+	}
+
+	members, err := models.GetProjectMembers(context.Request.Context(), project.ID)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the project members.", err)
+		return
+	}
+
+	setETag(context, project.Version)
+	context.JSON(http.StatusOK, gin.H{"Project": project, "Members": members, "Role": context.GetString("project_role")})
+}
+
+// UpdateProject godoc
+// @Summary Update project
+// @Description Renames a project or changes its description (owners or admin)
+// @Tags projects
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param project path string true "Project ID or name"
+// @Param body body models.Project true "Project"
+// @Param If-Match header string false "ETag of the version the change is based on"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400,403,404,409,412,428,500 {object} apierror.Error
+// @Router /projects/{project} [put]
+func UpdateProject(context *gin.Context) {
+	project, ok := selectedProject(context)
+	if !ok || !checkIfMatch(context, project.Version) || !bindProject(context, project) {
+		return
+	}
+
+	auditAs(context, "project.update", "project", project.ID, "")
+
+	err := project.UpdateProject(context.Request.Context())
+	if err != nil {
+		abortUpdateError(context, "Could not update the project.", err)
+		return
+	}
+
+	setETag(context, project.Version)
+	context.JSON(http.StatusOK, gin.H{"message": "Project updated successfully!", "Project": project})
+}
+
+// DeleteProject godoc
+// @Summary Delete project
+// @Description Deletes a project with its members and quota (owners or admin). VMs and storages of the project have to be deleted first.
+// @Tags projects
+// @Security BearerAuth
+// @Produce json
+// @Param project path string true "Project ID or name"
+// @Param If-Match header string false "ETag of the version the change is based on"
+// @Success 200 {object} map[string]string
+// @Failure 403,404,409,412,428,500 {object} apierror.Error
+// @Router /projects/{project} [delete]
+func DeleteProject(context *gin.Context) {
+	project, ok := selectedProject(context)
+	if !ok || !checkIfMatch(context, project.Version) {
+		return
+	}
+
+	auditAs(context, "project.delete", "project", project.ID, project.Name)
+
+	usage, err := models.GetProjectUsage(context.Request.Context(), project.ID)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the usage.", err)
+		return
+	}
+	if usage.VMs > 0 || usage.Volumes > 0 {
+		apierror.Abort(context, http.StatusConflict, apierror.CodeConflict, "The project still has VMs or storages, delete them first", apierror.Details{"usage": usage})
+		return
+	}
+
+	err = project.DeleteProjectByID(context.Request.Context())
+	if err != nil {
+		apierror.AbortError(context, "Could not delete the project.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Project deleted successfully with ID: " + strconv.FormatInt(project.ID, 10)})
+}
+
+// ListProjectMembers godoc
+// @Summary List project members
+// @Description Retrieves the members of a project with their roles (members or admin)
+// @Tags projects
+// @Security BearerAuth
+// @Produce json
+// @Param project path string true "Project ID or name"
+// @Success 200 {object} map[string]interface{}
+// @Failure 403,404,500 {object} apierror.Error
+// @Router /projects/{project}/members [get]
+func ListProjectMembers(context *gin.Context) {
+	members, err := models.GetProjectMembers(context.Request.Context(), context.GetInt64("project_id"))
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the project members.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"Members": members})
+}
+
+// SetProjectMember godoc
+// @Summary Add or change project member
+// @Description Adds an account to a project or changes its role: owner, member or viewer (owners or admin)
+// @Tags projects
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param project path string true "Project ID or name"
+// @Param account path int true "Account ID"
+// @Param member body ProjectMemberRequest true "Role"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400,403,404,409,500 {object} apierror.Error
+// @Router /projects/{project}/members/{account} [put]
+func SetProjectMember(context *gin.Context) {
+	account, ok := accountFromNamedParam(context, "account")
+	if !ok {
+		return
+	}
+
+	var request ProjectMemberRequest
+	err := context.ShouldBindJSON(&request)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse request data.", err)
+		return
+	}
+	if !models.ValidProjectRole(request.Role) {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Unknown role, use owner, member or viewer", nil)
+		return
+	}
+
+	projectID := context.GetInt64("project_id")
+	auditAs(context, "project.member_set", "project", projectID, "account="+strconv.FormatInt(account.ID, 10)+" role="+request.Role)
+
+	if request.Role != models.ProjectRoleOwner && !keepsProjectOwner(context, projectID, account.ID) {
+		return
+	}
+
+	member := models.ProjectMember{ProjectID: projectID, AccountID: account.ID, Username: account.Username, Role: request.Role}
+	err = member.SaveProjectMember(context.Request.Context())
+	if err != nil {
+		apierror.AbortError(context, "Could not save the project member.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Project member saved", "Member": member})
+}
+
+// RemoveProjectMember godoc
+// @Summary Remove project member
+// @Description Removes an account from a project (owners or admin). Its resources stay in the project, the last owner can't be removed.
+// @Tags projects
+// @Security BearerAuth
+// @Produce json
+// @Param project path string true "Project ID or name"
+// @Param account path int true "Account ID"
+// @Success 200 {object} map[string]string
+// @Failure 400,403,404,409,500 {object} apierror.Error
+// @Router /projects/{project}/members/{account} [delete]
+func RemoveProjectMember(context *gin.Context) {
+	accountId, err := strconv.ParseInt(context.Param("account"), 10, 64)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse account id.", err)
+		return
+	}
+
+	projectID := context.GetInt64("project_id")
+	auditAs(context, "project.member_remove", "project", projectID, "account="+strconv.FormatInt(accountId, 10))
+
+	member, err := models.GetProjectMember(context.Request.Context(), projectID, accountId)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the project member.", err)
+		return
+	}
+	if member == nil {
+		apierror.Abort(context, http.StatusNotFound, apierror.CodeNotFound, "The account is no member of the project", nil)
+		return
+	}
+
+	if !keepsProjectOwner(context, projectID, accountId) {
+		return
+	}
+
+	err = member.DeleteProjectMember(context.Request.Context())
+	if err != nil {
+		apierror.AbortError(context, "Could not remove the project member.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Account " + member.Username + " removed from the project"})
+}
+
+// GetProjectQuota godoc
+// @Summary Get project quota
+// @Description Retrieves the resource limits of a project (members or admin)
+// @Tags projects
+// @Security BearerAuth
+// @Produce json
+// @Param project path string true "Project ID or name"
+// @Success 200 {object} models.Quota
+// @Failure 403,404,500 {object} apierror.Error
+// @Router /projects/{project}/quota [get]
+func GetProjectQuota(context *gin.Context) {
+	quota, err := models.GetProjectQuota(context.Request.Context(), context.GetInt64("project_id"))
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the quota.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, quota)
+}
+
+// UpdateProjectQuota godoc
+// @Summary Update project quota
+// @Description Sets the resource limits of a project, -1 means unlimited and 0 blocks the resource (admin only)
+// @Tags projects
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param project path string true "Project ID or name"
+// @Param quota body models.Quota true "Quota"
+// @Success 200 {object} models.Quota
+// @Failure 400,403,404,500 {object} apierror.Error
+// @Router /projects/{project}/quota [put]
+func UpdateProjectQuota(context *gin.Context) {
+	var quota models.Quota
+	err := context.ShouldBindJSON(&quota)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse request data.", err)
+		return
+	}
+
+	if !validQuota(context, quota) {
+		return
+	}
+
+	quota.AccountID = 0
+	quota.ProjectID = context.GetInt64("project_id")
+	err = quota.SaveProjectQuota(context.Request.Context())
+	if err != nil {
+		apierror.AbortError(context, "Could not update the quota.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, quota)
+}
+
+// GetProjectUsage godoc
+// @Summary Get project usage
+// @Description Reports the current resource consumption of a project next to its quota (members or admin)
+// @Tags projects
+// @Security BearerAuth
+// @Produce json
+// @Param project path string true "Project ID or name"
+// @Success 200 {object} map[string]interface{}
+// @Failure 403,404,500 {object} apierror.Error
+// @Router /projects/{project}/usage [get]
+func GetProjectUsage(context *gin.Context) {
+	projectID := context.GetInt64("project_id")
+
+	usage, err := models.GetProjectUsage(context.Request.Context(), projectID)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the usage.", err)
+		return
+	}
+
+	quota, err := models.GetProjectQuota(context.Request.Context(), projectID)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the quota.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"Project ID": projectID, "Usage": usage, "Quota": quota})
+}
+
+// GetProjectInvoice godoc
+// @Summary Get project invoice
+// @Description Applies the price list to the metered usage of the resources of a project in a month (members or admin). The running month is billed up to now.
+// @Tags projects
+// @Security BearerAuth
+// @Produce json
+// @Produce text/csv
+// @Param project path string true "Project ID or name"
+// @Param period query string false "Month as YYYY-MM (default: current month)"
+// @Param format query string false "json (default) or csv"
+// @Success 200 {object} services.Invoice
+// @Failure 400,403,404,500 {object} apierror.Error
+// @Router /projects/{project}/invoices [get]
+func GetProjectInvoice(context *gin.Context) {
+	projectID := context.GetInt64("project_id")
+	respondInvoice(context, 0, projectID, "invoice-project-"+strconv.FormatInt(projectID, 10))
+}
+
+// selectedProject loads the project which the SelectProject middleware resolved
+func selectedProject(context *gin.Context) (*models.Project, bool) {
+	project, err := models.GetProjectByID(context.Request.Context(), context.GetInt64("project_id"))
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the project.", err)
+		return nil, false
+	}
+	if project == nil {
+		apierror.Abort(context, http.StatusNotFound, apierror.CodeNotFound, "Project not found", nil)
+		return nil, false
+	}
+	return project, true
+}
+
+// bindProject reads name and description of a project, the name must be unique and not a number,
+// which would be taken for a project ID when selecting the project
+func bindProject(context *gin.Context, project *models.Project) bool {
+	var request models.Project
+	err := context.ShouldBindJSON(&request)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse request data.", err)
+		return false
+	}
+
+	request.Name = strings.TrimSpace(request.Name)
+	if _, err := strconv.ParseInt(request.Name, 10, 64); err == nil || request.Name == "" {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "The project name can't be empty or a number", nil)
+		return false
+	}
+
+	existing, err := models.GetProjectByName(context.Request.Context(), request.Name)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the project.", err)
+		return false
+	}
+	if existing != nil && existing.ID != project.ID {
+		apierror.Abort(context, http.StatusConflict, apierror.CodeConflict, "A project with this name already exists", nil)
+		return false
+	}
+
+	project.Name = request.Name
+	project.Description = request.Description
+	return true
+}
+
+// keepsProjectOwner rejects a change which takes the owner role from the last owner of the project with 409
+func keepsProjectOwner(context *gin.Context, projectID, accountID int64) bool {
+	member, err := models.GetProjectMember(context.Request.Context(), projectID, accountID)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the project member.", err)
+		return false
+	}
+	if member == nil || member.Role != models.ProjectRoleOwner {
+		return true
+	}
+
+	owners, err := models.CountProjectOwners(context.Request.Context(), projectID)
+	if err != nil {
+		apierror.AbortError(context, "Could not count the project owners.", err)
+		return false
+	}
+	if owners <= 1 {
+		apierror.Abort(context, http.StatusConflict, apierror.CodeConflict, "The project needs at least one owner", nil)
+		return false
+	}
+
+	return true
+}
+
+// inSelectedProject reports whether a resource belongs to the project selected by the request
+// (project 0 without a selected project). Resources of other projects are not visible,
+// so it writes a 404 with the message otherwise.
+func inSelectedProject(context *gin.Context, projectID int64, notFound string) bool {
+	if projectID != context.GetInt64("project_id") {
+		apierror.Abort(context, http.StatusNotFound, apierror.CodeNotFound, notFound, nil)
+		return false
+	}
+	return true
+}
+
+// requireResourceAccess only lets the owner of a resource outside of any project or an admin pass,
+// resources of the selected project are shared by its members whose role SelectProject checked
+// It writes the error response and returns false otherwise
+func requireResourceAccess(context *gin.Context, accountID, projectID int64) bool {
+	if !inSelectedProject(context, projectID, "Not found in the selected project") {
+		return false
+	}
+	if projectID != 0 {
+		return true
+	}
+	return requireSelfOrAdmin(context, accountID)
+}
+
+// ownResourcesOnly restricts a list outside of any project to the resources of the account, admins list all of them
+// It writes the error response and returns false if the account can't be fetched
+func ownResourcesOnly(context *gin.Context, options *models.ListOptions) bool {
+	if context.GetInt64("project_id") != 0 {
+		return true
+	}
+
+	userId := context.GetInt64("user_id")
+	account, err := models.GetAccountByID(context.Request.Context(), userId)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the account.", err)
+		return false
+	}
+	if !account.IsAdmin() {
+		options.Filters["account_id"] = strconv.FormatInt(userId, 10)
+	}
+	return true
+}
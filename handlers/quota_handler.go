@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/services"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+)
+
+// quotaLocks serializes quota checks and the following resource changes per account or project,
+// so parallel requests can't both pass the check and exceed the quota together
+var quotaLocks = utils.NewKeyedMutex()
+
+// lockQuota locks the quota of a project, or with projectID 0 of an account, until the returned function is called
+func lockQuota(accountID, projectID int64) func() {
+	if projectID != 0 {
+		return quotaLocks.Lock("project-" + strconv.FormatInt(projectID, 10))
+	}
+	return quotaLocks.Lock(strconv.FormatInt(accountID, 10))
+}
+
+// GetAccountQuota godoc
+// @Summary Get account quota
+// @Description Retrieves the resource limits of an account (own account or admin)
+// @Tags account
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Account ID"
+// @Success 200 {object} models.Quota
+// @Failure 400,403,404,500 {object} apierror.Error
+// @Router /accounts/{id}/quota [get]
+func GetAccountQuota(context *gin.Context) {
+	account, ok := accountFromParam(context)
+	if !ok || !requireSelfOrAdmin(context, account.ID) {
+		return
+	}
+
+	quota, err := models.GetQuota(context.Request.Context(), account.ID)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the quota.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, quota)
+}
+
+// UpdateAccountQuota godoc
+// @Summary Update account quota
+// @Description Sets the resource limits of an account, -1 means unlimited and 0 blocks the resource (admin only)
+// @Tags account
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path int true "Account ID"
+// @Param quota body models.Quota true "Quota"
+// @Success 200 {object} models.Quota
+// @Failure 400,403,404,500 {object} apierror.Error
+// @Router /accounts/{id}/quota [put]
+func UpdateAccountQuota(context *gin.Context) {
+	account, ok := accountFromParam(context)
+	if !ok {
+		return
+	}
+
+	var quota models.Quota
+	err := context.ShouldBindJSON(&quota)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse request data.", err)
+		return
+	}
+
+	if !validQuota(context, quota) {
+		return
+	}
+
+	quota.AccountID = account.ID
+	err = quota.SaveQuota(context.Request.Context())
+	if err != nil {
+		apierror.AbortError(context, "Could not update the quota.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, quota)
+}
+
+// validQuota checks that every limit is -1 (unlimited), 0 (the resource is blocked) or positive
+// It writes the error response and returns false otherwise
+func validQuota(context *gin.Context, quota models.Quota) bool {
+	limits := []float64{float64(quota.MaxVMs), quota.MaxVCPUs, float64(quota.MaxMemoryMB), float64(quota.MaxVolumes), float64(quota.MaxStorageGB)}
+	for _, limit := range limits {
+		if limit < 0 && limit != models.Unlimited {
+			apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Quota limits must be -1 (unlimited), 0 (the resource is blocked) or positive.", nil)
+			return false
+		}
+	}
+	return true
+}
+
+// GetAccountUsage godoc
+// @Summary Get account usage
+// @Description Reports the current resource consumption of an account outside of any project next to its quota (own account or admin)
+// @Tags account
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Account ID"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400,403,404,500 {object} apierror.Error
+// @Router /accounts/{id}/usage [get]
+func GetAccountUsage(context *gin.Context) {
+	account, ok := accountFromParam(context)
+	if !ok || !requireSelfOrAdmin(context, account.ID) {
+		return
+	}
+
+	usage, err := accountUsage(context, account)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the usage.", err)
+		return
+	}
+
+	quota, err := models.GetQuota(context.Request.Context(), account.ID)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the quota.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"Account ID": account.ID, "Usage": usage, "Quota": quota})
+}
+
+// accountUsage returns the usage of an account outside of any project including the images
+// in its registry namespace, which count against the storage quota of the account
+func accountUsage(context *gin.Context, account *models.Account) (*models.Usage, error) {
+	usage, err := models.GetUsage(context.Request.Context(), account.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	registryBytes, err := services.RegistryUsage(account.Username)
+	if err != nil {
+		return nil, err
+	}
+	usage.AddRegistryBytes(registryBytes)
+
+	return usage, nil
+}
+
+// checkQuota rejects a change which would exceed the quota of the project, or with projectID 0
+// of the account, with 403 and a usage breakdown
+// The caller must hold lockQuota for the account or project until the change is stored
+func checkQuota(context *gin.Context, accountID, projectID int64, delta models.Usage) bool {
+	quota, err := models.GetQuota(context.Request.Context(), accountID)
+	if projectID != 0 {
+		quota, err = models.GetProjectQuota(context.Request.Context(), projectID)
+	}
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the quota.", err)
+		return false
+	}
+
+	var usage *models.Usage
+	if projectID != 0 {
+		usage, err = models.GetProjectUsage(context.Request.Context(), projectID)
+	} else {
+		var account *models.Account
+		account, err = models.GetAccountByID(context.Request.Context(), accountID)
+		if err == nil {
+			usage, err = accountUsage(context, account)
+		}
+	}
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the usage.", err)
+		return false
+	}
+
+	if exceeded := quota.Exceeded(usage, delta); len(exceeded) > 0 {
+		apierror.Abort(context, http.StatusForbidden, apierror.CodeQuotaExceeded, "Quota exceeded", apierror.Details{
+			"exceeded":  exceeded,
+			"usage":     usage,
+			"requested": delta,
+			"quota":     quota,
+		})
+		return false
+	}
+
+	return true
+}
+
+// requireSelfOrAdmin only lets the account itself or an admin pass
+// It writes the error response and returns false otherwise
+func requireSelfOrAdmin(context *gin.Context, accountID int64) bool {
+	userId := context.GetInt64("user_id")
+	if userId == accountID {
+		return true
+	}
+
+	account, err := models.GetAccountByID(context.Request.Context(), userId)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the account.", err)
+		return false
+	}
+
+	if !account.IsAdmin() {
+		apierror.Abort(context, http.StatusForbidden, apierror.CodeForbidden, "Forbidden - Only the account itself or an admin", nil)
+		return false
+	}
+
+	return true
+}
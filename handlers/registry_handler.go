@@ -0,0 +1,550 @@
+// Manage the incoming HTTP requests
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/services"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+)
+
+// The embedded registry implements the OCI Distribution API under /v2/, so the
+// docker CLI can push and pull "<registry host>/<account>/<repo>:<tag>".
+// Repositories are private: only the account named in the first path component
+// (and admins) may push or pull them.
+
+// registryError writes an error in the format of the OCI Distribution spec
+func registryError(context *gin.Context, status int, code string, message string) {
+	context.AbortWithStatusJSON(status, gin.H{"errors": []gin.H{{"code": code, "message": message}}})
+}
+
+// registryStorageError maps errors of the registry storage to OCI error codes
+func registryStorageError(context *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrBlobUnknown):
+		registryError(context, http.StatusNotFound, "BLOB_UNKNOWN", err.Error())
+	case errors.Is(err, services.ErrBlobUploadUnknown):
+		registryError(context, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", err.Error())
+	case errors.Is(err, services.ErrDigestInvalid):
+		registryError(context, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+	case errors.Is(err, services.ErrManifestUnknown):
+		registryError(context, http.StatusNotFound, "MANIFEST_UNKNOWN", err.Error())
+	case errors.Is(err, services.ErrNameUnknown):
+		registryError(context, http.StatusNotFound, "NAME_UNKNOWN", err.Error())
+	default:
+		registryError(context, http.StatusInternalServerError, "UNKNOWN", err.Error())
+	}
+}
+
+// registryChallenge asks the client to fetch a token from the token endpoint
+func registryChallenge(context *gin.Context) {
+	realm := fmt.Sprintf("http://%s/registry/token", context.Request.Host)
+	context.Header("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s",service="minicloud"`, realm))
+	registryError(context, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+}
+
+// registryAccount authenticates a registry request
+// Bearer tokens (issued by RegistryToken or the login endpoint) and Basic auth
+// with a password or an API key are accepted
+func registryAccount(context *gin.Context) (*models.Account, bool) {
+	header := context.GetHeader("Authorization")
+
+	if token, found := strings.CutPrefix(header, "Bearer "); found {
+		accountID, err := utils.VerifyToken(token)
+		if err != nil {
+			return nil, false
+		}
+		account, err := models.GetAccountByID(context.Request.Context(), accountID)
+		if err != nil {
+			return nil, false
+		}
+		setRegistryAccount(context, account, "jwt")
+		return account, true
+	}
+
+	username, secret, ok := context.Request.BasicAuth()
+	if !ok {
+		return nil, false
+	}
+
+	account, method, ok := authenticateBasic(context.Request.Context(), username, secret)
+	if ok {
+		setRegistryAccount(context, account, method)
+	}
+	return account, ok
+}
+
+// setRegistryAccount keeps the account of a registry request like Authenticate does (e.g., for the audit trail)
+func setRegistryAccount(context *gin.Context, account *models.Account, method string) {
+	context.Set("user_id", account.ID)
+	context.Set("auth_method", method)
+}
+
+// authenticateBasic checks a username with the account password, one of its API keys
+// or a token (used by the Docker daemon when MiniCloud pulls on behalf of an account)
+// It also returns how the account authenticated: jwt, api_key or password
+func authenticateBasic(ctx context.Context, username, secret string) (*models.Account, string, bool) {
+	if accountID, err := utils.VerifyToken(secret); err == nil {
+		account, err := models.GetAccountByID(ctx, accountID)
+		if err != nil || account.Username != username {
+			return nil, "", false
+		}
+		return account, "jwt", true
+	}
+
+	if utils.IsAPIKey(secret) {
+		account, err := models.GetAccountByAPIKey(ctx, secret)
+		if err != nil || account.Username != username {
+			return nil, "", false
+		}
+		return account, "api_key", true
+	}
+
+	credentials := models.Account{Username: username, Password: secret}
+	if err := credentials.ValidateCredentials(ctx); err != nil {
+		return nil, "", false
+	}
+
+	account, err := models.GetAccountByID(ctx, credentials.ID)
+	if err != nil {
+		return nil, "", false
+	}
+	return account, "password", true
+}
+
+// canAccessRepository reports whether the account owns the repository namespace
+func canAccessRepository(account *models.Account, name string) bool {
+	namespace, _, _ := strings.Cut(name, "/")
+	return account.IsAdmin() || namespace == account.Username
+}
+
+// RegistryToken godoc
+// @Summary Get a registry token
+// @Description Exchanges Basic credentials (password or API key) for a bearer token of the embedded registry, as used by the docker CLI.
+// @Tags registry
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /registry/token [get]
+func RegistryToken(context *gin.Context) {
+	username, secret, ok := context.Request.BasicAuth()
+	if !ok {
+		context.Header("WWW-Authenticate", `Basic realm="minicloud"`)
+		registryError(context, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+		return
+	}
+
+	account, method, ok := authenticateBasic(context.Request.Context(), username, secret)
+	if !ok {
+		registryError(context, http.StatusUnauthorized, "UNAUTHORIZED", "invalid credentials")
+		return
+	}
+	setRegistryAccount(context, account, method)
+
+	token, err := utils.GenerateToken(account.Username, account.ID)
+	if err != nil {
+		registryError(context, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{
+		"token":        token,
+		"access_token": token,
+		"expires_in":   int((72 * time.Hour).Seconds()),
+		"issued_at":    time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// Registry godoc
+// @Summary OCI Distribution API
+// @Description Embedded private registry (push and pull with the docker CLI). Repositories are named "<account>/<repo>".
+// @Description The Idempotency-Key header is ignored, blob uploads are resumable sessions and pushes of the same content are idempotent by digest.
+// @Tags registry
+// @Security BearerAuth
+// @Param path path string true "Distribution API path (e.g., alice/app/manifests/latest)"
+// @Success 200 {object} map[string]interface{}
+// @Failure 401,403,404 {object} map[string]interface{}
+// @Router /v2/{path} [get]
+func Registry(context *gin.Context) {
+	context.Header("Docker-Distribution-API-Version", "registry/2.0")
+
+	account, ok := registryAccount(context)
+	if !ok {
+		registryChallenge(context)
+		return
+	}
+
+	path := strings.Trim(context.Param("path"), "/")
+
+	// Version check, used by "docker login"
+	if path == "" {
+		context.JSON(http.StatusOK, gin.H{})
+		return
+	}
+
+	if path == "_catalog" {
+		repositories, err := services.ListRepositories(account.Username)
+		if err != nil {
+			registryStorageError(context, err)
+			return
+		}
+		context.JSON(http.StatusOK, gin.H{"repositories": repositories})
+		return
+	}
+
+	name, kind, reference, ok := splitRegistryPath(path)
+	if !ok || !services.ValidRepositoryName(name) {
+		registryError(context, http.StatusNotFound, "NAME_INVALID", "invalid repository name or path")
+		return
+	}
+
+	if !canAccessRepository(account, name) {
+		registryError(context, http.StatusForbidden, "DENIED", "repositories are private to their account: "+name)
+		return
+	}
+
+	switch kind {
+	case "tags":
+		registryListTags(context, name)
+	case "manifests":
+		registryManifest(context, name, reference)
+	case "blobs":
+		registryBlob(context, name, reference)
+	case "uploads":
+		registryUpload(context, account, name, reference)
+	default:
+		registryError(context, http.StatusNotFound, "UNSUPPORTED", "unsupported registry path")
+	}
+}
+
+// splitRegistryPath splits "<name>/manifests/<ref>", "<name>/blobs/<digest>",
+// "<name>/blobs/uploads/<id>" and "<name>/tags/list" into their parts
+func splitRegistryPath(path string) (name string, kind string, reference string, ok bool) {
+	if name, found := strings.CutSuffix(path, "/tags/list"); found {
+		return name, "tags", "", true
+	}
+	if i := strings.LastIndex(path, "/blobs/uploads"); i > 0 {
+		return path[:i], "uploads", strings.TrimPrefix(path[i+len("/blobs/uploads"):], "/"), true
+	}
+	for _, kind := range []string{"manifests", "blobs"} {
+		if i := strings.LastIndex(path, "/"+kind+"/"); i > 0 {
+			return path[:i], kind, path[i+len(kind)+2:], true
+		}
+	}
+	return "", "", "", false
+}
+
+func registryListTags(context *gin.Context, name string) {
+	if context.Request.Method != http.MethodGet {
+		registryError(context, http.StatusMethodNotAllowed, "UNSUPPORTED", "method not allowed")
+		return
+	}
+
+	tags, err := services.ListTags(name)
+	if err != nil {
+		registryStorageError(context, err)
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"name": name, "tags": tags})
+}
+
+func registryManifest(context *gin.Context, name, reference string) {
+	if !services.ValidTag(reference) && !services.ValidDigest(reference) {
+		registryError(context, http.StatusBadRequest, "MANIFEST_INVALID", "invalid tag or digest: "+reference)
+		return
+	}
+
+	switch context.Request.Method {
+	case http.MethodGet, http.MethodHead:
+		content, mediaType, digest, err := services.GetManifest(name, reference)
+		if err != nil {
+			registryStorageError(context, err)
+			return
+		}
+
+		context.Header("Docker-Content-Digest", digest)
+		context.Header("Content-Length", strconv.Itoa(len(content)))
+		if context.Request.Method == http.MethodHead {
+			context.Header("Content-Type", mediaType)
+			context.Status(http.StatusOK)
+			return
+		}
+		context.Data(http.StatusOK, mediaType, content)
+
+	case http.MethodPut:
+		content, err := io.ReadAll(io.LimitReader(context.Request.Body, 4<<20))
+		if err != nil {
+			registryError(context, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+			return
+		}
+
+		digest, err := services.PutManifest(name, reference, context.ContentType(), content)
+		if errors.Is(err, services.ErrBlobUnknown) || errors.Is(err, services.ErrManifestUnknown) {
+			registryError(context, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", err.Error())
+			return
+		}
+		if err != nil {
+			registryError(context, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+			return
+		}
+
+		context.Header("Location", "/v2/"+name+"/manifests/"+digest)
+		context.Header("Docker-Content-Digest", digest)
+		context.Status(http.StatusCreated)
+
+	case http.MethodDelete:
+		if !services.ValidDigest(reference) {
+			registryError(context, http.StatusBadRequest, "UNSUPPORTED", "manifests can only be deleted by digest")
+			return
+		}
+
+		if err := services.DeleteManifest(name, reference); err != nil {
+			registryStorageError(context, err)
+			return
+		}
+		context.Status(http.StatusAccepted)
+
+	default:
+		registryError(context, http.StatusMethodNotAllowed, "UNSUPPORTED", "method not allowed")
+	}
+}
+
+func registryBlob(context *gin.Context, name, digest string) {
+	if !services.ValidDigest(digest) {
+		registryError(context, http.StatusBadRequest, "DIGEST_INVALID", "invalid digest: "+digest)
+		return
+	}
+
+	switch context.Request.Method {
+	case http.MethodGet, http.MethodHead:
+		file, size, err := services.OpenBlob(name, digest)
+		if err != nil {
+			registryStorageError(context, err)
+			return
+		}
+		defer file.Close()
+
+		context.Header("Docker-Content-Digest", digest)
+		context.Header("Content-Length", strconv.FormatInt(size, 10))
+		if context.Request.Method == http.MethodHead {
+			context.Header("Content-Type", "application/octet-stream")
+			context.Status(http.StatusOK)
+			return
+		}
+		context.DataFromReader(http.StatusOK, size, "application/octet-stream", file, nil)
+
+	case http.MethodDelete:
+		if err := services.DeleteBlob(name, digest); err != nil {
+			registryStorageError(context, err)
+			return
+		}
+		context.Status(http.StatusAccepted)
+
+	default:
+		registryError(context, http.StatusMethodNotAllowed, "UNSUPPORTED", "method not allowed")
+	}
+}
+
+// maxBlobSize is the largest blob which can be pushed to the registry
+func maxBlobSize() int64 {
+	return int64(utils.GetEnvInt("MINICLOUD_REGISTRY_MAX_BLOB_SIZE_MB", 10240)) * 1024 * 1024
+}
+
+// blobUploadLimit is the limit of the body of a blob upload
+type blobUploadLimit struct {
+	// Whether the storage quota is tighter than MINICLOUD_REGISTRY_MAX_BLOB_SIZE_MB
+	quotaLimited bool
+
+	// Releases the quota of the namespace owner once the body is stored
+	unlock func()
+}
+
+// limitBlobUpload limits the body of a blob upload to the bytes left of MINICLOUD_REGISTRY_MAX_BLOB_SIZE_MB
+// and of the storage quota of the account owning the repository namespace. Uploads in progress count
+// against the quota, so a limited quota stays locked until the body is stored and the caller must call unlock.
+// It writes the error response and returns false otherwise
+func limitBlobUpload(context *gin.Context, name, uploadID string) (*blobUploadLimit, bool) {
+	namespace, _, _ := strings.Cut(name, "/")
+	owner, err := models.GetAccountByUsername(context.Request.Context(), namespace)
+	if err != nil {
+		registryError(context, http.StatusForbidden, "DENIED", "the namespace belongs to no account: "+namespace)
+		return nil, false
+	}
+
+	quota, err := models.GetQuota(context.Request.Context(), owner.ID)
+	if err != nil {
+		registryStorageError(context, err)
+		return nil, false
+	}
+
+	limit := &blobUploadLimit{unlock: func() {}}
+	if quota.MaxStorageGB != models.Unlimited {
+		limit.unlock = lockQuota(owner.ID, 0)
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			limit.unlock()
+		}
+	}()
+
+	uploaded, err := services.BlobUploadSize(name, uploadID)
+	if err != nil {
+		registryStorageError(context, err)
+		return nil, false
+	}
+	maxBytes := maxBlobSize() - uploaded
+
+	if quota.MaxStorageGB != models.Unlimited {
+		usage, err := accountUsage(context, owner)
+		if err != nil {
+			registryStorageError(context, err)
+			return nil, false
+		}
+		if free := quota.FreeStorageBytes(usage); free < maxBytes {
+			maxBytes = free
+			limit.quotaLimited = true
+		}
+	}
+
+	context.Request.Body = http.MaxBytesReader(context.Writer, context.Request.Body, max(maxBytes, 0))
+	ok = true
+	return limit, true
+}
+
+// registryUploadError drops an upload whose body exceeded its limit, so the partial blob doesn't
+// take up the disk, and maps other errors to OCI error codes
+func registryUploadError(context *gin.Context, name, uploadID string, limit *blobUploadLimit, err error) {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		registryStorageError(context, err)
+		return
+	}
+
+	services.CancelBlobUpload(name, uploadID)
+	if limit.quotaLimited {
+		registryError(context, http.StatusForbidden, "DENIED", "the blob exceeds the storage quota of the account")
+		return
+	}
+	registryError(context, http.StatusRequestEntityTooLarge, "SIZE_INVALID",
+		fmt.Sprintf("blobs must not be larger than %d bytes", maxBlobSize()))
+}
+
+func registryUpload(context *gin.Context, account *models.Account, name, uploadID string) {
+	location := "/v2/" + name + "/blobs/uploads/" + uploadID
+
+	switch {
+	case context.Request.Method == http.MethodPost && uploadID == "":
+		// Cross-repository mount of a blob the account can already read
+		if mount, from := context.Query("mount"), context.Query("from"); mount != "" && from != "" {
+			if services.ValidRepositoryName(from) && canAccessRepository(account, from) && services.MountBlob(name, from, mount) == nil {
+				context.Header("Location", "/v2/"+name+"/blobs/"+mount)
+				context.Header("Docker-Content-Digest", mount)
+				context.Status(http.StatusCreated)
+				return
+			}
+		}
+
+		digest := context.Query("digest")
+		if digest != "" && !services.ValidDigest(digest) {
+			registryError(context, http.StatusBadRequest, "DIGEST_INVALID", "invalid digest: "+digest)
+			return
+		}
+
+		newUploadID, err := services.StartBlobUpload(name)
+		if err != nil {
+			registryStorageError(context, err)
+			return
+		}
+
+		// Monolithic upload in a single request, the upload is only kept if it is stored
+		if digest != "" {
+			limit, ok := limitBlobUpload(context, name, newUploadID)
+			if !ok {
+				services.CancelBlobUpload(name, newUploadID)
+				return
+			}
+			defer limit.unlock()
+			if err := services.CompleteBlobUpload(name, newUploadID, digest, context.Request.Body); err != nil {
+				services.CancelBlobUpload(name, newUploadID)
+				registryUploadError(context, name, newUploadID, limit, err)
+				return
+			}
+			context.Header("Location", "/v2/"+name+"/blobs/"+digest)
+			context.Header("Docker-Content-Digest", digest)
+			context.Status(http.StatusCreated)
+			return
+		}
+
+		context.Header("Location", "/v2/"+name+"/blobs/uploads/"+newUploadID)
+		context.Header("Docker-Upload-UUID", newUploadID)
+		context.Header("Range", "0-0")
+		context.Status(http.StatusAccepted)
+
+	case context.Request.Method == http.MethodPatch && uploadID != "":
+		limit, ok := limitBlobUpload(context, name, uploadID)
+		if !ok {
+			return
+		}
+		defer limit.unlock()
+		size, err := services.AppendBlobUpload(name, uploadID, context.Request.Body)
+		if err != nil {
+			registryUploadError(context, name, uploadID, limit, err)
+			return
+		}
+		context.Header("Location", location)
+		context.Header("Docker-Upload-UUID", uploadID)
+		context.Header("Range", fmt.Sprintf("0-%d", max(size-1, 0)))
+		context.Status(http.StatusAccepted)
+
+	case context.Request.Method == http.MethodPut && uploadID != "":
+		digest := context.Query("digest")
+		if !services.ValidDigest(digest) {
+			registryError(context, http.StatusBadRequest, "DIGEST_INVALID", "invalid digest: "+digest)
+			return
+		}
+		limit, ok := limitBlobUpload(context, name, uploadID)
+		if !ok {
+			return
+		}
+		defer limit.unlock()
+		if err := services.CompleteBlobUpload(name, uploadID, digest, context.Request.Body); err != nil {
+			registryUploadError(context, name, uploadID, limit, err)
+			return
+		}
+		context.Header("Location", "/v2/"+name+"/blobs/"+digest)
+		context.Header("Docker-Content-Digest", digest)
+		context.Status(http.StatusCreated)
+
+	case context.Request.Method == http.MethodGet && uploadID != "":
+		size, err := services.BlobUploadSize(name, uploadID)
+		if err != nil {
+			registryStorageError(context, err)
+			return
+		}
+		context.Header("Location", location)
+		context.Header("Docker-Upload-UUID", uploadID)
+		context.Header("Range", fmt.Sprintf("0-%d", max(size-1, 0)))
+		context.Status(http.StatusNoContent)
+
+	case context.Request.Method == http.MethodDelete && uploadID != "":
+		if err := services.CancelBlobUpload(name, uploadID); err != nil {
+			registryStorageError(context, err)
+			return
+		}
+		context.Status(http.StatusNoContent)
+
+	default:
+		registryError(context, http.StatusMethodNotAllowed, "UNSUPPORTED", "method not allowed")
+	}
+}
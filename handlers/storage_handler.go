@@ -3,53 +3,82 @@ package handlers
 
 import (
 	"fmt"
+	"log/slog"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
 	"github.com/odeeka/go-minicloud-rest-api/models"
 	"github.com/odeeka/go-minicloud-rest-api/services"
 )
 
+// StorageRequest is the body of creating a storage volume
+type StorageRequest struct {
+	// Name of the volume, letters, digits, '_', '.' and '-' (generated if empty)
+	Name string `json:"name" binding:"omitempty,max=64,dockername" example:"data-1"`
+
+	// Size of the volume in gigabytes
+	SizeGB int `json:"size_gb" binding:"required,min=1,max=16384" example:"10"`
+
+	// Free-form key/value labels
+	Labels map[string]string `json:"labels" binding:"omitempty,labels"`
+}
+
+// StorageResizeRequest is the body of resizing a storage volume
+type StorageResizeRequest struct {
+	// New size of the volume in gigabytes
+	SizeGB int `json:"size_gb" binding:"required,min=1,max=16384" example:"20"`
+}
+
 // ListStorages godoc
 // @Summary List all storages
-// @Description Retrieves a list of all storage volumes from the database.
+// @Description Retrieves a list of all storage volumes of the selected project (without a project: outside of any project).
 // @Tags storages
 // @Security BearerAuth
 // @Produce json
+// @Param X-MiniCloud-Project header string false "Project ID or name"
+// @Param limit query int false "Maximum number of items (default 100, max 1000)"
+// @Param page_token query string false "NextPageToken of the previous page"
+// @Param sort query string false "id, name, size_gb, with - for descending (default id)"
+// @Param attached query bool false "true for storages attached to a VM, false for detached ones"
+// @Param vm_id query int false "ID of the VM the storage is attached to"
+// @Param name_prefix query string false "Beginning of the name"
+// @Param account_id query int false "Owner account ID"
+// @Param selector query string false "Label selector, e.g., env=dev,team in (a,b)"
 // @Success 200 {object} map[string]interface{}
-// @Failure 500 {object} map[string]string
+// @Failure 400,500 {object} apierror.Error
 // @Router /storages [get]
 func ListStorages(context *gin.Context) {
-	storages, err := models.GetAllStorages()
-	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to retriev all Storages"})
+	options, ok := listOptions(context)
+	if !ok || !ownResourcesOnly(context, &options) {
 		return
 	}
-	context.JSON(http.StatusOK, gin.H{"message": "Fetched all Storages from database", "Storages": storages})
+
+	storages, nextPageToken, err := models.ListStorages(context.Request.Context(), context.GetInt64("project_id"), options)
+	respondList(context, "Fetched Storages from database", storages, nextPageToken, err)
 }
 
 // CreateStorage godoc
 // @Summary Create a new storage volume
-// @Description Creates and starts a new storage container and stores its metadata.
+// @Description Creates and starts a new storage container and stores its metadata, in the selected project if there is one.
 // @Tags storages
 // @Security BearerAuth
 // @Accept json
 // @Produce json
-// @Param storage body models.Storage true "Storage object"
+// @Param X-MiniCloud-Project header string false "Project ID or name"
+// @Param storage body StorageRequest true "Storage object"
+// @Param Idempotency-Key header string false "Key to retry the request safely, retries replay the first response"
 // @Success 201 {object} map[string]interface{}
-// @Failure 400,500 {object} map[string]string
+// @Failure 400,422,500,502 {object} apierror.Error
 // @Router /storages [post]
 func CreateStorage(context *gin.Context) {
-	var storage models.Storage
-
-	err := context.ShouldBindJSON(&storage)
-
-	if err != nil {
-		context.JSON(http.StatusBadRequest, gin.H{"message": "Could not parse request data.", "error": err})
+	var request StorageRequest
+	if !bindRequest(context, &request) {
 		return
 	}
+	storage := models.Storage{Name: request.Name, SizeGB: request.SizeGB, Labels: request.Labels}
 
 	// Generate storage name if it's not defined
 	if storage.Name == "" {
@@ -61,20 +90,41 @@ func CreateStorage(context *gin.Context) {
 		storage.Name = fmt.Sprintf("minicloud-storage-%s", uuid.New().String()[:8])
 	}
 
-	err = services.StartStorageVolume(&storage)
+	// The volume belongs to the authenticated account and the selected project,
+	// it counts against the quota of the project or, without a project, of the account
+	storage.AccountID = context.GetInt64("user_id")
+	storage.ProjectID = context.GetInt64("project_id")
+	unlock := lockQuota(storage.AccountID, storage.ProjectID)
+	defer unlock()
+
+	if !checkQuota(context, storage.AccountID, storage.ProjectID, models.Usage{Volumes: 1, StorageGB: storage.SizeGB}) {
+		return
+	}
+
+	err := services.StartStorageVolume(context.Request.Context(), &storage)
 	if err != nil {
-		context.JSON(http.StatusBadRequest, gin.H{"message": "Failed to start/create the storage volume", "error": err.Error()})
+		apierror.AbortErr(context, http.StatusBadGateway, apierror.CodeRuntimeError, "Failed to start/create the storage volume", err)
 		return
 	}
 
 	// If the containers runs the metadata will be inserted
-	err = storage.InsertStorage()
+	err = storage.InsertStorage(context.Request.Context())
 
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Could not create storage metadata into database.", "error": err.Error()})
+		apierror.AbortError(context, "Could not create storage metadata into database.", err)
 		return
 	}
 
+	auditCreated(context, storage.ID)
+
+	// The allocated size is billed from now on
+	if err := services.MeterStorage(context.Request.Context(), &storage); err != nil {
+		slog.ErrorContext(context.Request.Context(), "Could not meter storage", "storage_id", storage.ID, "error", err)
+	}
+
+	services.PublishEvent(context.Request.Context(), models.EventStorageCreated, "storage", storage.ID, storage.AccountID, storage.ProjectID, storage)
+
+	setETag(context, storage.Version)
 	context.JSON(http.StatusCreated, gin.H{"message": "Storage created and stored in database", "Storage": storage})
 }
 
@@ -86,26 +136,27 @@ func CreateStorage(context *gin.Context) {
 // @Produce json
 // @Param id path int true "Storage ID"
 // @Success 200 {object} map[string]interface{}
-// @Failure 400,404,500 {object} map[string]string
+// @Header 200 {string} ETag "Version of the resource, for If-Match"
+// @Failure 400,403,404,500 {object} apierror.Error
 // @Router /storages/{id} [get]
 func GetStorage(context *gin.Context) {
 	storageId, err := strconv.ParseInt(context.Param("id"), 10, 64)
 	if err != nil {
-		context.JSON(http.StatusBadRequest, gin.H{"message": "Could not parse Storage id.", "error": err.Error()})
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse Storage id.", err)
 		return
 	}
 
-	storage, err := models.GetStorageByID(storageId)
+	storage, err := models.GetStorageByID(context.Request.Context(), storageId)
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Could not fetch target Storage.", "error": err.Error()})
+		apierror.AbortError(context, "Could not fetch target Storage.", err)
 		return
 	}
 
-	if storage == nil {
-		context.JSON(http.StatusNotFound, gin.H{"message": "Storage not found"})
+	if !requireResourceAccess(context, storage.AccountID, storage.ProjectID) {
 		return
 	}
 
+	setETag(context, storage.Version)
 	context.JSON(http.StatusOK, gin.H{"Storage": storage})
 }
 
@@ -115,22 +166,30 @@ func GetStorage(context *gin.Context) {
 // @Tags storages
 // @Security BearerAuth
 // @Param id path int true "Storage ID"
+// @Param If-Match header string false "ETag of the version the change is based on"
 // @Success 200 {object} map[string]string
-// @Failure 400,500 {object} map[string]string
+// @Failure 400,403,412,428,500 {object} apierror.Error
 // @Router /storages/{id} [delete]
 func DeleteStorage(context *gin.Context) {
 
 	storageId, err := strconv.ParseInt(context.Param("id"), 10, 64)
 
 	if err != nil {
-		context.JSON(http.StatusBadRequest, gin.H{"message": "Could not parse storage id.", "error": err.Error()})
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse storage id.", err)
 		return
 	}
 
-	storage, err := models.GetStorageByID(storageId)
+	unlock := lockResource("storage", storageId)
+	defer unlock()
+
+	storage, err := models.GetStorageByID(context.Request.Context(), storageId)
 
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Could not fetch the storage.", "error": err.Error()})
+		apierror.AbortError(context, "Could not fetch the storage.", err)
+		return
+	}
+
+	if !requireResourceAccess(context, storage.AccountID, storage.ProjectID) || !checkIfMatch(context, storage.Version) {
 		return
 	}
 
@@ -145,13 +204,19 @@ func DeleteStorage(context *gin.Context) {
 	// 	}
 	// }
 
-	err = storage.DeleteStorageByID()
+	err = storage.DeleteStorageByID(context.Request.Context())
 
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Could not delete the storage.", "error": err.Error()})
+		apierror.AbortError(context, "Could not delete the storage.", err)
 		return
 	}
 
+	if err := services.StopMetering(context.Request.Context(), models.MeteredStorage, storage.ID); err != nil {
+		slog.ErrorContext(context.Request.Context(), "Could not stop metering storage", "storage_id", storage.ID, "error", err)
+	}
+
+	services.PublishEvent(context.Request.Context(), models.EventStorageDeleted, "storage", storage.ID, storage.AccountID, storage.ProjectID, storage)
+
 	context.JSON(http.StatusOK, gin.H{"message": "Storage deleted successfully with ID: " + strconv.FormatInt(storage.ID, 10)})
 }
 
@@ -163,44 +228,129 @@ func DeleteStorage(context *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param id path int true "Storage ID"
-// @Param storage body models.Storage true "Updated storage data"
+// @Param storage body StorageResizeRequest true "Updated storage data"
+// @Param If-Match header string false "ETag of the version the change is based on"
 // @Success 200 {object} map[string]interface{}
-// @Failure 400,404,500 {object} map[string]string
+// @Failure 400,403,404,412,422,428,500 {object} apierror.Error
 // @Router /storages/{id} [put]
 func UpdateStorageSize(context *gin.Context) {
 	storageId, err := strconv.ParseInt(context.Param("id"), 10, 64)
 	if err != nil {
-		context.JSON(http.StatusBadRequest, gin.H{"message": "Could not parse storage id.", "error": err.Error()})
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse storage id.", err)
 		return
 	}
 
-	storage, err := models.GetStorageByID(storageId)
+	// Changes of the volume are serialized, the update is based on the version of the If-Match header
+	unlock := lockResource("storage", storageId)
+	defer unlock()
+
+	storage, err := models.GetStorageByID(context.Request.Context(), storageId)
 
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Could not fetch the storage.", "error": err.Error()})
+		apierror.AbortError(context, "Could not fetch the storage.", err)
 		return
 	}
 
-	if storage == nil {
-		context.JSON(http.StatusNotFound, gin.H{"message": "Storage not found with ID: " + strconv.FormatInt(storage.ID, 10)})
+	if !requireResourceAccess(context, storage.AccountID, storage.ProjectID) || !checkIfMatch(context, storage.Version) {
 		return
 	}
 
-	var updatedStorage models.Storage
-	err = context.ShouldBindJSON(&updatedStorage)
+	var request StorageResizeRequest
+	if !bindRequest(context, &request) {
+		return
+	}
+
+	applyStorageResize(context, storage, request, false)
+}
 
+// PatchStorage godoc
+// @Summary Patch storage
+// @Description Changes only the fields of the JSON Merge Patch (RFC 7396), the size is the only field which can change.
+// @Description With dry_run=true nothing is changed, the response has the resulting storage (volumes are never recreated).
+// @Tags storages
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param X-MiniCloud-Project header string false "Project ID or name"
+// @Param id path int true "Storage ID"
+// @Param dry_run query bool false "Only report the result"
+// @Param patch body StorageResizeRequest true "Fields to change"
+// @Param If-Match header string false "ETag of the version the change is based on"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400,403,404,412,415,422,428,500 {object} apierror.Error
+// @Router /storages/{id} [patch]
+func PatchStorage(context *gin.Context) {
+	storageId, err := strconv.ParseInt(context.Param("id"), 10, 64)
 	if err != nil {
-		context.JSON(http.StatusBadRequest, gin.H{"message": "Could not parse request data.", "error": err.Error()})
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse storage id.", err)
+		return
+	}
+
+	dryRun, ok := dryRunParam(context)
+	if !ok {
+		return
+	}
+
+	unlock := lockResource("storage", storageId)
+	defer unlock()
+
+	storage, err := models.GetStorageByID(context.Request.Context(), storageId)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the storage.", err)
+		return
+	}
+
+	if !requireResourceAccess(context, storage.AccountID, storage.ProjectID) || !checkIfMatch(context, storage.Version) {
+		return
+	}
+
+	request := StorageResizeRequest{SizeGB: storage.SizeGB}
+	if !bindMergePatch(context, &request) {
 		return
 	}
 
-	updatedStorage.ID = storageId
-	err = updatedStorage.UpdateStorageSizeByID()
+	applyStorageResize(context, storage, request, dryRun)
+}
+
+// applyStorageResize changes the size of the volume, a dry run only responds with the result
+func applyStorageResize(context *gin.Context, storage *models.Storage, request StorageResizeRequest, dryRun bool) {
+	updatedStorage := models.Storage{SizeGB: request.SizeGB}
+
+	// Growing the volume counts against the quota of the owner or the project
+	unlock := lockQuota(storage.AccountID, storage.ProjectID)
+	defer unlock()
+
+	if !checkQuota(context, storage.AccountID, storage.ProjectID, models.Usage{StorageGB: updatedStorage.SizeGB - storage.SizeGB}) {
+		return
+	}
+
+	updatedStorage.ID = storage.ID
+	updatedStorage.AccountID = storage.AccountID
+	updatedStorage.ProjectID = storage.ProjectID
+	if dryRun {
+		resized := *storage
+		resized.SizeGB = updatedStorage.SizeGB
+		context.JSON(http.StatusOK, gin.H{"message": "Dry run, the storage was not changed", "Storage": resized, "recreate": false})
+		return
+	}
+
+	updatedStorage.Version = storage.Version
+	err := updatedStorage.UpdateStorageSizeByID(context.Request.Context())
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Could not update storage size.", "error": err.Error()})
+		abortUpdateError(context, "Could not update storage size.", err)
 		return
 	}
 
+	// Bill the new size from now on
+	storage.SizeGB = updatedStorage.SizeGB
+	storage.Version = updatedStorage.Version
+	if err := services.MeterStorage(context.Request.Context(), storage); err != nil {
+		slog.ErrorContext(context.Request.Context(), "Could not meter storage", "storage_id", storage.ID, "error", err)
+	}
+
+	services.PublishEvent(context.Request.Context(), models.EventStorageResized, "storage", storage.ID, storage.AccountID, storage.ProjectID, storage)
+
+	setETag(context, updatedStorage.Version)
 	context.JSON(http.StatusOK, gin.H{"message": "Storage size updated successfully!", "Storage": updatedStorage})
 }
 
@@ -211,53 +361,64 @@ func UpdateStorageSize(context *gin.Context) {
 // @Security BearerAuth
 // @Param id path int true "Storage ID"
 // @Param vmid path int true "VM ID"
+// @Param If-Match header string false "ETag of the version the change is based on"
+// @Param Idempotency-Key header string false "Key to retry the request safely, retries replay the first response"
 // @Success 200 {object} map[string]interface{}
-// @Failure 400,404,500 {object} map[string]string
+// @Header 200 {string} ETag "Version of the resource, for If-Match"
+// @Failure 400,403,404,412,428,500 {object} apierror.Error
 // @Router /storages/{id}/attach/{vmid} [post]
 func AttachStorageToVM(context *gin.Context) {
 	storageId, err := strconv.ParseInt(context.Param("id"), 10, 64)
 	if err != nil {
-		context.JSON(http.StatusBadRequest, gin.H{"message": "Could not parse storage id.", "error": err.Error()})
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse storage id.", err)
 		return
 	}
 
 	vmId, err := strconv.ParseInt(context.Param("vmid"), 10, 64)
 	if err != nil {
-		context.JSON(http.StatusBadRequest, gin.H{"message": "Could not parse VM id.", "error": err.Error()})
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse VM id.", err)
 		return
 	}
 
-	storage, err := models.GetStorageByID(storageId)
+	// The VM is locked before the storage, like in every change which takes both locks
+	unlockVM := lockResource("vm", vmId)
+	defer unlockVM()
+	unlockStorage := lockResource("storage", storageId)
+	defer unlockStorage()
+
+	storage, err := models.GetStorageByID(context.Request.Context(), storageId)
 
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Could not fetch the storage.", "error": err.Error()})
+		apierror.AbortError(context, "Could not fetch the storage.", err)
 		return
 	}
 
-	if storage == nil {
-		context.JSON(http.StatusNotFound, gin.H{"message": "Storage not found with ID: " + strconv.FormatInt(storage.ID, 10)})
+	if !requireResourceAccess(context, storage.AccountID, storage.ProjectID) || !checkIfMatch(context, storage.Version) {
 		return
 	}
 
-	vm, err := models.GetVMByID(vmId)
+	vm, err := models.GetVMByID(context.Request.Context(), vmId)
 
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Could not fetch the VM.", "error": err.Error()})
+		apierror.AbortError(context, "Could not fetch the VM.", err)
 		return
 	}
 
-	if vm == nil {
-		context.JSON(http.StatusNotFound, gin.H{"message": "VM not found with ID: " + strconv.FormatInt(vm.ID, 10)})
+	if !requireResourceAccess(context, vm.AccountID, vm.ProjectID) {
 		return
 	}
 
 	storage.VMID = &vmId
-	err = storage.AttachStorageByID()
+	err = storage.AttachStorageByID(context.Request.Context())
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Could not attach storage to VM.", "error": err.Error()})
+		abortUpdateError(context, "Could not attach storage to VM.", err)
 		return
 	}
 
+	services.PublishEvent(context.Request.Context(), models.EventStorageAttached, "storage", storage.ID, storage.AccountID, storage.ProjectID,
+		gin.H{"storage": storage, "vm_id": vmId})
+
+	setETag(context, storage.Version)
 	context.JSON(http.StatusOK, gin.H{"message": "Storage attached successfully!", "Storage": storage})
 }
 
@@ -268,52 +429,63 @@ func AttachStorageToVM(context *gin.Context) {
 // @Security BearerAuth
 // @Param id path int true "Storage ID"
 // @Param vmid path int true "VM ID"
+// @Param If-Match header string false "ETag of the version the change is based on"
+// @Param Idempotency-Key header string false "Key to retry the request safely, retries replay the first response"
 // @Success 200 {object} map[string]interface{}
-// @Failure 400,404,500 {object} map[string]string
+// @Header 200 {string} ETag "Version of the resource, for If-Match"
+// @Failure 400,403,404,412,428,500 {object} apierror.Error
 // @Router /storages/{id}/detach/{vmid} [post]
 func DetachStorageFromVM(context *gin.Context) {
 	storageId, err := strconv.ParseInt(context.Param("id"), 10, 64)
 	if err != nil {
-		context.JSON(http.StatusBadRequest, gin.H{"message": "Could not parse storage id.", "error": err.Error()})
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse storage id.", err)
 		return
 	}
 
 	vmId, err := strconv.ParseInt(context.Param("vmid"), 10, 64)
 	if err != nil {
-		context.JSON(http.StatusBadRequest, gin.H{"message": "Could not parse VM id.", "error": err.Error()})
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse VM id.", err)
 		return
 	}
 
-	storage, err := models.GetStorageByID(storageId)
+	// The VM is locked before the storage, like in every change which takes both locks
+	unlockVM := lockResource("vm", vmId)
+	defer unlockVM()
+	unlockStorage := lockResource("storage", storageId)
+	defer unlockStorage()
+
+	storage, err := models.GetStorageByID(context.Request.Context(), storageId)
 
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Could not fetch the storage.", "error": err.Error()})
+		apierror.AbortError(context, "Could not fetch the storage.", err)
 		return
 	}
 
-	if storage == nil {
-		context.JSON(http.StatusNotFound, gin.H{"message": "Storage not found with ID: " + strconv.FormatInt(storage.ID, 10)})
+	if !requireResourceAccess(context, storage.AccountID, storage.ProjectID) || !checkIfMatch(context, storage.Version) {
 		return
 	}
 
-	vm, err := models.GetVMByID(vmId)
+	vm, err := models.GetVMByID(context.Request.Context(), vmId)
 
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Could not fetch the VM.", "error": err.Error()})
+		apierror.AbortError(context, "Could not fetch the VM.", err)
 		return
 	}
 
-	if vm == nil {
-		context.JSON(http.StatusNotFound, gin.H{"message": "VM not found with ID: " + strconv.FormatInt(vm.ID, 10)})
+	if !requireResourceAccess(context, vm.AccountID, vm.ProjectID) {
 		return
 	}
 
 	storage.ID = storageId
-	err = storage.DetachStorageByID()
+	err = storage.DetachStorageByID(context.Request.Context())
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Could not detach storage to VM.", "error": err.Error()})
+		abortUpdateError(context, "Could not detach storage to VM.", err)
 		return
 	}
 
+	services.PublishEvent(context.Request.Context(), models.EventStorageDetached, "storage", storage.ID, storage.AccountID, storage.ProjectID,
+		gin.H{"storage": storage, "vm_id": vmId})
+
+	setETag(context, storage.Version)
 	context.JSON(http.StatusOK, gin.H{"message": "Storage detached successfully!", "Storage": storage})
 }
@@ -0,0 +1,166 @@
+// Manage the incoming HTTP requests
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/services"
+)
+
+var (
+	// Names of containers and volumes as accepted by Docker
+	dockerNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+	// Names of environment variables as accepted by POSIX shells
+	envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// FieldError is one failing field of a request, listed in details.fields of validation_failed responses
+type FieldError struct {
+	// JSON path of the field, e.g., env[1FOO] or ports[0]
+	Field string `json:"field" example:"cpu"`
+
+	// The constraint which failed, e.g., gt or dockername
+	Rule string `json:"rule" example:"gt"`
+
+	// The parameter of the constraint (optional)
+	Param string `json:"param,omitempty" example:"0"`
+
+	// Human readable description
+	Message string `json:"message" example:"cpu must be greater than 0"`
+}
+
+// RegisterValidators adds the constraints of the request structs to the validator of Gin
+// and reports the JSON names of failing fields. It must be called before the routes are served.
+func RegisterValidators() {
+	validate, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		panic("Unexpected validator engine of Gin")
+	}
+
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		if name == "" {
+			return field.Name
+		}
+		return name
+	})
+
+	validators := map[string]validator.Func{
+		"dockername": func(field validator.FieldLevel) bool {
+			return dockerNamePattern.MatchString(field.Field().String())
+		},
+		"envkey": func(field validator.FieldLevel) bool {
+			return envKeyPattern.MatchString(field.Field().String())
+		},
+		"userdata": func(field validator.FieldLevel) bool {
+			return len(field.Field().String()) <= services.MaxUserDataBytes
+		},
+		"labels": func(field validator.FieldLevel) bool {
+			labels, ok := field.Field().Interface().(map[string]string)
+			return ok && models.ValidateLabels(labels) == nil
+		},
+	}
+	for tag, fn := range validators {
+		if err := validate.RegisterValidation(tag, fn); err != nil {
+			panic("Could not register the validator " + tag + ": " + err.Error())
+		}
+	}
+}
+
+// bindRequest parses the JSON body into the request struct and checks its constraints.
+// A broken body is 400, failing constraints are 422 with every failing field in details.fields.
+// It writes the error response and returns false if the request can't be used
+func bindRequest(context *gin.Context, request any) bool {
+	err := context.ShouldBindJSON(request)
+	if err == nil {
+		return true
+	}
+
+	var validationErrors validator.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse request data.", err)
+		return false
+	}
+
+	abortValidation(context, fieldErrors(validationErrors))
+	return false
+}
+
+// abortValidation writes the validation_failed response of the failing fields
+func abortValidation(context *gin.Context, fields []FieldError) {
+	apierror.Abort(context, http.StatusUnprocessableEntity, apierror.CodeValidationFailed,
+		"The request has invalid fields.", apierror.Details{"fields": fields})
+}
+
+// fieldErrors describes the failing constraints with the JSON path of their fields
+func fieldErrors(validationErrors validator.ValidationErrors) []FieldError {
+	fields := make([]FieldError, 0, len(validationErrors))
+	for _, validationError := range validationErrors {
+		// The namespace starts with the name of the request struct
+		field := validationError.Namespace()
+		if _, path, ok := strings.Cut(field, "."); ok {
+			field = path
+		}
+
+		fields = append(fields, FieldError{
+			Field:   field,
+			Rule:    validationError.Tag(),
+			Param:   validationError.Param(),
+			Message: fieldMessage(field, validationError),
+		})
+	}
+	return fields
+}
+
+// fieldMessage is the human readable description of a failing constraint
+func fieldMessage(field string, validationError validator.FieldError) string {
+	param := validationError.Param()
+	switch validationError.Tag() {
+	case "required":
+		return field + " is required"
+	case "required_without":
+		return field + " is required without " + param
+	case "gt":
+		return field + " must be greater than " + param
+	case "gte", "min":
+		if validationError.Kind() == reflect.String || validationError.Kind() == reflect.Slice || validationError.Kind() == reflect.Map {
+			return fmt.Sprintf("%s must have at least %s items or characters", field, param)
+		}
+		return field + " must be at least " + param
+	case "lte", "max":
+		if validationError.Kind() == reflect.String || validationError.Kind() == reflect.Slice || validationError.Kind() == reflect.Map {
+			return fmt.Sprintf("%s must have at most %s items or characters", field, param)
+		}
+		return field + " must be at most " + param
+	case "unique":
+		return field + " must not contain duplicates"
+	case "dockername":
+		return field + " must start with a letter or digit and contain only letters, digits, '_', '.' and '-'"
+	case "envkey":
+		return field + " must be a variable name: letters, digits and '_', not starting with a digit"
+	case "userdata":
+		return fmt.Sprintf("%s must be at most %d bytes", field, services.MaxUserDataBytes)
+	case "labels":
+		if labels, ok := validationError.Value().(map[string]string); ok {
+			if err := models.ValidateLabels(labels); err != nil {
+				return err.Error()
+			}
+		}
+		return field + " has invalid labels"
+	}
+	return fmt.Sprintf("%s fails the %s constraint", field, validationError.Tag())
+}
@@ -2,55 +2,182 @@
 package handlers
 
 import (
-	"fmt"
+	"log/slog"
+	"maps"
 	"net/http"
 	"reflect"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
 	"github.com/odeeka/go-minicloud-rest-api/models"
 	"github.com/odeeka/go-minicloud-rest-api/services"
 )
 
+// VMRequest is the body of creating or replacing a VM.
+// @Description CPU and memory may be left out when a flavor is set or the catalog image has defaults.
+type VMRequest struct {
+	// Name of the container, letters, digits, '_', '.' and '-'
+	Name string `json:"name" binding:"required,max=64,dockername" example:"web-1"`
+
+	// Image used to start the VM (e.g., "nginx", "ubuntu")
+	Image string `json:"image" binding:"required,max=255" example:"nginx"`
+
+	// Number of virtual CPUs, 0 for the value of the flavor or the image
+	CPU float64 `json:"cpu" binding:"omitempty,gt=0,lte=64" example:"1.5"`
+
+	// Memory in megabytes (Docker needs at least 6), 0 for the value of the flavor or the image
+	Memory int `json:"memory" binding:"omitempty,min=6,max=262144" example:"1024"`
+
+	// Ports to expose on the container
+	Ports []int `json:"ports" binding:"max=32,unique,dive,min=1,max=65535" example:"80,443"`
+
+	// Environment variables passed to the container
+	Env map[string]string `json:"env" binding:"max=128,dive,keys,max=255,envkey,endkeys,max=4096"`
+
+	// Name of the flavor which defines CPU, memory and disk
+	Flavor string `json:"flavor" binding:"max=64" example:"small"`
+
+	// A "#cloud-config" document which provisions the VM on first boot, at most services.MaxUserDataBytes
+	UserData string `json:"user_data" binding:"userdata"`
+
+	// Key pairs of the owner installed into the authorized_keys of root
+	KeyPairIDs []int64 `json:"key_pair_ids" binding:"max=16,unique,dive,gt=0" example:"1"`
+
+	// Free-form key/value labels
+	Labels map[string]string `json:"labels" binding:"omitempty,labels"`
+}
+
+// toVM copies the fields of the request into a VM model
+func (request *VMRequest) toVM() models.VM {
+	return models.VM{
+		Name:       request.Name,
+		Image:      request.Image,
+		CPU:        request.CPU,
+		Memory:     request.Memory,
+		Ports:      request.Ports,
+		Env:        request.Env,
+		Flavor:     request.Flavor,
+		UserData:   request.UserData,
+		KeyPairIDs: request.KeyPairIDs,
+		Labels:     request.Labels,
+	}
+}
+
+// requireVMResources checks that the flavor or the image defaults left the VM with CPU and memory,
+// Docker would start the container without limits otherwise. It writes the error response and returns false if not
+func requireVMResources(context *gin.Context, vm *models.VM) bool {
+	fields := []FieldError{}
+	if vm.CPU <= 0 {
+		fields = append(fields, FieldError{Field: "cpu", Rule: "required_without", Param: "flavor", Message: "cpu is required without a flavor or image default"})
+	}
+	if vm.Memory <= 0 {
+		fields = append(fields, FieldError{Field: "memory", Rule: "required_without", Param: "flavor", Message: "memory is required without a flavor or image default"})
+	}
+	if len(fields) > 0 {
+		abortValidation(context, fields)
+		return false
+	}
+	return true
+}
+
+// withImageWarning adds the warning of resolveVMImage to the response of a started VM
+func withImageWarning(response gin.H, warning string) gin.H {
+	if warning != "" {
+		response["warnings"] = []string{warning}
+	}
+	return response
+}
+
 // ListVMs godoc
 // @Summary      List all VMs
-// @Description  Retrieves a list of all virtual machines
+// @Description  Retrieves a list of all virtual machines of the selected project (without a project: outside of any project)
 // @Tags         vms
 // @Security BearerAuth
 // @Accept json
 // @Produce      json
+// @Param        X-MiniCloud-Project header  string  false  "Project ID or name"
+// @Param        limit       query     int     false  "Maximum number of items (default 100, max 1000)"
+// @Param        page_token  query     string  false  "NextPageToken of the previous page"
+// @Param        sort        query     string  false  "id, name, image, status, cpu, memory, with - for descending (default id)"
+// @Param        image       query     string  false  "Image with any tag (e.g., nginx) or with a tag (nginx:1.27)"
+// @Param        status      query     string  false  "VM status, e.g., running"
+// @Param        name_prefix query     string  false  "Beginning of the name"
+// @Param        flavor      query     string  false  "Flavor name"
+// @Param        account_id  query     int     false  "Owner account ID"
+// @Param        selector    query     string  false  "Label selector, e.g., env=dev,team in (a,b)"
 // @Success      200  {object}  map[string]interface{}
-// @Failure      500  {object}  map[string]string
+// @Failure      400,500  {object}  apierror.Error
 // @Router       /vms [get]
 func ListVMs(context *gin.Context) {
-	vms, err := models.GetAllVms()
-	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Failed to retriev all VMs"})
+	options, ok := listOptions(context)
+	if !ok || !ownResourcesOnly(context, &options) {
 		return
 	}
-	context.JSON(http.StatusOK, gin.H{"message": "Fetched all VMS from database", "VMS": vms})
+
+	vms, nextPageToken, err := models.ListVMs(context.Request.Context(), context.GetInt64("project_id"), options)
+	respondList(context, "Fetched VMs from database", vms, nextPageToken, err)
 }
 
 // CreateVM handles the POST request to create a new virtual machine simulation
 // CreateVM godoc
 // @Summary      Create a new VM
-// @Description  Creates and stores metadata for a new virtual machine simulation
+// @Description  Creates and stores metadata for a new virtual machine simulation, in the selected project if there is one
 // @Tags         vms
 // @Accept       json
 // @Produce      json
-// @Param        vm  body      models.VM  true  "VM to create"
+// @Param        X-MiniCloud-Project header  string  false  "Project ID or name"
+// @Param        vm  body      VMRequest  true  "VM to create"
+// @Param        Idempotency-Key  header  string  false  "Key to retry the request safely, retries replay the first response"
 // @Success      201  {object}  map[string]interface{}
-// @Failure      400  {object}  map[string]string
-// @Failure      500  {object}  map[string]string
+// @Failure      400  {object}  apierror.Error
+// @Failure      422  {object}  apierror.Error
+// @Failure      500  {object}  apierror.Error
+// @Failure      502  {object}  apierror.Error
 // @Router       /vms [post]
 func CreateVM(context *gin.Context) {
-	var vm models.VM
+	// Parse the incoming JSON payload and check its constraints before anything is started
+	var request VMRequest
+	if !bindRequest(context, &request) {
+		return
+	}
+	vm := request.toVM()
 
-	// Parse the incoming JSON payload into the VM model
-	err := context.ShouldBindJSON(&vm)
+	// Apply the flavor, free-form resources need a permission
+	if !resolveVMFlavor(context, &vm, nil) {
+		return
+	}
 
-	if err != nil {
-		context.JSON(http.StatusBadRequest, gin.H{"message": "Could not parse request data.", "error": err})
+	// Apply the image catalog (policy, defaults and digest pinning)
+	imageWarning, ok := resolveVMImage(context, &vm, true)
+	if !ok {
+		return
+	}
+
+	if !requireVMResources(context, &vm) {
+		return
+	}
+
+	// The resources must fit on the host
+	if !checkHostCapacity(context, vm.CPU, vm.Memory) {
+		return
+	}
+
+	// The VM belongs to the authenticated account and the selected project,
+	// it counts against the quota of the project or, without a project, of the account
+	vm.AccountID = context.GetInt64("user_id")
+	vm.ProjectID = context.GetInt64("project_id")
+
+	bootScript, ok := buildBootScript(context, &vm)
+	if !ok {
+		return
+	}
+
+	unlock := lockQuota(vm.AccountID, vm.ProjectID)
+	defer unlock()
+
+	if !checkQuota(context, vm.AccountID, vm.ProjectID, models.Usage{VMs: 1, VCPUs: vm.CPU, MemoryMB: vm.Memory}) {
 		return
 	}
 
@@ -58,53 +185,80 @@ func CreateVM(context *gin.Context) {
 	// This is the place to plug in different VM simulation technologies like Docker, VirtualBox, or others
 	// If you only want to simulate the VM at the database level and do not need to start an actual service,
 	// you can comment out the following line
-	err = services.StartContainer(&vm)
+	err := services.StartContainer(context.Request.Context(), &vm)
 	if err != nil {
-		context.JSON(http.StatusBadRequest, gin.H{"message": "Failed to start the VM", "error": err.Error()})
+		apierror.AbortErr(context, http.StatusBadGateway, apierror.CodeRuntimeError, "Failed to start the VM", err)
 		return
 	}
 
 	// Store the VM metadata in the database after the container has started
-	err = vm.InsertVM()
+	vm.Status = models.VMStatusRunning
+	err = vm.InsertVM(context.Request.Context())
 
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Could not create VM metadata into database.", "error": err})
+		apierror.AbortError(context, "Could not create VM metadata into database.", err)
 		return
 	}
 
+	auditCreated(context, vm.ID)
+
+	// The runtime of the VM is billed from now on
+	if err := services.MeterVM(context.Request.Context(), &vm); err != nil {
+		slog.ErrorContext(context.Request.Context(), "Could not meter VM", "vm_id", vm.ID, "error", err)
+	}
+
+	services.StartLogCapture(vm.ID, vm.AccountID, vm.ContainerID)
+
+	// Provision the VM in the background, the result is reported by GET /vms/:id/boot
+	if bootScript != "" {
+		go services.RunBootScript(context.Request.Context(), vm.ID, vm.AccountID, vm.ProjectID, vm.ContainerID, bootScript)
+	}
+
+	services.PublishEvent(context.Request.Context(), models.EventVMCreated, "vm", vm.ID, vm.AccountID, vm.ProjectID, vm)
+
 	// Return success response with the VM details
-	context.JSON(http.StatusCreated, gin.H{"message": "VM created and stored in database", "VM": vm})
+	setETag(context, vm.Version)
+	context.JSON(http.StatusCreated, withImageWarning(gin.H{"message": "VM created and stored in database", "VM": vm}, imageWarning))
 }
 
 // GetVM godoc
 // @Summary      Get VM by ID
-// @Description  Retrieves a single virtual machine by its ID
+// @Description  Retrieves a single virtual machine by its ID with a summary of its resource usage in the last hour
 // @Tags         vms
 // @Produce      json
 // @Param        id   path      int  true  "VM ID"
 // @Success      200  {object}  map[string]interface{}
-// @Failure      400  {object}  map[string]string
-// @Failure      404  {object}  map[string]string
-// @Failure      500  {object}  map[string]string
+// @Header       200  {string}  ETag  "Version of the resource, for If-Match"
+// @Failure      400  {object}  apierror.Error
+// @Failure      403  {object}  apierror.Error
+// @Failure      404  {object}  apierror.Error
+// @Failure      500  {object}  apierror.Error
 // @Router       /vms/{id} [get]
 func GetVM(context *gin.Context) {
 	vmId, err := strconv.ParseInt(context.Param("id"), 10, 64)
 	if err != nil {
-		context.JSON(http.StatusBadRequest, gin.H{"message": "Could not parse VM id.", "error": err.Error()})
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse VM id.", err)
 		return
 	}
 
-	vm, err := models.GetVMByID(vmId)
+	vm, err := models.GetVMByID(context.Request.Context(), vmId)
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Could not fetch target VM.", "error": err.Error()})
+		apierror.AbortError(context, "Could not fetch target VM.", err)
+		return
+	}
+	if !requireResourceAccess(context, vm.AccountID, vm.ProjectID) {
 		return
 	}
-	if vm == nil {
-		context.JSON(http.StatusNotFound, gin.H{"message": "VM not found"})
+
+	// How the recent usage compares with the CPU and memory settings
+	summary, err := models.GetVMMetricsSummary(context.Request.Context(), vm, time.Now().Add(-time.Hour), "1h")
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the VM metrics.", err)
 		return
 	}
 
-	context.JSON(http.StatusOK, gin.H{"vm": vm})
+	setETag(context, vm.Version)
+	context.JSON(http.StatusOK, gin.H{"vm": vm, "metrics": summary})
 }
 
 // DeleteVM godoc
@@ -113,42 +267,69 @@ func GetVM(context *gin.Context) {
 // @Tags         vms
 // @Produce      json
 // @Param        id   path      int  true  "VM ID"
+// @Param        If-Match  header  string  false  "ETag of the version the change is based on"
 // @Success      200  {object}  map[string]string
-// @Failure      400  {object}  map[string]string
-// @Failure      500  {object}  map[string]string
+// @Failure      400  {object}  apierror.Error
+// @Failure      403  {object}  apierror.Error
+// @Failure      404  {object}  apierror.Error
+// @Failure      412  {object}  apierror.Error
+// @Failure      428  {object}  apierror.Error
+// @Failure      500  {object}  apierror.Error
+// @Failure      502  {object}  apierror.Error
 // @Router       /vms/{id} [delete]
 func DeleteVM(context *gin.Context) {
 
 	vmId, err := strconv.ParseInt(context.Param("id"), 10, 64)
 
 	if err != nil {
-		context.JSON(http.StatusBadRequest, gin.H{"message": "Could not parse VM id.", "error": err})
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse VM id.", err)
 		return
 	}
 
-	vm, err := models.GetVMByID(vmId)
+	unlock := lockResource("vm", vmId)
+	defer unlock()
+
+	vm, err := models.GetVMByID(context.Request.Context(), vmId)
 
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Could not fetch the VM.", "error": err})
+		apierror.AbortError(context, "Could not fetch the VM.", err)
+		return
+	}
+
+	if !requireResourceAccess(context, vm.AccountID, vm.ProjectID) || !checkIfMatch(context, vm.Version) {
 		return
 	}
 
 	// Stop and remove Docker container if exists
 	if vm.ContainerID != "" {
-		err = services.StopAndRemoveContainer(vm.ContainerID)
+		err = services.StopAndRemoveContainer(context.Request.Context(), vm.ContainerID)
 		if err != nil {
-			context.JSON(http.StatusInternalServerError, gin.H{"message": "Could not remove VM (simulated container).", "error": err})
+			apierror.AbortErr(context, http.StatusBadGateway, apierror.CodeRuntimeError, "Could not remove VM (simulated container).", err)
 			return
 		}
 	}
 
-	err = vm.DeleteVMByID()
+	err = vm.DeleteVMByID(context.Request.Context())
 
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Could not delete the VM.", "error": err})
+		apierror.AbortError(context, "Could not delete the VM.", err)
 		return
 	}
 
+	if err := services.StopMetering(context.Request.Context(), models.MeteredVM, vm.ID); err != nil {
+		slog.ErrorContext(context.Request.Context(), "Could not stop metering VM", "vm_id", vm.ID, "error", err)
+	}
+
+	if err := models.DeleteBootRun(context.Request.Context(), vm.ID); err != nil {
+		slog.ErrorContext(context.Request.Context(), "Could not delete boot run", "vm_id", vm.ID, "error", err)
+	}
+
+	if err := models.DeleteVMMetrics(context.Request.Context(), vm.ID); err != nil {
+		slog.ErrorContext(context.Request.Context(), "Could not delete VM metrics", "vm_id", vm.ID, "error", err)
+	}
+
+	services.PublishEvent(context.Request.Context(), models.EventVMDeleted, "vm", vm.ID, vm.AccountID, vm.ProjectID, vm)
+
 	context.JSON(http.StatusOK, gin.H{"message": "VM deleted successfully with ID: " + strconv.FormatInt(vm.ID, 10)})
 }
 
@@ -159,41 +340,173 @@ func DeleteVM(context *gin.Context) {
 // @Accept       json
 // @Produce      json
 // @Param        id   path      int       true  "VM ID"
-// @Param        vm   body      models.VM true  "Updated VM"
+// @Param        vm   body      VMRequest true  "Updated VM"
+// @Param        If-Match  header  string  false  "ETag of the version the change is based on"
 // @Success      200  {object}  map[string]interface{}
-// @Failure      400  {object}  map[string]string
-// @Failure      500  {object}  map[string]string
+// @Failure      400  {object}  apierror.Error
+// @Failure      403  {object}  apierror.Error
+// @Failure      404  {object}  apierror.Error
+// @Failure      412  {object}  apierror.Error
+// @Failure      422  {object}  apierror.Error
+// @Failure      428  {object}  apierror.Error
+// @Failure      500  {object}  apierror.Error
+// @Failure      502  {object}  apierror.Error
 // @Router       /vms/{id} [put]
 func UpdateVM(context *gin.Context) {
 	vmId, err := strconv.ParseInt(context.Param("id"), 10, 64)
 	if err != nil {
-		context.JSON(http.StatusBadRequest, gin.H{"message": "Could not parse VM id.", "error": err})
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse VM id.", err)
 		return
 	}
 
+	// Changes of the VM are serialized, the update is based on the version of the If-Match header
+	unlock := lockResource("vm", vmId)
+	defer unlock()
+
 	// Get the current VM metadata
-	vm, err := models.GetVMByID(vmId)
+	vm, err := models.GetVMByID(context.Request.Context(), vmId)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the VM.", err)
+		return
+	}
+
+	if !requireResourceAccess(context, vm.AccountID, vm.ProjectID) || !checkIfMatch(context, vm.Version) {
+		return
+	}
+
+	var request VMRequest
+	if !bindRequest(context, &request) {
+		return
+	}
+	updatedVM := request.toVM()
+
+	// Labels are kept when the request has none
+	if updatedVM.Labels == nil {
+		updatedVM.Labels = vm.Labels
+	}
+
+	applyVMUpdate(context, vm, updatedVM, false)
+}
+
+// PatchVM godoc
+// @Summary      Patch VM
+// @Description  Changes only the fields of the JSON Merge Patch (RFC 7396), null removes a field (e.g., a label).
+// @Description  Like PUT, changing name, image, ports, env, user_data, key pairs or labels recreates the container, CPU and memory are updated live.
+// @Description  With dry_run=true nothing is changed, the response has the resulting VM and whether the container would be recreated.
+// @Tags         vms
+// @Security BearerAuth
+// @Accept       json
+// @Produce      json
+// @Param        X-MiniCloud-Project header  string  false  "Project ID or name"
+// @Param        id       path      int        true   "VM ID"
+// @Param        dry_run  query     bool       false  "Only report the result and whether the container would be recreated"
+// @Param        patch    body      VMRequest  true   "Fields to change"
+// @Param        If-Match  header  string  false  "ETag of the version the change is based on"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400  {object}  apierror.Error
+// @Failure      403  {object}  apierror.Error
+// @Failure      404  {object}  apierror.Error
+// @Failure      412  {object}  apierror.Error
+// @Failure      415  {object}  apierror.Error
+// @Failure      422  {object}  apierror.Error
+// @Failure      428  {object}  apierror.Error
+// @Failure      500  {object}  apierror.Error
+// @Failure      502  {object}  apierror.Error
+// @Router       /vms/{id} [patch]
+func PatchVM(context *gin.Context) {
+	vmId, err := strconv.ParseInt(context.Param("id"), 10, 64)
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Could not fetch the VM.", "error": err})
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse VM id.", err)
+		return
+	}
+
+	dryRun, ok := dryRunParam(context)
+	if !ok {
 		return
 	}
 
-	var updatedVM models.VM
-	err = context.ShouldBindJSON(&updatedVM)
+	unlock := lockResource("vm", vmId)
+	defer unlock()
 
+	vm, err := models.GetVMByID(context.Request.Context(), vmId)
 	if err != nil {
-		context.JSON(http.StatusBadRequest, gin.H{"message": "Could not parse request data.", "error": err})
+		apierror.AbortError(context, "Could not fetch the VM.", err)
 		return
 	}
 
-	needsRecreate := false
+	if !requireResourceAccess(context, vm.AccountID, vm.ProjectID) || !checkIfMatch(context, vm.Version) {
+		return
+	}
+
+	// The patch is applied to the request document of the current VM, so the fields
+	// which aren't sent keep their values and the constraints of PUT still hold
+	request := vmRequestFrom(vm)
+	if !bindMergePatch(context, &request) {
+		return
+	}
 
-	fmt.Println("Needs recreate: ", needsRecreate)
-	fmt.Println("VM image: ", vm.Image)
-	fmt.Println("VM ports: ", vm.Ports)
-	fmt.Println("VM env: ", vm.Env)
+	applyVMUpdate(context, vm, request.toVM(), dryRun)
+}
 
-	if vm.Image != updatedVM.Image {
+// vmRequestFrom is the request document which would replace the VM with itself
+func vmRequestFrom(vm *models.VM) VMRequest {
+	return VMRequest{
+		Name:       vm.Name,
+		Image:      vm.Image,
+		CPU:        vm.CPU,
+		Memory:     vm.Memory,
+		Ports:      vm.Ports,
+		Env:        vm.Env,
+		Flavor:     vm.Flavor,
+		UserData:   vm.UserData,
+		KeyPairIDs: vm.KeyPairIDs,
+		Labels:     vm.Labels,
+	}
+}
+
+// applyVMUpdate replaces the VM with the updated one: CPU and memory changes are applied to the running container,
+// other changes recreate it. A dry run only responds with the result and whether the container would be recreated
+func applyVMUpdate(context *gin.Context, vm *models.VM, updatedVM models.VM, dryRun bool) {
+	// Resizing between flavors only changes CPU and memory, so it takes the live update path below
+	if !resolveVMFlavor(context, &updatedVM, vm) {
+		return
+	}
+
+	// The catalog fills in the same defaults as on creation, so leaving them out is no change.
+	// A registry image is only pulled when it changes and never on a dry run,
+	// an unchanged image keeps the digest the VM was started from
+	imageChanged := vm.Image != updatedVM.Image
+	imageWarning, ok := resolveVMImage(context, &updatedVM, imageChanged && !dryRun)
+	if !ok {
+		return
+	}
+	if !imageChanged {
+		updatedVM.ImageDigest = vm.ImageDigest
+		imageWarning = ""
+	}
+
+	if !requireVMResources(context, &updatedVM) {
+		return
+	}
+
+	if !checkHostCapacity(context, updatedVM.CPU, updatedVM.Memory) {
+		return
+	}
+
+	// Growing CPU or memory counts against the quota of the owner or the project
+	updatedVM.AccountID = vm.AccountID
+	updatedVM.ProjectID = vm.ProjectID
+	unlock := lockQuota(vm.AccountID, vm.ProjectID)
+	defer unlock()
+
+	if !checkQuota(context, vm.AccountID, vm.ProjectID, models.Usage{VCPUs: updatedVM.CPU - vm.CPU, MemoryMB: updatedVM.Memory - vm.Memory}) {
+		return
+	}
+
+	needsRecreate := false
+
+	// The container is named after the VM, so a rename starts a new one
+	if imageChanged || vm.Name != updatedVM.Name {
 		needsRecreate = true
 	}
 
@@ -214,40 +527,181 @@ func UpdateVM(context *gin.Context) {
 		needsRecreate = true
 	}
 
-	fmt.Println("Needs recreate: ", needsRecreate)
-	// Perform a live update of the container when only CPU or memory values change.
-	// If image, ports, or environment variables are modified, the container should be recreated.
-	// This function simulates VM updates using container technology (e.g., Docker, VirtualBox, etc.).
-	if needsRecreate {
+	if updatedVM.KeyPairIDs != nil && len(updatedVM.KeyPairIDs) == 0 {
+		updatedVM.KeyPairIDs = nil
+	}
 
-		err = services.StopAndRemoveContainer(vm.ContainerID)
+	// Like cloud-init, the boot script runs again when the user data or the key pairs change,
+	// and on every new container since the authorized keys only exist in the container which ran it
+	// Docker can't change the labels of a container
+	if !maps.Equal(vm.Labels, updatedVM.Labels) {
+		needsRecreate = true
+	}
 
-		if err != nil {
-			context.JSON(http.StatusBadRequest, gin.H{"message": "Failed to stop & remove the VM", "error": err.Error()})
+	if vm.UserData != updatedVM.UserData || !reflect.DeepEqual(vm.KeyPairIDs, updatedVM.KeyPairIDs) {
+		needsRecreate = true
+	}
+	bootScript := ""
+	if needsRecreate {
+		script, ok := buildBootScript(context, &updatedVM)
+		if !ok {
+			return
 		}
+		bootScript = script
+	}
 
-		err = services.StartContainer(&updatedVM)
+	slog.DebugContext(context.Request.Context(), "Updating VM", "vm", vm, "update", updatedVM, "needs_recreate", needsRecreate, "dry_run", dryRun)
 
-		if err != nil {
-			context.JSON(http.StatusBadRequest, gin.H{"message": "Failed to start the VM", "error": err.Error()})
+	updatedVM.ID = vm.ID
+	if !needsRecreate {
+		// The container keeps running the image it was started from
+		updatedVM.ImageDigest = vm.ImageDigest
+		imageWarning = ""
+	}
+	if dryRun {
+		updatedVM.ContainerID = vm.ContainerID
+		updatedVM.Status = vm.Status
+		updatedVM.SSHPort = vm.SSHPort
+		updatedVM.Version = vm.Version
+		context.JSON(http.StatusOK, withImageWarning(gin.H{"message": "Dry run, the VM was not changed", "VM": updatedVM, "recreate": needsRecreate}, imageWarning))
+		return
+	}
+
+	// Perform a live update of the container when only CPU or memory values change.
+	// If image, ports, or environment variables are modified, the container should be recreated.
+	// This function simulates VM updates using container technology (e.g., Docker, VirtualBox, etc.).
+	if needsRecreate {
+		if !recreateVMContainer(context, vm.ContainerID, &updatedVM) {
 			return
 		}
-
 	} else {
 		updatedVM.ContainerID = vm.ContainerID // Keep the container ID
-		err = services.UpdateContainer(&updatedVM)
+		updatedVM.Status = vm.Status
+		updatedVM.SSHPort = vm.SSHPort
+		if err := services.UpdateContainer(context.Request.Context(), &updatedVM); err != nil {
+			apierror.AbortErr(context, http.StatusBadGateway, apierror.CodeRuntimeError, "Failed to update the VM", err)
+			return
+		}
+	}
+
+	// Update the database with new data
+	updatedVM.Version = vm.Version
+	err := updatedVM.UpdateVMByID(context.Request.Context())
+	if err != nil {
+		abortUpdateError(context, "Could not update the metadata of VM in database", err)
+		return
+	}
+
+	// Bill the new size from now on
+	if err := services.MeterVM(context.Request.Context(), &updatedVM); err != nil {
+		slog.ErrorContext(context.Request.Context(), "Could not meter VM", "vm_id", updatedVM.ID, "error", err)
+	}
+
+	if needsRecreate {
+		startRecreatedVM(context, &updatedVM, bootScript)
+	}
+
+	services.PublishEvent(context.Request.Context(), models.EventVMUpdated, "vm", updatedVM.ID, updatedVM.AccountID, updatedVM.ProjectID, updatedVM)
+
+	setETag(context, updatedVM.Version)
+	context.JSON(http.StatusOK, withImageWarning(gin.H{"message": "VM updated successfully!", "VM": updatedVM}, imageWarning))
+}
+
+// recreateVMContainer stops and removes the old container of the VM and starts a new one for its configuration
+// It writes the error response and returns false otherwise
+func recreateVMContainer(context *gin.Context, oldContainerID string, vm *models.VM) bool {
+	if err := services.StopAndRemoveContainer(context.Request.Context(), oldContainerID); err != nil {
+		apierror.AbortErr(context, http.StatusBadGateway, apierror.CodeRuntimeError, "Failed to stop & remove the VM", err)
+		return false
+	}
+
+	if err := services.StartContainer(context.Request.Context(), vm); err != nil {
+		apierror.AbortErr(context, http.StatusBadGateway, apierror.CodeRuntimeError, "Failed to start the VM", err)
+		return false
+	}
+	vm.Status = models.VMStatusRunning
+	return true
+}
+
+// startRecreatedVM captures the logs of the new container of a stored VM and runs its boot script
+func startRecreatedVM(context *gin.Context, vm *models.VM, bootScript string) {
+	// The logs of the old container stay in the log store, the new container is appended
+	services.StartLogCapture(vm.ID, vm.AccountID, vm.ContainerID)
+
+	if bootScript != "" {
+		go services.RunBootScript(context.Request.Context(), vm.ID, vm.AccountID, vm.ProjectID, vm.ContainerID, bootScript)
+	} else if err := models.DeleteBootRun(context.Request.Context(), vm.ID); err != nil {
+		slog.ErrorContext(context.Request.Context(), "Could not delete boot run", "vm_id", vm.ID, "error", err)
+	}
+}
+
+// GetVMBoot godoc
+// @Summary      Get VM boot script result
+// @Description  Retrieves the status, exit code and log of the boot script which runs the user_data of the VM
+// @Tags         vms
+// @Security BearerAuth
+// @Produce      json
+// @Param        id   path      int  true  "VM ID"
+// @Success      200  {object}  models.BootRun
+// @Failure      400  {object}  apierror.Error
+// @Failure      403  {object}  apierror.Error
+// @Failure      404  {object}  apierror.Error
+// @Failure      500  {object}  apierror.Error
+// @Router       /vms/{id}/boot [get]
+func GetVMBoot(context *gin.Context) {
+	vmId, err := strconv.ParseInt(context.Param("id"), 10, 64)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse VM id.", err)
+		return
 	}
+
+	vm, err := models.GetVMByID(context.Request.Context(), vmId)
 	if err != nil {
-		context.JSON(http.StatusBadRequest, gin.H{"message": "Failed to update the VM", "error": err.Error()})
+		apierror.AbortError(context, "Could not fetch the VM.", err)
+		return
+	}
+	if !requireResourceAccess(context, vm.AccountID, vm.ProjectID) {
 		return
 	}
 
-	// Update the database with new data
-	updatedVM.ID = vmId
-	err = updatedVM.UpdateVMByID()
+	run, err := models.GetBootRun(context.Request.Context(), vmId)
 	if err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"message": "Could not update the metadata of VM in database", "error": err})
+		apierror.AbortError(context, "Could not fetch the boot run.", err)
 		return
 	}
-	context.JSON(http.StatusOK, gin.H{"message": "VM updated successfully!", "VM": updatedVM})
+	if run == nil {
+		apierror.Abort(context, http.StatusNotFound, apierror.CodeNotFound, "The VM has no boot script", nil)
+		return
+	}
+
+	context.JSON(http.StatusOK, run)
+}
+
+// buildBootScript renders the key pairs and the user data of the VM to its boot script
+// It writes the error response and returns false for unknown key pairs or invalid user data
+func buildBootScript(context *gin.Context, vm *models.VM) (string, bool) {
+	authorizedKeys := []string{}
+	for _, keyPairId := range vm.KeyPairIDs {
+		keyPair, err := models.GetKeyPairByID(context.Request.Context(), keyPairId)
+		if err != nil {
+			apierror.AbortError(context, "Could not fetch the key pair.", err)
+			return "", false
+		}
+
+		// Only the key pairs of the VM owner can be installed
+		if keyPair == nil || keyPair.AccountID != vm.AccountID {
+			apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Key pair not found with ID: "+strconv.FormatInt(keyPairId, 10), nil)
+			return "", false
+		}
+
+		authorizedKeys = append(authorizedKeys, keyPair.PublicKey)
+	}
+
+	script, err := services.BuildBootScript(vm.UserData, authorizedKeys)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid user_data.", err)
+		return "", false
+	}
+
+	return script, true
 }
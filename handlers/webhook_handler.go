@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/services"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+)
+
+// WebhookRequest creates or replaces a webhook
+type WebhookRequest struct {
+	// The http(s) URL the events are POSTed to
+	URL string `json:"url" binding:"required"`
+
+	// The subscribed event types (e.g., ["vm.state_changed"]), "vm.*" for all types of a resource or "*" for all
+	EventTypes []string `json:"event_types" binding:"required"`
+
+	Description string `json:"description"`
+
+	// Inactive webhooks receive no deliveries (default true)
+	Active *bool `json:"active"`
+}
+
+// ListWebhooks godoc
+// @Summary List own webhooks
+// @Description Retrieves the webhooks of the authenticated account (without their secrets)
+// @Tags webhooks
+// @Security BearerAuth
+// @Produce json
+// @Param limit query int false "Maximum number of items (default 100, max 1000)"
+// @Param page_token query string false "NextPageToken of the previous page"
+// @Param sort query string false "id, created_at, with - for descending (default id)"
+// @Param active query bool false "true for active webhooks, false for inactive ones"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400,500 {object} apierror.Error
+// @Router /webhooks [get]
+func ListWebhooks(context *gin.Context) {
+	options, ok := listOptions(context)
+	if !ok {
+		return
+	}
+
+	webhooks, nextPageToken, err := models.ListWebhooks(context.Request.Context(), context.GetInt64("user_id"), options)
+	respondList(context, "Fetched webhooks", webhooks, nextPageToken, err)
+}
+
+// CreateWebhook godoc
+// @Summary Create a webhook
+// @Description Subscribes a URL to event types. Deliveries are POSTed with the event as JSON body and signed in the X-MiniCloud-Signature header ("sha256=" and the HMAC-SHA256 of "<X-MiniCloud-Timestamp>.<body>" with the secret). The secret is only returned in this response. The Idempotency-Key header is ignored, the secret is not stored for a replay.
+// @Tags webhooks
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param webhook body WebhookRequest true "Webhook"
+// @Success 201 {object} map[string]interface{}
+// @Failure 400,500 {object} apierror.Error
+// @Router /webhooks [post]
+func CreateWebhook(context *gin.Context) {
+	var webhook models.Webhook
+	if !bindWebhook(context, &webhook) {
+		return
+	}
+
+	secret, err := utils.GenerateWebhookSecret()
+	if err != nil {
+		apierror.AbortError(context, "Could not create webhook secret.", err)
+		return
+	}
+
+	webhook.AccountID = context.GetInt64("user_id")
+	webhook.Secret = secret
+	err = webhook.InsertWebhook(context.Request.Context())
+
+	if err != nil {
+		apierror.AbortError(context, "Could not create webhook.", err)
+		return
+	}
+
+	auditCreated(context, webhook.ID)
+
+	setETag(context, webhook.Version)
+	context.JSON(http.StatusCreated, gin.H{"message": "Webhook created, store the secret now: it is not shown again", "Webhook": webhook})
+}
+
+// GetWebhook godoc
+// @Summary Get webhook by ID
+// @Description Retrieves a webhook (own webhook or admin)
+// @Tags webhooks
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Webhook ID"
+// @Success 200 {object} map[string]interface{}
+// @Header 200 {string} ETag "Version of the resource, for If-Match"
+// @Failure 400,403,404,500 {object} apierror.Error
+// @Router /webhooks/{id} [get]
+func GetWebhook(context *gin.Context) {
+	webhook, ok := webhookFromParam(context)
+	if !ok {
+		return
+	}
+
+	setETag(context, webhook.Version)
+	context.JSON(http.StatusOK, gin.H{"Webhook": webhook})
+}
+
+// UpdateWebhook godoc
+// @Summary Update webhook
+// @Description Replaces URL, event types, description and state of a webhook (own webhook or admin). The secret stays the same.
+// @Tags webhooks
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path int true "Webhook ID"
+// @Param webhook body WebhookRequest true "Webhook"
+// @Param If-Match header string false "ETag of the version the change is based on"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400,403,404,412,428,500 {object} apierror.Error
+// @Router /webhooks/{id} [put]
+func UpdateWebhook(context *gin.Context) {
+	webhook, ok := webhookFromParam(context)
+	if !ok || !checkIfMatch(context, webhook.Version) || !bindWebhook(context, webhook) {
+		return
+	}
+
+	err := webhook.UpdateWebhook(context.Request.Context())
+	if err != nil {
+		abortUpdateError(context, "Could not update the webhook.", err)
+		return
+	}
+
+	setETag(context, webhook.Version)
+	context.JSON(http.StatusOK, gin.H{"message": "Webhook updated successfully!", "Webhook": webhook})
+}
+
+// DeleteWebhook godoc
+// @Summary Delete webhook
+// @Description Deletes a webhook with its delivery log (own webhook or admin)
+// @Tags webhooks
+// @Security BearerAuth
+// @Param id path int true "Webhook ID"
+// @Param If-Match header string false "ETag of the version the change is based on"
+// @Success 200 {object} map[string]string
+// @Failure 400,403,404,412,428,500 {object} apierror.Error
+// @Router /webhooks/{id} [delete]
+func DeleteWebhook(context *gin.Context) {
+	webhook, ok := webhookFromParam(context)
+	if !ok || !checkIfMatch(context, webhook.Version) {
+		return
+	}
+
+	err := webhook.DeleteWebhookByID(context.Request.Context())
+	if err != nil {
+		apierror.AbortError(context, "Could not delete the webhook.", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"message": "Webhook deleted successfully with ID: " + strconv.FormatInt(webhook.ID, 10)})
+}
+
+// PingWebhook godoc
+// @Summary Ping webhook
+// @Description Queues a webhook.ping delivery to test the receiver and the signature check, whatever the event types of the webhook
+// @Tags webhooks
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Webhook ID"
+// @Param Idempotency-Key header string false "Key to retry the request safely, retries replay the first response"
+// @Success 202 {object} map[string]string
+// @Failure 400,403,404,500 {object} apierror.Error
+// @Router /webhooks/{id}/ping [post]
+func PingWebhook(context *gin.Context) {
+	webhook, ok := webhookFromParam(context)
+	if !ok {
+		return
+	}
+
+	if err := services.PingWebhook(context.Request.Context(), webhook); err != nil {
+		apierror.AbortError(context, "Could not queue the ping.", err)
+		return
+	}
+
+	context.JSON(http.StatusAccepted, gin.H{"message": "Ping queued, see the deliveries of the webhook for the result"})
+}
+
+// ListWebhookDeliveries godoc
+// @Summary Webhook delivery log
+// @Description Returns the deliveries of a webhook newest first with the result of their last attempt (own webhook or admin). status=dead lists the dead letters, which failed every attempt.
+// @Tags webhooks
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Webhook ID"
+// @Param limit query int false "Maximum number of items (default 100, max 1000)"
+// @Param page_token query string false "NextPageToken of the previous page"
+// @Param sort query string false "id, created_at, with - for descending (default -id)"
+// @Param status query string false "pending, succeeded or dead"
+// @Param event_type query string false "Event type, e.g., vm.state_changed"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400,403,404,500 {object} apierror.Error
+// @Router /webhooks/{id}/deliveries [get]
+func ListWebhookDeliveries(context *gin.Context) {
+	webhook, ok := webhookFromParam(context)
+	if !ok {
+		return
+	}
+
+	options, ok := listOptions(context)
+	if !ok {
+		return
+	}
+
+	deliveries, nextPageToken, err := models.ListWebhookDeliveries(context.Request.Context(), webhook.ID, options)
+	respondList(context, "Fetched deliveries", deliveries, nextPageToken, err)
+}
+
+// RedeliverWebhook godoc
+// @Summary Redeliver a webhook delivery
+// @Description Queues a delivery again with fresh attempts, e.g., a dead letter after the receiver was fixed (own webhook or admin)
+// @Tags webhooks
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Webhook ID"
+// @Param deliveryId path int true "Delivery ID"
+// @Param Idempotency-Key header string false "Key to retry the request safely, retries replay the first response"
+// @Success 202 {object} map[string]interface{}
+// @Failure 400,403,404,409,500 {object} apierror.Error
+// @Router /webhooks/{id}/deliveries/{deliveryId}/redeliver [post]
+func RedeliverWebhook(context *gin.Context) {
+	webhook, ok := webhookFromParam(context)
+	if !ok {
+		return
+	}
+
+	deliveryId, err := strconv.ParseInt(context.Param("deliveryId"), 10, 64)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse delivery id.", err)
+		return
+	}
+
+	delivery, err := models.GetWebhookDeliveryByID(context.Request.Context(), webhook.ID, deliveryId)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the delivery.", err)
+		return
+	}
+	if delivery == nil {
+		apierror.Abort(context, http.StatusNotFound, apierror.CodeNotFound, "Delivery not found", nil)
+		return
+	}
+	if delivery.Status == models.DeliveryStatusPending {
+		apierror.Abort(context, http.StatusConflict, apierror.CodeConflict, "The delivery is still pending", nil)
+		return
+	}
+
+	if err := services.RedeliverWebhookDelivery(context.Request.Context(), delivery); err != nil {
+		apierror.AbortError(context, "Could not queue the delivery.", err)
+		return
+	}
+
+	context.JSON(http.StatusAccepted, gin.H{"message": "Delivery queued", "Delivery": delivery})
+}
+
+// bindWebhook parses and validates a WebhookRequest into the webhook
+// It writes the error response and returns false otherwise
+func bindWebhook(context *gin.Context, webhook *models.Webhook) bool {
+	var request WebhookRequest
+	if err := context.ShouldBindJSON(&request); err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse request data, url and event_types are required.", err)
+		return false
+	}
+
+	target, err := url.Parse(request.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "The url must be an absolute http or https URL.", nil)
+		return false
+	}
+
+	// Receivers must be public, the server must not be used to reach its own network (e.g., the metadata service)
+	if err := utils.CheckWebhookHost(context.Request.Context(), target.Hostname()); err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "The url must point to a public address.", err)
+		return false
+	}
+
+	if len(request.EventTypes) == 0 {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "At least one event type is required.", nil)
+		return false
+	}
+	for _, eventType := range request.EventTypes {
+		if !models.ValidWebhookEventType(eventType) {
+			apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Unknown event type: "+eventType, apierror.Details{
+				"event_types": strings.Join(models.EventTypes, ", "),
+			})
+			return false
+		}
+	}
+
+	webhook.URL = request.URL
+	webhook.EventTypes = request.EventTypes
+	webhook.Description = request.Description
+	webhook.Active = request.Active == nil || *request.Active
+	return true
+}
+
+// webhookFromParam loads the webhook of the ":id" path parameter for its owner or an admin
+// It writes the error response and returns false otherwise
+func webhookFromParam(context *gin.Context) (*models.Webhook, bool) {
+	webhookId, err := strconv.ParseInt(context.Param("id"), 10, 64)
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not parse webhook id.", err)
+		return nil, false
+	}
+
+	webhook, err := models.GetWebhookByID(context.Request.Context(), webhookId)
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the webhook.", err)
+		return nil, false
+	}
+	if webhook == nil {
+		apierror.Abort(context, http.StatusNotFound, apierror.CodeNotFound, "Webhook not found", nil)
+		return nil, false
+	}
+
+	if !requireSelfOrAdmin(context, webhook.AccountID) {
+		return nil, false
+	}
+
+	return webhook, true
+}
@@ -0,0 +1,81 @@
+// Structured logging with request IDs
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/odeeka/go-minicloud-rest-api/tracing"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+)
+
+// Redacted replaces secrets (e.g., values of VM environment variables) in logs
+const Redacted = "[REDACTED]"
+
+type requestIDKey struct{}
+
+// Init sets the default slog logger.
+// MINICLOUD_LOG_LEVEL is debug, info (default), warn or error,
+// MINICLOUD_LOG_FORMAT is json (default) or text.
+func Init() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(utils.GetEnv("MINICLOUD_LOG_LEVEL", "info"))); err != nil {
+		level = slog.LevelInfo
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if strings.EqualFold(utils.GetEnv("MINICLOUD_LOG_FORMAT", "json"), "text") {
+		handler = slog.NewTextHandler(os.Stdout, options)
+	} else {
+		handler = slog.NewJSONHandler(os.Stdout, options)
+	}
+
+	slog.SetDefault(slog.New(&contextHandler{handler}))
+}
+
+// WithRequestID returns a context whose log records carry the request ID
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestID returns the request ID of the context or an empty string
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// RedactEnv returns the names of environment variables with their values redacted
+func RedactEnv(env map[string]string) map[string]string {
+	redacted := make(map[string]string, len(env))
+	for key := range env {
+		redacted[key] = Redacted
+	}
+	return redacted
+}
+
+// contextHandler adds the request ID and trace ID of the context to every record logged with it
+type contextHandler struct {
+	slog.Handler
+}
+
+func (handler *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestID := RequestID(ctx); requestID != "" {
+		record.AddAttrs(slog.String("request_id", requestID))
+	}
+	if traceID := tracing.TraceID(ctx); traceID != "" {
+		record.AddAttrs(slog.String("trace_id", traceID))
+	}
+	return handler.Handler.Handle(ctx, record)
+}
+
+func (handler *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{handler.Handler.WithAttrs(attrs)}
+}
+
+func (handler *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{handler.Handler.WithGroup(name)}
+}
@@ -10,11 +10,23 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"log/slog"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/odeeka/go-minicloud-rest-api/db"
+	"github.com/odeeka/go-minicloud-rest-api/handlers"
+	"github.com/odeeka/go-minicloud-rest-api/logging"
+	"github.com/odeeka/go-minicloud-rest-api/metrics"
+	"github.com/odeeka/go-minicloud-rest-api/middlewares"
+	"github.com/odeeka/go-minicloud-rest-api/models"
 	"github.com/odeeka/go-minicloud-rest-api/routes"
+	"github.com/odeeka/go-minicloud-rest-api/services"
+	"github.com/odeeka/go-minicloud-rest-api/tracing"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 
 	_ "github.com/odeeka/go-minicloud-rest-api/docs" // Generated docs by Swagger init
 	swaggerFiles "github.com/swaggo/files"           // Embedded Swagger UI files
@@ -22,19 +34,91 @@ import (
 )
 
 func main() {
-	fmt.Println("MiniCloud Rest API...")
+	logging.Init()
+	slog.Info("MiniCloud Rest API...")
+
+	shutdownTracing, err := tracing.Init(context.Background())
+	if err != nil {
+		panic("Could not initialize tracing: " + err.Error())
+	}
+	defer shutdownTracing(context.Background())
 
 	db.InitDB()
 
-	server := gin.Default()
+	// The admin is configured, accounts registered through the API are regular users
+	err = models.BootstrapAdmin(context.Background(), utils.GetEnv("MINICLOUD_ADMIN_USERNAME", ""), utils.GetEnv("MINICLOUD_ADMIN_PASSWORD", ""))
+	if err != nil {
+		panic("Could not set up the admin account: " + err.Error())
+	}
+
+	// Keep the VM status and the metering in sync with the containers
+	services.StartReconciler()
+
+	// Capture the output of the VMs into the log store and apply its retention
+	if err := services.ResumeLogCaptures(context.Background()); err != nil {
+		slog.Error("Could not resume the log capture", "error", err)
+	}
+	services.StartLogJanitor()
+
+	// Sample the resource usage of the VMs
+	services.StartMetricsCollector()
+
+	// Export the number of VMs and volumes and the reconciler lag
+	services.RegisterResourceMetrics()
+
+	// Remove the events which are too old to resume a stream and send the webhooks
+	services.StartEventJanitor()
+	services.StartWebhookDispatcher()
+
+	// Remove the expired Idempotency-Keys of retried POST requests
+	services.StartIdempotencyJanitor()
+
+	// Remove the blob uploads to the registry which were abandoned
+	services.StartUploadJanitor()
+
+	// Export the audit trail as a hash chained JSONL file (if configured)
+	if err := services.StartAuditExport(context.Background()); err != nil {
+		slog.Error("Could not start the audit export", "error", err)
+	}
+
+	// Requests are logged by RequestLogger as structured records instead of the Gin logger
+	// Panics and unknown routes are answered with the error envelope of the API by Recovery, NoRoute and NoMethod
+	server := gin.New()
+	server.HandleMethodNotAllowed = true
+	server.Use(otelgin.Middleware(tracing.ServiceName, otelgin.WithGinFilter(traceRequest)),
+		middlewares.RequestID, middlewares.TraceID, middlewares.RequestLogger, middlewares.Metrics, middlewares.Audit, middlewares.Recovery)
+	server.NoRoute(middlewares.NoRoute)
+	server.NoMethod(middlewares.NoMethod)
+
+	// Prometheus endpoint
+	server.GET("/metrics", gin.WrapH(promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{})))
 
 	// Swagger endpoint
 	server.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
+	// Constraints of the request bodies (e.g., Docker names and env keys)
+	handlers.RegisterValidators()
+
 	routes.RegisterAccountRoutes(server)
 	routes.RegisterVmsRoutes(server)
 	routes.RegisterStoragesRoutes(server)
+	routes.RegisterImagesRoutes(server)
+	routes.RegisterFlavorsRoutes(server)
+	routes.RegisterKeyPairsRoutes(server)
+	routes.RegisterBillingRoutes(server)
+	routes.RegisterRegistryRoutes(server)
+	routes.RegisterAuditRoutes(server)
+	routes.RegisterEventRoutes(server)
+	routes.RegisterWebhookRoutes(server)
+	routes.RegisterLabelRoutes(server)
+	routes.RegisterProjectRoutes(server)
 	routes.RegisterPublicRoutes(server)
 
 	server.Run(":8080")
 }
+
+// traceRequest leaves the scrapes of /metrics and the Swagger UI out of the traces
+func traceRequest(context *gin.Context) bool {
+	path := context.Request.URL.Path
+	return path != "/metrics" && !strings.HasPrefix(path, "/swagger/")
+}
@@ -0,0 +1,55 @@
+// Prometheus metrics of the API server itself
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Registry holds every metric exported on /metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	// HTTPRequests counts the requests by route template (e.g., "/vms/:id"), not by raw path
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "minicloud_http_requests_total",
+		Help: "HTTP requests by method, route template and status code.",
+	}, []string{"method", "route", "status"})
+
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "minicloud_http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route template.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	// DockerCallDuration times the docker CLI calls of the compute and storage driver
+	DockerCallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "minicloud_docker_call_duration_seconds",
+		Help:    "Duration of docker CLI calls by command.",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300},
+	}, []string{"command"})
+
+	DockerCallFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "minicloud_docker_call_failures_total",
+		Help: "Failed docker CLI calls by command.",
+	}, []string{"command"})
+
+	// DBQueryDuration times the SQL statements by operation and table
+	DBQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "minicloud_db_query_duration_seconds",
+		Help:    "Duration of database queries by operation and table.",
+		Buckets: []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1},
+	}, []string{"operation", "table"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPRequestDuration,
+		DockerCallDuration,
+		DockerCallFailures,
+		DBQueryDuration,
+	)
+}
@@ -0,0 +1,27 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+)
+
+// RequireAdmin only lets authenticated accounts with the admin role pass
+// It must be registered after Authenticate, which sets the "user_id"
+func RequireAdmin(context *gin.Context) {
+	account, err := models.GetAccountByID(context.Request.Context(), context.GetInt64("user_id"))
+
+	if err != nil {
+		apierror.Abort(context, http.StatusUnauthorized, apierror.CodeUnauthorized, "Not authorized - Unknown account", nil)
+		return
+	}
+
+	if !account.IsAdmin() {
+		apierror.Abort(context, http.StatusForbidden, apierror.CodeForbidden, "Forbidden - Admin role required", nil)
+		return
+	}
+
+	context.Next()
+}
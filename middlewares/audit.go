@@ -0,0 +1,117 @@
+package middlewares
+
+import (
+	ctx "context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/services"
+)
+
+// digestReader hashes the request body while the handler reads it, so uploads are not buffered
+type digestReader struct {
+	io.ReadCloser
+	hash hash.Hash
+	size int64
+}
+
+func (reader *digestReader) Read(data []byte) (int, error) {
+	n, err := reader.ReadCloser.Read(data)
+	reader.hash.Write(data[:n])
+	reader.size += int64(n)
+	return n, err
+}
+
+// Audit records every mutating request (all methods but GET, HEAD and OPTIONS) in the audit trail,
+// with the account, how it authenticated, the digest of the body and the result.
+// Handlers name the action and resource of a request with the "audit_*" keys, which also audits
+// reads like a console session. It must be registered after RequestID.
+func Audit(context *gin.Context) {
+	var body *digestReader
+	if context.Request.Body != nil && context.Request.Body != http.NoBody {
+		body = &digestReader{ReadCloser: context.Request.Body, hash: sha256.New()}
+		context.Request.Body = body
+	}
+
+	context.Next()
+
+	method := context.Request.Method
+	action := context.GetString("audit_action")
+	if action == "" && (method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions) {
+		return
+	}
+
+	route := context.FullPath()
+	if route == "" {
+		route = context.Request.URL.Path
+	}
+	if action == "" {
+		action = method + " " + route
+	}
+
+	resourceType, resourceID := auditResource(context, route)
+
+	event := models.AuditEvent{
+		AccountID:    context.GetInt64("user_id"),
+		AuthMethod:   context.GetString("auth_method"),
+		Action:       action,
+		ResourceType: resourceType,
+		ResourceID:   resourceID,
+		Detail:       context.GetString("audit_detail"),
+		StatusCode:   context.Writer.Status(),
+		Result:       models.AuditResultSuccess,
+		SourceIP:     context.ClientIP(),
+		RequestID:    context.GetString("request_id"),
+	}
+	if event.StatusCode >= 400 {
+		event.Result = models.AuditResultFailure
+	}
+	if body != nil && body.size > 0 {
+		event.BodyDigest = "sha256:" + hex.EncodeToString(body.hash.Sum(nil))
+	}
+
+	// The event is recorded even if the client went away before the response
+	if err := services.RecordAuditEvent(ctx.WithoutCancel(context.Request.Context()), &event); err != nil {
+		slog.ErrorContext(context.Request.Context(), "Could not record audit event", "action", action, "error", err)
+	}
+}
+
+// auditResource returns the resource a request acts on, named by the handler or derived from the route:
+// the collection before the ":id" parameter (e.g., "/vms/:id/exec" is vm and the ID)
+// or the last collection for routes without ID (e.g., "POST /accounts/api-keys" is api-key).
+// Handlers of create requests set "audit_resource_id" to the new resource.
+func auditResource(context *gin.Context, route string) (string, int64) {
+	resourceType := context.GetString("audit_resource_type")
+	resourceID := context.GetInt64("audit_resource_id")
+	if resourceType != "" {
+		return resourceType, resourceID
+	}
+
+	collection := ""
+	segments := strings.Split(strings.Trim(route, "/"), "/")
+	for i, segment := range segments {
+		if segment == ":id" && i > 0 {
+			collection = segments[i-1]
+			if id, err := strconv.ParseInt(context.Param("id"), 10, 64); err == nil && resourceID == 0 {
+				resourceID = id
+			}
+			break
+		}
+		if !strings.HasPrefix(segment, ":") && !strings.HasPrefix(segment, "*") {
+			collection = segment
+		}
+	}
+
+	if collection == "v2" {
+		return "registry", resourceID
+	}
+	return strings.TrimSuffix(collection, "s"), resourceID
+}
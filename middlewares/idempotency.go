@@ -0,0 +1,161 @@
+package middlewares
+
+import (
+	"bytes"
+	ctx "context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+)
+
+const (
+	// IdempotencyKeyHeader makes a POST request safe to retry, the response of the first request is replayed
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	// IdempotentReplayedHeader marks a response replayed for a retried request
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	// maxIdempotentBody is the largest body of a request with an Idempotency-Key, it is read to fingerprint the request
+	maxIdempotentBody = 1 << 20
+)
+
+// validIdempotencyKey accepts printable ASCII keys, e.g., UUIDs generated by the client
+var validIdempotencyKey = regexp.MustCompile(`^[\x21-\x7E]{1,255}$`)
+
+// replayedHeaders are the response headers stored with the body of the response
+var replayedHeaders = []string{"Content-Type", "ETag", "Location"}
+
+// responseRecorder keeps a copy of the response body while it is written to the client
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (recorder *responseRecorder) Write(data []byte) (int, error) {
+	recorder.body.Write(data)
+	return recorder.ResponseWriter.Write(data)
+}
+
+func (recorder *responseRecorder) WriteString(data string) (int, error) {
+	recorder.body.WriteString(data)
+	return recorder.ResponseWriter.WriteString(data)
+}
+
+// Idempotency replays the response of POST requests retried with the same Idempotency-Key header.
+// Keys are scoped to the account and kept for MINICLOUD_IDEMPOTENCY_TTL (default 24h) with the fingerprint
+// of the request (method, path, project and body). A key reused for another request and a key whose first
+// request is still handled are 409. Responses with a 5xx status are not stored, so the key can be retried.
+// It must be registered after Authenticate (and SelectProject), on public routes keys are anonymous:
+// they are scoped to account 0 and the fingerprint, since anonymous clients can't be told apart.
+func Idempotency(context *gin.Context) {
+	key := context.GetHeader(IdempotencyKeyHeader)
+	if context.Request.Method != http.MethodPost || key == "" {
+		context.Next()
+		return
+	}
+
+	if !validIdempotencyKey.MatchString(key) {
+		apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest,
+			"The Idempotency-Key must be 1 to 255 printable ASCII characters.", nil)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(context.Request.Body, maxIdempotentBody+1))
+	if err != nil {
+		apierror.AbortErr(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "Could not read request data.", err)
+		return
+	}
+	if len(body) > maxIdempotentBody {
+		apierror.Abort(context, http.StatusRequestEntityTooLarge, apierror.CodePayloadTooLarge,
+			fmt.Sprintf("Requests with an Idempotency-Key must not be larger than %d bytes.", maxIdempotentBody), nil)
+		return
+	}
+	context.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	accountID := context.GetInt64("user_id")
+	fingerprint := requestFingerprint(context, body)
+	storedKey := key
+	if accountID == 0 {
+		storedKey = key + ":" + fingerprint
+	}
+	ttl := utils.GetEnvDuration("MINICLOUD_IDEMPOTENCY_TTL", 24*time.Hour)
+
+	stored, reserved, err := models.ReserveIdempotencyKey(context.Request.Context(), accountID, storedKey, fingerprint, ttl)
+	if err != nil {
+		apierror.AbortError(context, "Could not check the Idempotency-Key.", err)
+		return
+	}
+
+	if !reserved {
+		switch {
+		case stored.Fingerprint != fingerprint:
+			apierror.Abort(context, http.StatusConflict, apierror.CodeConflict,
+				"The Idempotency-Key was already used for another request.", apierror.Details{"idempotency_key": key})
+		case !stored.Completed():
+			apierror.Abort(context, http.StatusConflict, apierror.CodeConflict,
+				"The request with this Idempotency-Key is still in progress.", apierror.Details{"idempotency_key": key})
+		default:
+			for name, value := range stored.Headers {
+				context.Header(name, value)
+			}
+			context.Header(IdempotentReplayedHeader, "true")
+			context.Set("audit_detail", "replayed idempotency_key="+key)
+			context.Status(stored.StatusCode)
+			context.Writer.Write(stored.Body)
+			context.Abort()
+		}
+		return
+	}
+
+	// The response is stored even if the client went away, so its retry gets the result
+	detached := ctx.WithoutCancel(context.Request.Context())
+
+	// Failed requests (5xx and panics answered by Recovery) release the key
+	completed := false
+	defer func() {
+		if !completed {
+			if err := models.DeleteIdempotencyKey(detached, accountID, storedKey); err != nil {
+				slog.ErrorContext(detached, "Could not release the Idempotency-Key", "error", err)
+			}
+		}
+	}()
+
+	recorder := &responseRecorder{ResponseWriter: context.Writer}
+	context.Writer = recorder
+
+	context.Next()
+
+	status := recorder.Status()
+	if status < http.StatusInternalServerError {
+		headers := make(map[string]string)
+		for _, name := range replayedHeaders {
+			if value := recorder.Header().Get(name); value != "" {
+				headers[name] = value
+			}
+		}
+		err := models.CompleteIdempotencyKey(detached, accountID, storedKey, status, headers, recorder.body.Bytes())
+		if err != nil {
+			slog.ErrorContext(detached, "Could not store the response of the Idempotency-Key", "error", err)
+			return
+		}
+		completed = true
+	}
+}
+
+// requestFingerprint identifies the request of an Idempotency-Key by its method, path, project and body
+func requestFingerprint(context *gin.Context, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n%s\n", context.Request.Method, context.Request.URL.Path, context.GetHeader(ProjectHeader))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
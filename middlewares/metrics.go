@@ -0,0 +1,26 @@
+package middlewares
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/metrics"
+)
+
+// Metrics records count and latency of every request, labeled by the route template
+func Metrics(context *gin.Context) {
+	started := time.Now()
+
+	context.Next()
+
+	// Unknown paths share one label, so scanners can't create a label value per path
+	route := context.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+
+	method := context.Request.Method
+	metrics.HTTPRequests.WithLabelValues(method, route, strconv.Itoa(context.Writer.Status())).Inc()
+	metrics.HTTPRequestDuration.WithLabelValues(method, route).Observe(time.Since(started).Seconds())
+}
@@ -4,6 +4,8 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/models"
 	"github.com/odeeka/go-minicloud-rest-api/utils"
 )
 
@@ -11,18 +13,34 @@ func Authenticate(context *gin.Context) {
 	token := context.Request.Header.Get("Authorization")
 
 	if token == "" {
-		context.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Not authorized - Missing token"})
+		apierror.Abort(context, http.StatusUnauthorized, apierror.CodeUnauthorized, "Not authorized - Missing token", nil)
+		return
+	}
+
+	// Long-lived API keys are accepted in place of a JWT
+	if utils.IsAPIKey(token) {
+		account, err := models.GetAccountByAPIKey(context.Request.Context(), token)
+
+		if err != nil {
+			apierror.Abort(context, http.StatusUnauthorized, apierror.CodeUnauthorized, "Not authorized - Unknown API key", nil)
+			return
+		}
+
+		context.Set("user_id", account.ID)
+		context.Set("auth_method", "api_key")
+		context.Next()
 		return
 	}
 
 	user_id, err := utils.VerifyToken(token)
 
 	if err != nil {
-		context.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Not authorized - Wrong or malformed token"})
+		apierror.Abort(context, http.StatusUnauthorized, apierror.CodeUnauthorized, "Not authorized - Wrong or malformed token", nil)
 		return
 	}
 
 	context.Set("user_id", user_id) // Add some data to context
+	context.Set("auth_method", "jwt")
 
 	context.Next()
 }
@@ -0,0 +1,97 @@
+package middlewares
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+)
+
+// ProjectHeader selects the project of a request, unless the path starts with /projects/:project
+const ProjectHeader = "X-MiniCloud-Project"
+
+// SelectProject resolves the project of the ":project" path parameter or the X-MiniCloud-Project header
+// (ID or name) and checks the membership of the account: reading needs the viewer role, everything else
+// the member role. Admins have the owner role in every project.
+// It sets "project_id" and "project_role", requests without a project keep "project_id" 0.
+// It must be registered after Authenticate, which sets the "user_id"
+func SelectProject(context *gin.Context) {
+	selector := context.Param("project")
+	if header := context.GetHeader(ProjectHeader); header != "" {
+		if selector != "" && selector != header {
+			apierror.Abort(context, http.StatusBadRequest, apierror.CodeInvalidRequest, "The "+ProjectHeader+" header doesn't match the project of the path", nil)
+			return
+		}
+		selector = header
+	}
+
+	if selector == "" {
+		context.Set("project_id", int64(0))
+		context.Next()
+		return
+	}
+
+	var project *models.Project
+	var err error
+	if id, parseErr := strconv.ParseInt(selector, 10, 64); parseErr == nil {
+		project, err = models.GetProjectByID(context.Request.Context(), id)
+	} else {
+		project, err = models.GetProjectByName(context.Request.Context(), selector)
+	}
+	if err != nil {
+		apierror.AbortError(context, "Could not fetch the project.", err)
+		return
+	}
+	if project == nil {
+		apierror.Abort(context, http.StatusNotFound, apierror.CodeNotFound, "Project not found: "+selector, nil)
+		return
+	}
+
+	accountID := context.GetInt64("user_id")
+	account, err := models.GetAccountByID(context.Request.Context(), accountID)
+	if err != nil {
+		apierror.Abort(context, http.StatusUnauthorized, apierror.CodeUnauthorized, "Not authorized - Unknown account", nil)
+		return
+	}
+
+	role := models.ProjectRoleOwner
+	if !account.IsAdmin() {
+		member, err := models.GetProjectMember(context.Request.Context(), project.ID, accountID)
+		if err != nil {
+			apierror.AbortError(context, "Could not fetch the project membership.", err)
+			return
+		}
+		if member == nil {
+			apierror.Abort(context, http.StatusForbidden, apierror.CodeForbidden, "Forbidden - Not a member of the project", nil)
+			return
+		}
+		role = member.Role
+	}
+
+	required := models.ProjectRoleMember
+	if context.Request.Method == http.MethodGet || context.Request.Method == http.MethodHead {
+		required = models.ProjectRoleViewer
+	}
+	if !models.ProjectRoleAllows(role, required) {
+		apierror.Abort(context, http.StatusForbidden, apierror.CodeForbidden, "Forbidden - The "+required+" role in the project is required", nil)
+		return
+	}
+
+	context.Set("project_id", project.ID)
+	context.Set("project_role", role)
+	context.Next()
+}
+
+// RequireProjectRole only lets members with the role (or a higher one) in the selected project pass,
+// requests without a project are not affected. It must be registered after SelectProject.
+func RequireProjectRole(role string) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if context.GetInt64("project_id") != 0 && !models.ProjectRoleAllows(context.GetString("project_role"), role) {
+			apierror.Abort(context, http.StatusForbidden, apierror.CodeForbidden, "Forbidden - The "+role+" role in the project is required", nil)
+			return
+		}
+		context.Next()
+	}
+}
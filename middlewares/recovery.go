@@ -0,0 +1,46 @@
+package middlewares
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/apierror"
+)
+
+// Recovery turns a panic of a handler into a 500 response with the error envelope and logs the stack,
+// the panic value is not sent to the client. It must be registered after RequestID.
+func Recovery(context *gin.Context) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		// A broken connection can't get a response anymore, but aborting stops the remaining handlers
+		if recovered == http.ErrAbortHandler {
+			context.Abort()
+			return
+		}
+
+		slog.ErrorContext(context.Request.Context(), "Recovered from panic", "panic", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+		if context.Writer.Written() {
+			context.Abort()
+			return
+		}
+		apierror.Abort(context, http.StatusInternalServerError, apierror.CodeInternal, "Internal server error", nil)
+	}()
+
+	context.Next()
+}
+
+// NoRoute answers requests for unknown routes with the error envelope
+func NoRoute(context *gin.Context) {
+	apierror.Abort(context, http.StatusNotFound, apierror.CodeNotFound, "Route not found: "+context.Request.Method+" "+context.Request.URL.Path, nil)
+}
+
+// NoMethod answers requests with a method the route doesn't support with the error envelope
+func NoMethod(context *gin.Context) {
+	apierror.Abort(context, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed: "+context.Request.Method+" "+context.Request.URL.Path, nil)
+}
@@ -0,0 +1,60 @@
+package middlewares
+
+import (
+	"log/slog"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/odeeka/go-minicloud-rest-api/logging"
+)
+
+// RequestIDHeader carries the request ID from the client (optional) and back in the response
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID accepts IDs of clients and proxies which can't inject anything into the logs
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestID assigns every request an ID, taken from X-Request-ID or generated.
+// The ID is returned in the response header and added to the logs of handlers and services,
+// which log with the request context.
+func RequestID(context *gin.Context) {
+	requestID := context.GetHeader(RequestIDHeader)
+	if !validRequestID.MatchString(requestID) {
+		requestID = uuid.New().String()
+	}
+
+	context.Set("request_id", requestID)
+	context.Request = context.Request.WithContext(logging.WithRequestID(context.Request.Context(), requestID))
+	context.Header(RequestIDHeader, requestID)
+
+	context.Next()
+}
+
+// RequestLogger logs every request after it was handled, it must be registered after RequestID
+func RequestLogger(context *gin.Context) {
+	started := time.Now()
+
+	context.Next()
+
+	level := slog.LevelInfo
+	if context.Writer.Status() >= 500 {
+		level = slog.LevelError
+	}
+
+	// The raw query is left out, it can contain secrets (e.g., registry tokens)
+	attrs := []any{
+		"method", context.Request.Method,
+		"path", context.Request.URL.Path,
+		"route", context.FullPath(),
+		"status", context.Writer.Status(),
+		"duration_ms", time.Since(started).Milliseconds(),
+		"client_ip", context.ClientIP(),
+	}
+	if len(context.Errors) > 0 {
+		attrs = append(attrs, "errors", context.Errors.String())
+	}
+
+	slog.Log(context.Request.Context(), level, "request", attrs...)
+}
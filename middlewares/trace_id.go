@@ -0,0 +1,57 @@
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/tracing"
+)
+
+// errorBodyWriter holds back JSON bodies of error responses, so the trace ID can be added
+type errorBodyWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (writer *errorBodyWriter) holdBack() bool {
+	return writer.Status() >= 400 && strings.HasPrefix(writer.Header().Get("Content-Type"), "application/json")
+}
+
+func (writer *errorBodyWriter) Write(data []byte) (int, error) {
+	if writer.holdBack() {
+		return writer.body.Write(data)
+	}
+	return writer.ResponseWriter.Write(data)
+}
+
+func (writer *errorBodyWriter) WriteString(data string) (int, error) {
+	if writer.holdBack() {
+		return writer.body.WriteString(data)
+	}
+	return writer.ResponseWriter.WriteString(data)
+}
+
+// TraceID adds the "trace_id" of the request to JSON error responses (status 4xx and 5xx),
+// it must be registered after the tracing middleware
+func TraceID(context *gin.Context) {
+	writer := &errorBodyWriter{ResponseWriter: context.Writer}
+	context.Writer = writer
+
+	context.Next()
+
+	if writer.body.Len() == 0 {
+		return
+	}
+
+	body := writer.body.Bytes()
+	var response map[string]any
+	if traceID := tracing.TraceID(context.Request.Context()); traceID != "" && json.Unmarshal(body, &response) == nil {
+		response["trace_id"] = traceID
+		if withTraceID, err := json.Marshal(response); err == nil {
+			body = withTraceID
+		}
+	}
+	writer.ResponseWriter.Write(body)
+}
@@ -1,7 +1,9 @@
 package models
 
 import (
+	"context"
 	"errors"
+	"fmt"
 
 	"github.com/odeeka/go-minicloud-rest-api/db"
 	"github.com/odeeka/go-minicloud-rest-api/utils"
@@ -9,39 +11,73 @@ import (
 
 // Account represents a user account in the system
 type Account struct {
-	ID       int64  `json:"id"`       // Unique identifier
-	Username string `json:"username"` // Username for login
-	Password string `json:"password"` // Password (stored hashed, omit in response)
+	ID       int64  `json:"id"`                 // Unique identifier
+	Username string `json:"username"`           // Username for login
+	Password string `json:"password,omitempty"` // Password (stored hashed, cleared in responses)
+	Role     string `json:"role"`               // Role of the account ("admin" or "user"), assigned by the server
 }
 
-func GetAllAccount() ([]Account, error) {
-	query := "SELECT * FROM accounts"
-	rows, err := db.DB.Query(query)
+// Account roles
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+const accountColumns = "id, username, password, role"
+
+// scanAccount reads one account row selected with accountColumns
+func scanAccount(row rowScanner) (*Account, error) {
+	var acc Account
+	err := row.Scan(&acc.ID, &acc.Username, &acc.Password, &acc.Role)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var accounts []Account
+	return &acc, nil
+}
 
-	for rows.Next() {
-		var acc Account
-		err := rows.Scan(&acc.ID, &acc.Username, &acc.Password)
+// ListAccounts returns a page of accounts, the filters are role and name_prefix (of the username)
+func ListAccounts(ctx context.Context, options ListOptions) ([]Account, string, error) {
+	spec := listSpec{
+		table:       "accounts",
+		columns:     accountColumns,
+		defaultSort: "id",
+		sorts: map[string]listField{
+			"id":       {"id", fieldInt},
+			"username": {"username", fieldText},
+		},
+		filters: map[string]listFilter{
+			"role":        equalsFilter("role"),
+			"name_prefix": prefixFilter("username"),
+		},
+	}
+	return listPage(ctx, spec, options, scanAccount)
+}
 
-		if err != nil {
-			return nil, err
-		}
+// GetAccountByID returns a single account by its ID
+func GetAccountByID(ctx context.Context, id int64) (*Account, error) {
+	query := "SELECT id, username, password, role FROM accounts WHERE id = ?"
+	row := db.DB.QueryRowContext(ctx, query, id)
 
-		accounts = append(accounts, acc)
+	var acc Account
+	err := row.Scan(&acc.ID, &acc.Username, &acc.Password, &acc.Role)
+	if err != nil {
+		return nil, err
 	}
 
-	return accounts, nil
+	return &acc, nil
+}
+
+// IsAdmin reports whether the account has the admin role
+func (acc *Account) IsAdmin() bool {
+	return acc.Role == RoleAdmin
 }
 
-// Save the new account
-func (acc Account) Save() error {
-	query := "INSERT INTO accounts(username, password) VALUES (?, ?)"
-	stmt, err := db.DB.Prepare(query)
+// Save the new account as a regular user, the admin is configured by BootstrapAdmin
+func (acc Account) Save(ctx context.Context) error {
+	acc.Role = RoleUser
+
+	query := "INSERT INTO accounts(username, password, role) VALUES (?, ?, ?)"
+	stmt, err := db.DB.PrepareContext(ctx, query)
 
 	if err != nil {
 		return err
@@ -55,7 +91,7 @@ func (acc Account) Save() error {
 		return err
 	}
 
-	result, err := stmt.Exec(acc.Username, hashedPassword)
+	result, err := stmt.ExecContext(ctx, acc.Username, hashedPassword, acc.Role)
 
 	if err != nil {
 		return err
@@ -67,24 +103,23 @@ func (acc Account) Save() error {
 	return err
 }
 
-// func GetAccountByUsername(username string) (*Account, error) {
-// 	query := `SELECT id, username, password_hash FROM accounts WHERE username = ?`
-// 	row := db.DB.QueryRow(query, username)
+// GetAccountByUsername returns a single account by its username
+func GetAccountByUsername(ctx context.Context, username string) (*Account, error) {
+	query := "SELECT id, username, password, role FROM accounts WHERE username = ?"
+	row := db.DB.QueryRowContext(ctx, query, username)
 
-// 	var account Account
-// 	err := row.Scan(&account.ID, &account.Username, &account.Password)
-// 	if err == sql.ErrNoRows {
-// 		return nil, nil
-// 	} else if err != nil {
-// 		return nil, err
-// 	}
+	var acc Account
+	err := row.Scan(&acc.ID, &acc.Username, &acc.Password, &acc.Role)
+	if err != nil {
+		return nil, err
+	}
 
-// 	return &account, nil
-// }
+	return &acc, nil
+}
 
-func (acc *Account) ValidateCredentials() error {
+func (acc *Account) ValidateCredentials(ctx context.Context) error {
 	query := "SELECT id, password FROM accounts WHERE username = ?"
-	row := db.DB.QueryRow(query, acc.Username)
+	row := db.DB.QueryRowContext(ctx, query, acc.Username)
 
 	var retrievedPassword string
 	err := row.Scan(&acc.ID, &retrievedPassword)
@@ -101,3 +136,77 @@ func (acc *Account) ValidateCredentials() error {
 
 	return nil
 }
+
+// DeleteAccount removes the account together with its key pairs and their labels, API keys, quota, permissions,
+// project memberships and webhooks with their deliveries
+// The caller has to make sure the account doesn't own VMs or storages anymore and is no project's last owner
+func (acc *Account) DeleteAccount(ctx context.Context) error {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		"DELETE FROM labels WHERE resource_type = '" + LabelResourceKeyPair + "' AND resource_id IN (SELECT id FROM key_pairs WHERE account_id = ?)",
+		"DELETE FROM key_pairs WHERE account_id = ?",
+		"DELETE FROM webhook_deliveries WHERE webhook_id IN (SELECT id FROM webhooks WHERE account_id = ?)",
+		"DELETE FROM webhooks WHERE account_id = ?",
+		"DELETE FROM api_keys WHERE account_id = ?",
+		"DELETE FROM quotas WHERE account_id = ?",
+		"DELETE FROM account_permissions WHERE account_id = ?",
+		"DELETE FROM project_members WHERE account_id = ?",
+		"DELETE FROM accounts WHERE id = ?",
+	} {
+		if _, err := tx.ExecContext(ctx, query, acc.ID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// CountAdmins returns the number of accounts with the admin role
+func CountAdmins(ctx context.Context) (int, error) {
+	var count int
+	err := db.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM accounts WHERE role = ?", RoleAdmin).Scan(&count)
+	return count, err
+}
+
+// BootstrapAdmin gives the account with the username the admin role and creates it with the password
+// if it doesn't exist yet, VMs and storages without an owner are assigned to it. Nothing is done without a username.
+func BootstrapAdmin(ctx context.Context, username, password string) error {
+	if username == "" {
+		return nil
+	}
+
+	result, err := db.DB.ExecContext(ctx, "UPDATE accounts SET role = ? WHERE username = ?", RoleAdmin, username)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if updated == 0 {
+		if password == "" {
+			return errors.New("the admin account " + username + " doesn't exist and has no password to be created with")
+		}
+		if err := (Account{Username: username, Password: password}).Save(ctx); err != nil {
+			return err
+		}
+		if _, err := db.DB.ExecContext(ctx, "UPDATE accounts SET role = ? WHERE username = ?", RoleAdmin, username); err != nil {
+			return err
+		}
+	}
+
+	// VMs and storages from before ownership existed belong to the admin
+	for _, table := range []string{"vms", "storages"} {
+		query := fmt.Sprintf("UPDATE %s SET account_id = (SELECT id FROM accounts WHERE username = ?) WHERE account_id = 0", table)
+		if _, err := db.DB.ExecContext(ctx, query, username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Structures and DB operations
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/db"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+)
+
+// APIKey is a long-lived credential of an account (e.g., for CI or the docker CLI).
+// @Description The plain key is only returned once, when the API key is created.
+type APIKey struct {
+	// The unique ID of the API key
+	ID int64 `json:"id"`
+
+	// The account the key authenticates as
+	AccountID int64 `json:"account_id"`
+
+	// Name to recognize the key (e.g., "ci-pipeline")
+	Name string `json:"name"`
+
+	// The first characters of the key, to recognize it without revealing it
+	Prefix string `json:"prefix"`
+
+	// The plain key, only set in the response of the creation
+	Key string `json:"key,omitempty"`
+
+	// Creation time of the key
+	CreatedAt time.Time `json:"created_at"`
+
+	// Last time the key was used to authenticate
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+const apiKeyColumns = "id, account_id, name, prefix, created_at, last_used_at"
+
+// scanAPIKey reads one API key row selected with apiKeyColumns
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	var key APIKey
+	err := row.Scan(&key.ID, &key.AccountID, &key.Name, &key.Prefix, &key.CreatedAt, &key.LastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// ListAPIKeys returns a page of the API keys of the account, the filter is name_prefix
+func ListAPIKeys(ctx context.Context, accountID int64, options ListOptions) ([]APIKey, string, error) {
+	spec := listSpec{
+		table:       "api_keys",
+		columns:     apiKeyColumns,
+		defaultSort: "id",
+		sorts: map[string]listField{
+			"id":         {"id", fieldInt},
+			"name":       {"name", fieldText},
+			"created_at": {"created_at", fieldTime},
+		},
+		filters: map[string]listFilter{
+			"name_prefix": prefixFilter("name"),
+		},
+		conditions: []string{"account_id = ?"},
+		args:       []any{accountID},
+	}
+	return listPage(ctx, spec, options, scanAPIKey)
+}
+
+// InsertAPIKey generates a new key for the account and stores its hash
+// The plain key is set on the struct, so it can be returned once
+func (key *APIKey) InsertAPIKey(ctx context.Context) error {
+	plainKey, err := utils.GenerateAPIKey()
+	if err != nil {
+		return err
+	}
+
+	key.Key = plainKey
+	key.Prefix = plainKey[:len(utils.APIKeyPrefix)+6]
+	key.CreatedAt = time.Now().UTC()
+	key.LastUsedAt = nil
+
+	query := `
+	INSERT INTO api_keys (account_id, name, prefix, key_hash, created_at) 
+	VALUES (?, ?, ?, ?, ?)`
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, key.AccountID, key.Name, key.Prefix, utils.HashAPIKey(plainKey), key.CreatedAt)
+
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	key.ID = id
+	return err
+}
+
+// DeleteAPIKey revokes an API key of the account
+// It returns false if the account has no key with this ID
+func DeleteAPIKey(ctx context.Context, accountID int64, id int64) (bool, error) {
+	query := "DELETE FROM api_keys WHERE id = ? AND account_id = ?"
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, id, accountID)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// GetAccountByAPIKey returns the account an API key belongs to and records its usage
+func GetAccountByAPIKey(ctx context.Context, plainKey string) (*Account, error) {
+	query := `
+	SELECT accounts.id, accounts.username, accounts.password, accounts.role, api_keys.id
+	FROM api_keys JOIN accounts ON accounts.id = api_keys.account_id
+	WHERE api_keys.key_hash = ?`
+	row := db.DB.QueryRowContext(ctx, query, utils.HashAPIKey(plainKey))
+
+	var acc Account
+	var keyID int64
+	err := row.Scan(&acc.ID, &acc.Username, &acc.Password, &acc.Role, &keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.DB.ExecContext(ctx, "UPDATE api_keys SET last_used_at = ? WHERE id = ?", time.Now().UTC(), keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &acc, nil
+}
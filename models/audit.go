@@ -0,0 +1,171 @@
+// Structures and DB operations
+package models
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/db"
+)
+
+// AuditEvent records who did what to which resource.
+// @Description An entry of the append-only audit trail.
+type AuditEvent struct {
+	ID int64 `json:"id"`
+
+	// AccountID is the authenticated account (0 for anonymous requests, e.g., a failed login)
+	AccountID int64 `json:"account_id"`
+
+	// AuthMethod is how the account authenticated: jwt, api_key or password
+	AuthMethod string `json:"auth_method"`
+
+	// Action is a domain action (e.g., vm.exec) or the method and route (e.g., "DELETE /vms/:id")
+	Action       string `json:"action"`
+	ResourceType string `json:"resource_type"`
+	ResourceID   int64  `json:"resource_id"`
+	Detail       string `json:"detail"`
+
+	// BodyDigest is the SHA-256 of the request body ("sha256:..."), empty without body
+	BodyDigest string `json:"body_digest"`
+
+	// StatusCode is the HTTP status of the response, Result is success or failure
+	StatusCode int    `json:"status_code"`
+	Result     string `json:"result"`
+
+	SourceIP  string    `json:"source_ip"`
+	RequestID string    `json:"request_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Results of audited requests
+const (
+	AuditResultSuccess = "success"
+	AuditResultFailure = "failure"
+)
+
+// AuditFilter selects the audit events after an ID, zero values match everything
+type AuditFilter struct {
+	AfterID int64
+	Limit   int
+
+	// Ascending returns the oldest events first (e.g., to export them in order)
+	Ascending bool
+}
+
+const auditEventColumns = "id, account_id, auth_method, action, resource_type, resource_id, detail, body_digest, status_code, result, source_ip, request_id, created_at"
+
+func scanAuditEvent(row rowScanner) (*AuditEvent, error) {
+	var event AuditEvent
+	err := row.Scan(&event.ID, &event.AccountID, &event.AuthMethod, &event.Action, &event.ResourceType, &event.ResourceID,
+		&event.Detail, &event.BodyDigest, &event.StatusCode, &event.Result, &event.SourceIP, &event.RequestID, &event.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// InsertAuditEvent appends the event to the audit trail
+func (event *AuditEvent) InsertAuditEvent(ctx context.Context) error {
+	event.CreatedAt = time.Now().UTC()
+
+	query := `
+	INSERT INTO audit_events (account_id, auth_method, action, resource_type, resource_id, detail, body_digest, status_code, result, source_ip, request_id, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, event.AccountID, event.AuthMethod, event.Action, event.ResourceType, event.ResourceID, event.Detail,
+		event.BodyDigest, event.StatusCode, event.Result, event.SourceIP, event.RequestID, event.CreatedAt)
+
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	event.ID = id
+	return err
+}
+
+// GetAuditEvents returns the events matching the filter, newest first unless Ascending is set
+func GetAuditEvents(ctx context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	query := "SELECT " + auditEventColumns + " FROM audit_events WHERE id > ?"
+	args := []any{filter.AfterID}
+
+	if filter.Ascending {
+		query += " ORDER BY id"
+	} else {
+		query += " ORDER BY id DESC"
+	}
+
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := db.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, *event)
+	}
+
+	return events, rows.Err()
+}
+
+// ListAuditEvents returns a page of the audit trail, newest first unless sorted otherwise.
+// The filters are resource (a type or type:ID, e.g., vm:5), actor (account ID or username), from and to
+func ListAuditEvents(ctx context.Context, options ListOptions) ([]AuditEvent, string, error) {
+	spec := listSpec{
+		table:       "audit_events",
+		columns:     auditEventColumns,
+		defaultSort: "-id",
+		sorts: map[string]listField{
+			"id":         {"id", fieldInt},
+			"created_at": {"created_at", fieldTime},
+		},
+		filters: map[string]listFilter{
+			"resource": auditResourceFilter,
+			"actor":    auditActorFilter,
+			"from":     timeFilter("created_at", ">="),
+			"to":       timeFilter("created_at", "<"),
+		},
+	}
+	return listPage(ctx, spec, options, scanAuditEvent)
+}
+
+func auditResourceFilter(value string) (string, []any, error) {
+	resourceType, id, found := strings.Cut(value, ":")
+	if !found {
+		return "resource_type = ?", []any{resourceType}, nil
+	}
+	resourceID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return "", nil, fmt.Errorf("%q is not a type or type:ID", value)
+	}
+	return "resource_type = ? AND resource_id = ?", []any{resourceType, resourceID}, nil
+}
+
+// auditActorFilter matches the account by ID or by username
+func auditActorFilter(value string) (string, []any, error) {
+	if id, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return "account_id = ?", []any{id}, nil
+	}
+	return "account_id = (SELECT id FROM accounts WHERE username = ?)", []any{value}, nil
+}
@@ -0,0 +1,101 @@
+// Structures and DB operations
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/db"
+)
+
+// States of a boot script run
+const (
+	BootStatusRunning   = "running"
+	BootStatusSucceeded = "succeeded"
+	BootStatusFailed    = "failed"
+)
+
+// BootRun is the result of the last boot script (user_data) run of a VM.
+// @Description Status, exit code and output of the boot script of a VM.
+type BootRun struct {
+	// The VM which ran the boot script
+	VMID int64 `json:"vm_id"`
+
+	// The container the boot script ran in
+	ContainerID string `json:"container_id"`
+
+	// running, succeeded or failed
+	Status string `json:"status"`
+
+	// Exit code of the boot script (null while it runs)
+	ExitCode *int `json:"exit_code"`
+
+	// Combined stdout and stderr of the boot script
+	Log string `json:"log"`
+
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+}
+
+// SaveBootRun stores the boot run, replacing the previous run of the VM
+func (run *BootRun) SaveBootRun(ctx context.Context) error {
+	query := `
+	INSERT INTO vm_boot_runs (vm_id, container_id, status, exit_code, log, started_at, finished_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(vm_id) DO UPDATE SET
+		container_id = excluded.container_id,
+		status = excluded.status,
+		exit_code = excluded.exit_code,
+		log = excluded.log,
+		started_at = excluded.started_at,
+		finished_at = excluded.finished_at
+	`
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, run.VMID, run.ContainerID, run.Status, run.ExitCode, run.Log, run.StartedAt, run.FinishedAt)
+	return err
+}
+
+// GetBootRun returns the last boot run of a VM, or nil if the VM has no boot script
+func GetBootRun(ctx context.Context, vmID int64) (*BootRun, error) {
+	query := `
+	SELECT vm_id, container_id, status, exit_code, log, started_at, finished_at
+	FROM vm_boot_runs WHERE vm_id = ?`
+
+	var run BootRun
+	err := db.DB.QueryRowContext(ctx, query, vmID).Scan(&run.VMID, &run.ContainerID, &run.Status, &run.ExitCode, &run.Log,
+		&run.StartedAt, &run.FinishedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &run, nil
+}
+
+// DeleteBootRun removes the boot run of a VM
+func DeleteBootRun(ctx context.Context, vmID int64) error {
+	query := "DELETE FROM vm_boot_runs WHERE vm_id = ?"
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, vmID)
+	return err
+}
@@ -0,0 +1,173 @@
+// Structures and DB operations
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/db"
+)
+
+// Event types of the event stream
+const (
+	EventVMCreated          = "vm.created"
+	EventVMUpdated          = "vm.updated"
+	EventVMDeleted          = "vm.deleted"
+	EventVMStateChanged     = "vm.state_changed"
+	EventStorageCreated     = "storage.created"
+	EventStorageResized     = "storage.resized"
+	EventStorageDeleted     = "storage.deleted"
+	EventStorageAttached    = "storage.attached"
+	EventStorageDetached    = "storage.detached"
+	EventOperationCompleted = "operation.completed"
+)
+
+// EventTypes are all types published on the event stream
+var EventTypes = []string{
+	EventVMCreated, EventVMUpdated, EventVMDeleted, EventVMStateChanged,
+	EventStorageCreated, EventStorageResized, EventStorageDeleted, EventStorageAttached, EventStorageDetached,
+	EventOperationCompleted,
+}
+
+// Event is a change of a resource, published on the event stream.
+// @Description A resource change, its ID is the cursor to resume the stream.
+type Event struct {
+	ID           int64  `json:"id"`
+	Type         string `json:"type"`
+	ResourceType string `json:"resource_type"`
+	ResourceID   int64  `json:"resource_id"`
+
+	// AccountID owns the resource, events of account 0 (e.g., catalog images) are visible to every account
+	AccountID int64 `json:"account_id"`
+
+	// ProjectID is the project of the resource, its events are visible to the current members of the project
+	ProjectID int64 `json:"project_id"`
+
+	// Data is the resource after the change or the details of the change
+	Data      json.RawMessage `json:"data" swaggertype:"object"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// EventFilter selects events, zero values match everything
+type EventFilter struct {
+	AfterID      int64
+	ResourceType string
+	ResourceID   int64
+
+	// AccountID selects the events of the account outside of projects, of the projects it is a member of
+	// and those of account 0, Admin all events
+	AccountID int64
+	Admin     bool
+}
+
+// Match reports whether the event is selected by the filter
+// Events of projects need the membership of the account, which is checked by VisibleTo
+func (filter EventFilter) Match(event Event) bool {
+	if event.ID <= filter.AfterID {
+		return false
+	}
+	if filter.ResourceType != "" && event.ResourceType != filter.ResourceType {
+		return false
+	}
+	if filter.ResourceID != 0 && event.ResourceID != filter.ResourceID {
+		return false
+	}
+	return filter.Admin || event.AccountID == 0 || event.ProjectID != 0 || event.AccountID == filter.AccountID
+}
+
+// VisibleTo reports whether the account may see the event: the events of a project
+// go to its current members, so removed members no longer get them
+func (event Event) VisibleTo(ctx context.Context, filter EventFilter) (bool, error) {
+	if !filter.Match(event) {
+		return false, nil
+	}
+	if filter.Admin || event.ProjectID == 0 {
+		return true, nil
+	}
+	member, err := GetProjectMember(ctx, event.ProjectID, filter.AccountID)
+	return member != nil, err
+}
+
+// InsertEvent stores the event, which assigns its ID
+func (event *Event) InsertEvent(ctx context.Context) error {
+	event.CreatedAt = time.Now().UTC()
+
+	query := `
+	INSERT INTO events (type, resource_type, resource_id, account_id, project_id, data, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, event.Type, event.ResourceType, event.ResourceID, event.AccountID, event.ProjectID, string(event.Data), event.CreatedAt)
+
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	event.ID = id
+	return err
+}
+
+// GetEvents returns up to limit events matching the filter, oldest first
+func GetEvents(ctx context.Context, filter EventFilter, limit int) ([]Event, error) {
+	query := "SELECT id, type, resource_type, resource_id, account_id, project_id, data, created_at FROM events WHERE id > ?"
+	args := []any{filter.AfterID}
+
+	if filter.ResourceType != "" {
+		query += " AND resource_type = ?"
+		args = append(args, filter.ResourceType)
+	}
+	if filter.ResourceID != 0 {
+		query += " AND resource_id = ?"
+		args = append(args, filter.ResourceID)
+	}
+	if !filter.Admin {
+		query += " AND (account_id = 0 OR (project_id = 0 AND account_id = ?)" +
+			" OR project_id IN (SELECT project_id FROM project_members WHERE account_id = ?))"
+		args = append(args, filter.AccountID, filter.AccountID)
+	}
+
+	query += " ORDER BY id LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var event Event
+		var data string
+		err := rows.Scan(&event.ID, &event.Type, &event.ResourceType, &event.ResourceID, &event.AccountID, &event.ProjectID, &data, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		event.Data = json.RawMessage(data)
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// GetLastEventID returns the ID of the newest event (0 without events)
+func GetLastEventID(ctx context.Context) (int64, error) {
+	var id int64
+	err := db.DB.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) FROM events").Scan(&id)
+	return id, err
+}
+
+// DeleteEventsBefore removes the events older than the cutoff
+func DeleteEventsBefore(ctx context.Context, cutoff time.Time) error {
+	_, err := db.DB.ExecContext(ctx, "DELETE FROM events WHERE created_at < ?", cutoff.UTC())
+	return err
+}
@@ -0,0 +1,157 @@
+// Structures and DB operations
+package models
+
+import (
+	"context"
+	"github.com/odeeka/go-minicloud-rest-api/db"
+)
+
+// Flavor is an instance type which defines the resources of a VM.
+// @Description A named size (e.g., small, medium, large) for VMs.
+// @Description VMs created with a flavor get its CPU, memory and disk size.
+type Flavor struct {
+	// The unique ID of the flavor
+	ID int64 `json:"id"`
+
+	// The unique name of the flavor (e.g., "small")
+	Name string `json:"name"`
+
+	// Number of virtual CPUs
+	CPU float64 `json:"cpu"`
+
+	// Memory in megabytes
+	Memory int `json:"memory"`
+
+	// Root disk size in gigabytes
+	DiskGB int `json:"disk_gb"`
+
+	// Counts the changes of the flavor, it is the ETag of GET /flavors/:id
+	Version int64 `json:"version"`
+}
+
+const flavorColumns = "id, name, cpu, memory, disk_gb, version"
+
+// scanFlavor reads one flavor row selected with flavorColumns
+func scanFlavor(row rowScanner) (*Flavor, error) {
+	var flavor Flavor
+	err := row.Scan(&flavor.ID, &flavor.Name, &flavor.CPU, &flavor.Memory, &flavor.DiskGB, &flavor.Version)
+	if err != nil {
+		return nil, err
+	}
+	return &flavor, nil
+}
+
+// ListFlavors returns a page of flavors, smallest CPU first unless sorted otherwise. The filter is name_prefix
+func ListFlavors(ctx context.Context, options ListOptions) ([]Flavor, string, error) {
+	spec := listSpec{
+		table:       "flavors",
+		columns:     flavorColumns,
+		defaultSort: "cpu",
+		sorts: map[string]listField{
+			"id":      {"id", fieldInt},
+			"name":    {"name", fieldText},
+			"cpu":     {"cpu", fieldFloat},
+			"memory":  {"memory", fieldInt},
+			"disk_gb": {"disk_gb", fieldInt},
+		},
+		filters: map[string]listFilter{
+			"name_prefix": prefixFilter("name"),
+		},
+	}
+	return listPage(ctx, spec, options, scanFlavor)
+}
+
+func GetFlavorByID(ctx context.Context, id int64) (*Flavor, error) {
+	query := "SELECT " + flavorColumns + " FROM flavors WHERE id = ?"
+	return scanFlavor(db.DB.QueryRowContext(ctx, query, id))
+}
+
+// GetFlavorByName looks up a flavor by the name VMs refer to
+func GetFlavorByName(ctx context.Context, name string) (*Flavor, error) {
+	query := "SELECT " + flavorColumns + " FROM flavors WHERE name = ?"
+	return scanFlavor(db.DB.QueryRowContext(ctx, query, name))
+}
+
+func (flavor *Flavor) InsertFlavor(ctx context.Context) error {
+
+	query := `
+	INSERT INTO flavors (name, cpu, memory, disk_gb) 
+	VALUES (?, ?, ?, ?)`
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, flavor.Name, flavor.CPU, flavor.Memory, flavor.DiskGB)
+
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	flavor.ID = id
+	flavor.Version = 1
+	return err
+}
+
+// UpdateFlavorByID stores the sizes if the flavor still has the version of flavor.Version, which is increased.
+// It returns ErrVersionConflict if another request changed the flavor in the meantime
+func (flavor *Flavor) UpdateFlavorByID(ctx context.Context) error {
+	query := `
+	UPDATE flavors
+	SET cpu = ?, memory = ?, disk_gb = ?, version = version + 1
+	WHERE id = ? AND version = ?
+	`
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, flavor.CPU, flavor.Memory, flavor.DiskGB, flavor.ID, flavor.Version)
+	if err != nil {
+		return err
+	}
+	if err := checkVersionedUpdate(result); err != nil {
+		return err
+	}
+	flavor.Version++
+	return nil
+}
+
+func (flavor *Flavor) DeleteFlavorByID(ctx context.Context) error {
+	query := "DELETE FROM flavors WHERE id = ?"
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, flavor.ID)
+	return err
+}
+
+// CountVMsByFlavor returns how many VMs use the flavor
+func CountVMsByFlavor(ctx context.Context, name string) (int, error) {
+	var count int
+	err := db.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM vms WHERE flavor = ?", name).Scan(&count)
+	return count, err
+}
+
+// ApplyTo sets the resources of the VM to the ones of the flavor
+func (flavor *Flavor) ApplyTo(vm *VM) {
+	vm.Flavor = flavor.Name
+	vm.CPU = flavor.CPU
+	vm.Memory = flavor.Memory
+	vm.DiskGB = flavor.DiskGB
+}
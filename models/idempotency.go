@@ -0,0 +1,107 @@
+// Structures and DB operations
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/db"
+)
+
+// IdempotencyKey is a POST request of an account identified by the Idempotency-Key header
+// and its response. StatusCode is 0 while the request is handled.
+type IdempotencyKey struct {
+	AccountID   int64
+	Key         string
+	Fingerprint string
+	StatusCode  int
+	Headers     map[string]string
+	Body        []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+const idempotencyKeyColumns = "account_id, key, fingerprint, status_code, headers, body, created_at, expires_at"
+
+func scanIdempotencyKey(row rowScanner) (*IdempotencyKey, error) {
+	var record IdempotencyKey
+	var headers string
+	err := row.Scan(&record.AccountID, &record.Key, &record.Fingerprint, &record.StatusCode,
+		&headers, &record.Body, &record.CreatedAt, &record.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(headers), &record.Headers); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// Completed reports whether the response of the request is stored
+func (record *IdempotencyKey) Completed() bool {
+	return record.StatusCode != 0
+}
+
+// ReserveIdempotencyKey claims the key of the account for a request with the fingerprint until the TTL expires.
+// It returns true if the key was free (or expired), otherwise the stored request and false
+func ReserveIdempotencyKey(ctx context.Context, accountID int64, key, fingerprint string, ttl time.Duration) (*IdempotencyKey, bool, error) {
+	now := time.Now().UTC()
+
+	_, err := db.DB.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE account_id = ? AND key = ? AND expires_at < ?", accountID, key, now)
+	if err != nil {
+		return nil, false, err
+	}
+
+	query := `
+	INSERT INTO idempotency_keys (account_id, key, fingerprint, created_at, expires_at)
+	VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT (account_id, key) DO NOTHING
+	`
+	result, err := db.DB.ExecContext(ctx, query, accountID, key, fingerprint, now, now.Add(ttl))
+	if err != nil {
+		return nil, false, err
+	}
+	if inserted, err := result.RowsAffected(); err != nil {
+		return nil, false, err
+	} else if inserted == 1 {
+		return nil, true, nil
+	}
+
+	row := db.DB.QueryRowContext(ctx, "SELECT "+idempotencyKeyColumns+" FROM idempotency_keys WHERE account_id = ? AND key = ?", accountID, key)
+	record, err := scanIdempotencyKey(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Released by the request which held it in the meantime
+		return ReserveIdempotencyKey(ctx, accountID, key, fingerprint, ttl)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return record, false, nil
+}
+
+// CompleteIdempotencyKey stores the response of the request which reserved the key
+func CompleteIdempotencyKey(ctx context.Context, accountID int64, key string, statusCode int, headers map[string]string, body []byte) error {
+	data, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+
+	query := "UPDATE idempotency_keys SET status_code = ?, headers = ?, body = ? WHERE account_id = ? AND key = ?"
+	_, err = db.DB.ExecContext(ctx, query, statusCode, string(data), body, accountID, key)
+	return err
+}
+
+// DeleteIdempotencyKey releases the key, so the request can be retried with it
+func DeleteIdempotencyKey(ctx context.Context, accountID int64, key string) error {
+	_, err := db.DB.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE account_id = ? AND key = ?", accountID, key)
+	return err
+}
+
+// DeleteIdempotencyKeysBefore removes the keys which expired before the cutoff
+func DeleteIdempotencyKeysBefore(ctx context.Context, cutoff time.Time) error {
+	_, err := db.DB.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at < ?", cutoff.UTC())
+	return err
+}
@@ -0,0 +1,250 @@
+// Structures and DB operations
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/db"
+)
+
+// Pull states of a catalog image
+const (
+	ImageStatusPending = "pending"
+	ImageStatusPulling = "pulling"
+	ImageStatusReady   = "ready"
+	ImageStatusFailed  = "failed"
+)
+
+// Image is an approved image in the MiniCloud catalog.
+// @Description A Docker image which is pre-pulled and pinned to a digest.
+// @Description The defaults are applied to new VMs which do not set their own values.
+type Image struct {
+	// The unique ID of the catalog entry
+	ID int64 `json:"id"`
+
+	// The image reference used by VMs (e.g., "nginx:latest")
+	Name string `json:"name"`
+
+	// Human readable name shown in clients
+	DisplayName string `json:"display_name"`
+
+	// Default number of virtual CPUs for VMs using this image, the same limits as the cpu of a VM
+	DefaultCPU float64 `json:"default_cpu" binding:"omitempty,gt=0,lte=64"`
+
+	// Default memory in megabytes for VMs using this image, the same limits as the memory of a VM
+	DefaultMemory int `json:"default_memory" binding:"omitempty,min=6,max=262144"`
+
+	// Default ports exposed by VMs using this image
+	DefaultPorts []int `json:"default_ports" binding:"max=32,unique,dive,min=1,max=65535"`
+
+	// Content digest the tag resolved to at pull time (e.g., "sha256:...")
+	Digest string `json:"digest"`
+
+	// Pull state: pending, pulling, ready or failed
+	Status string `json:"status"`
+
+	// Error output of the last failed pull
+	StatusMessage string `json:"status_message"`
+
+	// Time of the last successful pull
+	PulledAt *time.Time `json:"pulled_at"`
+
+	// Free-form key/value labels
+	Labels map[string]string `json:"labels"`
+
+	// Counts the changes of the catalog entry, it is the ETag of GET /images/:id
+	Version int64 `json:"version"`
+}
+
+const imageColumns = "id, name, display_name, default_cpu, default_memory, default_ports, digest, status, status_message, pulled_at, version"
+
+// scanImage reads one image row selected with imageColumns
+func scanImage(row rowScanner) (*Image, error) {
+	var image Image
+	var portsJSON string
+
+	err := row.Scan(&image.ID, &image.Name, &image.DisplayName, &image.DefaultCPU, &image.DefaultMemory,
+		&portsJSON, &image.Digest, &image.Status, &image.StatusMessage, &image.PulledAt, &image.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(portsJSON), &image.DefaultPorts); err != nil {
+		return nil, err
+	}
+
+	return &image, nil
+}
+
+// ListImages returns a page of catalog images, the filters are status, name_prefix and selector
+func ListImages(ctx context.Context, options ListOptions) ([]Image, string, error) {
+	spec := listSpec{
+		table:       "images",
+		columns:     imageColumns,
+		defaultSort: "id",
+		sorts: map[string]listField{
+			"id":     {"id", fieldInt},
+			"name":   {"name", fieldText},
+			"status": {"status", fieldText},
+		},
+		filters: map[string]listFilter{
+			"status":      equalsFilter("status"),
+			"name_prefix": prefixFilter("name"),
+			"selector":    selectorFilter(LabelResourceImage),
+		},
+	}
+
+	images, nextPageToken, err := listPage(ctx, spec, options, scanImage)
+	if err != nil {
+		return nil, "", err
+	}
+	err = loadLabels(ctx, LabelResourceImage, images, func(image *Image) (int64, *map[string]string) { return image.ID, &image.Labels })
+	return images, nextPageToken, err
+}
+
+func GetImageByID(ctx context.Context, id int64) (*Image, error) {
+	query := "SELECT " + imageColumns + " FROM images WHERE id = ?"
+	image, err := scanImage(db.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		return nil, err
+	}
+
+	image.Labels, err = GetLabels(ctx, LabelResourceImage, image.ID)
+	return image, err
+}
+
+// GetImageByName looks up a catalog entry by its image reference
+func GetImageByName(ctx context.Context, name string) (*Image, error) {
+	query := "SELECT " + imageColumns + " FROM images WHERE name = ?"
+	return scanImage(db.DB.QueryRowContext(ctx, query, name))
+}
+
+func (image *Image) InsertImage(ctx context.Context) error {
+
+	portsJSON, _ := json.Marshal(image.DefaultPorts)
+
+	query := `
+	INSERT INTO images (name, display_name, default_cpu, default_memory, default_ports, digest, status, status_message, pulled_at) 
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, image.Name, image.DisplayName, image.DefaultCPU, image.DefaultMemory, string(portsJSON),
+		image.Digest, image.Status, image.StatusMessage, image.PulledAt)
+
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	image.ID = id
+	image.Version = 1
+
+	return ReplaceLabels(ctx, LabelResourceImage, image.ID, image.Labels)
+}
+
+// UpdateImageByID stores the defaults if the entry still has the version of image.Version, which is increased.
+// It returns ErrVersionConflict if another request changed the entry in the meantime
+func (image *Image) UpdateImageByID(ctx context.Context) error {
+	query := `
+	UPDATE images
+	SET display_name = ?, default_cpu = ?, default_memory = ?, default_ports = ?, version = version + 1
+	WHERE id = ? AND version = ?
+	`
+
+	portsJSON, _ := json.Marshal(image.DefaultPorts)
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, image.DisplayName, image.DefaultCPU, image.DefaultMemory, string(portsJSON), image.ID, image.Version)
+	if err != nil {
+		return err
+	}
+	if err := checkVersionedUpdate(result); err != nil {
+		return err
+	}
+	image.Version++
+	return nil
+}
+
+// UpdatePullStatus stores the result of a (pre-)pull
+func (image *Image) UpdatePullStatus(ctx context.Context) error {
+	query := `
+	UPDATE images
+	SET digest = ?, status = ?, status_message = ?, pulled_at = ?
+	WHERE id = ?
+	`
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, image.Digest, image.Status, image.StatusMessage, image.PulledAt, image.ID)
+	return err
+}
+
+func (image *Image) DeleteImageByID(ctx context.Context) error {
+	query := "DELETE FROM images WHERE id = ?"
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, image.ID)
+	if err != nil {
+		return err
+	}
+
+	return deleteLabels(ctx, db.DB, LabelResourceImage, image.ID)
+}
+
+// ApplyDefaults fills the resources of a VM which were not set by the client
+func (image *Image) ApplyDefaults(vm *VM) {
+	if vm.CPU == 0 {
+		vm.CPU = image.DefaultCPU
+	}
+	if vm.Memory == 0 {
+		vm.Memory = image.DefaultMemory
+	}
+	if len(vm.Ports) == 0 && len(image.DefaultPorts) > 0 {
+		vm.Ports = image.DefaultPorts
+	}
+}
+
+// ImageRepository strips the tag and digest from an image reference
+// ("registry:5000/team/app:1.0" -> "registry:5000/team/app")
+func ImageRepository(reference string) string {
+	if i := strings.Index(reference, "@"); i >= 0 {
+		reference = reference[:i]
+	}
+	if i := strings.LastIndex(reference, ":"); i > strings.LastIndex(reference, "/") {
+		reference = reference[:i]
+	}
+	return reference
+}
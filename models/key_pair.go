@@ -0,0 +1,158 @@
+// Structures and DB operations
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/db"
+)
+
+// KeyPair is an SSH public key of an account which can be installed into VMs.
+// @Description A generated key pair returns its private key only once, in the response of the creation.
+type KeyPair struct {
+	// The unique ID of the key pair
+	ID int64 `json:"id"`
+
+	// The account which owns the key pair
+	AccountID int64 `json:"account_id"`
+
+	// Name of the key pair, unique per account
+	Name string `json:"name"`
+
+	// The public key in authorized_keys format, leave it empty to generate a new key pair
+	PublicKey string `json:"public_key"`
+
+	// SHA256 fingerprint of the public key
+	Fingerprint string `json:"fingerprint"`
+
+	// The private key of a generated key pair, only set in the response of the creation
+	PrivateKey string `json:"private_key,omitempty"`
+
+	// Creation time of the key pair
+	CreatedAt time.Time `json:"created_at"`
+
+	// Free-form key/value labels
+	Labels map[string]string `json:"labels"`
+
+	// Counts the changes of the key pair, it is the ETag of GET /key-pairs/:id
+	Version int64 `json:"version"`
+}
+
+const keyPairColumns = "id, account_id, name, public_key, fingerprint, created_at, version"
+
+func scanKeyPair(row rowScanner) (*KeyPair, error) {
+	var keyPair KeyPair
+	err := row.Scan(&keyPair.ID, &keyPair.AccountID, &keyPair.Name, &keyPair.PublicKey, &keyPair.Fingerprint, &keyPair.CreatedAt, &keyPair.Version)
+	if err != nil {
+		return nil, err
+	}
+	return &keyPair, nil
+}
+
+// ListKeyPairs returns a page of the key pairs of the account, by name unless sorted otherwise.
+// The filters are name_prefix and selector
+func ListKeyPairs(ctx context.Context, accountID int64, options ListOptions) ([]KeyPair, string, error) {
+	spec := listSpec{
+		table:       "key_pairs",
+		columns:     keyPairColumns,
+		defaultSort: "name",
+		sorts: map[string]listField{
+			"id":         {"id", fieldInt},
+			"name":       {"name", fieldText},
+			"created_at": {"created_at", fieldTime},
+		},
+		filters: map[string]listFilter{
+			"name_prefix": prefixFilter("name"),
+			"selector":    selectorFilter(LabelResourceKeyPair),
+		},
+		conditions: []string{"account_id = ?"},
+		args:       []any{accountID},
+	}
+
+	keyPairs, nextPageToken, err := listPage(ctx, spec, options, scanKeyPair)
+	if err != nil {
+		return nil, "", err
+	}
+	err = loadLabels(ctx, LabelResourceKeyPair, keyPairs, func(keyPair *KeyPair) (int64, *map[string]string) {
+		return keyPair.ID, &keyPair.Labels
+	})
+	return keyPairs, nextPageToken, err
+}
+
+// GetKeyPairByID returns a single key pair, or nil if there is none with this ID
+func GetKeyPairByID(ctx context.Context, id int64) (*KeyPair, error) {
+	query := "SELECT " + keyPairColumns + " FROM key_pairs WHERE id = ?"
+	keyPair, err := scanKeyPair(db.DB.QueryRowContext(ctx, query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keyPair.Labels, err = GetLabels(ctx, LabelResourceKeyPair, keyPair.ID)
+	return keyPair, err
+}
+
+// GetKeyPairByName returns a key pair of the account by its name, or nil if there is none
+func GetKeyPairByName(ctx context.Context, accountID int64, name string) (*KeyPair, error) {
+	query := "SELECT " + keyPairColumns + " FROM key_pairs WHERE account_id = ? AND name = ?"
+	keyPair, err := scanKeyPair(db.DB.QueryRowContext(ctx, query, accountID, name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return keyPair, err
+}
+
+func (keyPair *KeyPair) InsertKeyPair(ctx context.Context) error {
+	keyPair.CreatedAt = time.Now().UTC()
+
+	query := `
+	INSERT INTO key_pairs (account_id, name, public_key, fingerprint, created_at) 
+	VALUES (?, ?, ?, ?, ?)`
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, keyPair.AccountID, keyPair.Name, keyPair.PublicKey, keyPair.Fingerprint, keyPair.CreatedAt)
+
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	keyPair.ID = id
+	keyPair.Version = 1
+
+	return ReplaceLabels(ctx, LabelResourceKeyPair, keyPair.ID, keyPair.Labels)
+}
+
+func (keyPair *KeyPair) DeleteKeyPairByID(ctx context.Context) error {
+	query := "DELETE FROM key_pairs WHERE id = ?"
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, keyPair.ID)
+	if err != nil {
+		return err
+	}
+
+	return deleteLabels(ctx, db.DB, LabelResourceKeyPair, keyPair.ID)
+}
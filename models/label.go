@@ -0,0 +1,397 @@
+// Structures and DB operations
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/odeeka/go-minicloud-rest-api/db"
+)
+
+// Resource types which carry labels
+const (
+	LabelResourceVM      = "vm"
+	LabelResourceStorage = "storage"
+	LabelResourceImage   = "image"
+	LabelResourceKeyPair = "key_pair"
+)
+
+// execer is implemented by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// labelTables are the tables of the labeled resource types
+var labelTables = map[string]string{
+	LabelResourceVM:      "vms",
+	LabelResourceStorage: "storages",
+	LabelResourceImage:   "images",
+	LabelResourceKeyPair: "key_pairs",
+}
+
+// LabelResourceTypes lists the resource types which carry labels, sorted
+var LabelResourceTypes = sortedKeys(labelTables)
+
+// Label keys and values follow the Kubernetes syntax: a name of up to 63 characters
+// (alphanumeric, "-", "_" and "." inside) with an optional DNS prefix (e.g., example.com/team)
+var (
+	labelNamePattern   = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?$`)
+	labelPrefixPattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+)
+
+// ValidateLabelKey checks the syntax of a label key
+func ValidateLabelKey(key string) error {
+	name := key
+	if prefix, rest, found := strings.Cut(key, "/"); found {
+		if len(prefix) > 253 || !labelPrefixPattern.MatchString(prefix) {
+			return fmt.Errorf("invalid label key %q: the prefix must be a DNS subdomain", key)
+		}
+		name = rest
+	}
+	if !labelNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid label key %q: at most 63 alphanumeric characters, '-', '_' or '.' inside", key)
+	}
+	return nil
+}
+
+// ValidateLabelValue checks the syntax of a label value, which may be empty
+func ValidateLabelValue(value string) error {
+	if value != "" && !labelNamePattern.MatchString(value) {
+		return fmt.Errorf("invalid label value %q: at most 63 alphanumeric characters, '-', '_' or '.' inside", value)
+	}
+	return nil
+}
+
+// ValidateLabels checks the syntax of all keys and values
+func ValidateLabels(labels map[string]string) error {
+	for _, key := range sortedKeys(labels) {
+		if err := ValidateLabelKey(key); err != nil {
+			return err
+		}
+		if err := ValidateLabelValue(labels[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetLabels returns the labels of a resource, nil if it has none
+func GetLabels(ctx context.Context, resourceType string, resourceID int64) (map[string]string, error) {
+	labels, err := GetLabelsOfResources(ctx, resourceType, []int64{resourceID})
+	return labels[resourceID], err
+}
+
+// GetLabelsOfResources returns the labels of several resources of a type by their ID
+func GetLabelsOfResources(ctx context.Context, resourceType string, resourceIDs []int64) (map[int64]map[string]string, error) {
+	labels := map[int64]map[string]string{}
+	if len(resourceIDs) == 0 {
+		return labels, nil
+	}
+
+	query := "SELECT resource_id, key, value FROM labels WHERE resource_type = ? AND resource_id IN (" + placeholders(len(resourceIDs)) + ")"
+	args := []any{resourceType}
+	for _, id := range resourceIDs {
+		args = append(args, id)
+	}
+
+	rows, err := db.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var key, value string
+		if err := rows.Scan(&id, &key, &value); err != nil {
+			return nil, err
+		}
+		if labels[id] == nil {
+			labels[id] = map[string]string{}
+		}
+		labels[id][key] = value
+	}
+
+	return labels, rows.Err()
+}
+
+// loadLabels sets the labels of a page of resources, field returns the ID and the labels field of a resource
+func loadLabels[T any](ctx context.Context, resourceType string, items []T, field func(*T) (int64, *map[string]string)) error {
+	ids := make([]int64, 0, len(items))
+	for i := range items {
+		id, _ := field(&items[i])
+		ids = append(ids, id)
+	}
+
+	labels, err := GetLabelsOfResources(ctx, resourceType, ids)
+	if err != nil {
+		return err
+	}
+
+	for i := range items {
+		id, target := field(&items[i])
+		*target = labels[id]
+	}
+	return nil
+}
+
+// ReplaceLabels stores the labels of a resource in place of its current ones
+func ReplaceLabels(ctx context.Context, resourceType string, resourceID int64, labels map[string]string) error {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM labels WHERE resource_type = ? AND resource_id = ?", resourceType, resourceID); err != nil {
+		return err
+	}
+	if err := setLabels(ctx, tx, resourceType, []int64{resourceID}, labels); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetLabels adds the labels to the resources, keys they already have get the new value
+func SetLabels(ctx context.Context, resourceType string, resourceIDs []int64, labels map[string]string) error {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setLabels(ctx, tx, resourceType, resourceIDs, labels); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func setLabels(ctx context.Context, tx execer, resourceType string, resourceIDs []int64, labels map[string]string) error {
+	query := `
+	INSERT INTO labels (resource_type, resource_id, key, value) VALUES (?, ?, ?, ?)
+	ON CONFLICT (resource_type, resource_id, key) DO UPDATE SET value = excluded.value`
+
+	for _, id := range resourceIDs {
+		for key, value := range labels {
+			if _, err := tx.ExecContext(ctx, query, resourceType, id, key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RemoveLabels removes the label keys from the resources, keys they don't have are ignored
+func RemoveLabels(ctx context.Context, resourceType string, resourceIDs []int64, keys []string) error {
+	if len(resourceIDs) == 0 || len(keys) == 0 {
+		return nil
+	}
+
+	query := "DELETE FROM labels WHERE resource_type = ? AND resource_id IN (" + placeholders(len(resourceIDs)) +
+		") AND key IN (" + placeholders(len(keys)) + ")"
+	args := []any{resourceType}
+	for _, id := range resourceIDs {
+		args = append(args, id)
+	}
+	for _, key := range keys {
+		args = append(args, key)
+	}
+
+	_, err := db.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// deleteLabels removes all labels of a deleted resource
+func deleteLabels(ctx context.Context, tx execer, resourceType string, resourceID int64) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM labels WHERE resource_type = ? AND resource_id = ?", resourceType, resourceID)
+	return err
+}
+
+// ResourceOwner is the account and the project a labeled resource belongs to
+type ResourceOwner struct {
+	AccountID int64
+	ProjectID int64
+}
+
+// GetResourceOwners returns the owner of each existing resource, account 0 for resources of the
+// catalog (images) and project 0 outside of any project. IDs of resources which don't exist are missing from the result
+func GetResourceOwners(ctx context.Context, resourceType string, resourceIDs []int64) (map[int64]ResourceOwner, error) {
+	table, found := labelTables[resourceType]
+	if !found {
+		return nil, fmt.Errorf("unknown resource type %q", resourceType)
+	}
+
+	owner := "account_id, 0"
+	switch resourceType {
+	case LabelResourceImage:
+		owner = "0, 0"
+	case LabelResourceVM, LabelResourceStorage:
+		owner = "account_id, project_id"
+	}
+
+	query := "SELECT id, " + owner + " FROM " + table + " WHERE id IN (" + placeholders(len(resourceIDs)) + ")"
+	args := make([]any, 0, len(resourceIDs))
+	for _, id := range resourceIDs {
+		args = append(args, id)
+	}
+
+	rows, err := db.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	owners := map[int64]ResourceOwner{}
+	for rows.Next() {
+		var id int64
+		var owner ResourceOwner
+		if err := rows.Scan(&id, &owner.AccountID, &owner.ProjectID); err != nil {
+			return nil, err
+		}
+		owners[id] = owner
+	}
+
+	return owners, rows.Err()
+}
+
+// ValidLabelResourceType reports whether the resource type carries labels
+func ValidLabelResourceType(resourceType string) bool {
+	return slices.Contains(LabelResourceTypes, resourceType)
+}
+
+// labelRequirement is one requirement of a label selector
+type labelRequirement struct {
+	key      string
+	operator string
+	values   []string
+}
+
+// Operators of label selectors
+const (
+	selectorEquals    = "="
+	selectorNotEquals = "!="
+	selectorIn        = "in"
+	selectorNotIn     = "notin"
+	selectorExists    = "exists"
+	selectorNotExists = "!"
+)
+
+var selectorSetPattern = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\((.*)\)$`)
+
+// parseSelector parses a Kubernetes style label selector, the requirements are separated by commas:
+// "env=dev", "env==dev", "env!=dev", "team in (a,b)", "team notin (a,b)", "env" (has the key) and "!env"
+func parseSelector(selector string) ([]labelRequirement, error) {
+	var requirements []labelRequirement
+	if strings.TrimSpace(selector) == "" {
+		return nil, nil
+	}
+
+	for _, part := range splitSelector(selector) {
+		part = strings.TrimSpace(part)
+		var requirement labelRequirement
+
+		switch {
+		case part == "":
+			return nil, fmt.Errorf("empty requirement in %q", selector)
+		case selectorSetPattern.MatchString(part):
+			match := selectorSetPattern.FindStringSubmatch(part)
+			requirement = labelRequirement{key: match[1], operator: match[2]}
+			for _, value := range strings.Split(match[3], ",") {
+				requirement.values = append(requirement.values, strings.TrimSpace(value))
+			}
+		case strings.Contains(part, "!="):
+			key, value, _ := strings.Cut(part, "!=")
+			requirement = labelRequirement{key: strings.TrimSpace(key), operator: selectorNotEquals, values: []string{strings.TrimSpace(value)}}
+		case strings.Contains(part, "="):
+			key, value, _ := strings.Cut(part, "=")
+			value = strings.TrimPrefix(value, "=")
+			requirement = labelRequirement{key: strings.TrimSpace(key), operator: selectorEquals, values: []string{strings.TrimSpace(value)}}
+		case strings.HasPrefix(part, "!"):
+			requirement = labelRequirement{key: strings.TrimSpace(part[1:]), operator: selectorNotExists}
+		default:
+			requirement = labelRequirement{key: part, operator: selectorExists}
+		}
+
+		if err := ValidateLabelKey(requirement.key); err != nil {
+			return nil, err
+		}
+		for _, value := range requirement.values {
+			if err := ValidateLabelValue(value); err != nil {
+				return nil, err
+			}
+		}
+		requirements = append(requirements, requirement)
+	}
+
+	return requirements, nil
+}
+
+// splitSelector splits a selector at the commas which are not inside the parentheses of a set
+func splitSelector(selector string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, char := range selector {
+		switch char {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, selector[start:])
+}
+
+// selectorFilter matches the resources of a list whose labels satisfy a label selector
+// Like in Kubernetes, != and notin also match resources without the key
+func selectorFilter(resourceType string) listFilter {
+	table := labelTables[resourceType]
+
+	return func(value string) (string, []any, error) {
+		requirements, err := parseSelector(value)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(requirements) == 0 {
+			return "1 = 1", nil, nil
+		}
+
+		var conditions []string
+		var args []any
+		for _, requirement := range requirements {
+			subquery := "EXISTS (SELECT 1 FROM labels WHERE labels.resource_type = ? AND labels.resource_id = " + table + ".id AND labels.key = ?"
+			args = append(args, resourceType, requirement.key)
+
+			if len(requirement.values) > 0 {
+				subquery += " AND labels.value IN (" + placeholders(len(requirement.values)) + ")"
+				for _, value := range requirement.values {
+					args = append(args, value)
+				}
+			}
+			subquery += ")"
+
+			switch requirement.operator {
+			case selectorNotEquals, selectorNotIn, selectorNotExists:
+				subquery = "NOT " + subquery
+			}
+			conditions = append(conditions, subquery)
+		}
+
+		return "(" + strings.Join(conditions, " AND ") + ")", args, nil
+	}
+}
+
+// placeholders returns "?, ?, ..." for an IN list of n values
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
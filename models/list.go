@@ -0,0 +1,306 @@
+// Structures and DB operations
+package models
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/db"
+)
+
+// Page sizes of list endpoints
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+// ListOptions pages, filters and sorts a list query
+type ListOptions struct {
+	// Maximum number of items of the page
+	Limit int
+
+	// Token of the previous page, empty for the first page
+	PageToken string
+
+	// Field to sort by, with a "-" prefix in descending order (empty for the default order of the list)
+	Sort string
+
+	// Filters by name (e.g., status=running), each list supports its own
+	Filters map[string]string
+}
+
+// ListError is an invalid option of a list query (e.g., an unknown filter), the request is at fault
+type ListError struct {
+	Message string
+}
+
+func (err *ListError) Error() string {
+	return err.Message
+}
+
+// Kinds of sortable fields, to restore the sort value of a page token
+const (
+	fieldInt = iota
+	fieldFloat
+	fieldText
+	fieldTime
+)
+
+type listField struct {
+	column string
+	kind   int
+}
+
+// listFilter turns the value of a filter into an SQL condition on the table
+type listFilter func(value string) (string, []any, error)
+
+// listSpec describes a list: its table, the sortable fields and the filters
+type listSpec struct {
+	table       string
+	columns     string
+	defaultSort string
+	sorts       map[string]listField
+	filters     map[string]listFilter
+
+	// conditions always applied (e.g., the owner of the resources)
+	conditions []string
+	args       []any
+}
+
+// pageToken is the position after the last item of a page: its sort value and ID
+type pageToken struct {
+	Sort  string `json:"s"`
+	ID    int64  `json:"i"`
+	Value any    `json:"v"`
+}
+
+// listScanner appends the ID and the sort value of a row to the columns read by the scan function of the list
+type listScanner struct {
+	rows  *sql.Rows
+	extra []any
+}
+
+func (scanner listScanner) Scan(dest ...any) error {
+	return scanner.rows.Scan(append(dest, scanner.extra...)...)
+}
+
+// listPage runs the list query with the options and returns the items of the page and the token of the next page
+// Pagination is keyset based (sort value and ID), so pages stay stable while items are created or deleted
+func listPage[T any](ctx context.Context, spec listSpec, options ListOptions, scan func(rowScanner) (*T, error)) ([]T, string, error) {
+	limit := options.Limit
+	if limit == 0 {
+		limit = DefaultListLimit
+	}
+	if limit < 1 || limit > MaxListLimit {
+		return nil, "", &ListError{fmt.Sprintf("limit must be between 1 and %d", MaxListLimit)}
+	}
+
+	sortName := options.Sort
+	if sortName == "" {
+		sortName = spec.defaultSort
+	}
+	descending := strings.HasPrefix(sortName, "-")
+	field, found := spec.sorts[strings.TrimPrefix(sortName, "-")]
+	if !found {
+		return nil, "", &ListError{"sort must be one of " + strings.Join(sortedKeys(spec.sorts), ", ") + " (with - for descending)"}
+	}
+
+	conditions := slices.Clone(spec.conditions)
+	args := slices.Clone(spec.args)
+
+	for name, value := range options.Filters {
+		filter, found := spec.filters[name]
+		if !found {
+			return nil, "", &ListError{"unknown filter " + name + ", the filters are " + strings.Join(sortedKeys(spec.filters), ", ")}
+		}
+		condition, filterArgs, err := filter(value)
+		if err != nil {
+			return nil, "", &ListError{name + ": " + err.Error()}
+		}
+		conditions = append(conditions, condition)
+		args = append(args, filterArgs...)
+	}
+
+	if options.PageToken != "" {
+		token, err := decodePageToken(options.PageToken, sortName, field)
+		if err != nil {
+			return nil, "", err
+		}
+
+		operator := ">"
+		if descending {
+			operator = "<"
+		}
+		if field.column == "id" {
+			conditions = append(conditions, "id "+operator+" ?")
+			args = append(args, token.ID)
+		} else {
+			conditions = append(conditions, fmt.Sprintf("(%s %s ? OR (%s = ? AND id %s ?))", field.column, operator, field.column, operator))
+			args = append(args, token.Value, token.Value, token.ID)
+		}
+	}
+
+	query := "SELECT " + spec.columns + ", id, " + field.column + " FROM " + spec.table
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	direction := "ASC"
+	if descending {
+		direction = "DESC"
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT ?", field.column, direction, direction)
+	// One more row tells whether there is a next page
+	args = append(args, limit+1)
+
+	rows, err := db.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	items := []T{}
+	var last pageToken
+	for rows.Next() {
+		if len(items) == limit {
+			return items, encodePageToken(last), rows.Err()
+		}
+
+		var id int64
+		var value any
+		item, err := scan(listScanner{rows: rows, extra: []any{&id, &value}})
+		if err != nil {
+			return nil, "", err
+		}
+		items = append(items, *item)
+		last = pageToken{Sort: sortName, ID: id, Value: value}
+	}
+
+	return items, "", rows.Err()
+}
+
+func encodePageToken(token pageToken) string {
+	data, _ := json.Marshal(token)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodePageToken restores the position of a page token, which must come from a list with the same sort
+func decodePageToken(value, sortName string, field listField) (*pageToken, error) {
+	invalid := &ListError{"invalid page_token"}
+
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, invalid
+	}
+
+	var token pageToken
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&token); err != nil {
+		return nil, invalid
+	}
+	if token.Sort != sortName {
+		return nil, &ListError{"page_token belongs to a list with another sort"}
+	}
+
+	switch field.kind {
+	case fieldInt:
+		number, ok := token.Value.(json.Number)
+		if !ok {
+			return nil, invalid
+		}
+		token.Value, err = number.Int64()
+	case fieldFloat:
+		number, ok := token.Value.(json.Number)
+		if !ok {
+			return nil, invalid
+		}
+		token.Value, err = number.Float64()
+	case fieldText:
+		if _, ok := token.Value.(string); !ok {
+			return nil, invalid
+		}
+	case fieldTime:
+		text, ok := token.Value.(string)
+		if !ok {
+			return nil, invalid
+		}
+		token.Value, err = time.Parse(time.RFC3339Nano, text)
+	}
+	if err != nil {
+		return nil, invalid
+	}
+
+	return &token, nil
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// equalsFilter matches the column exactly
+func equalsFilter(column string) listFilter {
+	return func(value string) (string, []any, error) {
+		return column + " = ?", []any{value}, nil
+	}
+}
+
+// idFilter matches an ID column
+func idFilter(column string) listFilter {
+	return func(value string) (string, []any, error) {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("%q is not an ID", value)
+		}
+		return column + " = ?", []any{id}, nil
+	}
+}
+
+// prefixFilter matches the beginning of a text column
+func prefixFilter(column string) listFilter {
+	return func(value string) (string, []any, error) {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+		return column + ` LIKE ? ESCAPE '\'`, []any{escaped + "%"}, nil
+	}
+}
+
+// boolFilter selects the rows where the condition is true or, with false, where it isn't
+func boolFilter(condition string) listFilter {
+	return func(value string) (string, []any, error) {
+		set, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", nil, fmt.Errorf("%q is not true or false", value)
+		}
+		if set {
+			return condition, nil, nil
+		}
+		return "NOT (" + condition + ")", nil, nil
+	}
+}
+
+// timeFilter compares a time column with an RFC 3339 time or, with a duration like 24h, the time that long ago
+func timeFilter(column, operator string) listFilter {
+	return func(value string) (string, []any, error) {
+		if duration, err := time.ParseDuration(value); err == nil {
+			return column + " " + operator + " ?", []any{time.Now().Add(-duration).UTC()}, nil
+		}
+		at, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return "", nil, fmt.Errorf("%q is neither an RFC 3339 time nor a duration", value)
+		}
+		return column + " " + operator + " ?", []any{at.UTC()}, nil
+	}
+}
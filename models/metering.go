@@ -0,0 +1,113 @@
+// Structures and DB operations
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/db"
+)
+
+// Resource types of metering records
+const (
+	MeteredVM      = "vm"
+	MeteredStorage = "storage"
+)
+
+// MeteringRecord is one interval in which a resource ran with constant size.
+// Lifecycle events (create, resize, state change, delete) close the open record and start a new one.
+type MeteringRecord struct {
+	ID           int64      `json:"id"`
+	AccountID    int64      `json:"account_id"`
+	ProjectID    int64      `json:"project_id"`
+	ResourceType string     `json:"resource_type"`
+	ResourceID   int64      `json:"resource_id"`
+	ResourceName string     `json:"resource_name"`
+	CPU          float64    `json:"cpu"`
+	MemoryMB     int        `json:"memory_mb"`
+	SizeGB       int        `json:"size_gb"`
+	StartedAt    time.Time  `json:"started_at"`
+	EndedAt      *time.Time `json:"ended_at"`
+}
+
+// InsertMeteringRecord opens a new interval
+func (record *MeteringRecord) InsertMeteringRecord(ctx context.Context) error {
+	query := `
+	INSERT INTO metering_records (account_id, project_id, resource_type, resource_id, resource_name, cpu, memory_mb, size_gb, started_at) 
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, record.AccountID, record.ProjectID, record.ResourceType, record.ResourceID, record.ResourceName,
+		record.CPU, record.MemoryMB, record.SizeGB, record.StartedAt)
+
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	record.ID = id
+	return err
+}
+
+// CloseMeteringRecords ends the open interval of a resource
+func CloseMeteringRecords(ctx context.Context, resourceType string, resourceID int64, endedAt time.Time) error {
+	query := `
+	UPDATE metering_records
+	SET ended_at = ?
+	WHERE resource_type = ? AND resource_id = ? AND ended_at IS NULL
+	`
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, endedAt, resourceType, resourceID)
+	return err
+}
+
+// GetMeteringRecords returns the records which overlap the time range [from, to), either of a project
+// or, with projectID 0, of the resources of an account outside of any project
+func GetMeteringRecords(ctx context.Context, accountID, projectID int64, from, to time.Time) ([]MeteringRecord, error) {
+	scope, scopeArgs := "account_id = ? AND project_id = 0", []any{accountID}
+	if projectID != 0 {
+		scope, scopeArgs = "project_id = ?", []any{projectID}
+	}
+
+	query := `
+	SELECT id, account_id, project_id, resource_type, resource_id, resource_name, cpu, memory_mb, size_gb, started_at, ended_at
+	FROM metering_records
+	WHERE ` + scope + ` AND started_at < ? AND (ended_at IS NULL OR ended_at > ?)
+	ORDER BY resource_type, resource_id, started_at`
+	rows, err := db.DB.QueryContext(ctx, query, append(scopeArgs, to, from)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []MeteringRecord
+
+	for rows.Next() {
+		var record MeteringRecord
+		err := rows.Scan(&record.ID, &record.AccountID, &record.ProjectID, &record.ResourceType, &record.ResourceID, &record.ResourceName,
+			&record.CPU, &record.MemoryMB, &record.SizeGB, &record.StartedAt, &record.EndedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
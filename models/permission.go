@@ -0,0 +1,95 @@
+// Structures and DB operations
+package models
+
+import (
+	"context"
+	"github.com/odeeka/go-minicloud-rest-api/db"
+)
+
+// Permissions which can be granted to accounts by admins
+// Admins implicitly have every permission
+const (
+	// PermissionCustomResources allows VMs with free-form CPU and memory instead of a flavor
+	PermissionCustomResources = "vms.custom_resources"
+)
+
+// KnownPermissions lists every permission which can be granted
+var KnownPermissions = []string{
+	PermissionCustomResources,
+}
+
+// IsKnownPermission reports whether the permission exists
+func IsKnownPermission(permission string) bool {
+	for _, known := range KnownPermissions {
+		if known == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// GetPermissions returns the permissions granted to an account
+func GetPermissions(ctx context.Context, accountID int64) ([]string, error) {
+	query := "SELECT permission FROM account_permissions WHERE account_id = ? ORDER BY permission"
+	rows, err := db.DB.QueryContext(ctx, query, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := []string{}
+
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+
+	return permissions, nil
+}
+
+// HasPermission reports whether the account is an admin or was granted the permission
+func (acc *Account) HasPermission(ctx context.Context, permission string) (bool, error) {
+	if acc.IsAdmin() {
+		return true, nil
+	}
+
+	var count int
+	query := "SELECT COUNT(*) FROM account_permissions WHERE account_id = ? AND permission = ?"
+	err := db.DB.QueryRowContext(ctx, query, acc.ID, permission).Scan(&count)
+	return count > 0, err
+}
+
+// GrantPermission grants a permission to an account (granting twice is a no-op)
+func GrantPermission(ctx context.Context, accountID int64, permission string) error {
+	query := "INSERT OR IGNORE INTO account_permissions (account_id, permission) VALUES (?, ?)"
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, accountID, permission)
+	return err
+}
+
+// RevokePermission removes a permission from an account
+func RevokePermission(ctx context.Context, accountID int64, permission string) error {
+	query := "DELETE FROM account_permissions WHERE account_id = ? AND permission = ?"
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, accountID, permission)
+	return err
+}
@@ -0,0 +1,71 @@
+// Structures and DB operations
+package models
+
+import (
+	"context"
+	"github.com/odeeka/go-minicloud-rest-api/db"
+)
+
+// Billable items of the price list
+const (
+	PriceVCPUHour      = "vm.vcpu_hour"
+	PriceMemoryGBHour  = "vm.memory_gb_hour"
+	PriceStorageGBHour = "storage.gb_hour"
+)
+
+// Price is the unit price of a billable item.
+// @Description One entry of the price list which applies to metering records.
+type Price struct {
+	// The billable item (vm.vcpu_hour, vm.memory_gb_hour or storage.gb_hour)
+	Item string `json:"item"`
+
+	// Price per unit
+	UnitPrice float64 `json:"unit_price"`
+
+	// Unit of the quantity (e.g., "vCPU-hour")
+	Unit string `json:"unit"`
+}
+
+// GetPriceList returns every price keyed by item
+func GetPriceList(ctx context.Context) (map[string]Price, error) {
+	query := "SELECT item, unit_price, unit FROM prices ORDER BY item"
+	rows, err := db.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prices := map[string]Price{}
+
+	for rows.Next() {
+		var price Price
+		if err := rows.Scan(&price.Item, &price.UnitPrice, &price.Unit); err != nil {
+			return nil, err
+		}
+		prices[price.Item] = price
+	}
+
+	return prices, nil
+}
+
+// UpdatePrice changes the unit price of an existing item
+// It returns false if the item is not on the price list
+func (price *Price) UpdatePrice(ctx context.Context) (bool, error) {
+	query := "UPDATE prices SET unit_price = ? WHERE item = ?"
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, price.UnitPrice, price.Item)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
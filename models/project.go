@@ -0,0 +1,322 @@
+// Structures and DB operations
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/db"
+)
+
+// Roles of project members, each role includes the rights of the roles below it
+const (
+	// Manages the project, its members and its resources
+	ProjectRoleOwner = "owner"
+	// Creates, changes and deletes the resources of the project
+	ProjectRoleMember = "member"
+	// Reads the resources of the project
+	ProjectRoleViewer = "viewer"
+)
+
+var projectRoleRanks = map[string]int{
+	ProjectRoleViewer: 1,
+	ProjectRoleMember: 2,
+	ProjectRoleOwner:  3,
+}
+
+// ValidProjectRole reports whether the role is owner, member or viewer
+func ValidProjectRole(role string) bool {
+	_, ok := projectRoleRanks[role]
+	return ok
+}
+
+// ProjectRoleAllows reports whether a member with the role has the rights of the required role
+func ProjectRoleAllows(role, required string) bool {
+	return projectRoleRanks[role] >= projectRoleRanks[required]
+}
+
+// Project groups VMs and storages of several accounts.
+// @Description Resources created with a selected project belong to the project instead of the account,
+// @Description the members of the project share them according to their roles.
+type Project struct {
+	// The unique ID of the project
+	ID int64 `json:"id"`
+
+	// The unique name of the project
+	Name string `json:"name" binding:"required"`
+
+	// Description of the project
+	Description string `json:"description"`
+
+	// Creation time of the project
+	CreatedAt time.Time `json:"created_at"`
+
+	// Counts the changes of the project, it is the ETag of GET /projects/:project
+	Version int64 `json:"version"`
+}
+
+// ProjectMember is the role of one account in a project
+type ProjectMember struct {
+	ProjectID int64  `json:"project_id"`
+	AccountID int64  `json:"account_id"`
+	Username  string `json:"username"`
+
+	// owner, member or viewer
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const projectColumns = "id, name, description, created_at, version"
+
+func scanProject(row rowScanner) (*Project, error) {
+	var project Project
+	err := row.Scan(&project.ID, &project.Name, &project.Description, &project.CreatedAt, &project.Version)
+	if err != nil {
+		return nil, err
+	}
+	return &project, nil
+}
+
+// ListProjects returns a page of the projects the account is a member of (all projects for admins),
+// the filter is name_prefix
+func ListProjects(ctx context.Context, accountID int64, all bool, options ListOptions) ([]Project, string, error) {
+	spec := listSpec{
+		table:       "projects",
+		columns:     projectColumns,
+		defaultSort: "name",
+		sorts: map[string]listField{
+			"id":         {"id", fieldInt},
+			"name":       {"name", fieldText},
+			"created_at": {"created_at", fieldTime},
+		},
+		filters: map[string]listFilter{
+			"name_prefix": prefixFilter("name"),
+		},
+	}
+	if !all {
+		spec.conditions = []string{"id IN (SELECT project_id FROM project_members WHERE account_id = ?)"}
+		spec.args = []any{accountID}
+	}
+	return listPage(ctx, spec, options, scanProject)
+}
+
+// GetProjectByID returns a single project, or nil if there is none with this ID
+func GetProjectByID(ctx context.Context, id int64) (*Project, error) {
+	query := "SELECT " + projectColumns + " FROM projects WHERE id = ?"
+	project, err := scanProject(db.DB.QueryRowContext(ctx, query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return project, err
+}
+
+// GetProjectByName returns a single project, or nil if there is none with this name
+func GetProjectByName(ctx context.Context, name string) (*Project, error) {
+	query := "SELECT " + projectColumns + " FROM projects WHERE name = ?"
+	project, err := scanProject(db.DB.QueryRowContext(ctx, query, name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return project, err
+}
+
+// InsertProject stores the project with the account as its first owner
+func (project *Project) InsertProject(ctx context.Context, ownerID int64) error {
+	project.CreatedAt = time.Now().UTC()
+
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "INSERT INTO projects (name, description, created_at) VALUES (?, ?, ?)",
+		project.Name, project.Description, project.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO project_members (project_id, account_id, role, created_at) VALUES (?, ?, ?, ?)",
+		id, ownerID, ProjectRoleOwner, project.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	project.ID = id
+	project.Version = 1
+	return nil
+}
+
+// UpdateProject stores name and description of the project if it still has the version of project.Version,
+// which is increased. It returns ErrVersionConflict if another request changed the project in the meantime
+func (project *Project) UpdateProject(ctx context.Context) error {
+	query := "UPDATE projects SET name = ?, description = ?, version = version + 1 WHERE id = ? AND version = ?"
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, project.Name, project.Description, project.ID, project.Version)
+	if err != nil {
+		return err
+	}
+	if err := checkVersionedUpdate(result); err != nil {
+		return err
+	}
+	project.Version++
+	return nil
+}
+
+// DeleteProjectByID deletes the project with its members and quota
+// The caller has to make sure the project has no VMs or storages anymore
+func (project *Project) DeleteProjectByID(ctx context.Context) error {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		"DELETE FROM project_members WHERE project_id = ?",
+		"DELETE FROM project_quotas WHERE project_id = ?",
+		"DELETE FROM projects WHERE id = ?",
+	} {
+		if _, err := tx.ExecContext(ctx, query, project.ID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+const projectMemberColumns = "project_members.project_id, project_members.account_id, accounts.username, project_members.role, project_members.created_at"
+
+func scanProjectMember(row rowScanner) (*ProjectMember, error) {
+	var member ProjectMember
+	err := row.Scan(&member.ProjectID, &member.AccountID, &member.Username, &member.Role, &member.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+// GetProjectMembers returns the members of a project ordered by account
+func GetProjectMembers(ctx context.Context, projectID int64) ([]ProjectMember, error) {
+	query := "SELECT " + projectMemberColumns + `
+	FROM project_members JOIN accounts ON accounts.id = project_members.account_id
+	WHERE project_members.project_id = ?
+	ORDER BY project_members.account_id`
+
+	rows, err := db.DB.QueryContext(ctx, query, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []ProjectMember{}
+	for rows.Next() {
+		member, err := scanProjectMember(rows)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, *member)
+	}
+
+	return members, rows.Err()
+}
+
+// GetProjectMember returns the membership of an account in a project, or nil if it is no member
+func GetProjectMember(ctx context.Context, projectID, accountID int64) (*ProjectMember, error) {
+	query := "SELECT " + projectMemberColumns + `
+	FROM project_members JOIN accounts ON accounts.id = project_members.account_id
+	WHERE project_members.project_id = ? AND project_members.account_id = ?`
+
+	member, err := scanProjectMember(db.DB.QueryRowContext(ctx, query, projectID, accountID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return member, err
+}
+
+// SaveProjectMember adds the account to the project or changes its role
+func (member *ProjectMember) SaveProjectMember(ctx context.Context) error {
+	member.CreatedAt = time.Now().UTC()
+
+	query := `
+	INSERT INTO project_members (project_id, account_id, role, created_at)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT(project_id, account_id) DO UPDATE SET role = excluded.role`
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, member.ProjectID, member.AccountID, member.Role, member.CreatedAt)
+	return err
+}
+
+// DeleteProjectMember removes the account from the project
+func (member *ProjectMember) DeleteProjectMember(ctx context.Context) error {
+	query := "DELETE FROM project_members WHERE project_id = ? AND account_id = ?"
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, member.ProjectID, member.AccountID)
+	return err
+}
+
+// GetSoleOwnedProjects returns the names of the projects in which the account is the only owner
+func GetSoleOwnedProjects(ctx context.Context, accountID int64) ([]string, error) {
+	query := `
+	SELECT p.name FROM projects p JOIN project_members m ON m.project_id = p.id
+	WHERE m.account_id = ? AND m.role = ?
+	AND (SELECT COUNT(*) FROM project_members o WHERE o.project_id = p.id AND o.role = ?) = 1
+	ORDER BY p.name`
+	rows, err := db.DB.QueryContext(ctx, query, accountID, ProjectRoleOwner, ProjectRoleOwner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// CountProjectOwners returns the number of members with the owner role
+func CountProjectOwners(ctx context.Context, projectID int64) (int, error) {
+	var count int
+	err := db.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM project_members WHERE project_id = ? AND role = ?",
+		projectID, ProjectRoleOwner).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,230 @@
+// Structures and DB operations
+package models
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/odeeka/go-minicloud-rest-api/db"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+)
+
+// Unlimited disables a single limit of a quota
+const Unlimited = -1
+
+// Quota limits the resources one account or one project can consume.
+// @Description Limits per account or project, -1 means unlimited and 0 blocks the resource.
+// @Description Accounts and projects without an explicit quota get the defaults of the MINICLOUD_QUOTA_* environment variables.
+type Quota struct {
+	// The account the quota applies to (0 for a project quota)
+	AccountID int64 `json:"account_id"`
+
+	// The project the quota applies to (0 for an account quota)
+	ProjectID int64 `json:"project_id"`
+
+	// Maximum number of VMs
+	MaxVMs int `json:"max_vms"`
+
+	// Maximum sum of virtual CPUs over all VMs
+	MaxVCPUs float64 `json:"max_vcpus"`
+
+	// Maximum sum of memory in megabytes over all VMs
+	MaxMemoryMB int `json:"max_memory_mb"`
+
+	// Maximum number of storage volumes
+	MaxVolumes int `json:"max_volumes"`
+
+	// Maximum sum of size_gb over all storage volumes
+	MaxStorageGB int `json:"max_storage_gb"`
+}
+
+// Usage is the current (or requested) resource consumption of an account or a project
+type Usage struct {
+	VMs       int     `json:"vms"`
+	VCPUs     float64 `json:"vcpus"`
+	MemoryMB  int     `json:"memory_mb"`
+	Volumes   int     `json:"volumes"`
+	StorageGB int     `json:"storage_gb"`
+
+	// Bytes stored in the image registry by an account, included in StorageGB rounded up to whole GB
+	RegistryBytes int64 `json:"registry_bytes,omitempty"`
+}
+
+// bytesPerGB converts the registry bytes to the GB of the storage quota
+const bytesPerGB = 1 << 30
+
+// AddRegistryBytes counts the bytes stored in the image registry against the storage of the usage
+func (usage *Usage) AddRegistryBytes(bytes int64) {
+	usage.RegistryBytes += bytes
+	usage.StorageGB += int((bytes + bytesPerGB - 1) / bytesPerGB)
+}
+
+// FreeStorageBytes returns the bytes which can still be stored within the storage quota
+func (quota *Quota) FreeStorageBytes(usage *Usage) int64 {
+	volumesGB := usage.StorageGB - int((usage.RegistryBytes+bytesPerGB-1)/bytesPerGB)
+	return max(int64(quota.MaxStorageGB-volumesGB)*bytesPerGB-usage.RegistryBytes, 0)
+}
+
+// DefaultQuota returns the quota of accounts which have none set by an admin
+func DefaultQuota(accountID int64) *Quota {
+	return &Quota{
+		AccountID:    accountID,
+		MaxVMs:       utils.GetEnvInt("MINICLOUD_QUOTA_VMS", 10),
+		MaxVCPUs:     float64(utils.GetEnvInt("MINICLOUD_QUOTA_VCPUS", 8)),
+		MaxMemoryMB:  utils.GetEnvInt("MINICLOUD_QUOTA_MEMORY_MB", 8192),
+		MaxVolumes:   utils.GetEnvInt("MINICLOUD_QUOTA_VOLUMES", 20),
+		MaxStorageGB: utils.GetEnvInt("MINICLOUD_QUOTA_STORAGE_GB", 100),
+	}
+}
+
+// GetQuota returns the quota of an account, or the default quota if none was set
+func GetQuota(ctx context.Context, accountID int64) (*Quota, error) {
+	query := `
+	SELECT account_id, max_vms, max_vcpus, max_memory_mb, max_volumes, max_storage_gb
+	FROM quotas WHERE account_id = ?`
+	row := db.DB.QueryRowContext(ctx, query, accountID)
+
+	var quota Quota
+	err := row.Scan(&quota.AccountID, &quota.MaxVMs, &quota.MaxVCPUs, &quota.MaxMemoryMB, &quota.MaxVolumes, &quota.MaxStorageGB)
+	if err == sql.ErrNoRows {
+		return DefaultQuota(accountID), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &quota, nil
+}
+
+// SaveQuota inserts or replaces the quota of the account
+func (quota *Quota) SaveQuota(ctx context.Context) error {
+	query := `
+	INSERT INTO quotas (account_id, max_vms, max_vcpus, max_memory_mb, max_volumes, max_storage_gb)
+	VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT(account_id) DO UPDATE SET
+		max_vms = excluded.max_vms,
+		max_vcpus = excluded.max_vcpus,
+		max_memory_mb = excluded.max_memory_mb,
+		max_volumes = excluded.max_volumes,
+		max_storage_gb = excluded.max_storage_gb`
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, quota.AccountID, quota.MaxVMs, quota.MaxVCPUs, quota.MaxMemoryMB, quota.MaxVolumes, quota.MaxStorageGB)
+	return err
+}
+
+// DefaultProjectQuota returns the quota of projects which have none set by an admin,
+// projects get the same defaults as accounts
+func DefaultProjectQuota(projectID int64) *Quota {
+	quota := DefaultQuota(0)
+	quota.ProjectID = projectID
+	return quota
+}
+
+// GetProjectQuota returns the quota of a project, or the default quota if none was set
+func GetProjectQuota(ctx context.Context, projectID int64) (*Quota, error) {
+	query := `
+	SELECT project_id, max_vms, max_vcpus, max_memory_mb, max_volumes, max_storage_gb
+	FROM project_quotas WHERE project_id = ?`
+	row := db.DB.QueryRowContext(ctx, query, projectID)
+
+	var quota Quota
+	err := row.Scan(&quota.ProjectID, &quota.MaxVMs, &quota.MaxVCPUs, &quota.MaxMemoryMB, &quota.MaxVolumes, &quota.MaxStorageGB)
+	if err == sql.ErrNoRows {
+		return DefaultProjectQuota(projectID), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &quota, nil
+}
+
+// SaveProjectQuota inserts or replaces the quota of the project
+func (quota *Quota) SaveProjectQuota(ctx context.Context) error {
+	query := `
+	INSERT INTO project_quotas (project_id, max_vms, max_vcpus, max_memory_mb, max_volumes, max_storage_gb)
+	VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT(project_id) DO UPDATE SET
+		max_vms = excluded.max_vms,
+		max_vcpus = excluded.max_vcpus,
+		max_memory_mb = excluded.max_memory_mb,
+		max_volumes = excluded.max_volumes,
+		max_storage_gb = excluded.max_storage_gb`
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, quota.ProjectID, quota.MaxVMs, quota.MaxVCPUs, quota.MaxMemoryMB, quota.MaxVolumes, quota.MaxStorageGB)
+	return err
+}
+
+// GetUsage sums up the VMs and storage volumes owned by an account outside of any project,
+// resources of projects count against the quota of their project
+func GetUsage(ctx context.Context, accountID int64) (*Usage, error) {
+	return usageWhere(ctx, "account_id = ? AND project_id = 0", accountID)
+}
+
+// GetProjectUsage sums up the VMs and storage volumes of a project
+func GetProjectUsage(ctx context.Context, projectID int64) (*Usage, error) {
+	return usageWhere(ctx, "project_id = ?", projectID)
+}
+
+// GetProjectResourcesUsage sums up the VMs and storage volumes which an account created in projects
+func GetProjectResourcesUsage(ctx context.Context, accountID int64) (*Usage, error) {
+	return usageWhere(ctx, "account_id = ? AND project_id != 0", accountID)
+}
+
+func usageWhere(ctx context.Context, condition string, arg any) (*Usage, error) {
+	var usage Usage
+
+	err := db.DB.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(SUM(cpu), 0), COALESCE(SUM(memory), 0) FROM vms WHERE "+condition, arg).
+		Scan(&usage.VMs, &usage.VCPUs, &usage.MemoryMB)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.DB.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(SUM(size_gb), 0) FROM storages WHERE "+condition, arg).
+		Scan(&usage.Volumes, &usage.StorageGB)
+	if err != nil {
+		return nil, err
+	}
+
+	return &usage, nil
+}
+
+// Exceeded returns the limits which the usage plus the requested change would exceed
+// Only growing values are checked, so shrinking is always possible
+func (quota *Quota) Exceeded(usage *Usage, delta Usage) []string {
+	var exceeded []string
+
+	if delta.VMs > 0 && quota.MaxVMs != Unlimited && usage.VMs+delta.VMs > quota.MaxVMs {
+		exceeded = append(exceeded, "vms")
+	}
+	if delta.VCPUs > 0 && quota.MaxVCPUs != Unlimited && usage.VCPUs+delta.VCPUs > quota.MaxVCPUs {
+		exceeded = append(exceeded, "vcpus")
+	}
+	if delta.MemoryMB > 0 && quota.MaxMemoryMB != Unlimited && usage.MemoryMB+delta.MemoryMB > quota.MaxMemoryMB {
+		exceeded = append(exceeded, "memory_mb")
+	}
+	if delta.Volumes > 0 && quota.MaxVolumes != Unlimited && usage.Volumes+delta.Volumes > quota.MaxVolumes {
+		exceeded = append(exceeded, "volumes")
+	}
+	if delta.StorageGB > 0 && quota.MaxStorageGB != Unlimited && usage.StorageGB+delta.StorageGB > quota.MaxStorageGB {
+		exceeded = append(exceeded, "storage_gb")
+	}
+
+	return exceeded
+}
@@ -0,0 +1,61 @@
+// Structures and DB operations
+package models
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+
+	"github.com/odeeka/go-minicloud-rest-api/db"
+)
+
+// Setting keys controlled by admins
+const (
+	// SettingEnforceImageCatalog rejects VM images which are not registered in the catalog
+	SettingEnforceImageCatalog = "images.enforce_catalog"
+)
+
+// GetSetting returns the stored value of a setting or the fallback if it was never set
+func GetSetting(ctx context.Context, key string, fallback string) (string, error) {
+	query := "SELECT value FROM settings WHERE key = ?"
+	row := db.DB.QueryRowContext(ctx, query, key)
+
+	var value string
+	err := row.Scan(&value)
+	if err == sql.ErrNoRows {
+		return fallback, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return value, nil
+}
+
+// GetBoolSetting returns a setting parsed as boolean
+func GetBoolSetting(ctx context.Context, key string, fallback bool) (bool, error) {
+	value, err := GetSetting(ctx, key, strconv.FormatBool(fallback))
+	if err != nil {
+		return false, err
+	}
+
+	return strconv.ParseBool(value)
+}
+
+// SetSetting inserts or overwrites the value of a setting
+func SetSetting(ctx context.Context, key string, value string) error {
+	query := `
+	INSERT INTO settings (key, value) VALUES (?, ?)
+	ON CONFLICT(key) DO UPDATE SET value = excluded.value`
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, key, value)
+	return err
+}
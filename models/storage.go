@@ -2,6 +2,7 @@
 package models
 
 import (
+	"context"
 	"github.com/odeeka/go-minicloud-rest-api/db"
 )
 
@@ -23,40 +24,73 @@ type Storage struct {
 
 	// The ID of the container that simulates the volume
 	ContainerID string `json:"container_id"`
+
+	// The owner of the volume, set from the authenticated account
+	AccountID int64 `json:"account_id"`
+
+	// The project of the volume, set from the selected project (0 outside of any project)
+	ProjectID int64 `json:"project_id"`
+
+	// Free-form key/value labels, also set as Docker labels on the volume when it is created
+	// (Docker can't change them later and the volume isn't recreated for them)
+	Labels map[string]string `json:"labels"`
+
+	// Counts the changes of the volume, it is the ETag of GET /storages/:id
+	Version int64 `json:"version"`
 }
 
-// Classical CRUD methods
-func GetAllStorages() ([]Storage, error) {
-	query := "SELECT * FROM storages"
-	rows, err := db.DB.Query(query)
+const storageColumns = "id, name, size_gb, vm_id, container_id, account_id, project_id, version"
+
+// scanStorage reads one storage row selected with storageColumns
+func scanStorage(row rowScanner) (*Storage, error) {
+	var storage Storage
+	err := row.Scan(&storage.ID, &storage.Name, &storage.SizeGB, &storage.VMID, &storage.ContainerID, &storage.AccountID, &storage.ProjectID, &storage.Version)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var storages []Storage
-
-	for rows.Next() {
-		var storage Storage
-		err := rows.Scan(&storage.ID, &storage.Name, &storage.SizeGB, &storage.VMID, &storage.ContainerID)
-
-		if err != nil {
-			return nil, err
-		}
+	return &storage, nil
+}
 
-		storages = append(storages, storage)
+// ListStorages returns a page of the storages of a project (0 for storages outside of any project),
+// the filters are attached, vm_id, name_prefix, account_id and selector
+func ListStorages(ctx context.Context, projectID int64, options ListOptions) ([]Storage, string, error) {
+	spec := listSpec{
+		table:       "storages",
+		columns:     storageColumns,
+		defaultSort: "id",
+		conditions:  []string{"project_id = ?"},
+		args:        []any{projectID},
+		sorts: map[string]listField{
+			"id":      {"id", fieldInt},
+			"name":    {"name", fieldText},
+			"size_gb": {"size_gb", fieldInt},
+		},
+		filters: map[string]listFilter{
+			"attached":    boolFilter("vm_id IS NOT NULL"),
+			"vm_id":       idFilter("vm_id"),
+			"name_prefix": prefixFilter("name"),
+			"account_id":  idFilter("account_id"),
+			"selector":    selectorFilter(LabelResourceStorage),
+		},
 	}
 
-	return storages, nil
+	storages, nextPageToken, err := listPage(ctx, spec, options, scanStorage)
+	if err != nil {
+		return nil, "", err
+	}
+	err = loadLabels(ctx, LabelResourceStorage, storages, func(storage *Storage) (int64, *map[string]string) {
+		return storage.ID, &storage.Labels
+	})
+	return storages, nextPageToken, err
 }
 
-func (storage *Storage) InsertStorage() error {
+func (storage *Storage) InsertStorage(ctx context.Context) error {
 
 	query := `
-	INSERT INTO storages (name, size_gb, vm_id, container_id) 
-	VALUES (?, ?, ?, ?)`
+	INSERT INTO storages (name, size_gb, vm_id, container_id, account_id, project_id) 
+	VALUES (?, ?, ?, ?, ?, ?)`
 
-	stmt, err := db.DB.Prepare(query)
+	stmt, err := db.DB.PrepareContext(ctx, query)
 
 	if err != nil {
 		return err
@@ -64,35 +98,37 @@ func (storage *Storage) InsertStorage() error {
 
 	defer stmt.Close()
 
-	result, err := stmt.Exec(storage.Name, storage.SizeGB, storage.VMID, storage.ContainerID)
+	result, err := stmt.ExecContext(ctx, storage.Name, storage.SizeGB, storage.VMID, storage.ContainerID, storage.AccountID, storage.ProjectID)
 
 	if err != nil {
 		return err
 	}
 
 	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
 	storage.ID = id
-	return err
-}
+	storage.Version = 1
 
-func GetStorageByID(id int64) (*Storage, error) {
-	query := "SELECT * FROM storages WHERE id = ?"
-	row := db.DB.QueryRow(query, id)
-
-	var storage Storage
+	return ReplaceLabels(ctx, LabelResourceStorage, storage.ID, storage.Labels)
+}
 
-	err := row.Scan(&storage.ID, &storage.Name, &storage.SizeGB, &storage.VMID, &storage.ContainerID)
+func GetStorageByID(ctx context.Context, id int64) (*Storage, error) {
+	query := "SELECT " + storageColumns + " FROM storages WHERE id = ?"
+	storage, err := scanStorage(db.DB.QueryRowContext(ctx, query, id))
 	if err != nil {
 		return nil, err
 	}
 
-	return &storage, nil
+	storage.Labels, err = GetLabels(ctx, LabelResourceStorage, storage.ID)
+	return storage, err
 }
 
-func (storage *Storage) DeleteStorageByID() error {
+func (storage *Storage) DeleteStorageByID(ctx context.Context) error {
 	query := "DELETE FROM storages WHERE id = ?"
 
-	stmt, err := db.DB.Prepare(query)
+	stmt, err := db.DB.PrepareContext(ctx, query)
 
 	if err != nil {
 		return err
@@ -100,18 +136,24 @@ func (storage *Storage) DeleteStorageByID() error {
 
 	defer stmt.Close()
 
-	_, err = stmt.Exec(storage.ID)
-	return err
+	_, err = stmt.ExecContext(ctx, storage.ID)
+	if err != nil {
+		return err
+	}
+
+	return deleteLabels(ctx, db.DB, LabelResourceStorage, storage.ID)
 }
 
-func (storage *Storage) UpdateStorageSizeByID() error {
+// UpdateStorageSizeByID stores the size if the volume still has the version of storage.Version, which is increased.
+// It returns ErrVersionConflict if another request changed the volume in the meantime
+func (storage *Storage) UpdateStorageSizeByID(ctx context.Context) error {
 	query := `
 	UPDATE storages
-	SET size_gb = ?
-	WHERE id = ?
+	SET size_gb = ?, version = version + 1
+	WHERE id = ? AND version = ?
 	`
 
-	stmt, err := db.DB.Prepare(query)
+	stmt, err := db.DB.PrepareContext(ctx, query)
 
 	if err != nil {
 		return err
@@ -119,14 +161,21 @@ func (storage *Storage) UpdateStorageSizeByID() error {
 
 	defer stmt.Close()
 
-	_, err = stmt.Exec(storage.SizeGB, storage.ID)
-	return err
+	result, err := stmt.ExecContext(ctx, storage.SizeGB, storage.ID, storage.Version)
+	if err != nil {
+		return err
+	}
+	if err := checkVersionedUpdate(result); err != nil {
+		return err
+	}
+	storage.Version++
+	return nil
 }
 
-func (storage *Storage) AttachStorageByID() error {
-	query := `UPDATE storages SET vm_id = ? WHERE id = ?`
+func (storage *Storage) AttachStorageByID(ctx context.Context) error {
+	query := `UPDATE storages SET vm_id = ?, version = version + 1 WHERE id = ? AND version = ?`
 
-	stmt, err := db.DB.Prepare(query)
+	stmt, err := db.DB.PrepareContext(ctx, query)
 
 	if err != nil {
 		return err
@@ -134,14 +183,21 @@ func (storage *Storage) AttachStorageByID() error {
 
 	defer stmt.Close()
 
-	_, err = stmt.Exec(storage.VMID, storage.ID)
-	return err
+	result, err := stmt.ExecContext(ctx, storage.VMID, storage.ID, storage.Version)
+	if err != nil {
+		return err
+	}
+	if err := checkVersionedUpdate(result); err != nil {
+		return err
+	}
+	storage.Version++
+	return nil
 }
 
-func (storage *Storage) DetachStorageByID() error {
-	query := `UPDATE storages SET vm_id = -1 WHERE id = ?`
+func (storage *Storage) DetachStorageByID(ctx context.Context) error {
+	query := `UPDATE storages SET vm_id = -1, version = version + 1 WHERE id = ? AND version = ?`
 
-	stmt, err := db.DB.Prepare(query)
+	stmt, err := db.DB.PrepareContext(ctx, query)
 
 	if err != nil {
 		return err
@@ -149,6 +205,26 @@ func (storage *Storage) DetachStorageByID() error {
 
 	defer stmt.Close()
 
-	_, err = stmt.Exec(storage.ID)
-	return err
+	result, err := stmt.ExecContext(ctx, storage.ID, storage.Version)
+	if err != nil {
+		return err
+	}
+	if err := checkVersionedUpdate(result); err != nil {
+		return err
+	}
+	storage.Version++
+	return nil
+}
+
+// Attachment states of a volume, detached volumes have no VM or the VM ID -1
+const (
+	StorageStatusAttached = "attached"
+	StorageStatusDetached = "detached"
+)
+
+// CountStoragesByStatus returns the number of volumes per attachment state
+func CountStoragesByStatus(ctx context.Context) (map[string]int, error) {
+	return countByColumn(ctx, `
+	SELECT CASE WHEN vm_id IS NULL OR vm_id <= 0 THEN '`+StorageStatusDetached+`' ELSE '`+StorageStatusAttached+`' END AS status, COUNT(*)
+	FROM storages GROUP BY status`)
 }
@@ -0,0 +1,22 @@
+// Structures and DB operations
+package models
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// ErrVersionConflict is returned by updates when the resource has another version than the one the update is based on
+var ErrVersionConflict = errors.New("the resource was changed by another request")
+
+// checkVersionedUpdate turns an update which matched no row ("WHERE id = ? AND version = ?") into ErrVersionConflict
+func checkVersionedUpdate(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrVersionConflict
+	}
+	return nil
+}
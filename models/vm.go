@@ -2,10 +2,14 @@
 package models
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
+	"strings"
 
 	"github.com/odeeka/go-minicloud-rest-api/db"
+	"github.com/odeeka/go-minicloud-rest-api/logging"
 )
 
 // VM represents a simulated virtual machine in the system.
@@ -33,7 +37,7 @@ type VM struct {
 
 	// Ports to expose on the container (e.g., [80, 443]).
 	// example: [80, 443]
-	Ports []int `json"ports"`
+	Ports []int `json:"ports"`
 
 	// Env contains environment variables passed to the container.
 	// example: {"ENV": "dev"}
@@ -42,12 +46,121 @@ type VM struct {
 	// ContainerID is the Docker container ID simulating the VM.
 	// required: false
 	ContainerID string `json:"container_id"`
+
+	// ImageDigest is the content digest of the image the container runs.
+	// Catalog images record their pinned repo digest, other images the local image ID.
+	// required: false
+	ImageDigest string `json:"image_digest"`
+
+	// Flavor is the name of the instance type which defines CPU, memory and disk.
+	// When set, it takes precedence over the CPU and Memory values of the request.
+	// example: small
+	Flavor string `json:"flavor"`
+
+	// DiskGB is the root disk size in gigabytes defined by the flavor.
+	// required: false
+	DiskGB int `json:"disk_gb"`
+
+	// AccountID is the owner of the VM, set from the authenticated account.
+	// required: false
+	AccountID int64 `json:"account_id"`
+
+	// ProjectID is the project the VM belongs to, set from the selected project
+	// (0 outside of any project).
+	// required: false
+	ProjectID int64 `json:"project_id"`
+
+	// Status is the state of the container as last seen by the reconciler
+	// (e.g., running, exited, missing).
+	// required: false
+	Status string `json:"status"`
+
+	// UserData is a "#cloud-config" document which provisions the VM on first boot
+	// (write_files, runcmd, users and ssh_authorized_keys are supported).
+	// required: false
+	UserData string `json:"user_data"`
+
+	// KeyPairIDs are the key pairs of the owner whose public keys are installed
+	// into the authorized_keys of root.
+	// example: [1]
+	KeyPairIDs []int64 `json:"key_pair_ids"`
+
+	// SSHPort is the host port mapped to port 22 of the VM (0 without key pairs).
+	// required: false
+	SSHPort int `json:"ssh_port"`
+
+	// Labels are free-form key/value pairs (e.g., team, environment or ticket), also set
+	// as Docker labels on the container, a change recreates it.
+	// example: {"env": "dev"}
+	Labels map[string]string `json:"labels"`
+
+	// Version counts the changes of the VM, it is the ETag of GET /vms/:id.
+	// required: false
+	Version int64 `json:"version"`
+}
+
+// VM states which are not reported by Docker itself
+const (
+	VMStatusRunning = "running"
+	VMStatusMissing = "missing"
+	VMStatusUnknown = "unknown"
+)
+
+// LogValue describes the VM in logs without the values of its environment variables
+// and its user data, which often contain secrets
+func (vm VM) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int64("id", vm.ID),
+		slog.String("name", vm.Name),
+		slog.String("image", vm.Image),
+		slog.Float64("cpu", vm.CPU),
+		slog.Int("memory", vm.Memory),
+		slog.Any("ports", vm.Ports),
+		slog.Any("env", logging.RedactEnv(vm.Env)),
+		slog.String("container_id", vm.ContainerID),
+		slog.Int64("account_id", vm.AccountID),
+		slog.Int64("project_id", vm.ProjectID),
+	)
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+const vmColumns = "id, name, image, cpu, memory, ports, env, container_id, image_digest, flavor, disk_gb, account_id, status, user_data, key_pair_ids, ssh_port, project_id, version"
+
+// scanVM reads one VM row selected with vmColumns
+func scanVM(row rowScanner) (*VM, error) {
+	var vm VM
+	var portsJSON string
+	var envJSON string
+	var keyPairIDsJSON string
+
+	err := row.Scan(&vm.ID, &vm.Name, &vm.Image, &vm.CPU, &vm.Memory, &portsJSON, &envJSON, &vm.ContainerID, &vm.ImageDigest,
+		&vm.Flavor, &vm.DiskGB, &vm.AccountID, &vm.Status, &vm.UserData, &keyPairIDsJSON, &vm.SSHPort, &vm.ProjectID, &vm.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse JSON strings to Go types
+	if err := json.Unmarshal([]byte(portsJSON), &vm.Ports); err != nil {
+		return nil, fmt.Errorf("failed to parse ports JSON: %w", err)
+	}
+	if err := json.Unmarshal([]byte(envJSON), &vm.Env); err != nil {
+		return nil, fmt.Errorf("failed to parse env JSON: %w", err)
+	}
+	if err := json.Unmarshal([]byte(keyPairIDsJSON), &vm.KeyPairIDs); err != nil {
+		return nil, fmt.Errorf("failed to parse key pair IDs JSON: %w", err)
+	}
+
+	return &vm, nil
 }
 
 // Classical CRUD methods
-func GetAllVms() ([]VM, error) {
-	query := "SELECT * FROM vms"
-	rows, err := db.DB.Query(query)
+func GetAllVms(ctx context.Context) ([]VM, error) {
+	query := "SELECT " + vmColumns + " FROM vms"
+	rows, err := db.DB.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -56,39 +169,73 @@ func GetAllVms() ([]VM, error) {
 	var vms []VM
 
 	for rows.Next() {
-		var vm VM
-		var portsStr string
-		var envStr string
-		err := rows.Scan(&vm.ID, &vm.Name, &vm.Image, &vm.CPU, &vm.Memory, &portsStr, &envStr, &vm.ContainerID)
+		vm, err := scanVM(rows)
 
 		if err != nil {
 			return nil, err
 		}
 
-		// Convert from JSON string to Go type
-		if err := json.Unmarshal([]byte(portsStr), &vm.Ports); err != nil {
-			return nil, err
-		}
-		if err := json.Unmarshal([]byte(envStr), &vm.Env); err != nil {
-			return nil, err
-		}
-
-		vms = append(vms, vm)
+		vms = append(vms, *vm)
 	}
 
 	return vms, nil
 }
 
-func (vm *VM) InsertVM() error {
+// ListVMs returns a page of the VMs of a project (0 for VMs outside of any project),
+// the filters are image, status, name_prefix, flavor, account_id and selector
+func ListVMs(ctx context.Context, projectID int64, options ListOptions) ([]VM, string, error) {
+	spec := listSpec{
+		table:       "vms",
+		columns:     vmColumns,
+		defaultSort: "id",
+		conditions:  []string{"project_id = ?"},
+		args:        []any{projectID},
+		sorts: map[string]listField{
+			"id":     {"id", fieldInt},
+			"name":   {"name", fieldText},
+			"image":  {"image", fieldText},
+			"status": {"status", fieldText},
+			"cpu":    {"cpu", fieldFloat},
+			"memory": {"memory", fieldInt},
+		},
+		filters: map[string]listFilter{
+			"image":       imageFilter,
+			"status":      equalsFilter("status"),
+			"name_prefix": prefixFilter("name"),
+			"flavor":      equalsFilter("flavor"),
+			"account_id":  idFilter("account_id"),
+			"selector":    selectorFilter(LabelResourceVM),
+		},
+	}
+
+	vms, nextPageToken, err := listPage(ctx, spec, options, scanVM)
+	if err != nil {
+		return nil, "", err
+	}
+	err = loadLabels(ctx, LabelResourceVM, vms, func(vm *VM) (int64, *map[string]string) { return vm.ID, &vm.Labels })
+	return vms, nextPageToken, err
+}
+
+// imageFilter matches an image with any tag (e.g., nginx matches nginx and nginx:1.27) or exactly with a tag
+func imageFilter(value string) (string, []any, error) {
+	if strings.Contains(value, ":") || strings.Contains(value, "@") {
+		return "image = ?", []any{value}, nil
+	}
+	condition, args, err := prefixFilter("image")(value + ":")
+	return "(image = ? OR " + condition + ")", append([]any{value}, args...), err
+}
+
+func (vm *VM) InsertVM(ctx context.Context) error {
 
 	portsJSON, _ := json.Marshal(vm.Ports)
 	envJSON, _ := json.Marshal(vm.Env)
+	keyPairIDsJSON, _ := json.Marshal(vm.KeyPairIDs)
 
 	query := `
-	INSERT INTO vms (name, image, cpu, memory, ports, env, container_id) 
-	VALUES (?, ?, ?, ?, ?, ?, ?)`
+	INSERT INTO vms (name, image, cpu, memory, ports, env, container_id, image_digest, flavor, disk_gb, account_id, status, user_data, key_pair_ids, ssh_port, project_id) 
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
-	stmt, err := db.DB.Prepare(query)
+	stmt, err := db.DB.PrepareContext(ctx, query)
 
 	if err != nil {
 		return err
@@ -96,45 +243,38 @@ func (vm *VM) InsertVM() error {
 
 	defer stmt.Close()
 
-	result, err := stmt.Exec(vm.Name, vm.Image, vm.CPU, vm.Memory, string(portsJSON), string(envJSON), vm.ContainerID)
+	result, err := stmt.ExecContext(ctx, vm.Name, vm.Image, vm.CPU, vm.Memory, string(portsJSON), string(envJSON), vm.ContainerID, vm.ImageDigest,
+		vm.Flavor, vm.DiskGB, vm.AccountID, vm.Status, vm.UserData, string(keyPairIDsJSON), vm.SSHPort, vm.ProjectID)
 
 	if err != nil {
 		return err
 	}
 
 	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
 	vm.ID = id
-	return err
-}
+	vm.Version = 1
 
-func GetVMByID(id int64) (*VM, error) {
-	query := "SELECT * FROM vms WHERE id = ?"
-	row := db.DB.QueryRow(query, id)
-
-	var vm VM
-	var portsJSON string
-	var envJSON string
+	return ReplaceLabels(ctx, LabelResourceVM, vm.ID, vm.Labels)
+}
 
-	err := row.Scan(&vm.ID, &vm.Name, &vm.Image, &vm.CPU, &vm.Memory, &portsJSON, &envJSON, &vm.ContainerID)
+func GetVMByID(ctx context.Context, id int64) (*VM, error) {
+	query := "SELECT " + vmColumns + " FROM vms WHERE id = ?"
+	vm, err := scanVM(db.DB.QueryRowContext(ctx, query, id))
 	if err != nil {
 		return nil, err
 	}
 
-	// Parse JSON strings to Go types
-	if err := json.Unmarshal([]byte(portsJSON), &vm.Ports); err != nil {
-		return nil, fmt.Errorf("failed to parse ports JSON: %w", err)
-	}
-	if err := json.Unmarshal([]byte(envJSON), &vm.Env); err != nil {
-		return nil, fmt.Errorf("failed to parse env JSON: %w", err)
-	}
-
-	return &vm, nil
+	vm.Labels, err = GetLabels(ctx, LabelResourceVM, vm.ID)
+	return vm, err
 }
 
-func (vm *VM) DeleteVMByID() error {
+func (vm *VM) DeleteVMByID(ctx context.Context) error {
 	query := "DELETE FROM vms WHERE id = ?"
 
-	stmt, err := db.DB.Prepare(query)
+	stmt, err := db.DB.PrepareContext(ctx, query)
 
 	if err != nil {
 		return err
@@ -142,21 +282,29 @@ func (vm *VM) DeleteVMByID() error {
 
 	defer stmt.Close()
 
-	_, err = stmt.Exec(vm.ID)
-	return err
+	_, err = stmt.ExecContext(ctx, vm.ID)
+	if err != nil {
+		return err
+	}
+
+	return deleteLabels(ctx, db.DB, LabelResourceVM, vm.ID)
 }
 
-func (vm *VM) UpdateVMByID() error {
+// UpdateVMByID stores the VM if it still has the version of vm.Version, which is increased.
+// It returns ErrVersionConflict if another request changed the VM in the meantime
+func (vm *VM) UpdateVMByID(ctx context.Context) error {
 	query := `
 	UPDATE vms
-	SET name = ?, image = ?, cpu = ?, memory = ?, ports = ?, env = ?, container_id = ?
-	WHERE id = ?
+	SET name = ?, image = ?, cpu = ?, memory = ?, ports = ?, env = ?, container_id = ?, image_digest = ?, flavor = ?, disk_gb = ?, status = ?, user_data = ?, key_pair_ids = ?, ssh_port = ?,
+	version = version + 1
+	WHERE id = ? AND version = ?
 	`
 
 	portsJSON, _ := json.Marshal(vm.Ports)
 	envJSON, _ := json.Marshal(vm.Env)
+	keyPairIDsJSON, _ := json.Marshal(vm.KeyPairIDs)
 
-	stmt, err := db.DB.Prepare(query)
+	stmt, err := db.DB.PrepareContext(ctx, query)
 
 	if err != nil {
 		return err
@@ -164,6 +312,57 @@ func (vm *VM) UpdateVMByID() error {
 
 	defer stmt.Close()
 
-	_, err = stmt.Exec(vm.Name, vm.Image, vm.CPU, vm.Memory, string(portsJSON), string(envJSON), vm.ContainerID, vm.ID)
+	result, err := stmt.ExecContext(ctx, vm.Name, vm.Image, vm.CPU, vm.Memory, string(portsJSON), string(envJSON), vm.ContainerID, vm.ImageDigest,
+		vm.Flavor, vm.DiskGB, vm.Status, vm.UserData, string(keyPairIDsJSON), vm.SSHPort, vm.ID, vm.Version)
+	if err != nil {
+		return err
+	}
+	if err := checkVersionedUpdate(result); err != nil {
+		return err
+	}
+	vm.Version++
+
+	return ReplaceLabels(ctx, LabelResourceVM, vm.ID, vm.Labels)
+}
+
+// UpdateVMStatus stores the container state observed by the reconciler
+func (vm *VM) UpdateVMStatus(ctx context.Context) error {
+	query := "UPDATE vms SET status = ? WHERE id = ?"
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, vm.Status, vm.ID)
 	return err
 }
+
+// CountVMsByStatus returns the number of VMs per stored status
+func CountVMsByStatus(ctx context.Context) (map[string]int, error) {
+	return countByColumn(ctx, "SELECT status, COUNT(*) FROM vms GROUP BY status")
+}
+
+// countByColumn reads "SELECT <value>, COUNT(*) ... GROUP BY <value>" into a map
+func countByColumn(ctx context.Context, query string) (map[string]int, error) {
+	rows, err := db.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		var value string
+		var count int
+		if err := rows.Scan(&value, &count); err != nil {
+			return nil, err
+		}
+		counts[value] = count
+	}
+
+	return counts, rows.Err()
+}
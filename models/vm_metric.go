@@ -0,0 +1,163 @@
+// Structures and DB operations
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/db"
+)
+
+// Resolutions of the stored VM metrics, raw samples are downsampled to hourly points
+const (
+	MetricResolutionRaw  = "raw"
+	MetricResolutionHour = "1h"
+)
+
+// VMMetricSample is the resource usage of a VM at one point in time.
+// CPU and memory are averages with their peak, network and block I/O are bytes transferred since the previous point.
+type VMMetricSample struct {
+	VMID            int64     `json:"-"`
+	Time            time.Time `json:"time"`
+	CPUCores        float64   `json:"cpu_cores"`
+	CPUCoresMax     float64   `json:"cpu_cores_max"`
+	MemoryMB        float64   `json:"memory_mb"`
+	MemoryMBMax     float64   `json:"memory_mb_max"`
+	NetRxBytes      int64     `json:"net_rx_bytes"`
+	NetTxBytes      int64     `json:"net_tx_bytes"`
+	BlockReadBytes  int64     `json:"block_read_bytes"`
+	BlockWriteBytes int64     `json:"block_write_bytes"`
+}
+
+// VMMetricsSummary compares the recent usage of a VM with its CPU and memory settings
+type VMMetricsSummary struct {
+	Window            string  `json:"window"`
+	Samples           int     `json:"samples"`
+	CPUCoresAvg       float64 `json:"cpu_cores_avg"`
+	CPUCoresMax       float64 `json:"cpu_cores_max"`
+	CPUUtilization    float64 `json:"cpu_utilization"` // average share of the allocated CPUs (0-1)
+	MemoryMBAvg       float64 `json:"memory_mb_avg"`
+	MemoryMBMax       float64 `json:"memory_mb_max"`
+	MemoryUtilization float64 `json:"memory_utilization"` // peak share of the allocated memory (0-1)
+}
+
+// InsertVMMetricSample stores a raw sample
+func (sample *VMMetricSample) InsertVMMetricSample(ctx context.Context) error {
+	query := `
+	INSERT OR REPLACE INTO vm_metrics (vm_id, resolution, ts, cpu_cores, cpu_cores_max, memory_mb, memory_mb_max,
+		net_rx_bytes, net_tx_bytes, block_read_bytes, block_write_bytes)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, sample.VMID, MetricResolutionRaw, sample.Time.Unix(), sample.CPUCores, sample.CPUCoresMax,
+		sample.MemoryMB, sample.MemoryMBMax, sample.NetRxBytes, sample.NetTxBytes, sample.BlockReadBytes, sample.BlockWriteBytes)
+	return err
+}
+
+// DownsampleVMMetrics rolls the raw samples of complete hours up into hourly points
+// and removes raw samples older than rawRetention and hourly points older than hourRetention
+func DownsampleVMMetrics(ctx context.Context, rawRetention, hourRetention time.Duration) error {
+	now := time.Now()
+	currentHour := now.Truncate(time.Hour).Unix()
+
+	query := `
+	INSERT OR IGNORE INTO vm_metrics (vm_id, resolution, ts, cpu_cores, cpu_cores_max, memory_mb, memory_mb_max,
+		net_rx_bytes, net_tx_bytes, block_read_bytes, block_write_bytes)
+	SELECT vm_id, ?, (ts / 3600) * 3600, AVG(cpu_cores), MAX(cpu_cores_max), AVG(memory_mb), MAX(memory_mb_max),
+		SUM(net_rx_bytes), SUM(net_tx_bytes), SUM(block_read_bytes), SUM(block_write_bytes)
+	FROM vm_metrics
+	WHERE resolution = ? AND ts < ?
+	GROUP BY vm_id, ts / 3600`
+
+	if _, err := db.DB.ExecContext(ctx, query, MetricResolutionHour, MetricResolutionRaw, currentHour); err != nil {
+		return err
+	}
+
+	_, err := db.DB.ExecContext(ctx, "DELETE FROM vm_metrics WHERE (resolution = ? AND ts < ?) OR (resolution = ? AND ts < ?)",
+		MetricResolutionRaw, now.Add(-rawRetention).Unix(), MetricResolutionHour, now.Add(-hourRetention).Unix())
+	return err
+}
+
+// GetVMMetrics aggregates the samples of a VM in [from, to) into buckets of step
+// Ranges within rawSince use the raw samples, older ranges the hourly points
+// and the raw samples of the hours which are not rolled up yet
+func GetVMMetrics(ctx context.Context, vmID int64, from, to time.Time, step time.Duration, rawSince time.Time) ([]VMMetricSample, error) {
+	filter := "resolution = 'raw'"
+	if from.Before(rawSince) {
+		filter = `(
+			(resolution = '1h' AND ts < rolled_up.until) OR
+			(resolution = 'raw' AND ts >= rolled_up.until)
+		)`
+	}
+
+	stepSeconds := int64(step.Seconds())
+	query := `
+	SELECT (ts / ?) * ?, AVG(cpu_cores), MAX(cpu_cores_max), AVG(memory_mb), MAX(memory_mb_max),
+		SUM(net_rx_bytes), SUM(net_tx_bytes), SUM(block_read_bytes), SUM(block_write_bytes)
+	FROM vm_metrics, (
+		SELECT COALESCE(MAX(ts) + 3600, 0) AS until FROM vm_metrics WHERE vm_id = ? AND resolution = '1h'
+	) AS rolled_up
+	WHERE vm_id = ? AND ts >= ? AND ts < ? AND ` + filter + `
+	GROUP BY ts / ?
+	ORDER BY 1`
+
+	rows, err := db.DB.QueryContext(ctx, query, stepSeconds, stepSeconds, vmID, vmID, from.Unix(), to.Unix(), stepSeconds)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := []VMMetricSample{}
+
+	for rows.Next() {
+		var sample VMMetricSample
+		var ts int64
+		err := rows.Scan(&ts, &sample.CPUCores, &sample.CPUCoresMax, &sample.MemoryMB, &sample.MemoryMBMax,
+			&sample.NetRxBytes, &sample.NetTxBytes, &sample.BlockReadBytes, &sample.BlockWriteBytes)
+		if err != nil {
+			return nil, err
+		}
+		sample.VMID = vmID
+		sample.Time = time.Unix(ts, 0).UTC()
+		samples = append(samples, sample)
+	}
+
+	return samples, nil
+}
+
+// GetVMMetricsSummary summarizes the raw samples of the VM since the given time
+func GetVMMetricsSummary(ctx context.Context, vm *VM, since time.Time, window string) (*VMMetricsSummary, error) {
+	query := `
+	SELECT COUNT(*), COALESCE(AVG(cpu_cores), 0), COALESCE(MAX(cpu_cores_max), 0), COALESCE(AVG(memory_mb), 0), COALESCE(MAX(memory_mb_max), 0)
+	FROM vm_metrics
+	WHERE vm_id = ? AND resolution = ? AND ts >= ?`
+
+	summary := VMMetricsSummary{Window: window}
+	err := db.DB.QueryRowContext(ctx, query, vm.ID, MetricResolutionRaw, since.Unix()).Scan(&summary.Samples,
+		&summary.CPUCoresAvg, &summary.CPUCoresMax, &summary.MemoryMBAvg, &summary.MemoryMBMax)
+	if err != nil {
+		return nil, err
+	}
+
+	if vm.CPU > 0 {
+		summary.CPUUtilization = summary.CPUCoresAvg / vm.CPU
+	}
+	if vm.Memory > 0 {
+		summary.MemoryUtilization = summary.MemoryMBMax / float64(vm.Memory)
+	}
+
+	return &summary, nil
+}
+
+// DeleteVMMetrics removes the metrics of a deleted VM
+func DeleteVMMetrics(ctx context.Context, vmID int64) error {
+	_, err := db.DB.ExecContext(ctx, "DELETE FROM vm_metrics WHERE vm_id = ?", vmID)
+	return err
+}
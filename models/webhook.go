@@ -0,0 +1,372 @@
+// Structures and DB operations
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/db"
+)
+
+// Webhook subscribes a URL to event types of the event stream.
+// @Description The signing secret is only returned once, in the response of the creation.
+type Webhook struct {
+	// The unique ID of the webhook
+	ID int64 `json:"id"`
+
+	// The account which owns the webhook, it receives the events of the account (all events for admins)
+	AccountID int64 `json:"account_id"`
+
+	// The http(s) URL the events are POSTed to
+	URL string `json:"url"`
+
+	// The subscribed event types (e.g., vm.state_changed), "vm.*" for all types of a resource or "*" for all
+	EventTypes []string `json:"event_types"`
+
+	// Description to recognize the webhook (e.g., "chat bot")
+	Description string `json:"description"`
+
+	// Inactive webhooks receive no deliveries
+	Active bool `json:"active"`
+
+	// The secret of the HMAC signature, only set in the response of the creation
+	Secret string `json:"secret,omitempty"`
+
+	// Creation time of the webhook
+	CreatedAt time.Time `json:"created_at"`
+
+	// Counts the changes of the webhook, it is the ETag of GET /webhooks/:id
+	Version int64 `json:"version"`
+}
+
+// Matches reports whether the webhook is subscribed to the event type
+func (webhook *Webhook) Matches(eventType string) bool {
+	resource, _, _ := strings.Cut(eventType, ".")
+	for _, subscribed := range webhook.EventTypes {
+		if subscribed == "*" || subscribed == eventType || subscribed == resource+".*" {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidWebhookEventType reports whether a subscription names an event type, all types of a resource or all types
+func ValidWebhookEventType(eventType string) bool {
+	if eventType == "*" || slices.Contains(EventTypes, eventType) {
+		return true
+	}
+
+	resource, found := strings.CutSuffix(eventType, ".*")
+	return found && slices.ContainsFunc(EventTypes, func(known string) bool {
+		return strings.HasPrefix(known, resource+".")
+	})
+}
+
+const webhookColumns = "id, account_id, url, event_types, description, active, created_at, version"
+
+func scanWebhook(row rowScanner) (*Webhook, error) {
+	var webhook Webhook
+	var eventTypes string
+	err := row.Scan(&webhook.ID, &webhook.AccountID, &webhook.URL, &eventTypes, &webhook.Description, &webhook.Active, &webhook.CreatedAt, &webhook.Version)
+	if err != nil {
+		return nil, err
+	}
+	webhook.EventTypes = strings.Split(eventTypes, ",")
+	return &webhook, nil
+}
+
+// ListWebhooks returns a page of the webhooks of the account, the filter is active
+func ListWebhooks(ctx context.Context, accountID int64, options ListOptions) ([]Webhook, string, error) {
+	spec := listSpec{
+		table:       "webhooks",
+		columns:     webhookColumns,
+		defaultSort: "id",
+		sorts: map[string]listField{
+			"id":         {"id", fieldInt},
+			"created_at": {"created_at", fieldTime},
+		},
+		filters: map[string]listFilter{
+			"active": boolFilter("active = 1"),
+		},
+		conditions: []string{"account_id = ?"},
+		args:       []any{accountID},
+	}
+	return listPage(ctx, spec, options, scanWebhook)
+}
+
+// GetWebhookByID returns a single webhook, or nil if there is none with this ID
+func GetWebhookByID(ctx context.Context, id int64) (*Webhook, error) {
+	query := "SELECT " + webhookColumns + " FROM webhooks WHERE id = ?"
+	webhook, err := scanWebhook(db.DB.QueryRowContext(ctx, query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return webhook, err
+}
+
+// GetWebhooksForEvent returns the active webhooks receiving the events of the account outside of projects,
+// or with a project ID those of the current members of the project. Admins receive all events and
+// events of account 0 (e.g., catalog images) go to every account
+func GetWebhooksForEvent(ctx context.Context, accountID, projectID int64) ([]Webhook, error) {
+	query := `
+	SELECT webhooks.id, webhooks.account_id, webhooks.url, webhooks.event_types, webhooks.description, webhooks.active, webhooks.created_at, webhooks.version
+	FROM webhooks JOIN accounts ON accounts.id = webhooks.account_id
+	WHERE webhooks.active = 1 AND (? = 0 OR accounts.role = ?
+		OR (? = 0 AND webhooks.account_id = ?)
+		OR webhooks.account_id IN (SELECT account_id FROM project_members WHERE project_id = ?))`
+
+	rows, err := db.DB.QueryContext(ctx, query, accountID, RoleAdmin, projectID, accountID, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []Webhook
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, *webhook)
+	}
+
+	return webhooks, rows.Err()
+}
+
+// GetWebhookSecret returns the signing secret of a webhook
+func GetWebhookSecret(ctx context.Context, id int64) (string, error) {
+	var secret string
+	err := db.DB.QueryRowContext(ctx, "SELECT secret FROM webhooks WHERE id = ?", id).Scan(&secret)
+	return secret, err
+}
+
+// InsertWebhook stores the webhook with its secret, which is set by the caller
+func (webhook *Webhook) InsertWebhook(ctx context.Context) error {
+	webhook.CreatedAt = time.Now().UTC()
+
+	query := `
+	INSERT INTO webhooks (account_id, url, event_types, description, secret, active, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, webhook.AccountID, webhook.URL, strings.Join(webhook.EventTypes, ","), webhook.Description,
+		webhook.Secret, webhook.Active, webhook.CreatedAt)
+
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	webhook.ID = id
+	webhook.Version = 1
+	return err
+}
+
+// UpdateWebhook stores URL, event types, description and state of the webhook if it still has the version
+// of webhook.Version, which is increased. It returns ErrVersionConflict if another request changed the webhook in the meantime
+func (webhook *Webhook) UpdateWebhook(ctx context.Context) error {
+	query := "UPDATE webhooks SET url = ?, event_types = ?, description = ?, active = ?, version = version + 1 WHERE id = ? AND version = ?"
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, webhook.URL, strings.Join(webhook.EventTypes, ","), webhook.Description, webhook.Active, webhook.ID, webhook.Version)
+	if err != nil {
+		return err
+	}
+	if err := checkVersionedUpdate(result); err != nil {
+		return err
+	}
+	webhook.Version++
+	return nil
+}
+
+// DeleteWebhookByID deletes the webhook with its delivery log
+func (webhook *Webhook) DeleteWebhookByID(ctx context.Context) error {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM webhook_deliveries WHERE webhook_id = ?", webhook.ID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM webhooks WHERE id = ?", webhook.ID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Status of webhook deliveries, dead deliveries failed every attempt and wait for a manual redelivery
+const (
+	DeliveryStatusPending   = "pending"
+	DeliveryStatusSucceeded = "succeeded"
+	DeliveryStatusDead      = "dead"
+)
+
+// WebhookDelivery is an event sent (or to be sent) to a webhook, with the result of the last attempt.
+// @Description An entry of the delivery log of a webhook.
+type WebhookDelivery struct {
+	ID        int64  `json:"id"`
+	WebhookID int64  `json:"webhook_id"`
+	EventID   int64  `json:"event_id"`
+	EventType string `json:"event_type"`
+
+	// The JSON body which is POSTed
+	Payload json.RawMessage `json:"payload" swaggertype:"object"`
+
+	// pending, succeeded or dead
+	Status   string `json:"status"`
+	Attempts int    `json:"attempts"`
+
+	// The HTTP status or error of the last attempt
+	LastStatusCode int    `json:"last_status_code"`
+	LastError      string `json:"last_error"`
+
+	// When a pending delivery is attempted next
+	NextAttemptAt *time.Time `json:"next_attempt_at"`
+	DeliveredAt   *time.Time `json:"delivered_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+const webhookDeliveryColumns = "id, webhook_id, event_id, event_type, payload, status, attempts, last_status_code, last_error, next_attempt_at, delivered_at, created_at"
+
+func scanWebhookDelivery(row rowScanner) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	var payload string
+	err := row.Scan(&delivery.ID, &delivery.WebhookID, &delivery.EventID, &delivery.EventType, &payload, &delivery.Status, &delivery.Attempts,
+		&delivery.LastStatusCode, &delivery.LastError, &delivery.NextAttemptAt, &delivery.DeliveredAt, &delivery.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	delivery.Payload = json.RawMessage(payload)
+	return &delivery, nil
+}
+
+func queryWebhookDeliveries(ctx context.Context, query string, args ...any) ([]WebhookDelivery, error) {
+	rows, err := db.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// ListWebhookDeliveries returns a page of the delivery log of a webhook, newest first unless sorted otherwise.
+// The filters are status (dead for the dead letters) and event_type
+func ListWebhookDeliveries(ctx context.Context, webhookID int64, options ListOptions) ([]WebhookDelivery, string, error) {
+	spec := listSpec{
+		table:       "webhook_deliveries",
+		columns:     webhookDeliveryColumns,
+		defaultSort: "-id",
+		sorts: map[string]listField{
+			"id":         {"id", fieldInt},
+			"created_at": {"created_at", fieldTime},
+		},
+		filters: map[string]listFilter{
+			"status":     equalsFilter("status"),
+			"event_type": equalsFilter("event_type"),
+		},
+		conditions: []string{"webhook_id = ?"},
+		args:       []any{webhookID},
+	}
+	return listPage(ctx, spec, options, scanWebhookDelivery)
+}
+
+// GetWebhookDeliveryByID returns a delivery of the webhook, or nil if there is none with this ID
+func GetWebhookDeliveryByID(ctx context.Context, webhookID, id int64) (*WebhookDelivery, error) {
+	query := "SELECT " + webhookDeliveryColumns + " FROM webhook_deliveries WHERE id = ? AND webhook_id = ?"
+	delivery, err := scanWebhookDelivery(db.DB.QueryRowContext(ctx, query, id, webhookID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return delivery, err
+}
+
+// GetDueWebhookDeliveries returns up to limit pending deliveries whose next attempt is due
+func GetDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]WebhookDelivery, error) {
+	query := "SELECT " + webhookDeliveryColumns + " FROM webhook_deliveries WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at, id LIMIT ?"
+	return queryWebhookDeliveries(ctx, query, DeliveryStatusPending, now.UTC(), limit)
+}
+
+// InsertWebhookDelivery queues the delivery
+func (delivery *WebhookDelivery) InsertWebhookDelivery(ctx context.Context) error {
+	delivery.CreatedAt = time.Now().UTC()
+
+	query := `
+	INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload, status, attempts, last_status_code, last_error, next_attempt_at, delivered_at, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	result, err := stmt.ExecContext(ctx, delivery.WebhookID, delivery.EventID, delivery.EventType, string(delivery.Payload), delivery.Status,
+		delivery.Attempts, delivery.LastStatusCode, delivery.LastError, delivery.NextAttemptAt, delivery.DeliveredAt, delivery.CreatedAt)
+
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	delivery.ID = id
+	return err
+}
+
+// UpdateWebhookDelivery stores the status and the result of the last attempt
+func (delivery *WebhookDelivery) UpdateWebhookDelivery(ctx context.Context) error {
+	query := `
+	UPDATE webhook_deliveries SET status = ?, attempts = ?, last_status_code = ?, last_error = ?, next_attempt_at = ?, delivered_at = ?
+	WHERE id = ?`
+
+	stmt, err := db.DB.PrepareContext(ctx, query)
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, delivery.Status, delivery.Attempts, delivery.LastStatusCode, delivery.LastError,
+		delivery.NextAttemptAt, delivery.DeliveredAt, delivery.ID)
+	return err
+}
+
+// DeleteWebhookDeliveriesBefore removes finished deliveries older than the cutoff, pending deliveries are kept
+func DeleteWebhookDeliveriesBefore(ctx context.Context, cutoff time.Time) error {
+	_, err := db.DB.ExecContext(ctx, "DELETE FROM webhook_deliveries WHERE status != ? AND created_at < ?", DeliveryStatusPending, cutoff.UTC())
+	return err
+}
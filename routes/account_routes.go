@@ -4,12 +4,34 @@ package routes
 import (
 	"github.com/gin-gonic/gin"
 	"github.com/odeeka/go-minicloud-rest-api/handlers"
+	"github.com/odeeka/go-minicloud-rest-api/middlewares"
 )
 
 func RegisterAccountRoutes(server *gin.Engine) {
 
 	accountsGroup := server.Group("/accounts")
-	accountsGroup.GET("", handlers.GetAccounts)
-	accountsGroup.POST("", handlers.RegisterAccount)
+	// Sign-ups take anonymous Idempotency-Keys, logins are safe to retry and their tokens are not stored
+	accountsGroup.POST("", middlewares.Idempotency, handlers.RegisterAccount)
 	accountsGroup.POST("/login", handlers.LoginAccount)
+
+	// with authentication through middleware
+	// API keys are shown once, so their creation takes no Idempotency-Key: a replay would store the key in clear
+	authAccountsGroup := accountsGroup.Group("")
+	authAccountsGroup.Use(middlewares.Authenticate)
+	authAccountsGroup.GET("/api-keys", handlers.ListAPIKeys)
+	authAccountsGroup.POST("/api-keys", handlers.CreateAPIKey)
+	authAccountsGroup.DELETE("/api-keys/:id", handlers.DeleteAPIKey)
+	authAccountsGroup.DELETE("/:id", handlers.DeleteAccount)
+	authAccountsGroup.GET("/:id/quota", handlers.GetAccountQuota)
+	authAccountsGroup.GET("/:id/usage", handlers.GetAccountUsage)
+	authAccountsGroup.GET("/:id/invoices", handlers.GetAccountInvoice)
+
+	// account administration is restricted to admins
+	adminAccountsGroup := authAccountsGroup.Group("")
+	adminAccountsGroup.Use(middlewares.RequireAdmin)
+	adminAccountsGroup.GET("", handlers.GetAccounts)
+	adminAccountsGroup.PUT("/:id/quota", handlers.UpdateAccountQuota)
+	adminAccountsGroup.GET("/:id/permissions", handlers.GetAccountPermissions)
+	adminAccountsGroup.PUT("/:id/permissions/:permission", handlers.GrantAccountPermission)
+	adminAccountsGroup.DELETE("/:id/permissions/:permission", handlers.RevokeAccountPermission)
 }
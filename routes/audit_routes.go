@@ -0,0 +1,16 @@
+// To define / register the REST routes and endpoints
+package routes
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/handlers"
+	"github.com/odeeka/go-minicloud-rest-api/middlewares"
+)
+
+func RegisterAuditRoutes(server *gin.Engine) {
+
+	// the audit trail is restricted to admins
+	adminAuditGroup := server.Group("/audit")
+	adminAuditGroup.Use(middlewares.Authenticate, middlewares.RequireAdmin)
+	adminAuditGroup.GET("", handlers.ListAuditEvents)
+}
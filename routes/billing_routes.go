@@ -0,0 +1,21 @@
+// To define / register the REST routes and endpoints
+package routes
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/handlers"
+	"github.com/odeeka/go-minicloud-rest-api/middlewares"
+)
+
+func RegisterBillingRoutes(server *gin.Engine) {
+
+	// with authentication through middleware
+	authPricesGroup := server.Group("/prices")
+	authPricesGroup.Use(middlewares.Authenticate)
+	authPricesGroup.GET("", handlers.ListPrices)
+
+	// the price list is managed by admins
+	adminPricesGroup := authPricesGroup.Group("")
+	adminPricesGroup.Use(middlewares.RequireAdmin)
+	adminPricesGroup.PUT("/:item", handlers.UpdatePrice)
+}
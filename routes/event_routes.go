@@ -0,0 +1,16 @@
+// To define / register the REST routes and endpoints
+package routes
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/handlers"
+	"github.com/odeeka/go-minicloud-rest-api/middlewares"
+)
+
+func RegisterEventRoutes(server *gin.Engine) {
+
+	// with authentication through middleware
+	authEventsGroup := server.Group("/events")
+	authEventsGroup.Use(middlewares.Authenticate)
+	authEventsGroup.GET("", handlers.StreamEvents)
+}
@@ -0,0 +1,24 @@
+// To define / register the REST routes and endpoints
+package routes
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/handlers"
+	"github.com/odeeka/go-minicloud-rest-api/middlewares"
+)
+
+func RegisterFlavorsRoutes(server *gin.Engine) {
+
+	// with authentication through middleware
+	authFlavorsGroup := server.Group("/flavors")
+	authFlavorsGroup.Use(middlewares.Authenticate, middlewares.Idempotency)
+	authFlavorsGroup.GET("", handlers.ListFlavors)
+	authFlavorsGroup.GET("/:id", handlers.GetFlavor)
+
+	// flavor management is restricted to admins
+	adminFlavorsGroup := authFlavorsGroup.Group("")
+	adminFlavorsGroup.Use(middlewares.RequireAdmin)
+	adminFlavorsGroup.POST("", handlers.CreateFlavor)
+	adminFlavorsGroup.PUT("/:id", handlers.UpdateFlavor)
+	adminFlavorsGroup.DELETE("/:id", handlers.DeleteFlavor)
+}
@@ -0,0 +1,94 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/db"
+	"github.com/odeeka/go-minicloud-rest-api/handlers"
+	"github.com/odeeka/go-minicloud-rest-api/middlewares"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+)
+
+// testServer registers the routes on a fresh database and returns a token of a new account
+func testServer(t *testing.T) (*gin.Engine, string) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	db.InitDB()
+	t.Cleanup(func() { db.DB.Close() })
+
+	ctx := context.Background()
+	if err := (models.Account{Username: "alice", Password: "pw"}).Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	account, err := models.GetAccountByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := utils.GenerateToken(account.Username, account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	server := gin.New()
+	handlers.RegisterValidators()
+	RegisterAccountRoutes(server)
+	RegisterKeyPairsRoutes(server)
+	RegisterWebhookRoutes(server)
+	return server, token
+}
+
+// Responses which carry a secret must never be stored for a replay of their Idempotency-Key
+func TestSecretsAreNotReplayed(t *testing.T) {
+	t.Setenv("MINICLOUD_WEBHOOK_ALLOW_PRIVATE", "true")
+
+	tests := []struct {
+		path   string
+		body   string
+		secret string
+	}{
+		{"/accounts/api-keys", `{"name":"ci"}`, `"key":"`},
+		{"/key-pairs", `{"name":"generated"}`, "PRIVATE KEY"},
+		{"/webhooks", `{"url":"http://127.0.0.1:9/hook","event_types":["*"]}`, `"secret":"`},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			server, token := testServer(t)
+
+			var bodies []string
+			for attempt := range 2 {
+				request := httptest.NewRequest(http.MethodPost, test.path, strings.NewReader(test.body))
+				request.Header.Set("Authorization", token)
+				request.Header.Set("Content-Type", "application/json")
+				request.Header.Set(middlewares.IdempotencyKeyHeader, "retry-1")
+				recorder := httptest.NewRecorder()
+				server.ServeHTTP(recorder, request)
+
+				if recorder.Header().Get(middlewares.IdempotentReplayedHeader) != "" {
+					t.Fatalf("the response was replayed: %s", recorder.Body)
+				}
+				if attempt == 0 && !strings.Contains(recorder.Body.String(), test.secret) {
+					t.Fatalf("expected a response with the secret, got %d %s", recorder.Code, recorder.Body)
+				}
+				bodies = append(bodies, recorder.Body.String())
+			}
+			if bodies[0] == bodies[1] {
+				t.Errorf("the retry returned the first response with its secret")
+			}
+
+			var stored int
+			if err := db.DB.QueryRow("SELECT COUNT(*) FROM idempotency_keys").Scan(&stored); err != nil {
+				t.Fatal(err)
+			}
+			if stored != 0 {
+				t.Errorf("%d responses were stored for a replay", stored)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+// To define / register the REST routes and endpoints
+package routes
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/handlers"
+	"github.com/odeeka/go-minicloud-rest-api/middlewares"
+)
+
+func RegisterImagesRoutes(server *gin.Engine) {
+
+	// with authentication through middleware
+	authImagesGroup := server.Group("/images")
+	authImagesGroup.Use(middlewares.Authenticate, middlewares.Idempotency)
+	authImagesGroup.GET("", handlers.ListImages)
+	authImagesGroup.GET("/policy", handlers.GetImagePolicy)
+	authImagesGroup.GET("/:id", handlers.GetImage)
+
+	// catalog management is restricted to admins
+	adminImagesGroup := authImagesGroup.Group("")
+	adminImagesGroup.Use(middlewares.RequireAdmin)
+	adminImagesGroup.POST("", handlers.CreateImage)
+	adminImagesGroup.PUT("/policy", handlers.UpdateImagePolicy)
+	adminImagesGroup.PUT("/:id", handlers.UpdateImage)
+	adminImagesGroup.DELETE("/:id", handlers.DeleteImage)
+	adminImagesGroup.POST("/:id/pull", handlers.PullCatalogImage)
+}
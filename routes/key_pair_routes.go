@@ -0,0 +1,20 @@
+// To define / register the REST routes and endpoints
+package routes
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/handlers"
+	"github.com/odeeka/go-minicloud-rest-api/middlewares"
+)
+
+func RegisterKeyPairsRoutes(server *gin.Engine) {
+
+	// with authentication through middleware
+	// Generated private keys are shown once, so key pairs take no Idempotency-Key: a replay would store the key in clear
+	authKeyPairsGroup := server.Group("/key-pairs")
+	authKeyPairsGroup.Use(middlewares.Authenticate)
+	authKeyPairsGroup.GET("", handlers.ListKeyPairs)
+	authKeyPairsGroup.POST("", handlers.CreateKeyPair)
+	authKeyPairsGroup.GET("/:id", handlers.GetKeyPair)
+	authKeyPairsGroup.DELETE("/:id", handlers.DeleteKeyPair)
+}
@@ -0,0 +1,17 @@
+// To define / register the REST routes and endpoints
+package routes
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/handlers"
+	"github.com/odeeka/go-minicloud-rest-api/middlewares"
+)
+
+func RegisterLabelRoutes(server *gin.Engine) {
+
+	// with authentication through middleware, resources of a project need the X-MiniCloud-Project header
+	authLabelsGroup := server.Group("/labels")
+	authLabelsGroup.Use(middlewares.Authenticate, middlewares.SelectProject, middlewares.Idempotency)
+	authLabelsGroup.POST("", handlers.LabelResources)
+	authLabelsGroup.POST("/remove", handlers.UnlabelResources)
+}
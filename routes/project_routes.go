@@ -0,0 +1,32 @@
+// To define / register the REST routes and endpoints
+package routes
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/handlers"
+	"github.com/odeeka/go-minicloud-rest-api/middlewares"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+)
+
+func RegisterProjectRoutes(server *gin.Engine) {
+
+	// with authentication through middleware
+	authProjectsGroup := server.Group("/projects")
+	authProjectsGroup.Use(middlewares.Authenticate, middlewares.Idempotency)
+	authProjectsGroup.GET("", handlers.ListProjects)
+	authProjectsGroup.POST("", handlers.CreateProject)
+
+	// The VMs and storages of a project are registered by RegisterVmsRoutes and RegisterStoragesRoutes
+	projectGroup := authProjectsGroup.Group("/:project")
+	projectGroup.Use(middlewares.SelectProject)
+	projectGroup.GET("", handlers.GetProject)
+	projectGroup.PUT("", middlewares.RequireProjectRole(models.ProjectRoleOwner), handlers.UpdateProject)
+	projectGroup.DELETE("", middlewares.RequireProjectRole(models.ProjectRoleOwner), handlers.DeleteProject)
+	projectGroup.GET("/members", handlers.ListProjectMembers)
+	projectGroup.PUT("/members/:account", middlewares.RequireProjectRole(models.ProjectRoleOwner), handlers.SetProjectMember)
+	projectGroup.DELETE("/members/:account", middlewares.RequireProjectRole(models.ProjectRoleOwner), handlers.RemoveProjectMember)
+	projectGroup.GET("/quota", handlers.GetProjectQuota)
+	projectGroup.PUT("/quota", middlewares.RequireAdmin, handlers.UpdateProjectQuota)
+	projectGroup.GET("/usage", handlers.GetProjectUsage)
+	projectGroup.GET("/invoices", handlers.GetProjectInvoice)
+}
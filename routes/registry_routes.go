@@ -0,0 +1,15 @@
+// To define / register the REST routes and endpoints
+package routes
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/handlers"
+)
+
+func RegisterRegistryRoutes(server *gin.Engine) {
+
+	// OCI Distribution API, authenticated by the registry handler itself
+	// (the docker CLI speaks Basic auth and bearer tokens instead of the raw JWT header)
+	server.Any("/v2/*path", handlers.Registry)
+	server.GET("/registry/token", handlers.RegistryToken)
+}
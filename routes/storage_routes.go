@@ -19,14 +19,18 @@ func RegisterStoragesRoutes(server *gin.Engine) {
 	// storagesGroup.POST("/:id/attach/:vmid", handlers.AttachStorageToVM)
 	// storagesGroup.POST("/:id/detach/:vmid", handlers.DetachStorageFromVM)
 
-	// with authentication through middleware
-	authStoragesGroup := server.Group("/storages")
-	authStoragesGroup.Use(middlewares.Authenticate)
-	authStoragesGroup.GET("", handlers.ListStorages)
-	authStoragesGroup.POST("", handlers.CreateStorage)
-	authStoragesGroup.GET("/:id", handlers.GetStorage)
-	authStoragesGroup.DELETE("/:id", handlers.DeleteStorage)
-	authStoragesGroup.PUT("/:id", handlers.UpdateStorageSize)
-	authStoragesGroup.POST("/:id/attach/:vmid", handlers.AttachStorageToVM)
-	authStoragesGroup.POST("/:id/detach/:vmid", handlers.DetachStorageFromVM)
+	// with authentication through middleware, the project of the storages is selected
+	// by the X-MiniCloud-Project header or the /projects/:project prefix
+	for _, path := range []string{"/storages", "/projects/:project/storages"} {
+		authStoragesGroup := server.Group(path)
+		authStoragesGroup.Use(middlewares.Authenticate, middlewares.SelectProject, middlewares.Idempotency)
+		authStoragesGroup.GET("", handlers.ListStorages)
+		authStoragesGroup.POST("", handlers.CreateStorage)
+		authStoragesGroup.GET("/:id", handlers.GetStorage)
+		authStoragesGroup.DELETE("/:id", handlers.DeleteStorage)
+		authStoragesGroup.PUT("/:id", handlers.UpdateStorageSize)
+		authStoragesGroup.PATCH("/:id", handlers.PatchStorage)
+		authStoragesGroup.POST("/:id/attach/:vmid", handlers.AttachStorageToVM)
+		authStoragesGroup.POST("/:id/detach/:vmid", handlers.DetachStorageFromVM)
+	}
 }
@@ -5,6 +5,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/odeeka/go-minicloud-rest-api/handlers"
 	"github.com/odeeka/go-minicloud-rest-api/middlewares"
+	"github.com/odeeka/go-minicloud-rest-api/models"
 )
 
 func RegisterVmsRoutes(server *gin.Engine) {
@@ -17,12 +18,23 @@ func RegisterVmsRoutes(server *gin.Engine) {
 	// vmsGroup.DELETE("/:id", handlers.DeleteVM)
 	// vmsGroup.PUT("/:id", handlers.UpdateVM)
 
-	// with authentication through middleware
-	authVmsGroup := server.Group("/vms")
-	authVmsGroup.Use(middlewares.Authenticate)
-	authVmsGroup.GET("", handlers.ListVMs)
-	authVmsGroup.GET("/:id", handlers.GetVM)
-	authVmsGroup.POST("", handlers.CreateVM)
-	authVmsGroup.DELETE("/:id", handlers.DeleteVM)
-	authVmsGroup.PUT("/:id", handlers.UpdateVM)
+	// with authentication through middleware, the project of the VMs is selected
+	// by the X-MiniCloud-Project header or the /projects/:project prefix
+	for _, path := range []string{"/vms", "/projects/:project/vms"} {
+		authVmsGroup := server.Group(path)
+		authVmsGroup.Use(middlewares.Authenticate, middlewares.SelectProject, middlewares.Idempotency)
+		authVmsGroup.GET("", handlers.ListVMs)
+		authVmsGroup.GET("/:id", handlers.GetVM)
+		authVmsGroup.POST("", handlers.CreateVM)
+		authVmsGroup.DELETE("/:id", handlers.DeleteVM)
+		authVmsGroup.PUT("/:id", handlers.UpdateVM)
+		authVmsGroup.PATCH("/:id", handlers.PatchVM)
+		authVmsGroup.GET("/:id/boot", middlewares.RequireProjectRole(models.ProjectRoleMember), handlers.GetVMBoot)
+		authVmsGroup.GET("/:id/console", middlewares.RequireProjectRole(models.ProjectRoleMember), handlers.VMConsole)
+		authVmsGroup.GET("/:id/logs", handlers.GetVMLogs)
+		authVmsGroup.GET("/:id/metrics", handlers.GetVMMetrics)
+		authVmsGroup.GET("/:id/files", middlewares.RequireProjectRole(models.ProjectRoleMember), handlers.DownloadVMFiles)
+		authVmsGroup.PUT("/:id/files", middlewares.RequireProjectRole(models.ProjectRoleMember), handlers.UploadVMFiles)
+		authVmsGroup.POST("/:id/exec", middlewares.RequireProjectRole(models.ProjectRoleMember), handlers.ExecVM)
+	}
 }
@@ -0,0 +1,24 @@
+// To define / register the REST routes and endpoints
+package routes
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/odeeka/go-minicloud-rest-api/handlers"
+	"github.com/odeeka/go-minicloud-rest-api/middlewares"
+)
+
+func RegisterWebhookRoutes(server *gin.Engine) {
+
+	// with authentication through middleware
+	authWebhooksGroup := server.Group("/webhooks")
+	authWebhooksGroup.Use(middlewares.Authenticate)
+	authWebhooksGroup.GET("", handlers.ListWebhooks)
+	// The signing secret is shown once, so the creation takes no Idempotency-Key: a replay would store the secret in clear
+	authWebhooksGroup.POST("", handlers.CreateWebhook)
+	authWebhooksGroup.GET("/:id", handlers.GetWebhook)
+	authWebhooksGroup.PUT("/:id", handlers.UpdateWebhook)
+	authWebhooksGroup.DELETE("/:id", handlers.DeleteWebhook)
+	authWebhooksGroup.POST("/:id/ping", middlewares.Idempotency, handlers.PingWebhook)
+	authWebhooksGroup.GET("/:id/deliveries", handlers.ListWebhookDeliveries)
+	authWebhooksGroup.POST("/:id/deliveries/:deliveryId/redeliver", middlewares.Idempotency, handlers.RedeliverWebhook)
+}
@@ -0,0 +1,161 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+)
+
+// auditGenesisHash is the previous hash of the first exported event
+const auditGenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// AuditExportRecord is one line of the JSONL export.
+// Hash is the SHA-256 of PrevHash and the JSON of the event, so removing
+// or changing a line breaks the chain of every following line.
+type AuditExportRecord struct {
+	models.AuditEvent
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+var (
+	// auditMu keeps the order of the exported events the order of their IDs
+	auditMu         sync.Mutex
+	auditExportFile *os.File
+	auditLastHash   = auditGenesisHash
+	auditLastID     int64
+)
+
+// RecordAuditEvent appends the event to the audit trail and to the export file (if enabled)
+func RecordAuditEvent(ctx context.Context, event *models.AuditEvent) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	if err := event.InsertAuditEvent(ctx); err != nil {
+		return err
+	}
+
+	if auditExportFile == nil {
+		return nil
+	}
+	return exportAuditEvent(*event)
+}
+
+// StartAuditExport appends every audit event to MINICLOUD_AUDIT_EXPORT_FILE (JSONL with hash chain).
+// The export is disabled without the variable. An existing file is continued: the chain resumes
+// from its last line and events recorded meanwhile (e.g., while the export was disabled) are caught up.
+func StartAuditExport(ctx context.Context) error {
+	path := utils.GetEnv("MINICLOUD_AUDIT_EXPORT_FILE", "")
+	if path == "" {
+		return nil
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	lastID, lastHash, err := readAuditExportTail(path)
+	if err != nil {
+		return err
+	}
+	auditLastID, auditLastHash = lastID, lastHash
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	auditExportFile = file
+
+	events, err := models.GetAuditEvents(ctx, models.AuditFilter{AfterID: auditLastID, Ascending: true})
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		if err := exportAuditEvent(event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// exportAuditEvent appends one line to the chain, the caller holds auditMu
+func exportAuditEvent(event models.AuditEvent) error {
+	if event.ID <= auditLastID {
+		return nil
+	}
+
+	hash, err := AuditEventHash(auditLastHash, event)
+	if err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(AuditExportRecord{AuditEvent: event, PrevHash: auditLastHash, Hash: hash})
+	if err != nil {
+		return err
+	}
+	if _, err := auditExportFile.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("could not export audit event %d: %w", event.ID, err)
+	}
+
+	auditLastID, auditLastHash = event.ID, hash
+	return nil
+}
+
+// AuditEventHash chains an event to the hash of the previous one: sha256(prevHash + "\n" + JSON of the event)
+func AuditEventHash(prevHash string, event models.AuditEvent) (string, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(prevHash + "\n" + string(data)))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// readAuditExportTail returns ID and hash of the last exported event, after verifying the chain of the file
+func readAuditExportTail(path string) (int64, string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, auditGenesisHash, nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	lastID, lastHash := int64(0), auditGenesisHash
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		var record AuditExportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return 0, "", fmt.Errorf("audit export line %d: %w", line, err)
+		}
+
+		hash, err := AuditEventHash(lastHash, record.AuditEvent)
+		if err != nil {
+			return 0, "", err
+		}
+		if record.PrevHash != lastHash || record.Hash != hash {
+			return 0, "", fmt.Errorf("audit export line %d breaks the hash chain", line)
+		}
+
+		lastID, lastHash = record.ID, hash
+	}
+
+	return lastID, lastHash, scanner.Err()
+}
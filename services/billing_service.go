@@ -0,0 +1,162 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+)
+
+// InvoiceLineItem is the cost of one billable item of one resource in the period
+type InvoiceLineItem struct {
+	ResourceType   string  `json:"resource_type"`
+	ResourceID     int64   `json:"resource_id"`
+	ResourceName   string  `json:"resource_name"`
+	Item           string  `json:"item"`
+	RuntimeSeconds int64   `json:"runtime_seconds"`
+	Quantity       float64 `json:"quantity"`
+	Unit           string  `json:"unit"`
+	UnitPrice      float64 `json:"unit_price"`
+	Amount         float64 `json:"amount"`
+}
+
+// Invoice sums up the metered usage of an account or a project in one month
+type Invoice struct {
+	AccountID int64             `json:"account_id"`
+	ProjectID int64             `json:"project_id"`
+	Period    string            `json:"period"`
+	From      time.Time         `json:"from"`
+	To        time.Time         `json:"to"`
+	Currency  string            `json:"currency"`
+	LineItems []InvoiceLineItem `json:"line_items"`
+	Total     float64           `json:"total"`
+}
+
+// ParseBillingPeriod parses a period like "2026-10" into the time range of the month
+func ParseBillingPeriod(period string) (time.Time, time.Time, error) {
+	from, err := time.Parse("2006-01", period)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("period must look like 2026-10: %w", err)
+	}
+	return from, from.AddDate(0, 1, 0), nil
+}
+
+// BuildInvoice applies the price list to the metering records in the period, either of a project
+// or, with projectID 0, of the resources of an account outside of any project
+// The running month is billed up to now
+func BuildInvoice(ctx context.Context, accountID, projectID int64, period string) (*Invoice, error) {
+	from, to, err := ParseBillingPeriod(period)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	if to.After(now) {
+		to = now
+	}
+
+	invoice := &Invoice{
+		AccountID: accountID,
+		ProjectID: projectID,
+		Period:    period,
+		From:      from,
+		To:        to,
+		Currency:  utils.GetEnv("MINICLOUD_BILLING_CURRENCY", "USD"),
+		LineItems: []InvoiceLineItem{},
+	}
+
+	if !to.After(from) {
+		return invoice, nil
+	}
+
+	records, err := models.GetMeteringRecords(ctx, accountID, projectID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	prices, err := models.GetPriceList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// One line item per resource and billable item
+	type lineKey struct {
+		resourceType string
+		resourceID   int64
+		item         string
+	}
+	lines := map[lineKey]*InvoiceLineItem{}
+
+	add := func(record models.MeteringRecord, item string, seconds int64, quantity float64) {
+		key := lineKey{record.ResourceType, record.ResourceID, item}
+		line, ok := lines[key]
+		if !ok {
+			line = &InvoiceLineItem{
+				ResourceType: record.ResourceType,
+				ResourceID:   record.ResourceID,
+				ResourceName: record.ResourceName,
+				Item:         item,
+				Unit:         prices[item].Unit,
+				UnitPrice:    prices[item].UnitPrice,
+			}
+			lines[key] = line
+		}
+		line.RuntimeSeconds += seconds
+		line.Quantity += quantity
+	}
+
+	for _, record := range records {
+		start := record.StartedAt
+		if start.Before(from) {
+			start = from
+		}
+		end := to
+		if record.EndedAt != nil && record.EndedAt.Before(to) {
+			end = *record.EndedAt
+		}
+		if !end.After(start) {
+			continue
+		}
+
+		seconds := int64(end.Sub(start).Seconds())
+		hours := end.Sub(start).Hours()
+
+		switch record.ResourceType {
+		case models.MeteredVM:
+			add(record, models.PriceVCPUHour, seconds, record.CPU*hours)
+			add(record, models.PriceMemoryGBHour, seconds, float64(record.MemoryMB)/1024*hours)
+		case models.MeteredStorage:
+			add(record, models.PriceStorageGBHour, seconds, float64(record.SizeGB)*hours)
+		}
+	}
+
+	for _, line := range lines {
+		line.Quantity = roundTo(line.Quantity, 6)
+		line.Amount = roundTo(line.Quantity*line.UnitPrice, 6)
+		invoice.LineItems = append(invoice.LineItems, *line)
+		invoice.Total += line.Amount
+	}
+	invoice.Total = roundTo(invoice.Total, 6)
+
+	sort.Slice(invoice.LineItems, func(i, j int) bool {
+		a, b := invoice.LineItems[i], invoice.LineItems[j]
+		if a.ResourceType != b.ResourceType {
+			return a.ResourceType > b.ResourceType // VMs first
+		}
+		if a.ResourceID != b.ResourceID {
+			return a.ResourceID < b.ResourceID
+		}
+		return a.Item < b.Item
+	})
+
+	return invoice, nil
+}
+
+func roundTo(value float64, decimals int) float64 {
+	factor := math.Pow(10, float64(decimals))
+	return math.Round(value*factor) / factor
+}
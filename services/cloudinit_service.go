@@ -0,0 +1,296 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// Limits of the user data and of the stored boot log
+const (
+	MaxUserDataBytes = 16 * 1024
+	maxBootLogBytes  = 64 * 1024
+)
+
+// CloudConfig is the supported subset of a cloud-init "#cloud-config" document
+type CloudConfig struct {
+	Users             []yaml.Node `yaml:"users"`
+	SSHAuthorizedKeys []string    `yaml:"ssh_authorized_keys"`
+	WriteFiles        []WriteFile `yaml:"write_files"`
+	RunCmd            []yaml.Node `yaml:"runcmd"`
+}
+
+// CloudUser is an entry of "users"
+type CloudUser struct {
+	Name              string   `yaml:"name"`
+	Shell             string   `yaml:"shell"`
+	Sudo              string   `yaml:"sudo"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys"`
+}
+
+// WriteFile is an entry of "write_files"
+type WriteFile struct {
+	Path        string `yaml:"path"`
+	Content     string `yaml:"content"`
+	Permissions string `yaml:"permissions"`
+	Owner       string `yaml:"owner"`
+	Append      bool   `yaml:"append"`
+}
+
+var userNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// BuildBootScript renders the public keys of the VM key pairs and its "#cloud-config" user data
+// to a POSIX shell boot script. It returns an empty script if there is nothing to provision.
+func BuildBootScript(userData string, authorizedKeys []string) (string, error) {
+	if userData == "" && len(authorizedKeys) == 0 {
+		return "", nil
+	}
+
+	var script strings.Builder
+	script.WriteString("#!/bin/sh\n")
+	script.WriteString("# Generated by MiniCloud from the key pairs and the user_data of the VM\n")
+	script.WriteString("set -e\n")
+	script.WriteString(`home_of() { grep "^$1:" /etc/passwd | cut -d: -f6; }` + "\n")
+
+	if len(authorizedKeys) > 0 {
+		script.WriteString("echo '==> key pairs'\n")
+		renderAuthorizedKeys(&script, "root", authorizedKeys)
+	}
+
+	if userData != "" {
+		if err := renderUserData(&script, userData); err != nil {
+			return "", err
+		}
+	}
+
+	script.WriteString("echo '==> done'\n")
+
+	return script.String(), nil
+}
+
+// renderUserData validates a "#cloud-config" document and appends its steps to the script
+func renderUserData(script *strings.Builder, userData string) error {
+	if len(userData) > MaxUserDataBytes {
+		return fmt.Errorf("user_data is larger than %d bytes", MaxUserDataBytes)
+	}
+	if !strings.HasPrefix(userData, "#cloud-config") {
+		return errors.New(`user_data must start with "#cloud-config"`)
+	}
+
+	var config CloudConfig
+	decoder := yaml.NewDecoder(strings.NewReader(userData))
+	decoder.KnownFields(true) // reject the cloud-config modules which are not supported
+	if err := decoder.Decode(&config); err != nil {
+		return fmt.Errorf("invalid cloud-config: %w", err)
+	}
+
+	for _, node := range config.Users {
+		// "default" stands for the default user of the image, which is root in containers
+		if node.Kind == yaml.ScalarNode && node.Value == "default" {
+			continue
+		}
+
+		var user CloudUser
+		if err := node.Decode(&user); err != nil {
+			return fmt.Errorf("invalid users entry: %w", err)
+		}
+		if err := renderUser(script, user); err != nil {
+			return err
+		}
+	}
+
+	if len(config.SSHAuthorizedKeys) > 0 {
+		fmt.Fprintf(script, "echo '==> ssh_authorized_keys root'\n")
+		renderAuthorizedKeys(script, "root", config.SSHAuthorizedKeys)
+	}
+
+	for _, file := range config.WriteFiles {
+		if err := renderWriteFile(script, file); err != nil {
+			return err
+		}
+	}
+
+	for i, node := range config.RunCmd {
+		fmt.Fprintf(script, "echo '==> runcmd %d'\n", i+1)
+
+		switch node.Kind {
+		case yaml.ScalarNode:
+			// A string runs as a shell command line
+			script.WriteString(node.Value + "\n")
+		case yaml.SequenceNode:
+			// A list is an argument vector without shell interpretation
+			var argv []string
+			if err := node.Decode(&argv); err != nil || len(argv) == 0 {
+				return fmt.Errorf("runcmd entry %d must be a string or a list of strings", i+1)
+			}
+			quoted := make([]string, len(argv))
+			for j, arg := range argv {
+				quoted[j] = shellQuote(arg)
+			}
+			script.WriteString(strings.Join(quoted, " ") + "\n")
+		default:
+			return fmt.Errorf("runcmd entry %d must be a string or a list of strings", i+1)
+		}
+	}
+
+	return nil
+}
+
+func renderUser(script *strings.Builder, user CloudUser) error {
+	if !userNamePattern.MatchString(user.Name) {
+		return fmt.Errorf("invalid user name: %q", user.Name)
+	}
+	if user.Shell == "" {
+		user.Shell = "/bin/sh"
+	}
+
+	name := shellQuote(user.Name)
+	fmt.Fprintf(script, "echo %s\n", shellQuote("==> user "+user.Name))
+	fmt.Fprintf(script, "if ! id -u %s >/dev/null 2>&1; then\n", name)
+	fmt.Fprintf(script, "  if command -v useradd >/dev/null 2>&1; then useradd -m -s %s %s; else adduser -D -s %s %s; fi\n",
+		shellQuote(user.Shell), name, shellQuote(user.Shell), name)
+	script.WriteString("fi\n")
+
+	if user.Sudo != "" {
+		if strings.ContainsAny(user.Sudo, "\n") {
+			return fmt.Errorf("invalid sudo rule of user %s", user.Name)
+		}
+		script.WriteString("mkdir -p /etc/sudoers.d\n")
+		fmt.Fprintf(script, "printf '%%s\\n' %s > /etc/sudoers.d/90-minicloud-%s\n", shellQuote(user.Name+" "+user.Sudo), user.Name)
+		fmt.Fprintf(script, "chmod 0440 /etc/sudoers.d/90-minicloud-%s\n", user.Name)
+	}
+
+	if len(user.SSHAuthorizedKeys) > 0 {
+		renderAuthorizedKeys(script, user.Name, user.SSHAuthorizedKeys)
+	}
+
+	return nil
+}
+
+func renderAuthorizedKeys(script *strings.Builder, user string, keys []string) {
+	fmt.Fprintf(script, "dir=\"$(home_of %s)/.ssh\"\n", shellQuote(user))
+	script.WriteString("mkdir -p \"$dir\" && chmod 700 \"$dir\"\n")
+	for _, key := range keys {
+		fmt.Fprintf(script, "printf '%%s\\n' %s >> \"$dir/authorized_keys\"\n", shellQuote(strings.TrimSpace(key)))
+	}
+	script.WriteString("chmod 600 \"$dir/authorized_keys\"\n")
+	fmt.Fprintf(script, "chown -R %s \"$dir\"\n", shellQuote(user))
+}
+
+func renderWriteFile(script *strings.Builder, file WriteFile) error {
+	if !path.IsAbs(file.Path) {
+		return fmt.Errorf("write_files path must be absolute: %q", file.Path)
+	}
+	if file.Permissions != "" {
+		if _, err := strconv.ParseUint(file.Permissions, 8, 32); err != nil {
+			return fmt.Errorf("invalid permissions of %s: %q", file.Path, file.Permissions)
+		}
+	}
+
+	redirect := ">"
+	if file.Append {
+		redirect = ">>"
+	}
+
+	target := shellQuote(file.Path)
+	fmt.Fprintf(script, "echo %s\n", shellQuote("==> write_files "+file.Path))
+	fmt.Fprintf(script, "mkdir -p %s\n", shellQuote(path.Dir(file.Path)))
+	fmt.Fprintf(script, "printf '%%s' %s %s %s\n", shellQuote(file.Content), redirect, target)
+	if file.Permissions != "" {
+		fmt.Fprintf(script, "chmod %s %s\n", file.Permissions, target)
+	}
+	if file.Owner != "" {
+		fmt.Fprintf(script, "chown %s %s\n", shellQuote(file.Owner), target)
+	}
+
+	return nil
+}
+
+// shellQuote quotes a value as a single argument for sh
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// RunBootScript runs the boot script of the VM as root in its container and stores status, exit code and log.
+// It blocks until the script ends or MINICLOUD_BOOT_TIMEOUT (default 10m) passes, so callers run it in a goroutine.
+// The script outlives the request, the context only carries its request ID into logs and queries.
+func RunBootScript(ctx context.Context, vmID, accountID, projectID int64, containerID, script string) {
+	ctx = context.WithoutCancel(ctx)
+
+	run := models.BootRun{
+		VMID:        vmID,
+		ContainerID: containerID,
+		Status:      models.BootStatusRunning,
+		StartedAt:   time.Now().UTC(),
+	}
+	if err := run.SaveBootRun(ctx); err != nil {
+		slog.ErrorContext(ctx, "Could not store boot run", "vm_id", vmID, "error", err)
+		return
+	}
+
+	output, exitCode := runBootScript(ctx, containerID, script)
+
+	finishedAt := time.Now().UTC()
+	run.FinishedAt = &finishedAt
+	run.ExitCode = &exitCode
+	run.Log = output
+	run.Status = models.BootStatusSucceeded
+	if exitCode != 0 {
+		run.Status = models.BootStatusFailed
+	}
+
+	if err := run.SaveBootRun(ctx); err != nil {
+		slog.ErrorContext(ctx, "Could not store boot run", "vm_id", vmID, "error", err)
+		return
+	}
+
+	slog.InfoContext(ctx, "Boot script finished", "vm_id", vmID, "status", run.Status, "exit_code", exitCode)
+
+	PublishEvent(ctx, models.EventOperationCompleted, "vm", vmID, accountID, projectID,
+		OperationResult{Operation: "vm.boot", Status: run.Status, Message: fmt.Sprintf("exit code %d", exitCode)})
+}
+
+func runBootScript(ctx context.Context, containerID, script string) (string, int) {
+	timeout := utils.GetEnvDuration("MINICLOUD_BOOT_TIMEOUT", 10*time.Minute)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	cmd := dockerCommandContext(ctx, "exec", "-i", "--user", "0", containerID, "sh", "-s")
+	cmd.Stdin = strings.NewReader(script)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+
+	log := output.String()
+	if len(log) > maxBootLogBytes {
+		log = "[truncated]\n" + log[len(log)-maxBootLogBytes:]
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return log + fmt.Sprintf("\nboot script timed out after %s", timeout), -1
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return log, exitErr.ExitCode()
+	}
+	if err != nil {
+		return log + "\n" + err.Error(), -1
+	}
+
+	return log, 0
+}
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+
+	"github.com/creack/pty"
+)
+
+// maxExecOutputBytes limits stdout and stderr of one-shot commands
+const maxExecOutputBytes = 1024 * 1024
+
+// ExecResult is the outcome of a one-shot command in a VM
+type ExecResult struct {
+	Stdout    string `json:"stdout"`
+	Stderr    string `json:"stderr"`
+	ExitCode  int    `json:"exit_code"`
+	TimedOut  bool   `json:"timed_out"`
+	Truncated bool   `json:"truncated"`
+}
+
+// StartConsole starts an interactive shell in the container attached to a new pseudo terminal
+// The caller reads and writes the returned terminal and has to kill and wait for the command
+func StartConsole(containerID string) (*os.File, *exec.Cmd, error) {
+	// Not a timed docker call, the session lasts as long as the user stays connected
+	cmd := exec.Command("docker", "exec", "-it", "-e", "TERM=xterm-256color", containerID,
+		"sh", "-c", "if command -v bash >/dev/null 2>&1; then exec bash; else exec sh; fi")
+
+	terminal, err := pty.StartWithSize(cmd, &pty.Winsize{Cols: 80, Rows: 24})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return terminal, cmd, nil
+}
+
+// ResizeConsole changes the size of the console terminal, docker exec passes it to the container
+func ResizeConsole(terminal *os.File, cols, rows uint16) error {
+	return pty.Setsize(terminal, &pty.Winsize{Cols: cols, Rows: rows})
+}
+
+// ExecInContainer runs a command in the container and returns its output and exit code
+func ExecInContainer(ctx context.Context, containerID string, command []string, stdin string) (*ExecResult, error) {
+	args := append([]string{"exec", "-i", containerID}, command...)
+	cmd := dockerCommandContext(ctx, args...)
+
+	stdout := &limitedBuffer{limit: maxExecOutputBytes}
+	stderr := &limitedBuffer{limit: maxExecOutputBytes}
+	cmd.Stdin = bytes.NewBufferString(stdin)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+
+	result := &ExecResult{
+		Stdout:    stdout.String(),
+		Stderr:    stderr.String(),
+		Truncated: stdout.truncated || stderr.truncated,
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		result.TimedOut = true
+		result.ExitCode = -1
+		return result, nil
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		result.ExitCode = exitErr.ExitCode()
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// limitedBuffer keeps the first bytes written to it and drops the rest
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (buffer *limitedBuffer) Write(data []byte) (int, error) {
+	if room := buffer.limit - buffer.Len(); room < len(data) {
+		buffer.truncated = true
+		if room > 0 {
+			buffer.Buffer.Write(data[:room])
+		}
+		return len(data), nil
+	}
+	return buffer.Buffer.Write(data)
+}
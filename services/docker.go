@@ -0,0 +1,126 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/logging"
+	"github.com/odeeka/go-minicloud-rest-api/metrics"
+	"github.com/odeeka/go-minicloud-rest-api/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// dockerCmd is a docker CLI call whose duration and failure are exported as metrics
+// and which is traced as child span of the request
+type dockerCmd struct {
+	*exec.Cmd
+	ctx     context.Context
+	args    []string
+	command string
+	started time.Time
+	span    trace.Span
+}
+
+// dockerCommand prepares a docker CLI call of the compute and storage driver.
+// The context only carries the request ID into the logs: the call is not killed with it,
+// so a client which disconnects doesn't leave a half-created container behind.
+func dockerCommand(ctx context.Context, args ...string) *dockerCmd {
+	return &dockerCmd{Cmd: exec.Command("docker", args...), ctx: ctx, args: args, command: dockerCommandLabel(args)}
+}
+
+// dockerCommandContext prepares a docker CLI call which is killed when the context is done
+func dockerCommandContext(ctx context.Context, args ...string) *dockerCmd {
+	return &dockerCmd{Cmd: exec.CommandContext(ctx, "docker", args...), ctx: ctx, args: args, command: dockerCommandLabel(args)}
+}
+
+func (cmd *dockerCmd) Run() error {
+	cmd.start()
+	err := cmd.Cmd.Run()
+	cmd.observe(err)
+	return err
+}
+
+func (cmd *dockerCmd) CombinedOutput() ([]byte, error) {
+	cmd.start()
+	output, err := cmd.Cmd.CombinedOutput()
+	cmd.observe(err)
+	return output, err
+}
+
+func (cmd *dockerCmd) start() {
+	cmd.started = time.Now()
+	_, cmd.span = tracing.StartChild(cmd.ctx, "docker "+cmd.command,
+		attribute.StringSlice("docker.args", redactDockerArgs(cmd.args)))
+}
+
+func (cmd *dockerCmd) observe(err error) {
+	tracing.End(cmd.span, err)
+
+	duration := time.Since(cmd.started)
+	metrics.DockerCallDuration.WithLabelValues(cmd.command).Observe(duration.Seconds())
+	if err != nil {
+		metrics.DockerCallFailures.WithLabelValues(cmd.command).Inc()
+	}
+
+	attrs := []any{"args", redactDockerArgs(cmd.args), "duration_ms", duration.Milliseconds()}
+	if err != nil {
+		attrs = append(attrs, "error", err)
+	}
+	slog.DebugContext(cmd.ctx, "docker call", attrs...)
+}
+
+// redactDockerArgs hides the values of environment variables ("-e NAME=value")
+func redactDockerArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	copy(redacted, args)
+
+	for i := 1; i < len(redacted); i++ {
+		if redacted[i-1] == "-e" {
+			name, _, _ := strings.Cut(redacted[i], "=")
+			redacted[i] = name + "=" + logging.Redacted
+		}
+	}
+	return redacted
+}
+
+// dockerCommandLabel names the call by its subcommand (e.g., "run", "volume create"),
+// container IDs and other arguments would create a label value per call
+func dockerCommandLabel(args []string) string {
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--config":
+			i++
+		case strings.HasPrefix(args[i], "-"):
+		case args[i] == "image" || args[i] == "volume" || args[i] == "container":
+			if i+1 < len(args) {
+				return args[i] + " " + args[i+1]
+			}
+			return args[i]
+		default:
+			return args[i]
+		}
+	}
+	return "unknown"
+}
+
+// dockerLabelArgs returns the "--label key=value" arguments of the labels of a resource, sorted by key.
+// Docker can't change the labels of existing containers and volumes, they are set at creation only:
+// VMs are recreated when their labels change, volumes keep the labels of their creation
+func dockerLabelArgs(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	args := make([]string, 0, 2*len(keys))
+	for _, key := range keys {
+		args = append(args, "--label", key+"="+labels[key])
+	}
+	return args
+}
@@ -0,0 +1,176 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/tracing"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+)
+
+const (
+	// eventBuffer is the number of events a subscriber may fall behind before it is dropped
+	eventBuffer = 256
+
+	// eventReplayPage is the number of stored events read at once when a stream resumes
+	eventReplayPage = 500
+
+	// eventKeepAlive is how often an idle stream is kept alive
+	eventKeepAlive = 15 * time.Second
+)
+
+// ErrEventSubscriberDropped ends a stream which could not keep up, the client resumes it with its cursor
+var ErrEventSubscriberDropped = errors.New("event stream fell behind, resume it with the last event ID")
+
+var (
+	// eventsMu keeps the order in which the subscribers receive events the order of their IDs
+	eventsMu         sync.Mutex
+	eventSubscribers = map[chan models.Event]struct{}{}
+)
+
+// PublishEvent stores a change of a resource, sends it to the subscribers of the event stream
+// and queues it for the webhooks subscribed to its type.
+// A failure is only logged, it doesn't fail the change which already happened.
+func PublishEvent(ctx context.Context, eventType, resourceType string, resourceID, accountID, projectID int64, data any) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		slog.ErrorContext(ctx, "Could not encode event", "type", eventType, "error", err)
+		return
+	}
+
+	event := models.Event{
+		Type:         eventType,
+		ResourceType: resourceType,
+		ResourceID:   resourceID,
+		AccountID:    accountID,
+		ProjectID:    projectID,
+		Data:         payload,
+	}
+
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+
+	if err := event.InsertEvent(ctx); err != nil {
+		slog.ErrorContext(ctx, "Could not store event", "type", eventType, "error", err)
+		return
+	}
+
+	for subscriber := range eventSubscribers {
+		select {
+		case subscriber <- event:
+		default:
+			// A slow client must not block the publishers
+			delete(eventSubscribers, subscriber)
+			close(subscriber)
+		}
+	}
+
+	if err := enqueueWebhookDeliveries(ctx, event); err != nil {
+		slog.ErrorContext(ctx, "Could not queue webhook deliveries", "type", eventType, "error", err)
+	}
+}
+
+// OperationResult is the data of an operation.completed event, for work which continues after the request (e.g., an image pull)
+type OperationResult struct {
+	Operation string `json:"operation"`
+	Status    string `json:"status"`
+	Message   string `json:"message,omitempty"`
+}
+
+// FollowEvents sends the events matching the filter until the context ends or send fails.
+// With resume, the stored events after filter.AfterID are sent first, otherwise only new events.
+// send is called with nil when the stream is idle, to keep the connection alive.
+func FollowEvents(ctx context.Context, filter models.EventFilter, resume bool, send func(*models.Event) error) error {
+	// Subscribe before reading the stored events, so no event is lost in between
+	subscriber := make(chan models.Event, eventBuffer)
+	eventsMu.Lock()
+	eventSubscribers[subscriber] = struct{}{}
+	eventsMu.Unlock()
+
+	defer func() {
+		eventsMu.Lock()
+		if _, found := eventSubscribers[subscriber]; found {
+			delete(eventSubscribers, subscriber)
+			close(subscriber)
+		}
+		eventsMu.Unlock()
+	}()
+
+	if !resume {
+		lastID, err := models.GetLastEventID(ctx)
+		if err != nil {
+			return err
+		}
+		filter.AfterID = lastID
+	}
+
+	for resume {
+		events, err := models.GetEvents(ctx, filter, eventReplayPage)
+		if err != nil {
+			return err
+		}
+		for i := range events {
+			if err := send(&events[i]); err != nil {
+				return err
+			}
+			filter.AfterID = events[i].ID
+		}
+		resume = len(events) == eventReplayPage
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-subscriber:
+			if !ok {
+				return ErrEventSubscriberDropped
+			}
+			// Events up to the cursor were already sent from the store
+			visible, err := event.VisibleTo(ctx, filter)
+			if err != nil {
+				return err
+			}
+			if !visible {
+				continue
+			}
+			if err := send(&event); err != nil {
+				return err
+			}
+			filter.AfterID = event.ID
+		case <-keepAlive.C:
+			if err := send(nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// StartEventJanitor removes events and finished webhook deliveries older than MINICLOUD_EVENTS_RETENTION
+// (default 168h) every hour. Streams can only be resumed within the retention
+func StartEventJanitor() {
+	go func() {
+		for {
+			if err := tracing.Job("cleanup events", cleanupEvents); err != nil {
+				slog.Error("Event cleanup failed", "error", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func cleanupEvents(ctx context.Context) error {
+	cutoff := time.Now().Add(-utils.GetEnvDuration("MINICLOUD_EVENTS_RETENTION", 7*24*time.Hour))
+	if err := models.DeleteEventsBefore(ctx, cutoff); err != nil {
+		return err
+	}
+	return models.DeleteWebhookDeliveriesBefore(ctx, cutoff)
+}
@@ -0,0 +1,34 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// CopyToContainer extracts a tar archive into a directory of the container ("docker cp -")
+func CopyToContainer(ctx context.Context, containerID, dir string, archive io.Reader) error {
+	cmd := dockerCommand(ctx, "cp", "-", containerID+":"+dir)
+	cmd.Stdin = archive
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("docker cp failed: %w, output: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// CopyFromContainer writes a path of the container as tar archive to the writer ("docker cp ... -")
+func CopyFromContainer(ctx context.Context, containerID, path string, archive io.Writer) error {
+	var stderr bytes.Buffer
+	cmd := dockerCommand(ctx, "cp", containerID+":"+path, "-")
+	cmd.Stdout = archive
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("docker cp failed: %w, output: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HostCapacity describes the resources of the Docker host which VMs share
+type HostCapacity struct {
+	// Number of CPUs of the host
+	CPUs int `json:"cpus"`
+
+	// Total memory of the host in megabytes
+	MemoryMB int `json:"memory_mb"`
+}
+
+var (
+	hostCapacityMu      sync.Mutex
+	hostCapacity        *HostCapacity
+	hostCapacityFetched time.Time
+)
+
+// hostCapacityTTL limits how often "docker info" is called
+const hostCapacityTTL = time.Minute
+
+// GetHostCapacity returns the CPUs and memory of the Docker host
+func GetHostCapacity(ctx context.Context) (*HostCapacity, error) {
+	hostCapacityMu.Lock()
+	defer hostCapacityMu.Unlock()
+
+	if hostCapacity != nil && time.Since(hostCapacityFetched) < hostCapacityTTL {
+		return hostCapacity, nil
+	}
+
+	cmd := dockerCommand(ctx, "info", "--format", "{{.NCPU}} {{.MemTotal}}")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("docker info failed: %w, output: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	fields := strings.Fields(strings.TrimSpace(string(output)))
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("unexpected docker info output: %s", strings.TrimSpace(string(output)))
+	}
+
+	cpus, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host CPUs: %w", err)
+	}
+
+	memoryBytes, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host memory: %w", err)
+	}
+
+	hostCapacity = &HostCapacity{CPUs: cpus, MemoryMB: int(memoryBytes / (1024 * 1024))}
+	hostCapacityFetched = time.Now()
+
+	return hostCapacity, nil
+}
+
+// Fits validates that CPU and memory are positive and fit on the host
+func (capacity *HostCapacity) Fits(cpu float64, memory int) error {
+	if cpu <= 0 {
+		return fmt.Errorf("cpu must be greater than 0")
+	}
+	if memory <= 0 {
+		return fmt.Errorf("memory must be greater than 0")
+	}
+
+	if cpu > float64(capacity.CPUs) {
+		return fmt.Errorf("cpu %.2f exceeds the %d CPUs of the host", cpu, capacity.CPUs)
+	}
+	if memory > capacity.MemoryMB {
+		return fmt.Errorf("memory %dMB exceeds the %dMB of the host", memory, capacity.MemoryMB)
+	}
+
+	return nil
+}
@@ -0,0 +1,26 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/tracing"
+)
+
+// StartIdempotencyJanitor removes the expired Idempotency-Keys every hour
+func StartIdempotencyJanitor() {
+	go func() {
+		for {
+			if err := tracing.Job("cleanup idempotency keys", cleanupIdempotencyKeys); err != nil {
+				slog.Error("Idempotency key cleanup failed", "error", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func cleanupIdempotencyKeys(ctx context.Context) error {
+	return models.DeleteIdempotencyKeysBefore(ctx, time.Now())
+}
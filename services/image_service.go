@@ -0,0 +1,100 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/models"
+)
+
+// PullImage pulls a catalog image and resolves its tag to a content digest.
+// The outcome (digest, status and error output) is stored on the catalog entry,
+// so it can run in the background after the image was registered (the pull outlives the request).
+func PullImage(ctx context.Context, image *models.Image) error {
+	ctx = context.WithoutCancel(ctx)
+
+	image.Status = models.ImageStatusPulling
+	image.StatusMessage = ""
+	if err := image.UpdatePullStatus(ctx); err != nil {
+		return err
+	}
+
+	digest, err := pullAndResolveDigest(ctx, image.Name)
+	if err != nil {
+		image.Status = models.ImageStatusFailed
+		image.StatusMessage = err.Error()
+		if updateErr := image.UpdatePullStatus(ctx); updateErr != nil {
+			return updateErr
+		}
+		publishPullCompleted(ctx, image)
+		return err
+	}
+
+	now := time.Now().UTC()
+	image.Digest = digest
+	image.Status = models.ImageStatusReady
+	image.PulledAt = &now
+
+	if err := image.UpdatePullStatus(ctx); err != nil {
+		return err
+	}
+	publishPullCompleted(ctx, image)
+	return nil
+}
+
+// publishPullCompleted reports the result of a pull, catalog images are visible to every account
+func publishPullCompleted(ctx context.Context, image *models.Image) {
+	PublishEvent(ctx, models.EventOperationCompleted, "image", image.ID, 0, 0,
+		OperationResult{Operation: "image.pull", Status: image.Status, Message: image.StatusMessage})
+}
+
+// pullAndResolveDigest pulls the image and returns the repo digest of the pulled tag.
+// The digest is empty when the registry did not report one; such images are not pinned.
+func pullAndResolveDigest(ctx context.Context, name string) (string, error) {
+	cmd := dockerCommand(ctx, "pull", name)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("docker pull failed: %w, output: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return resolveRepoDigest(ctx, name)
+}
+
+// resolveRepoDigest returns the repo digest of a local image or an empty string if it has none
+func resolveRepoDigest(ctx context.Context, name string) (string, error) {
+	cmd := dockerCommand(ctx, "image", "inspect", "--format", "{{json .RepoDigests}}", name)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("docker image inspect failed: %w, output: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	var repoDigests []string
+	if err := json.Unmarshal(output, &repoDigests); err != nil {
+		return "", fmt.Errorf("failed to parse repo digests: %w", err)
+	}
+
+	// Repo digests look like "nginx@sha256:..."; pick the one of the pulled repository
+	repository := models.ImageRepository(name)
+	for _, repoDigest := range repoDigests {
+		repo, digest, found := strings.Cut(repoDigest, "@")
+		if found && (repo == repository || strings.HasSuffix(repo, "/"+repository) || strings.HasSuffix(repository, "/"+repo)) {
+			return digest, nil
+		}
+	}
+
+	return "", nil
+}
+
+// ContainerImageID returns the ID of the image a container was created from
+func ContainerImageID(ctx context.Context, containerID string) (string, error) {
+	cmd := dockerCommand(ctx, "inspect", "--format", "{{.Image}}", containerID)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("docker inspect failed: %w, output: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
@@ -0,0 +1,521 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/tracing"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+)
+
+// The logs of a VM are stored in <MINICLOUD_LOGS_DIR>/vm-<id>/ as JSON lines:
+// current.log is appended to and rotated to <timestamp>.log when it reaches MINICLOUD_LOGS_MAX_SIZE_MB,
+// meta.json keeps the owner, so the logs stay accessible after the VM is deleted
+const (
+	currentLogFile = "current.log"
+	logMetaFile    = "meta.json"
+)
+
+// LogEntry is one line of output of a VM
+type LogEntry struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"` // stdout or stderr
+	Log    string    `json:"log"`
+}
+
+// LogMeta identifies the VM a log directory belongs to
+type LogMeta struct {
+	VMID      int64 `json:"vm_id"`
+	AccountID int64 `json:"account_id"`
+}
+
+var (
+	logWritersMu sync.Mutex
+	logWriters   = map[int64]*vmLogWriter{}
+
+	logCapturesMu sync.Mutex
+	logCaptures   = map[string]bool{}
+)
+
+func logsDir() string {
+	return utils.GetEnv("MINICLOUD_LOGS_DIR", "logs-data")
+}
+
+func vmLogDir(vmID int64) string {
+	return filepath.Join(logsDir(), "vm-"+strconv.FormatInt(vmID, 10))
+}
+
+// vmLogWriter appends the entries of one VM to its current log file and rotates it
+type vmLogWriter struct {
+	mu   sync.Mutex
+	dir  string
+	file *os.File
+	size int64
+}
+
+func getLogWriter(vmID int64) *vmLogWriter {
+	logWritersMu.Lock()
+	defer logWritersMu.Unlock()
+
+	writer, ok := logWriters[vmID]
+	if !ok {
+		writer = &vmLogWriter{dir: vmLogDir(vmID)}
+		logWriters[vmID] = writer
+	}
+	return writer
+}
+
+func (writer *vmLogWriter) append(entry LogEntry) error {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	if writer.file == nil {
+		file, err := os.OpenFile(filepath.Join(writer.dir, currentLogFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		writer.file = file
+		writer.size = info.Size()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	n, err := writer.file.Write(append(line, '\n'))
+	writer.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	maxSize := int64(utils.GetEnvInt("MINICLOUD_LOGS_MAX_SIZE_MB", 10)) * 1024 * 1024
+	if writer.size < maxSize {
+		return nil
+	}
+
+	// Rotate, rotated files are named by time so they sort chronologically
+	writer.file.Close()
+	writer.file = nil
+	rotated := time.Now().UTC().Format("20060102T150405.000000000") + ".log"
+	return os.Rename(filepath.Join(writer.dir, currentLogFile), filepath.Join(writer.dir, rotated))
+}
+
+// close releases the current log file, the next entry opens it again
+func (writer *vmLogWriter) close() {
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+
+	if writer.file != nil {
+		writer.file.Close()
+		writer.file = nil
+	}
+}
+
+// StartLogCapture follows the output of the container of a VM into the log store until the container is removed
+// It does nothing if the container is already captured
+func StartLogCapture(vmID, accountID int64, containerID string) {
+	if containerID == "" {
+		return
+	}
+
+	logCapturesMu.Lock()
+	if logCaptures[containerID] {
+		logCapturesMu.Unlock()
+		return
+	}
+	logCaptures[containerID] = true
+	logCapturesMu.Unlock()
+
+	go func() {
+		defer func() {
+			logCapturesMu.Lock()
+			delete(logCaptures, containerID)
+			logCapturesMu.Unlock()
+		}()
+
+		if err := captureLogs(vmID, accountID, containerID); err != nil {
+			slog.Error("Log capture failed", "vm_id", vmID, "error", err)
+		}
+	}()
+}
+
+// ResumeLogCaptures restarts the log capture of every VM, e.g., after a restart of the server
+func ResumeLogCaptures(ctx context.Context) error {
+	vms, err := models.GetAllVms(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, vm := range vms {
+		StartLogCapture(vm.ID, vm.AccountID, vm.ContainerID)
+	}
+	return nil
+}
+
+func captureLogs(vmID, accountID int64, containerID string) error {
+	dir := vmLogDir(vmID)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+
+	meta, _ := json.Marshal(LogMeta{VMID: vmID, AccountID: accountID})
+	if err := os.WriteFile(filepath.Join(dir, logMetaFile), meta, 0o640); err != nil {
+		return err
+	}
+
+	// Continue after the last stored line instead of capturing the whole output again
+	args := []string{"logs", "--follow", "--timestamps"}
+	last := lastLogTime(vmID)
+	if !last.IsZero() {
+		args = append(args, "--since", last.Format(time.RFC3339Nano))
+	}
+	args = append(args, containerID)
+
+	// Not a timed docker call, it follows the container until it is removed
+	cmd := exec.Command("docker", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	writer := getLogWriter(vmID)
+	var wg sync.WaitGroup
+	for stream, reader := range map[string]io.Reader{"stdout": stdout, "stderr": stderr} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			scanner := bufio.NewScanner(reader)
+			scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+			for scanner.Scan() {
+				entry := parseDockerLogLine(stream, scanner.Text())
+				if !entry.Time.After(last) {
+					continue
+				}
+				if err := writer.append(entry); err != nil {
+					slog.Error("Could not store log", "vm_id", vmID, "error", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	writer.close()
+
+	return cmd.Wait()
+}
+
+// parseDockerLogLine splits the timestamp added by "docker logs --timestamps" from the message
+func parseDockerLogLine(stream, line string) LogEntry {
+	entry := LogEntry{Time: time.Now().UTC(), Stream: stream, Log: line}
+
+	prefix, message, found := strings.Cut(line, " ")
+	if timestamp, err := time.Parse(time.RFC3339Nano, prefix); found && err == nil {
+		entry.Time = timestamp.UTC()
+		entry.Log = message
+	}
+	return entry
+}
+
+// lastLogTime returns the time of the last stored entry of the VM
+func lastLogTime(vmID int64) time.Time {
+	var last time.Time
+	files, _ := logFiles(vmID)
+
+	// The newest file with entries has the last one
+	for i := len(files) - 1; i >= 0 && last.IsZero(); i-- {
+		file, err := os.Open(files[i])
+		if err != nil {
+			continue
+		}
+		readLogEntries(file, func(entry LogEntry) {
+			if entry.Time.After(last) {
+				last = entry.Time
+			}
+		})
+		file.Close()
+	}
+	return last
+}
+
+// logFiles returns the log files of the VM in chronological order (current.log last)
+func logFiles(vmID int64) ([]string, error) {
+	dir := vmLogDir(vmID)
+	rotated, err := filepath.Glob(filepath.Join(dir, "2*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(rotated)
+
+	current := filepath.Join(dir, currentLogFile)
+	if _, err := os.Stat(current); err == nil {
+		rotated = append(rotated, current)
+	}
+	return rotated, nil
+}
+
+func readLogEntries(reader io.Reader, fn func(LogEntry)) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 2*1024*1024)
+	for scanner.Scan() {
+		var entry LogEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			fn(entry)
+		}
+	}
+}
+
+// GetLogMeta returns the owner of the logs of a VM, or nil if there are no logs
+func GetLogMeta(vmID int64) (*LogMeta, error) {
+	data, err := os.ReadFile(filepath.Join(vmLogDir(vmID), logMetaFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var meta LogMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// ReadLogs returns the stored entries of the VM after since, limited to the last tail entries (0 means all)
+func ReadLogs(vmID int64, since time.Time, tail int) ([]LogEntry, error) {
+	files, err := logFiles(vmID)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []LogEntry{}
+	for _, path := range files {
+		file, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // rotated meanwhile
+		}
+		if err != nil {
+			return nil, err
+		}
+		readLogEntries(file, func(entry LogEntry) {
+			if entry.Time.After(since) {
+				entries = append(entries, entry)
+			}
+		})
+		file.Close()
+	}
+
+	if tail > 0 && len(entries) > tail {
+		entries = entries[len(entries)-tail:]
+	}
+	return entries, nil
+}
+
+// FollowLogs sends the stored entries like ReadLogs, then every new entry until the context ends or send fails
+func FollowLogs(ctx context.Context, vmID int64, since time.Time, tail int, send func(LogEntry) error) error {
+	files, err := logFiles(vmID)
+	if err != nil {
+		return err
+	}
+
+	// Keep the current log file open, following continues where the stored entries end
+	current := filepath.Join(vmLogDir(vmID), currentLogFile)
+	var file *os.File
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	entries := []LogEntry{}
+	collect := func(entry LogEntry) {
+		if entry.Time.After(since) {
+			entries = append(entries, entry)
+		}
+	}
+
+	var pending []byte
+	for _, path := range files {
+		opened, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if path != current {
+			readLogEntries(opened, collect)
+			opened.Close()
+			continue
+		}
+		file = opened
+		if pending, err = readLogLines(file, pending, collect); err != nil {
+			return err
+		}
+	}
+
+	if tail > 0 && len(entries) > tail {
+		entries = entries[len(entries)-tail:]
+	}
+	for _, entry := range entries {
+		if err := send(entry); err != nil {
+			return err
+		}
+	}
+
+	// Poll the current log file, reopen it after a rotation
+	var sendErr error
+	sendNew := func(entry LogEntry) {
+		if sendErr == nil {
+			sendErr = send(entry)
+		}
+	}
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		if file == nil {
+			opened, err := os.Open(current)
+			if err != nil {
+				continue
+			}
+			file = opened
+			pending = nil
+		}
+
+		if pending, err = readLogLines(file, pending, sendNew); err != nil {
+			return err
+		}
+		if sendErr != nil {
+			return sendErr
+		}
+
+		// current.log was rotated, the rest of the old file has been read above
+		if info, err := os.Stat(current); err != nil || !sameFile(file, info) {
+			file.Close()
+			file = nil
+		}
+	}
+}
+
+// readLogLines reads the complete lines appended to the file since the last call
+// The incomplete last line is returned and passed again with the next call
+func readLogLines(file *os.File, pending []byte, fn func(LogEntry)) ([]byte, error) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return pending, err
+	}
+	pending = append(pending, data...)
+
+	for {
+		newline := bytes.IndexByte(pending, '\n')
+		if newline < 0 {
+			return pending, nil
+		}
+		var entry LogEntry
+		if json.Unmarshal(pending[:newline], &entry) == nil {
+			fn(entry)
+		}
+		pending = pending[newline+1:]
+	}
+}
+
+func sameFile(file *os.File, info os.FileInfo) bool {
+	openedInfo, err := file.Stat()
+	return err == nil && os.SameFile(openedInfo, info)
+}
+
+// StartLogJanitor removes log files older than MINICLOUD_LOGS_RETENTION (default 168h) every hour
+// The logs of deleted VMs disappear with their last file
+func StartLogJanitor() {
+	go func() {
+		for {
+			if err := tracing.Job("cleanup logs", cleanupLogs); err != nil {
+				slog.Error("Log cleanup failed", "error", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func cleanupLogs(ctx context.Context) error {
+	retention := utils.GetEnvDuration("MINICLOUD_LOGS_RETENTION", 7*24*time.Hour)
+	cutoff := time.Now().Add(-retention)
+
+	dirs, err := filepath.Glob(filepath.Join(logsDir(), "vm-*"))
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		files, err := filepath.Glob(filepath.Join(dir, "*.log"))
+		if err != nil {
+			return err
+		}
+
+		remaining := 0
+		for _, path := range files {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if info.ModTime().Before(cutoff) && filepath.Base(path) != currentLogFile {
+				os.Remove(path)
+				continue
+			}
+			if info.ModTime().Before(cutoff) && !logDirInUse(ctx, dir) {
+				os.Remove(path)
+				continue
+			}
+			remaining++
+		}
+
+		if remaining == 0 && !logDirInUse(ctx, dir) {
+			os.RemoveAll(dir)
+		}
+	}
+
+	return nil
+}
+
+// logDirInUse reports whether the VM of the log directory still exists
+func logDirInUse(ctx context.Context, dir string) bool {
+	vmID, err := strconv.ParseInt(strings.TrimPrefix(filepath.Base(dir), "vm-"), 10, 64)
+	if err != nil {
+		return false
+	}
+	_, err = models.GetVMByID(ctx, vmID)
+	return err == nil
+}
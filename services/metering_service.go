@@ -0,0 +1,59 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/models"
+)
+
+// MeterVM records a lifecycle event of a VM (created, resized, recreated or state changed):
+// the open metering interval is closed and, if the VM runs, a new one with its current size starts
+func MeterVM(ctx context.Context, vm *models.VM) error {
+	now := time.Now().UTC()
+
+	if err := models.CloseMeteringRecords(ctx, models.MeteredVM, vm.ID, now); err != nil {
+		return err
+	}
+
+	if vm.Status != models.VMStatusRunning {
+		return nil
+	}
+
+	record := models.MeteringRecord{
+		AccountID:    vm.AccountID,
+		ProjectID:    vm.ProjectID,
+		ResourceType: models.MeteredVM,
+		ResourceID:   vm.ID,
+		ResourceName: vm.Name,
+		CPU:          vm.CPU,
+		MemoryMB:     vm.Memory,
+		StartedAt:    now,
+	}
+	return record.InsertMeteringRecord(ctx)
+}
+
+// MeterStorage records a lifecycle event of a storage volume (created or resized)
+func MeterStorage(ctx context.Context, storage *models.Storage) error {
+	now := time.Now().UTC()
+
+	if err := models.CloseMeteringRecords(ctx, models.MeteredStorage, storage.ID, now); err != nil {
+		return err
+	}
+
+	record := models.MeteringRecord{
+		AccountID:    storage.AccountID,
+		ProjectID:    storage.ProjectID,
+		ResourceType: models.MeteredStorage,
+		ResourceID:   storage.ID,
+		ResourceName: storage.Name,
+		SizeGB:       storage.SizeGB,
+		StartedAt:    now,
+	}
+	return record.InsertMeteringRecord(ctx)
+}
+
+// StopMetering closes the open interval of a deleted resource
+func StopMetering(ctx context.Context, resourceType string, resourceID int64) error {
+	return models.CloseMeteringRecords(ctx, resourceType, resourceID, time.Now().UTC())
+}
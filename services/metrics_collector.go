@@ -0,0 +1,212 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/tracing"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+)
+
+// Raw samples are kept for a day, hourly points for 30 days by default
+func metricsRawRetention() time.Duration {
+	return utils.GetEnvDuration("MINICLOUD_METRICS_RAW_RETENTION", 24*time.Hour)
+}
+
+func metricsHourRetention() time.Duration {
+	return utils.GetEnvDuration("MINICLOUD_METRICS_RETENTION", 30*24*time.Hour)
+}
+
+// MetricsRawSince returns since when raw samples are available
+func MetricsRawSince() time.Time {
+	return time.Now().Add(-metricsRawRetention())
+}
+
+// containerStats is one line of "docker stats --format '{{json .}}'"
+type containerStats struct {
+	ID       string `json:"ID"`
+	CPUPerc  string `json:"CPUPerc"`
+	MemUsage string `json:"MemUsage"`
+	NetIO    string `json:"NetIO"`
+	BlockIO  string `json:"BlockIO"`
+}
+
+// ioCounters are the cumulative counters of a container, to store the bytes transferred between samples
+type ioCounters struct {
+	netRx, netTx, blockRead, blockWrite int64
+}
+
+var (
+	countersMu   sync.Mutex
+	lastCounters = map[string]ioCounters{}
+)
+
+// StartMetricsCollector samples the stats of every VM container every MINICLOUD_METRICS_INTERVAL (default 30s)
+// and downsamples older samples to hourly points
+func StartMetricsCollector() {
+	interval := utils.GetEnvDuration("MINICLOUD_METRICS_INTERVAL", 30*time.Second)
+
+	go func() {
+		lastDownsample := time.Time{}
+		for {
+			if err := tracing.Job("collect metrics", CollectVMMetrics); err != nil {
+				slog.Error("Metrics collection failed", "error", err)
+			}
+
+			if time.Since(lastDownsample) >= time.Hour {
+				err := tracing.Job("downsample metrics", func(ctx context.Context) error {
+					return models.DownsampleVMMetrics(ctx, metricsRawRetention(), metricsHourRetention())
+				})
+				if err != nil {
+					slog.Error("Metrics downsampling failed", "error", err)
+				}
+				lastDownsample = time.Now()
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// CollectVMMetrics stores one sample for every VM with a running container
+func CollectVMMetrics(ctx context.Context) error {
+	vms, err := models.GetAllVms(ctx)
+	if err != nil {
+		return err
+	}
+
+	vmsByContainer := map[string]int64{}
+	for _, vm := range vms {
+		if vm.ContainerID != "" {
+			vmsByContainer[vm.ContainerID] = vm.ID
+		}
+	}
+	if len(vmsByContainer) == 0 {
+		return nil
+	}
+
+	cmd := dockerCommand(ctx, "stats", "--no-stream", "--no-trunc", "--format", "{{json .}}")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("docker stats failed: %w, output: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	now := time.Now().UTC()
+	seen := map[string]bool{}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		var stats containerStats
+		if json.Unmarshal([]byte(line), &stats) != nil {
+			continue
+		}
+
+		vmID, ok := vmsByContainer[stats.ID]
+		if !ok {
+			continue
+		}
+		seen[stats.ID] = true
+
+		sample := sampleFromStats(vmID, now, stats)
+		if err := sample.InsertVMMetricSample(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Forget the counters of removed containers
+	countersMu.Lock()
+	for containerID := range lastCounters {
+		if !seen[containerID] {
+			delete(lastCounters, containerID)
+		}
+	}
+	countersMu.Unlock()
+
+	return nil
+}
+
+func sampleFromStats(vmID int64, now time.Time, stats containerStats) models.VMMetricSample {
+	// CPUPerc is relative to one core, e.g., "150.00%" is one and a half cores
+	cpuPercent, _ := strconv.ParseFloat(strings.TrimSuffix(stats.CPUPerc, "%"), 64)
+	memoryUsed, _ := parseIOPair(stats.MemUsage)
+	netRx, netTx := parseIOPair(stats.NetIO)
+	blockRead, blockWrite := parseIOPair(stats.BlockIO)
+
+	current := ioCounters{netRx: netRx, netTx: netTx, blockRead: blockRead, blockWrite: blockWrite}
+
+	countersMu.Lock()
+	previous, known := lastCounters[stats.ID]
+	lastCounters[stats.ID] = current
+	countersMu.Unlock()
+
+	// The first sample of a container only sets the baseline of the counters
+	delta := ioCounters{}
+	if known {
+		delta = ioCounters{
+			netRx:      counterDelta(previous.netRx, current.netRx),
+			netTx:      counterDelta(previous.netTx, current.netTx),
+			blockRead:  counterDelta(previous.blockRead, current.blockRead),
+			blockWrite: counterDelta(previous.blockWrite, current.blockWrite),
+		}
+	}
+
+	cores := cpuPercent / 100
+	memoryMB := float64(memoryUsed) / 1024 / 1024
+
+	return models.VMMetricSample{
+		VMID:            vmID,
+		Time:            now,
+		CPUCores:        cores,
+		CPUCoresMax:     cores,
+		MemoryMB:        memoryMB,
+		MemoryMBMax:     memoryMB,
+		NetRxBytes:      delta.netRx,
+		NetTxBytes:      delta.netTx,
+		BlockReadBytes:  delta.blockRead,
+		BlockWriteBytes: delta.blockWrite,
+	}
+}
+
+// counterDelta handles counters which restarted from zero
+func counterDelta(previous, current int64) int64 {
+	if current < previous {
+		return current
+	}
+	return current - previous
+}
+
+// parseIOPair parses values like "1.5kB / 3MB" or "12MiB / 256MiB"
+func parseIOPair(value string) (int64, int64) {
+	first, second, _ := strings.Cut(value, "/")
+	return parseByteSize(first), parseByteSize(second)
+}
+
+// byteUnits are the units of docker stats, binary for memory and decimal for I/O
+var byteUnits = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"kB", 1e3}, {"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+func parseByteSize(value string) int64 {
+	value = strings.TrimSpace(value)
+	for _, unit := range byteUnits {
+		if number, found := strings.CutSuffix(value, unit.suffix); found {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+			if err != nil {
+				return 0
+			}
+			return int64(parsed * unit.multiplier)
+		}
+	}
+	return 0
+}
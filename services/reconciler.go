@@ -0,0 +1,106 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/tracing"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+)
+
+var (
+	reconcilerMu      sync.Mutex
+	lastReconcileTime time.Time
+)
+
+// LastReconcile returns when the reconciler last completed a pass (zero before the first one)
+func LastReconcile() time.Time {
+	reconcilerMu.Lock()
+	defer reconcilerMu.Unlock()
+	return lastReconcileTime
+}
+
+// StartReconciler periodically compares the containers of the VMs with their stored status.
+// State changes (e.g., a crashed container) are stored and recorded as metering events.
+// The interval is configured with MINICLOUD_RECONCILE_INTERVAL (default 15s).
+func StartReconciler() {
+	interval := utils.GetEnvDuration("MINICLOUD_RECONCILE_INTERVAL", 15*time.Second)
+
+	go func() {
+		for {
+			if err := tracing.Job("reconcile", ReconcileVMs); err != nil {
+				slog.Error("Reconciler failed", "error", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// ReconcileVMs runs a single pass of the reconciler
+func ReconcileVMs(ctx context.Context) error {
+	states, err := containerStates(ctx)
+	if err != nil {
+		return err
+	}
+
+	vms, err := models.GetAllVms(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := range vms {
+		vm := &vms[i]
+
+		status, found := states[vm.ContainerID]
+		if !found {
+			status = models.VMStatusMissing
+		}
+
+		if status == vm.Status {
+			continue
+		}
+
+		previousStatus := vm.Status
+		vm.Status = status
+		if err := vm.UpdateVMStatus(ctx); err != nil {
+			return err
+		}
+
+		if err := MeterVM(ctx, vm); err != nil {
+			return err
+		}
+
+		PublishEvent(ctx, models.EventVMStateChanged, "vm", vm.ID, vm.AccountID, vm.ProjectID,
+			map[string]any{"vm": vm, "previous_status": previousStatus, "status": status})
+	}
+
+	reconcilerMu.Lock()
+	lastReconcileTime = time.Now()
+	reconcilerMu.Unlock()
+
+	return nil
+}
+
+// containerStates returns the state (running, exited, paused, ...) of every container by its full ID
+func containerStates(ctx context.Context) (map[string]string, error) {
+	cmd := dockerCommand(ctx, "ps", "--all", "--no-trunc", "--format", "{{.ID}} {{.State}}")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("docker ps failed: %w, output: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	states := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		id, state, found := strings.Cut(line, " ")
+		if found {
+			states[id] = state
+		}
+	}
+
+	return states, nil
+}
@@ -0,0 +1,589 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/odeeka/go-minicloud-rest-api/tracing"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+)
+
+// The embedded registry keeps everything on local disk:
+//
+//	<dir>/blobs/sha256/<hex>                      content addressed blobs (layers, configs, manifests)
+//	<dir>/uploads/<name>/_<uuid>                  blob uploads in progress to the repository
+//	<dir>/repositories/<name>/_layers/<hex>       blobs pushed to (and readable from) the repository
+//	<dir>/repositories/<name>/_manifests/<hex>    media type of each manifest of the repository
+//	<dir>/repositories/<name>/_tags/<tag>         digest the tag points to
+
+// RegistryImagePrefix is how VMs reference images of the embedded registry ("minicloud/<account>/<repo>:<tag>")
+const RegistryImagePrefix = "minicloud/"
+
+// Errors of the registry storage, mapped to OCI error codes by the handler
+var (
+	ErrBlobUnknown       = errors.New("blob unknown to registry")
+	ErrBlobUploadUnknown = errors.New("blob upload unknown to registry")
+	ErrDigestInvalid     = errors.New("provided digest did not match uploaded content")
+	ErrManifestUnknown   = errors.New("manifest unknown")
+	ErrNameUnknown       = errors.New("repository name not known to registry")
+)
+
+var (
+	repositoryNamePattern = regexp.MustCompile(`^[a-z0-9]+(?:[._-][a-z0-9]+)*(?:/[a-z0-9]+(?:[._-][a-z0-9]+)*)*$`)
+	tagPattern            = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	digestPattern         = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// RegistryDir returns the root directory of the embedded registry
+func RegistryDir() string {
+	return utils.GetEnv("MINICLOUD_REGISTRY_DIR", "registry-data")
+}
+
+// RegistryHost returns the address under which the Docker daemon reaches the embedded registry
+// Docker treats registries on localhost as insecure by default, so plain HTTP works out of the box
+func RegistryHost() string {
+	return utils.GetEnv("MINICLOUD_REGISTRY_HOST", "localhost:8080")
+}
+
+// ValidRepositoryName reports whether the name is a valid OCI repository name
+func ValidRepositoryName(name string) bool {
+	return len(name) <= 255 && repositoryNamePattern.MatchString(name)
+}
+
+// ValidTag reports whether the reference is a valid tag
+func ValidTag(tag string) bool {
+	return tagPattern.MatchString(tag)
+}
+
+// ValidDigest reports whether the reference is a supported (sha256) digest
+func ValidDigest(digest string) bool {
+	return digestPattern.MatchString(digest)
+}
+
+func blobPath(digest string) string {
+	return filepath.Join(RegistryDir(), "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+// uploadPath binds the upload to its repository, the "_" prefix can't clash with a repository name
+func uploadPath(name, uploadID string) string {
+	return filepath.Join(RegistryDir(), "uploads", filepath.FromSlash(name), "_"+uploadID)
+}
+
+func repositoryPath(name string, parts ...string) string {
+	return filepath.Join(append([]string{RegistryDir(), "repositories", filepath.FromSlash(name)}, parts...)...)
+}
+
+// touch creates an empty marker file including its parent directories
+func touch(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, nil, 0o644)
+}
+
+// StatBlob returns the size of a blob which was pushed to the repository
+func StatBlob(name, digest string) (int64, error) {
+	if !ValidDigest(digest) {
+		return 0, ErrBlobUnknown
+	}
+
+	if _, err := os.Stat(repositoryPath(name, "_layers", strings.TrimPrefix(digest, "sha256:"))); err != nil {
+		return 0, ErrBlobUnknown
+	}
+
+	info, err := os.Stat(blobPath(digest))
+	if err != nil {
+		return 0, ErrBlobUnknown
+	}
+
+	return info.Size(), nil
+}
+
+// OpenBlob opens a blob of the repository for reading
+func OpenBlob(name, digest string) (*os.File, int64, error) {
+	size, err := StatBlob(name, digest)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	file, err := os.Open(blobPath(digest))
+	if err != nil {
+		return nil, 0, ErrBlobUnknown
+	}
+
+	return file, size, nil
+}
+
+// DeleteBlob removes a blob from the repository
+// The content itself stays, other repositories may still reference it
+func DeleteBlob(name, digest string) error {
+	if _, err := StatBlob(name, digest); err != nil {
+		return err
+	}
+	return os.Remove(repositoryPath(name, "_layers", strings.TrimPrefix(digest, "sha256:")))
+}
+
+// MountBlob makes an existing blob of another repository available in this repository
+func MountBlob(name, from, digest string) error {
+	if _, err := StatBlob(from, digest); err != nil {
+		return err
+	}
+	return touch(repositoryPath(name, "_layers", strings.TrimPrefix(digest, "sha256:")))
+}
+
+// StartBlobUpload creates a new, empty upload to the repository and returns its ID
+func StartBlobUpload(name string) (string, error) {
+	uploadID := uuid.New().String()
+
+	if err := os.MkdirAll(filepath.Dir(uploadPath(name, uploadID)), 0o755); err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(uploadPath(name, uploadID), nil, 0o644); err != nil {
+		return "", err
+	}
+
+	return uploadID, nil
+}
+
+// BlobUploadSize returns the number of bytes received so far
+// Uploads are only known to the repository which started them
+func BlobUploadSize(name, uploadID string) (int64, error) {
+	if _, err := uuid.Parse(uploadID); err != nil {
+		return 0, ErrBlobUploadUnknown
+	}
+
+	info, err := os.Stat(uploadPath(name, uploadID))
+	if err != nil {
+		return 0, ErrBlobUploadUnknown
+	}
+
+	return info.Size(), nil
+}
+
+// AppendBlobUpload appends a chunk to the upload and returns the new size
+func AppendBlobUpload(name, uploadID string, chunk io.Reader) (int64, error) {
+	if _, err := BlobUploadSize(name, uploadID); err != nil {
+		return 0, err
+	}
+
+	file, err := os.OpenFile(uploadPath(name, uploadID), os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, chunk); err != nil {
+		return 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+// CompleteBlobUpload appends the last chunk, verifies the digest
+// and moves the content into the blob store of the repository
+func CompleteBlobUpload(name, uploadID, digest string, lastChunk io.Reader) error {
+	if _, err := AppendBlobUpload(name, uploadID, lastChunk); err != nil {
+		return err
+	}
+
+	file, err := os.Open(uploadPath(name, uploadID))
+	if err != nil {
+		return ErrBlobUploadUnknown
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	if "sha256:"+hex.EncodeToString(hash.Sum(nil)) != digest {
+		os.Remove(uploadPath(name, uploadID))
+		return ErrDigestInvalid
+	}
+
+	if err := os.MkdirAll(filepath.Dir(blobPath(digest)), 0o755); err != nil {
+		return err
+	}
+
+	if err := os.Rename(uploadPath(name, uploadID), blobPath(digest)); err != nil {
+		return err
+	}
+
+	return touch(repositoryPath(name, "_layers", strings.TrimPrefix(digest, "sha256:")))
+}
+
+// CancelBlobUpload drops an upload in progress
+func CancelBlobUpload(name, uploadID string) error {
+	if _, err := BlobUploadSize(name, uploadID); err != nil {
+		return err
+	}
+	return os.Remove(uploadPath(name, uploadID))
+}
+
+// StartUploadJanitor removes blob uploads which received no data for MINICLOUD_REGISTRY_UPLOAD_TTL (default 24h) every hour
+func StartUploadJanitor() {
+	go func() {
+		for {
+			if err := tracing.Job("cleanup registry uploads", cleanupUploads); err != nil {
+				slog.Error("Registry upload cleanup failed", "error", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func cleanupUploads(ctx context.Context) error {
+	cutoff := time.Now().Add(-utils.GetEnvDuration("MINICLOUD_REGISTRY_UPLOAD_TTL", 24*time.Hour))
+
+	return filepath.WalkDir(filepath.Join(RegistryDir(), "uploads"), func(path string, entry os.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return filepath.SkipDir
+		}
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.ModTime().Before(cutoff) {
+			slog.InfoContext(ctx, "Removing abandoned registry upload", "path", path)
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PutManifest stores a manifest under its digest and, if the reference is a tag, points the tag to it
+func PutManifest(name, reference, mediaType string, content []byte) (string, error) {
+	sum := sha256.Sum256(content)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	if ValidDigest(reference) && reference != digest {
+		return "", ErrDigestInvalid
+	}
+
+	// Every blob the manifest refers to must have been pushed first
+	var manifest struct {
+		Config *struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+		Layers []struct {
+			Digest string `json:"digest"`
+		} `json:"layers"`
+		Manifests []struct {
+			Digest string `json:"digest"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return "", fmt.Errorf("invalid manifest: %w", err)
+	}
+
+	if manifest.Config != nil {
+		if _, err := StatBlob(name, manifest.Config.Digest); err != nil {
+			return "", err
+		}
+	}
+	for _, layer := range manifest.Layers {
+		if _, err := StatBlob(name, layer.Digest); err != nil {
+			return "", err
+		}
+	}
+	for _, child := range manifest.Manifests {
+		if !ValidDigest(child.Digest) {
+			return "", ErrManifestUnknown
+		}
+		if _, err := os.Stat(repositoryPath(name, "_manifests", strings.TrimPrefix(child.Digest, "sha256:"))); err != nil {
+			return "", ErrManifestUnknown
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(blobPath(digest)), 0o755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(blobPath(digest), content, 0o644); err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(repositoryPath(name, "_manifests"), 0o755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(repositoryPath(name, "_manifests", strings.TrimPrefix(digest, "sha256:")), []byte(mediaType), 0o644); err != nil {
+		return "", err
+	}
+
+	if ValidTag(reference) {
+		if err := os.MkdirAll(repositoryPath(name, "_tags"), 0o755); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(repositoryPath(name, "_tags", reference), []byte(digest), 0o644); err != nil {
+			return "", err
+		}
+	}
+
+	return digest, nil
+}
+
+// ResolveManifest returns the digest of a manifest referenced by tag or digest
+func ResolveManifest(name, reference string) (string, error) {
+	digest := reference
+
+	if !ValidDigest(reference) {
+		if !ValidTag(reference) {
+			return "", ErrManifestUnknown
+		}
+		content, err := os.ReadFile(repositoryPath(name, "_tags", reference))
+		if err != nil {
+			return "", ErrManifestUnknown
+		}
+		digest = string(content)
+	}
+
+	if _, err := os.Stat(repositoryPath(name, "_manifests", strings.TrimPrefix(digest, "sha256:"))); err != nil {
+		return "", ErrManifestUnknown
+	}
+
+	return digest, nil
+}
+
+// GetManifest returns the content, media type and digest of a manifest
+func GetManifest(name, reference string) ([]byte, string, string, error) {
+	digest, err := ResolveManifest(name, reference)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	mediaType, err := os.ReadFile(repositoryPath(name, "_manifests", strings.TrimPrefix(digest, "sha256:")))
+	if err != nil {
+		return nil, "", "", ErrManifestUnknown
+	}
+
+	content, err := os.ReadFile(blobPath(digest))
+	if err != nil {
+		return nil, "", "", ErrManifestUnknown
+	}
+
+	return content, string(mediaType), digest, nil
+}
+
+// DeleteManifest removes a manifest and every tag pointing to it
+func DeleteManifest(name, digest string) error {
+	if _, err := ResolveManifest(name, digest); err != nil {
+		return err
+	}
+
+	tags, err := ListTags(name)
+	if err != nil && !errors.Is(err, ErrNameUnknown) {
+		return err
+	}
+	for _, tag := range tags {
+		content, err := os.ReadFile(repositoryPath(name, "_tags", tag))
+		if err == nil && string(content) == digest {
+			if err := os.Remove(repositoryPath(name, "_tags", tag)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return os.Remove(repositoryPath(name, "_manifests", strings.TrimPrefix(digest, "sha256:")))
+}
+
+// ListTags returns the sorted tags of a repository
+func ListTags(name string) ([]string, error) {
+	entries, err := os.ReadDir(repositoryPath(name, "_tags"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNameUnknown
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		tags = append(tags, entry.Name())
+	}
+	sort.Strings(tags)
+
+	return tags, nil
+}
+
+// ListRepositories returns the sorted repository names below the given namespace (e.g., an account)
+func ListRepositories(namespace string) ([]string, error) {
+	root := repositoryPath(namespace)
+	var names []string
+
+	err := filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() && entry.Name() == "_tags" {
+			rel, err := filepath.Rel(filepath.Join(RegistryDir(), "repositories"), filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			names = append(names, filepath.ToSlash(rel))
+			return filepath.SkipDir
+		}
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), "_") {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// RegistryUsage returns the bytes of the blobs and manifests stored in the repositories of the namespace,
+// content shared by several repositories is counted once, and of the uploads in progress
+func RegistryUsage(namespace string) (int64, error) {
+	counted := make(map[string]bool)
+	var total int64
+
+	err := filepath.WalkDir(repositoryPath(namespace), func(path string, entry os.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		parent := filepath.Base(filepath.Dir(path))
+		if entry.IsDir() || (parent != "_layers" && parent != "_manifests") || counted[entry.Name()] {
+			return nil
+		}
+		counted[entry.Name()] = true
+
+		info, err := os.Stat(blobPath("sha256:" + entry.Name()))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	err = filepath.WalkDir(filepath.Join(RegistryDir(), "uploads", namespace), func(path string, entry os.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return filepath.SkipDir
+		}
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+// DeleteNamespace removes the repositories of an account, the blobs stay for other repositories which reference them
+func DeleteNamespace(namespace string) error {
+	// Names which aren't valid repository names can't have repositories
+	if !ValidRepositoryName(namespace) || strings.Contains(namespace, "/") {
+		return nil
+	}
+	if err := os.RemoveAll(filepath.Join(RegistryDir(), "uploads", namespace)); err != nil {
+		return err
+	}
+	return os.RemoveAll(repositoryPath(namespace))
+}
+
+// ParseRegistryImage splits a VM image "minicloud/<account>/<repo>:<tag>" into the
+// owning account and the reference the Docker daemon pulls ("<registry host>/<account>/<repo>:<tag>")
+// It returns ok == false for images which are not served by the embedded registry
+func ParseRegistryImage(image string) (account string, pullReference string, ok bool) {
+	if !strings.HasPrefix(image, RegistryImagePrefix) {
+		return "", "", false
+	}
+
+	name := strings.TrimPrefix(image, RegistryImagePrefix)
+	account, _, found := strings.Cut(name, "/")
+	if !found || account == "" {
+		return "", "", false
+	}
+
+	return account, RegistryHost() + "/" + name, true
+}
+
+// PullRegistryImage pulls an image of the embedded registry on behalf of an account
+// and returns the digest of the pulled manifest
+// The Docker daemon authenticates with a short-lived token in a throw-away client config,
+// so no credentials are left in the user's docker config
+func PullRegistryImage(ctx context.Context, pullReference, username string, accountID int64) (string, error) {
+	token, err := utils.GenerateToken(username, accountID)
+	if err != nil {
+		return "", err
+	}
+
+	configDir, err := os.MkdirTemp("", "minicloud-docker-config-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(configDir)
+
+	auth := username + ":" + token
+	config, _ := json.Marshal(map[string]any{
+		"auths": map[string]any{
+			RegistryHost(): map[string]string{"auth": base64.StdEncoding.EncodeToString([]byte(auth))},
+		},
+	})
+	if err := os.WriteFile(filepath.Join(configDir, "config.json"), config, 0o600); err != nil {
+		return "", err
+	}
+
+	cmd := dockerCommand(ctx, "--config", configDir, "pull", pullReference)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("docker pull failed: %w, output: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return resolveRepoDigest(ctx, pullReference)
+}
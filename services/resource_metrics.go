@@ -0,0 +1,62 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/metrics"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	vmsDesc = prometheus.NewDesc("minicloud_vms",
+		"Number of VMs by status as last seen by the reconciler.", []string{"status"}, nil)
+	volumesDesc = prometheus.NewDesc("minicloud_volumes",
+		"Number of storage volumes by attachment status.", []string{"status"}, nil)
+	reconcilerLagDesc = prometheus.NewDesc("minicloud_reconciler_lag_seconds",
+		"Seconds since the reconciler completed its last pass (since startup before the first one).", nil, nil)
+)
+
+// resourceCollector reads the resource counts from the database when /metrics is scraped
+type resourceCollector struct {
+	started time.Time
+}
+
+// RegisterResourceMetrics exports the number of VMs and volumes and the reconciler lag
+func RegisterResourceMetrics() {
+	metrics.Registry.MustRegister(&resourceCollector{started: time.Now()})
+}
+
+func (collector *resourceCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- vmsDesc
+	descs <- volumesDesc
+	descs <- reconcilerLagDesc
+}
+
+func (collector *resourceCollector) Collect(values chan<- prometheus.Metric) {
+	ctx := context.Background()
+
+	if counts, err := models.CountVMsByStatus(ctx); err != nil {
+		slog.Error("Could not count VMs", "error", err)
+	} else {
+		for status, count := range counts {
+			values <- prometheus.MustNewConstMetric(vmsDesc, prometheus.GaugeValue, float64(count), status)
+		}
+	}
+
+	if counts, err := models.CountStoragesByStatus(ctx); err != nil {
+		slog.Error("Could not count volumes", "error", err)
+	} else {
+		for status, count := range counts {
+			values <- prometheus.MustNewConstMetric(volumesDesc, prometheus.GaugeValue, float64(count), status)
+		}
+	}
+
+	last := LastReconcile()
+	if last.IsZero() {
+		last = collector.started
+	}
+	values <- prometheus.MustNewConstMetric(reconcilerLagDesc, prometheus.GaugeValue, time.Since(last).Seconds())
+}
@@ -1,18 +1,19 @@
 package services
 
 import (
+	"context"
 	"fmt"
-	"os/exec"
 	"strings"
 
 	"github.com/odeeka/go-minicloud-rest-api/models"
 )
 
-func StartStorageVolume(storage *models.Storage) error {
+func StartStorageVolume(ctx context.Context, storage *models.Storage) error {
 
 	volumeName := storage.Name
 
-	cmd := exec.Command("docker", "volume", "create", volumeName)
+	args := append([]string{"volume", "create"}, dockerLabelArgs(storage.Labels)...)
+	cmd := dockerCommand(ctx, append(args, volumeName)...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("docker volume failed: %w, output: %s", err, strings.TrimSpace(string(output)))
@@ -1,15 +1,18 @@
 package services
 
 import (
+	"context"
 	"fmt"
-	"os/exec"
+	"log/slog"
+	"strconv"
 	"strings"
 
 	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
 )
 
 // StartContainer simulates the VM by running a Docker container for the VM configuration
-func StartContainer(vm *models.VM) error {
+func StartContainer(ctx context.Context, vm *models.VM) error {
 	// Base command to run
 	args := []string{"run", "-d"}
 
@@ -23,6 +26,11 @@ func StartContainer(vm *models.VM) error {
 		}
 	}
 
+	// SSH access for VMs with key pairs, Docker picks a free host port
+	if len(vm.KeyPairIDs) > 0 {
+		args = append(args, "-p", "22")
+	}
+
 	// Set the container name (not used random name)
 	args = append(args, "--name", fmt.Sprintf("%s", vm.Name))
 
@@ -32,20 +40,27 @@ func StartContainer(vm *models.VM) error {
 	// CPU limit (in decimal format, e.g., 0.5 means 50% of one CPU core)
 	args = append(args, "--cpus", fmt.Sprintf("%.2f", vm.CPU))
 
+	// Root disk size of the flavor, only supported by some storage drivers (e.g., overlay2 on xfs with pquota)
+	if vm.DiskGB > 0 && utils.GetEnv("MINICLOUD_ENFORCE_DISK_SIZE", "false") == "true" {
+		args = append(args, "--storage-opt", fmt.Sprintf("size=%dG", vm.DiskGB))
+	}
+
 	// Environment variables
 	for key, value := range vm.Env {
 		envMapping := fmt.Sprintf("%s=%s", key, value)
 		args = append(args, "-e", envMapping)
 	}
 
-	// Base image
-	args = append(args, vm.Image)
+	args = append(args, dockerLabelArgs(vm.Labels)...)
 
-	// (Debug) Output the full command with arguments to terminal
-	fmt.Println("Running Docker with args:", args)
+	// Base image, pinned to the digest resolved by the image catalog when there is one
+	args = append(args, imageReference(vm))
+
+	// The arguments are logged by dockerCommand at debug level, with the env values redacted
+	slog.InfoContext(ctx, "Starting container", "vm", vm.Name, "image", vm.Image)
 
 	// Run docker command
-	cmd := exec.Command("docker", args...)
+	cmd := dockerCommand(ctx, args...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("docker run failed: %w, output: %s", err, strings.TrimSpace(string(output)))
@@ -54,20 +69,71 @@ func StartContainer(vm *models.VM) error {
 	// Save container ID into VM
 	vm.ContainerID = strings.TrimSpace(string(output))
 
+	vm.SSHPort = 0
+	if len(vm.KeyPairIDs) > 0 {
+		sshPort, err := containerHostPort(ctx, vm.ContainerID, 22)
+		if err != nil {
+			return err
+		}
+		vm.SSHPort = sshPort
+	}
+
+	// Record what the container actually runs for images outside of the catalog
+	if vm.ImageDigest == "" {
+		imageID, err := ContainerImageID(ctx, vm.ContainerID)
+		if err != nil {
+			return err
+		}
+		vm.ImageDigest = imageID
+	}
+
 	return nil
 }
 
+// imageReference returns the image to run for the VM
+// A VM with an image digest runs "repository@digest" instead of the mutable tag
+// and "minicloud/..." images are served by the embedded registry
+func imageReference(vm *models.VM) string {
+	image := vm.Image
+	if _, pullReference, ok := ParseRegistryImage(image); ok {
+		image = pullReference
+	}
+
+	if vm.ImageDigest == "" {
+		return image
+	}
+	return models.ImageRepository(image) + "@" + vm.ImageDigest
+}
+
+// containerHostPort returns the host port Docker published for a TCP port of the container
+func containerHostPort(ctx context.Context, containerID string, port int) (int, error) {
+	cmd := dockerCommand(ctx, "port", containerID, fmt.Sprintf("%d/tcp", port))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("docker port failed: %w, output: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	// e.g., "0.0.0.0:49153" and "[::]:49153"
+	firstLine, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+	hostPort, err := strconv.Atoi(firstLine[strings.LastIndex(firstLine, ":")+1:])
+	if err != nil {
+		return 0, fmt.Errorf("unexpected docker port output: %s", firstLine)
+	}
+
+	return hostPort, nil
+}
+
 // StopAndRemoveContainer stops and removes a Docker container by ID
-func StopAndRemoveContainer(containerID string) error {
+func StopAndRemoveContainer(ctx context.Context, containerID string) error {
 	// Stop
-	stopCmd := exec.Command("docker", "stop", containerID)
+	stopCmd := dockerCommand(ctx, "stop", containerID)
 	stopOut, stopErr := stopCmd.CombinedOutput()
 	if stopErr != nil {
 		return fmt.Errorf("failed to stop container: %w, output: %s", stopErr, strings.TrimSpace(string(stopOut)))
 	}
 
 	// Remove
-	rmCmd := exec.Command("docker", "rm", containerID)
+	rmCmd := dockerCommand(ctx, "rm", containerID)
 	rmOut, rmErr := rmCmd.CombinedOutput()
 	if rmErr != nil {
 		return fmt.Errorf("failed to remove container: %w, output: %s", rmErr, strings.TrimSpace(string(rmOut)))
@@ -77,7 +143,7 @@ func StopAndRemoveContainer(containerID string) error {
 }
 
 // UpdateContainer simulates the VM by running a Docker container for the VM configuration
-func UpdateContainer(vm *models.VM) error {
+func UpdateContainer(ctx context.Context, vm *models.VM) error {
 
 	// Base command for update
 	args := []string{"update"}
@@ -88,13 +154,14 @@ func UpdateContainer(vm *models.VM) error {
 
 	// CPU limit (in decimal format, e.g., 0.5 means 50% of one CPU core)
 	args = append(args, "--cpus", fmt.Sprintf("%.2f", vm.CPU))
-	args = append(args, vm.Name)
 
-	// (Debug) Show the command in terminal
-	fmt.Println("Updating Docker with args:", args)
+	// Names are not unique, the container is addressed by its ID
+	args = append(args, vm.ContainerID)
+
+	slog.InfoContext(ctx, "Updating container", "vm", vm.Name, "container_id", vm.ContainerID, "cpu", vm.CPU, "memory", vm.Memory)
 
 	// Run the command
-	cmd := exec.Command("docker", args...)
+	cmd := dockerCommand(ctx, args...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("docker update failed: %w, output: %s", err, strings.TrimSpace(string(output)))
@@ -0,0 +1,283 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/tracing"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Headers of webhook deliveries
+const (
+	WebhookEventHeader     = "X-MiniCloud-Event"
+	WebhookDeliveryHeader  = "X-MiniCloud-Delivery"
+	WebhookTimestampHeader = "X-MiniCloud-Timestamp"
+	WebhookSignatureHeader = "X-MiniCloud-Signature"
+)
+
+// EventWebhookPing is only sent to a single webhook, to test the receiver
+const EventWebhookPing = "webhook.ping"
+
+// webhookClient only connects to public addresses. The check runs when the connection is made,
+// after the name was resolved, so DNS answers that changed since the webhook was saved and redirects are covered.
+var webhookClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				if utils.AllowPrivateWebhookTargets() {
+					return nil
+				}
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !utils.IsPublicIP(ip) {
+					return fmt.Errorf("webhook receiver %s is not a public address", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// webhookBatch is the number of due deliveries attempted at once
+const webhookBatch = 20
+
+// webhookWake starts a dispatcher pass right away, e.g., for a new event
+var webhookWake = make(chan struct{}, 1)
+
+func wakeWebhookDispatcher() {
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// enqueueWebhookDeliveries queues the event for every webhook subscribed to it
+func enqueueWebhookDeliveries(ctx context.Context, event models.Event) error {
+	webhooks, err := models.GetWebhooksForEvent(ctx, event.AccountID, event.ProjectID)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	queued := false
+	for i := range webhooks {
+		if !webhooks[i].Matches(event.Type) {
+			continue
+		}
+		if err := queueWebhookDelivery(ctx, webhooks[i].ID, event.ID, event.Type, payload); err != nil {
+			return err
+		}
+		queued = true
+	}
+
+	if queued {
+		wakeWebhookDispatcher()
+	}
+	return nil
+}
+
+func queueWebhookDelivery(ctx context.Context, webhookID, eventID int64, eventType string, payload []byte) error {
+	now := time.Now().UTC()
+	delivery := models.WebhookDelivery{
+		WebhookID:     webhookID,
+		EventID:       eventID,
+		EventType:     eventType,
+		Payload:       payload,
+		Status:        models.DeliveryStatusPending,
+		NextAttemptAt: &now,
+	}
+	return delivery.InsertWebhookDelivery(ctx)
+}
+
+// PingWebhook queues a webhook.ping delivery to the webhook, whatever its event types
+func PingWebhook(ctx context.Context, webhook *models.Webhook) error {
+	payload, err := json.Marshal(map[string]any{
+		"type":       EventWebhookPing,
+		"webhook_id": webhook.ID,
+		"created_at": time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := queueWebhookDelivery(ctx, webhook.ID, 0, EventWebhookPing, payload); err != nil {
+		return err
+	}
+
+	wakeWebhookDispatcher()
+	return nil
+}
+
+// RedeliverWebhookDelivery queues a delivery again with fresh attempts (e.g., from the dead-letter list)
+func RedeliverWebhookDelivery(ctx context.Context, delivery *models.WebhookDelivery) error {
+	now := time.Now().UTC()
+	delivery.Status = models.DeliveryStatusPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = &now
+	delivery.DeliveredAt = nil
+
+	if err := delivery.UpdateWebhookDelivery(ctx); err != nil {
+		return err
+	}
+
+	wakeWebhookDispatcher()
+	return nil
+}
+
+// StartWebhookDispatcher sends the queued deliveries, when events are published and
+// every MINICLOUD_WEBHOOK_POLL_INTERVAL (default 5s) for the retries
+func StartWebhookDispatcher() {
+	interval := utils.GetEnvDuration("MINICLOUD_WEBHOOK_POLL_INTERVAL", 5*time.Second)
+
+	go func() {
+		for {
+			if err := tracing.Job("deliver webhooks", deliverDueWebhooks); err != nil {
+				slog.Error("Webhook delivery failed", "error", err)
+			}
+
+			select {
+			case <-webhookWake:
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+// deliverDueWebhooks attempts the due deliveries until none is left
+func deliverDueWebhooks(ctx context.Context) error {
+	for {
+		deliveries, err := models.GetDueWebhookDeliveries(ctx, time.Now(), webhookBatch)
+		if err != nil {
+			return err
+		}
+
+		var wg sync.WaitGroup
+		for i := range deliveries {
+			wg.Add(1)
+			go func(delivery *models.WebhookDelivery) {
+				defer wg.Done()
+				if err := attemptWebhookDelivery(ctx, delivery); err != nil {
+					slog.ErrorContext(ctx, "Could not store webhook delivery", "delivery_id", delivery.ID, "error", err)
+				}
+			}(&deliveries[i])
+		}
+		wg.Wait()
+
+		if len(deliveries) < webhookBatch {
+			return nil
+		}
+	}
+}
+
+// attemptWebhookDelivery POSTs the payload and stores the result. A failed attempt is retried with
+// exponential backoff from MINICLOUD_WEBHOOK_RETRY_BASE (default 10s, at most 1h apart), after
+// MINICLOUD_WEBHOOK_MAX_ATTEMPTS (default 8) the delivery is dead.
+func attemptWebhookDelivery(ctx context.Context, delivery *models.WebhookDelivery) error {
+	ctx, span := tracing.StartChild(ctx, "webhook delivery",
+		attribute.Int64("webhook.id", delivery.WebhookID), attribute.String("webhook.event_type", delivery.EventType))
+
+	statusCode, err := postWebhook(ctx, delivery)
+	tracing.End(span, err)
+
+	delivery.Attempts++
+	delivery.LastStatusCode = statusCode
+	delivery.LastError = ""
+	now := time.Now().UTC()
+
+	if err == nil {
+		delivery.Status = models.DeliveryStatusSucceeded
+		delivery.NextAttemptAt = nil
+		delivery.DeliveredAt = &now
+		return delivery.UpdateWebhookDelivery(ctx)
+	}
+
+	delivery.LastError = err.Error()
+	if delivery.Attempts >= utils.GetEnvInt("MINICLOUD_WEBHOOK_MAX_ATTEMPTS", 8) {
+		delivery.Status = models.DeliveryStatusDead
+		delivery.NextAttemptAt = nil
+		slog.WarnContext(ctx, "Webhook delivery is dead", "webhook_id", delivery.WebhookID, "delivery_id", delivery.ID,
+			"attempts", delivery.Attempts, "error", err)
+	} else {
+		next := now.Add(webhookBackoff(delivery.Attempts))
+		delivery.NextAttemptAt = &next
+	}
+
+	return delivery.UpdateWebhookDelivery(ctx)
+}
+
+// webhookBackoff returns the delay after the given number of failed attempts: base, 2*base, 4*base, ...
+func webhookBackoff(attempts int) time.Duration {
+	delay := utils.GetEnvDuration("MINICLOUD_WEBHOOK_RETRY_BASE", 10*time.Second)
+	for i := 1; i < attempts && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	return min(delay, time.Hour)
+}
+
+// postWebhook sends a delivery signed with the secret of its webhook and returns the HTTP status
+// Any status but 2xx is an error
+func postWebhook(ctx context.Context, delivery *models.WebhookDelivery) (int, error) {
+	webhook, err := models.GetWebhookByID(ctx, delivery.WebhookID)
+	if err != nil {
+		return 0, err
+	}
+	if webhook == nil {
+		return 0, fmt.Errorf("webhook %d was deleted", delivery.WebhookID)
+	}
+
+	secret, err := models.GetWebhookSecret(ctx, webhook.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	timeout := utils.GetEnvDuration("MINICLOUD_WEBHOOK_TIMEOUT", 10*time.Second)
+	requestCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(requestCtx, http.MethodPost, webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "MiniCloud-Webhook")
+	request.Header.Set(WebhookEventHeader, delivery.EventType)
+	request.Header.Set(WebhookDeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	request.Header.Set(WebhookTimestampHeader, timestamp)
+	request.Header.Set(WebhookSignatureHeader, "sha256="+utils.SignWebhookPayload(secret, timestamp, delivery.Payload))
+
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("receiver answered %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
@@ -0,0 +1,181 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/odeeka/go-minicloud-rest-api/db"
+	"github.com/odeeka/go-minicloud-rest-api/models"
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+)
+
+// receivedWebhook is a delivery as seen by the receiver
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookReceiver starts a local receiver which answers every delivery with the status
+func webhookReceiver(t *testing.T, status int) (*httptest.Server, func() []receivedWebhook) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var received []receivedWebhook
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, receivedWebhook{header: r.Header.Clone(), body: body})
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []receivedWebhook {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]receivedWebhook(nil), received...)
+	}
+}
+
+// queueTestDelivery creates a webhook for the URL in a fresh database and queues one delivery to it
+func queueTestDelivery(t *testing.T, url string) (*models.Webhook, *models.WebhookDelivery) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	db.InitDB()
+	t.Cleanup(func() { db.DB.Close() })
+
+	ctx := context.Background()
+	secret, err := utils.GenerateWebhookSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhook := &models.Webhook{AccountID: 1, URL: url, EventTypes: []string{"*"}, Active: true, Secret: secret}
+	if err := webhook.InsertWebhook(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	payload, _ := json.Marshal(map[string]any{"type": models.EventVMCreated, "resource_id": 7})
+	if err := queueWebhookDelivery(ctx, webhook.ID, 1, models.EventVMCreated, payload); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := models.GetDueWebhookDeliveries(ctx, time.Now().Add(time.Second), 10)
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("expected one due delivery, got %d (%v)", len(deliveries), err)
+	}
+	return webhook, &deliveries[0]
+}
+
+func TestWebhookDeliveryIsSigned(t *testing.T) {
+	t.Setenv("MINICLOUD_WEBHOOK_ALLOW_PRIVATE", "true")
+	server, received := webhookReceiver(t, http.StatusNoContent)
+	webhook, delivery := queueTestDelivery(t, server.URL)
+
+	if err := attemptWebhookDelivery(context.Background(), delivery); err != nil {
+		t.Fatal(err)
+	}
+	if delivery.Status != models.DeliveryStatusSucceeded || delivery.Attempts != 1 || delivery.LastStatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected delivery result: %+v", delivery)
+	}
+
+	requests := received()
+	if len(requests) != 1 {
+		t.Fatalf("expected one request, got %d", len(requests))
+	}
+	request := requests[0]
+	if string(request.body) != string(delivery.Payload) {
+		t.Errorf("body = %s, want %s", request.body, delivery.Payload)
+	}
+	if got := request.header.Get(WebhookEventHeader); got != models.EventVMCreated {
+		t.Errorf("%s = %q", WebhookEventHeader, got)
+	}
+
+	timestamp := request.header.Get(WebhookTimestampHeader)
+	want := "sha256=" + utils.SignWebhookPayload(webhook.Secret, timestamp, request.body)
+	if got := request.header.Get(WebhookSignatureHeader); got != want {
+		t.Errorf("%s = %q, want %q", WebhookSignatureHeader, got, want)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	t.Setenv("MINICLOUD_WEBHOOK_RETRY_BASE", "10s")
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{9, 2560 * time.Second},
+		{10, time.Hour},
+		{50, time.Hour},
+	}
+	for _, test := range tests {
+		if got := webhookBackoff(test.attempts); got != test.want {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestWebhookDeliveryIsDeadAfterMaxAttempts(t *testing.T) {
+	t.Setenv("MINICLOUD_WEBHOOK_ALLOW_PRIVATE", "true")
+	t.Setenv("MINICLOUD_WEBHOOK_MAX_ATTEMPTS", "3")
+	t.Setenv("MINICLOUD_WEBHOOK_RETRY_BASE", "10s")
+	server, received := webhookReceiver(t, http.StatusInternalServerError)
+	_, delivery := queueTestDelivery(t, server.URL)
+	ctx := context.Background()
+
+	if err := attemptWebhookDelivery(ctx, delivery); err != nil {
+		t.Fatal(err)
+	}
+	if delivery.Status != models.DeliveryStatusPending || delivery.LastStatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected a pending retry after the first failure: %+v", delivery)
+	}
+	if delivery.NextAttemptAt == nil || time.Until(*delivery.NextAttemptAt) < 9*time.Second {
+		t.Fatalf("expected the retry about 10s later, got %v", delivery.NextAttemptAt)
+	}
+
+	for range 2 {
+		if err := attemptWebhookDelivery(ctx, delivery); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if delivery.Status != models.DeliveryStatusDead || delivery.Attempts != 3 || delivery.NextAttemptAt != nil {
+		t.Fatalf("expected a dead delivery after 3 attempts: %+v", delivery)
+	}
+	if len(received()) != 3 {
+		t.Errorf("expected 3 requests, got %d", len(received()))
+	}
+
+	// The dead letter is stored and no longer due
+	stored, err := models.GetWebhookDeliveryByID(ctx, delivery.WebhookID, delivery.ID)
+	if err != nil || stored.Status != models.DeliveryStatusDead {
+		t.Fatalf("stored delivery = %+v (%v)", stored, err)
+	}
+	due, err := models.GetDueWebhookDeliveries(ctx, time.Now().Add(2*time.Hour), 10)
+	if err != nil || len(due) != 0 {
+		t.Fatalf("expected no due deliveries, got %d (%v)", len(due), err)
+	}
+}
+
+func TestWebhookDeliveryRejectsPrivateAddresses(t *testing.T) {
+	server, received := webhookReceiver(t, http.StatusNoContent)
+	_, delivery := queueTestDelivery(t, server.URL)
+
+	if err := attemptWebhookDelivery(context.Background(), delivery); err != nil {
+		t.Fatal(err)
+	}
+	if delivery.Status == models.DeliveryStatusSucceeded || !strings.Contains(delivery.LastError, "not a public address") {
+		t.Fatalf("expected the loopback receiver to be refused: %+v", delivery)
+	}
+	if len(received()) != 0 {
+		t.Errorf("the receiver was reached")
+	}
+}
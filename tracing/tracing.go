@@ -0,0 +1,115 @@
+// OpenTelemetry tracing of requests, driver calls and database queries
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/odeeka/go-minicloud-rest-api/utils"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName is the default service.name of the spans (OTEL_SERVICE_NAME overrides it)
+const ServiceName = "minicloud"
+
+// Tracer creates the spans of the API server, it delegates to the provider set by Init
+var Tracer = otel.Tracer("github.com/odeeka/go-minicloud-rest-api")
+
+// Init installs the tracer provider and returns a function which flushes the remaining spans.
+// MINICLOUD_TRACES_EXPORTER is a comma separated list of otlp, stdout and file (default none).
+// OTLP is configured with the standard OTEL_EXPORTER_OTLP_* variables (HTTP, default localhost:4318),
+// the file exporter writes JSON spans to MINICLOUD_TRACES_FILE (default traces.jsonl).
+// Without exporter spans are still created, so logs and error responses carry trace IDs.
+func Init(ctx context.Context) (func(context.Context) error, error) {
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", ServiceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+
+	for _, name := range strings.Split(utils.GetEnv("MINICLOUD_TRACES_EXPORTER", "none"), ",") {
+		switch strings.TrimSpace(name) {
+		case "none", "":
+		case "otlp":
+			exporter, err := otlptracehttp.New(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("could not create the OTLP exporter: %w", err)
+			}
+			options = append(options, sdktrace.WithBatcher(exporter))
+		case "stdout":
+			exporter, err := stdouttrace.New()
+			if err != nil {
+				return nil, err
+			}
+			options = append(options, sdktrace.WithSyncer(exporter))
+		case "file":
+			file, err := os.OpenFile(utils.GetEnv("MINICLOUD_TRACES_FILE", "traces.jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+			if err != nil {
+				return nil, fmt.Errorf("could not open the trace file: %w", err)
+			}
+			exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+			if err != nil {
+				return nil, err
+			}
+			options = append(options, sdktrace.WithSyncer(exporter))
+		default:
+			return nil, fmt.Errorf("unknown trace exporter %q", name)
+		}
+	}
+
+	provider := sdktrace.NewTracerProvider(options...)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return provider.Shutdown, nil
+}
+
+// StartChild starts a span only when the context already has one, so calls outside of
+// a request or a background job (e.g., creating the tables) don't become traces of their own
+func StartChild(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return Tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records the error (if any) on the span and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceID returns the trace ID of the context or an empty string
+func TraceID(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.HasTraceID() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
+
+// Job runs a background job (e.g., a reconciler pass) as root span of a trace of its own
+func Job(name string, job func(ctx context.Context) error) error {
+	ctx, span := Tracer.Start(context.Background(), name, trace.WithNewRoot())
+	err := job(ctx)
+	End(span, err)
+	return err
+}
@@ -2,7 +2,7 @@ package utils
 
 import (
 	"errors"
-	"fmt"
+	"log/slog"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -32,7 +32,7 @@ func VerifyToken(token string) (int64, error) {
 	})
 
 	if err != nil {
-		fmt.Println("Could not parse token")
+		slog.Debug("Could not parse token", "error", err)
 		return 0, errors.New("Could not parse token.")
 	}
 
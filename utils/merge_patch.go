@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// MergePatch applies a JSON Merge Patch (RFC 7396) to a JSON document: members of patch objects
+// replace the members of the document recursively, null members remove them
+func MergePatch(document, patch []byte) ([]byte, error) {
+	var target any
+	if len(bytes.TrimSpace(document)) > 0 {
+		if err := decodeJSON(document, &target); err != nil {
+			return nil, err
+		}
+	}
+
+	var changes any
+	if err := decodeJSON(patch, &changes); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(mergePatch(target, changes))
+}
+
+func mergePatch(target, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]any)
+	if !ok {
+		targetObject = map[string]any{}
+	}
+
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+			continue
+		}
+		targetObject[name] = mergePatch(targetObject[name], value)
+	}
+	return targetObject
+}
+
+// decodeJSON keeps numbers as written, e.g., large IDs don't lose precision as float64
+func decodeJSON(data []byte, value any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(value)
+}
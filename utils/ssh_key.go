@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// GenerateSSHKeyPair creates a new ed25519 key pair
+// It returns the public key in authorized_keys format and the private key in OpenSSH PEM format
+func GenerateSSHKeyPair(comment string) (string, string, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	block, err := ssh.MarshalPrivateKey(privateKey, comment)
+	if err != nil {
+		return "", "", err
+	}
+
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublicKey))) + " " + comment
+	return authorizedKey, string(pem.EncodeToMemory(block)), nil
+}
+
+// ParseSSHPublicKey validates a public key in authorized_keys format (e.g., "ssh-ed25519 AAAA... me@laptop")
+// It returns the normalized key with its comment and the SHA256 fingerprint
+func ParseSSHPublicKey(publicKey string) (string, string, error) {
+	key, comment, options, rest, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return "", "", errors.New("invalid public key, expected the authorized_keys format (e.g., ssh-ed25519 AAAA... me@laptop)")
+	}
+	if len(options) > 0 || len(strings.TrimSpace(string(rest))) > 0 {
+		return "", "", errors.New("the public key must be a single key without options")
+	}
+
+	normalized := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	if comment != "" {
+		normalized += " " + comment
+	}
+
+	return normalized, ssh.FingerprintSHA256(key), nil
+}
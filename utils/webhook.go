@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// WebhookSecretPrefix marks a webhook signing secret
+const WebhookSecretPrefix = "whsec_"
+
+// GenerateWebhookSecret creates a new random secret to sign the deliveries of a webhook
+// Unlike API keys it is stored as it is, since signing needs the secret itself
+func GenerateWebhookSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return WebhookSecretPrefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// SignWebhookPayload returns the signature of a delivery: the hex HMAC-SHA256 of "<timestamp>.<body>"
+// Signing the timestamp lets receivers reject replayed deliveries
+func SignWebhookPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// nonPublicPrefixes are the ranges besides loopback, private and link-local which don't reach the internet
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "This network"
+	netip.MustParsePrefix("100.64.0.0/10"), // Carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // Benchmarking
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64, embeds IPv4 addresses
+}
+
+// AllowPrivateWebhookTargets reports whether webhooks may deliver to loopback and private addresses,
+// only for local development and tests (MINICLOUD_WEBHOOK_ALLOW_PRIVATE)
+func AllowPrivateWebhookTargets() bool {
+	return GetEnv("MINICLOUD_WEBHOOK_ALLOW_PRIVATE", "false") == "true"
+}
+
+// IsPublicIP reports whether the address is a public unicast address. Loopback, private, link-local
+// (e.g., the cloud metadata service 169.254.169.254), multicast and unspecified addresses are not.
+func IsPublicIP(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckWebhookHost resolves the host of a webhook URL and returns an error unless all its addresses are public
+func CheckWebhookHost(ctx context.Context, host string) error {
+	if AllowPrivateWebhookTargets() {
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("could not resolve %s: %w", host, err)
+	}
+	for _, addr := range addrs {
+		if !IsPublicIP(addr.IP) {
+			return fmt.Errorf("%s resolves to the non-public address %s", host, addr.IP)
+		}
+	}
+	return nil
+}